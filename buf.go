@@ -192,6 +192,15 @@ func (r *tdsBuffer) ReadByte() (res byte, err error) {
 	return res, nil
 }
 
+// UnreadByte unreads the last byte read by ReadByte.
+func (r *tdsBuffer) UnreadByte() error {
+	if r.rpos == 0 {
+		return errors.New("UnreadByte at beginning of buffer")
+	}
+	r.rpos--
+	return nil
+}
+
 func (r *tdsBuffer) byte() byte {
 	b, err := r.ReadByte()
 	if err != nil {
@@ -3,10 +3,13 @@ package mssql
 import (
 	"bytes"
 	"context"
+	"database/sql/driver"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"math"
-	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -28,6 +31,26 @@ type Bulk struct {
 	columnsName []string
 	tablename   string
 	numRows     int
+	// batchBytes is the size of the rows sent since the bulk command
+	batchBytes int64
+	// inTransaction is set while the internal transaction of a batch is
+	// open
+	inTransaction bool
+	// rowOrdinal is the ordinal of the last row given to AddRow, rows are
+	// counted from 1
+	rowOrdinal int64
+	// batch is the number of the batch being sent, batchFirstRow and
+	// batchLastRow are the ordinals of its first and last rows sent,
+	// batchRows the count of its rows sent and skipped the ordinals of the
+	// rows in between that failed to convert
+	batch         int
+	batchFirstRow int64
+	batchLastRow  int64
+	batchRows     int
+	skipped       []int64
+	// retrying is set while the rows of a failed batch are copied again,
+	// numRows counted them when they were sent first
+	retrying bool
 
 	headerSent bool
 	Options    BulkOptions
@@ -41,6 +64,105 @@ type BulkOptions struct {
 	RowsPerBatch      int
 	Order             []string
 	Tablock           bool
+	// KeepIdentity inserts the values given for identity columns instead
+	// of the values generated by the server.
+	KeepIdentity bool
+	// UseInternalTransaction runs every batch in a transaction of its own
+	// that is rolled back when the batch fails. It cannot be used when the
+	// connection is in a transaction.
+	UseInternalTransaction bool
+	// OnProgress is called with the number of rows sent so far after every
+	// NotifyAfter rows. Rows copied again in the error rows mode are
+	// counted once.
+	NotifyAfter int
+	OnProgress  func(rows int64) `json:"-"`
+	// OnRowError enables the error rows mode of Conn.BulkCopyFrom. Rows
+	// that fail to convert are skipped, and a batch the server fails is
+	// copied again row by row, or in halves when BisectErrorRows is set,
+	// to find the failing rows. Every failing row is passed to OnRowError
+	// with its ordinal, its values and the error, usually a *BulkError,
+	// and is not copied. The copy stops with the error OnRowError returns,
+	// if any.
+	//
+	// The rows of a batch are kept until the batch is committed. Retrying
+	// needs the failed batch to be rolled back on its own, which is not
+	// the case for all errors in a transaction.
+	OnRowError      func(row int64, values []interface{}, err error) error `json:"-"`
+	BisectErrorRows bool
+}
+
+// BulkError is the error of a bulk copy row that failed to convert or of a
+// batch the server failed. Rows are counted from 1 in the order they are
+// given to AddRow.
+type BulkError struct {
+	// Batch is the number of the batch, counted from 1.
+	Batch int
+	// FirstRow and LastRow are the ordinals of the first and the last row
+	// sent in the batch.
+	FirstRow int64
+	LastRow  int64
+	// Row and Column are the row and the column that failed when they
+	// are known, 0 and "" otherwise.
+	Row    int64
+	Column string
+	Err    error
+}
+
+func (e *BulkError) Error() string {
+	switch {
+	case e.Row != 0 && e.Column != "":
+		return fmt.Sprintf("bulkcopy: row %d, column %s: %v", e.Row, e.Column, e.Err)
+	case e.Row != 0:
+		return fmt.Sprintf("bulkcopy: row %d: %v", e.Row, e.Err)
+	}
+	return fmt.Sprintf("bulkcopy: batch %d, rows %d to %d: %v", e.Batch, e.FirstRow, e.LastRow, e.Err)
+}
+
+// Unwrap returns the error of the conversion or the server.
+func (e *BulkError) Unwrap() error {
+	return e.Err
+}
+
+// bulkErrorRow matches the row and the column numbers in the messages of
+// bulk load errors, e.g. "Bulk load data conversion error (truncation) for
+// row 2, column 3 (name)." or "Received an invalid column length from the
+// bcp client for colid 3."
+var bulkErrorRow = regexp.MustCompile(`row (\d+), column (\d+)|colid (\d+)`)
+
+// batchError returns the error of the server for the batch being sent.
+func (b *Bulk) batchError(err Error) *BulkError {
+	e := &BulkError{Batch: b.batch, FirstRow: b.batchFirstRow, LastRow: b.batchLastRow, Err: err}
+	if b.batchRows == 1 {
+		e.Row = b.batchLastRow
+	}
+	msgs := append([]Error{err}, err.All...)
+	for _, msg := range msgs {
+		m := bulkErrorRow.FindStringSubmatch(msg.Message)
+		if m == nil {
+			continue
+		}
+		if m[1] != "" {
+			n, _ := strconv.ParseInt(m[1], 10, 64)
+			e.Row = b.batchRowOrdinal(n)
+		}
+		col := m[2] + m[3]
+		if i, _ := strconv.Atoi(col); i > 0 && i <= len(b.bulkColumns) {
+			e.Column = b.bulkColumns[i-1].ColName
+		}
+		break
+	}
+	return e
+}
+
+// batchRowOrdinal returns the ordinal of the nth row sent in the batch.
+func (b *Bulk) batchRowOrdinal(n int64) int64 {
+	row := b.batchFirstRow + n - 1
+	for _, s := range b.skipped {
+		if s <= row {
+			row++
+		}
+	}
+	return row
 }
 
 type DataValue interface{}
@@ -51,6 +173,30 @@ const (
 	sqlTimeFormat     = "15:04:05.9999999"
 )
 
+// bulkTimeFormats are the accepted formats of date and time strings, the
+// first one with a time zone that matches is used. bcp writes offsets
+// after a space.
+var bulkTimeFormats = []string{
+	sqlDateTimeFormat,
+	"2006-01-02 15:04:05.999999999 -07:00",
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	sqlDateFormat,
+}
+
+// parseBulkTime parses a date and time string, times without a zone are
+// in UTC.
+func parseBulkTime(val string) (t time.Time, err error) {
+	val = strings.TrimSpace(val)
+	for _, layout := range bulkTimeFormats {
+		if t, err = time.Parse(layout, val); err == nil {
+			return t, nil
+		}
+	}
+	return t, err
+}
+
 func (cn *Conn) CreateBulk(table string, columns []string) (_ *Bulk) {
 	b := Bulk{ctx: context.Background(), cn: cn, tablename: table, headerSent: false, columnsName: columns}
 	b.Debug = false
@@ -64,32 +210,11 @@ func (cn *Conn) CreateBulkContext(ctx context.Context, table string, columns []s
 }
 
 func (b *Bulk) sendBulkCommand(ctx context.Context) (err error) {
-	//get table columns info
-	err = b.getMetadata(ctx)
-	if err != nil {
-		return err
-	}
-
-	//match the columns
-	for _, colname := range b.columnsName {
-		var bulkCol *columnStruct
-
-		for _, m := range b.metadata {
-			if m.ColName == colname {
-				bulkCol = &m
-				break
-			}
-		}
-		if bulkCol != nil {
-
-			if bulkCol.ti.TypeId == typeUdt {
-				//send udt as binary
-				bulkCol.ti.TypeId = typeBigVarBin
-			}
-			b.bulkColumns = append(b.bulkColumns, *bulkCol)
-			b.dlogf(ctx, "Adding column %s %s %#x", colname, bulkCol.ColName, bulkCol.ti.TypeId)
-		} else {
-			return fmt.Errorf("column %s does not exist in destination table %s", colname, b.tablename)
+	// the columns are known when a batch follows another one
+	if b.bulkColumns == nil {
+		err = b.matchColumns(ctx)
+		if err != nil {
+			return err
 		}
 	}
 
@@ -104,6 +229,26 @@ func (b *Bulk) sendBulkCommand(ctx context.Context) (err error) {
 		col_defs.WriteString("[" + col.ColName + "] " + makeDecl(col.ti))
 	}
 
+	if b.Options.UseInternalTransaction && !b.inTransaction {
+		if b.cn.sess.tranid != 0 {
+			return errors.New("mssql: UseInternalTransaction cannot be used in a transaction")
+		}
+		if _, err = b.cn.begin(ctx, isolationUseCurrent); err != nil {
+			return err
+		}
+		b.inTransaction = true
+		defer func() {
+			if !b.headerSent {
+				b.rollback()
+			}
+		}()
+	}
+	b.batch++
+	b.batchFirstRow = b.rowOrdinal
+	b.batchLastRow = 0
+	b.batchRows = 0
+	b.skipped = b.skipped[:0]
+
 	//options
 	var with_opts []string
 
@@ -128,6 +273,9 @@ func (b *Bulk) sendBulkCommand(ctx context.Context) (err error) {
 	if b.Options.Tablock {
 		with_opts = append(with_opts, "TABLOCK")
 	}
+	if b.Options.KeepIdentity {
+		with_opts = append(with_opts, "KEEP_IDENTITY")
+	}
 	var with_part string
 	if len(with_opts) > 0 {
 		with_part = fmt.Sprintf("WITH (%s)", strings.Join(with_opts, ","))
@@ -135,13 +283,13 @@ func (b *Bulk) sendBulkCommand(ctx context.Context) (err error) {
 
 	query := fmt.Sprintf("INSERT BULK %s (%s) %s", b.tablename, col_defs.String(), with_part)
 
-	stmt, err := b.cn.PrepareContext(ctx, query)
+	stmt, err := b.cn.prepareInternal(ctx, query)
 	if err != nil {
 		return fmt.Errorf("Prepare failed: %s", err.Error())
 	}
 	b.dlogf(ctx, query)
 
-	_, err = stmt.(*Stmt).ExecContext(ctx, nil)
+	_, err = stmt.ExecContext(ctx, nil)
 	if err != nil {
 		return err
 	}
@@ -158,9 +306,48 @@ func (b *Bulk) sendBulkCommand(ctx context.Context) (err error) {
 	return
 }
 
+// matchColumns looks up the columns of the bulk copy in the destination
+// table.
+func (b *Bulk) matchColumns(ctx context.Context) (err error) {
+	//get table columns info
+	err = b.getMetadata(ctx)
+	if err != nil {
+		return err
+	}
+
+	//match the columns
+	for _, colname := range b.columnsName {
+		var bulkCol *columnStruct
+
+		for _, m := range b.metadata {
+			if m.ColName == colname {
+				bulkCol = &m
+				break
+			}
+		}
+		if bulkCol != nil {
+
+			if bulkCol.ti.TypeId == typeUdt {
+				//send udt as binary
+				bulkCol.ti.TypeId = typeBigVarBin
+			}
+			b.bulkColumns = append(b.bulkColumns, *bulkCol)
+			b.dlogf(ctx, "Adding column %s %s %#x", colname, bulkCol.ColName, bulkCol.ti.TypeId)
+		} else {
+			return fmt.Errorf("column %s does not exist in destination table %s", colname, b.tablename)
+		}
+	}
+
+	return nil
+}
+
 // AddRow immediately writes the row to the destination table.
 // The arguments are the row values in the order they were specified.
+//
+// Rows that fail to convert return a *BulkError and are not sent, the
+// following rows can still be added.
 func (b *Bulk) AddRow(row []interface{}) (err error) {
+	b.rowOrdinal++
 	if !b.headerSent {
 		err = b.sendBulkCommand(b.ctx)
 		if err != nil {
@@ -173,23 +360,34 @@ func (b *Bulk) AddRow(row []interface{}) (err error) {
 			len(row), len(b.bulkColumns))
 	}
 
-	bytes, err := b.makeRowData(row)
+	params, err := b.makeRowParams(row)
 	if err != nil {
+		b.skipped = append(b.skipped, b.rowOrdinal)
 		return
 	}
 
-	_, err = b.cn.sess.buf.Write(bytes)
+	w := &countingWriter{w: b.cn.sess.buf}
+	err = b.writeRowData(w, params)
+	b.batchBytes += w.n
 	if err != nil {
 		return
 	}
 
+	b.batchLastRow = b.rowOrdinal
+	b.batchRows++
+	if b.retrying {
+		return
+	}
 	b.numRows = b.numRows + 1
+	if b.Options.OnProgress != nil && b.Options.NotifyAfter > 0 && b.numRows%b.Options.NotifyAfter == 0 {
+		b.Options.OnProgress(int64(b.numRows))
+	}
 	return
 }
 
-func (b *Bulk) makeRowData(row []interface{}) ([]byte, error) {
-	buf := new(bytes.Buffer)
-	buf.WriteByte(byte(tokenRow))
+// makeRowParams converts the values of a row before any of it is sent.
+func (b *Bulk) makeRowParams(row []interface{}) ([]param, error) {
+	params := make([]param, len(b.bulkColumns))
 
 	var logcol bytes.Buffer
 	for i, col := range b.bulkColumns {
@@ -199,24 +397,48 @@ func (b *Bulk) makeRowData(row []interface{}) ([]byte, error) {
 		}
 		param, err := b.makeParam(row[i], col)
 		if err != nil {
-			return nil, fmt.Errorf("bulkcopy: %s", err.Error())
+			return nil, &BulkError{
+				Batch:    b.batch,
+				FirstRow: b.batchFirstRow,
+				LastRow:  b.batchLastRow,
+				Row:      b.rowOrdinal,
+				Column:   col.ColName,
+				Err:      err,
+			}
 		}
 
 		if col.ti.Writer == nil {
 			return nil, fmt.Errorf("no writer for column: %s, TypeId: %#x",
 				col.ColName, col.ti.TypeId)
 		}
-		err = col.ti.Writer(buf, param.ti, param.buffer)
-		if err != nil {
-			return nil, fmt.Errorf("bulkcopy: %s", err.Error())
-		}
+		params[i] = param
 	}
 
 	b.dlogf(b.ctx, "row[%d] %s", b.numRows, logcol.String())
 
-	return buf.Bytes(), nil
+	return params, nil
+}
+
+// writeRowData writes a row, streamed values are read as they are sent.
+func (b *Bulk) writeRowData(w io.Writer, params []param) (err error) {
+	if _, err = w.Write([]byte{byte(tokenRow)}); err != nil {
+		return
+	}
+	for i, col := range b.bulkColumns {
+		if params[i].reader != nil {
+			err = writePLPStream(w, params[i].reader, b.cn.sess.buf.PackageSize())
+		} else {
+			err = col.ti.Writer(w, params[i].ti, params[i].buffer)
+		}
+		if err != nil {
+			return fmt.Errorf("bulkcopy: %s", err.Error())
+		}
+	}
+	return
 }
 
+// Done ends the batch and returns the number of rows copied. A batch the
+// server fails returns a *BulkError.
 func (b *Bulk) Done() (rowcount int64, err error) {
 	if !b.headerSent {
 		//no rows had been sent
@@ -236,15 +458,43 @@ func (b *Bulk) Done() (rowcount int64, err error) {
 
 	buf.FinishPacket()
 
+	b.headerSent = false
+	b.batchBytes = 0
+
 	reader := startReading(b.cn.sess, b.ctx, outputs{})
 	err = reader.iterateResponse()
 	if err != nil {
-		return 0, b.cn.checkBadConn(b.ctx, err, false)
+		b.rollback()
+		err = b.cn.checkBadConn(b.ctx, err, false)
+		if serverErr, ok := err.(Error); ok {
+			err = b.batchError(serverErr)
+		}
+		return 0, err
+	}
+	if b.inTransaction {
+		b.inTransaction = false
+		b.cn.transactionCtx = b.ctx
+		if err = b.cn.Commit(); err != nil {
+			return 0, err
+		}
 	}
 
 	return reader.rowCount, nil
 }
 
+// rollback rolls back the internal transaction of a failed batch.
+func (b *Bulk) rollback() {
+	if !b.inTransaction {
+		return
+	}
+	b.inTransaction = false
+	// the server may have rolled back the transaction already
+	if b.cn.connectionGood && b.cn.sess.tranid != 0 {
+		b.cn.transactionCtx = b.ctx
+		b.cn.Rollback()
+	}
+}
+
 func (b *Bulk) createColMetadata() []byte {
 	buf := new(bytes.Buffer)
 	buf.WriteByte(byte(tokenColMetadata))                              // token
@@ -278,7 +528,7 @@ func (b *Bulk) createColMetadata() []byte {
 }
 
 func (b *Bulk) getMetadata(ctx context.Context) (err error) {
-	stmt, err := b.cn.prepareContext(ctx, "SET FMTONLY ON")
+	stmt, err := b.cn.prepareInternal(ctx, "SET FMTONLY ON")
 	if err != nil {
 		return
 	}
@@ -289,7 +539,7 @@ func (b *Bulk) getMetadata(ctx context.Context) (err error) {
 	}
 
 	// Get columns info.
-	stmt, err = b.cn.prepareContext(ctx, fmt.Sprintf("select * from %s SET FMTONLY OFF", b.tablename))
+	stmt, err = b.cn.prepareInternal(ctx, fmt.Sprintf("select * from %s SET FMTONLY OFF", b.tablename))
 	if err != nil {
 		return
 	}
@@ -310,31 +560,78 @@ func (b *Bulk) getMetadata(ctx context.Context) (err error) {
 	return rows.Close()
 }
 
+// bulkValue converts a value to one of the types makeParam encodes: nil,
+// int64, float64, bool, string, []byte, time.Time and streams. Values are
+// converted like query parameters, driver.Valuer implementations are
+// called.
+func bulkValue(val interface{}) (interface{}, error) {
+	switch v := val.(type) {
+	case nil, int64, float64, bool, string, []byte, time.Time, VarBinaryStream, NVarCharStream, Variant:
+		return val, nil
+	case driver.Valuer:
+	case io.Reader:
+		return v, nil
+	default:
+		if v, ok := bulkValueExtra(val); ok {
+			return v, nil
+		}
+	}
+	return driver.DefaultParameterConverter.ConvertValue(val)
+}
+
 func (b *Bulk) makeParam(val DataValue, col columnStruct) (res param, err error) {
 	res.ti.Size = col.ti.Size
 	res.ti.TypeId = col.ti.TypeId
 
+	val, err = bulkValue(val)
+	if err != nil {
+		err = fmt.Errorf("mssql: invalid value for column %s: %v", col.ColName, err)
+		return
+	}
 	if val == nil {
 		res.ti.Size = 0
 		return
 	}
 
+	if isPLP(&col.ti) {
+		// large values can be streamed
+		switch val := val.(type) {
+		case VarBinaryStream:
+			res.reader = val.R
+			return
+		case NVarCharStream:
+			if col.ti.TypeId != typeNVarChar && col.ti.TypeId != typeXml {
+				err = fmt.Errorf("mssql: invalid type for column %s: %T", col.ColName, val)
+				return
+			}
+			if val.R != nil {
+				res.reader = newUcs2Reader(val.R)
+			}
+			return
+		case io.Reader:
+			res.reader = val
+			return
+		}
+	}
+
 	switch col.ti.TypeId {
 
 	case typeInt1, typeInt2, typeInt4, typeInt8, typeIntN:
 		var intvalue int64
 
 		switch val := val.(type) {
-		case int:
-			intvalue = int64(val)
-		case int32:
-			intvalue = int64(val)
 		case int64:
 			intvalue = val
-		case float32:
-			intvalue = int64(val)
 		case float64:
 			intvalue = int64(val)
+		case bool:
+			if val {
+				intvalue = 1
+			}
+		case string:
+			if intvalue, err = strconv.ParseInt(strings.TrimSpace(val), 10, 64); err != nil {
+				return res, fmt.Errorf("bulk: unable to convert string to int: %v", err)
+			}
 		default:
 			err = fmt.Errorf("mssql: invalid type for int column: %T", val)
 			return
@@ -354,14 +651,14 @@ func (b *Bulk) makeParam(val DataValue, col columnStruct) (res param, err error)
 		var floatvalue float64
 
 		switch val := val.(type) {
-		case float32:
-			floatvalue = float64(val)
 		case float64:
 			floatvalue = val
-		case int:
-			floatvalue = float64(val)
 		case int64:
 			floatvalue = float64(val)
+		case string:
+			if floatvalue, err = strconv.ParseFloat(strings.TrimSpace(val), 64); err != nil {
+				return res, fmt.Errorf("bulk: unable to convert string to float: %v", err)
+			}
 		default:
 			err = fmt.Errorf("mssql: invalid type for float column: %T %s", val, val)
 			return
@@ -374,44 +671,54 @@ func (b *Bulk) makeParam(val DataValue, col columnStruct) (res param, err error)
 			res.buffer = make([]byte, 8)
 			binary.LittleEndian.PutUint64(res.buffer, math.Float64bits(floatvalue))
 		}
-	case typeNVarChar, typeNText, typeNChar:
+	case typeNVarChar, typeNText, typeNChar, typeXml:
 
 		switch val := val.(type) {
-		case string:
-			res.buffer = str2ucs2(val)
-		case int64:
-			res.buffer = []byte(strconv.FormatInt(val, 10))
 		case []byte:
 			res.buffer = val
 		default:
-			err = fmt.Errorf("mssql: invalid type for nvarchar column: %T %s", val, val)
-			return
+			var str string
+			if str, err = bulkString(val); err != nil {
+				err = fmt.Errorf("mssql: invalid type for nvarchar column: %T %s", val, val)
+				return
+			}
+			res.buffer = str2ucs2(str)
 		}
 		res.ti.Size = len(res.buffer)
 
 	case typeVarChar, typeBigVarChar, typeText, typeChar, typeBigChar:
 		switch val := val.(type) {
-		case string:
-			res.buffer = []byte(val)
 		case []byte:
 			res.buffer = val
-		case int64:
-			res.buffer = []byte(strconv.FormatInt(val, 10))
 		default:
-			err = fmt.Errorf("mssql: invalid type for varchar column: %T %s", val, val)
-			return
+			var str string
+			if str, err = bulkString(val); err != nil {
+				err = fmt.Errorf("mssql: invalid type for varchar column: %T %s", val, val)
+				return
+			}
+			res.buffer = []byte(str)
 		}
 		res.ti.Size = len(res.buffer)
 
 	case typeBit, typeBitN:
-		if reflect.TypeOf(val).Kind() != reflect.Bool {
+		var bit bool
+		switch val := val.(type) {
+		case bool:
+			bit = val
+		case int64:
+			bit = val != 0
+		case string:
+			if bit, err = strconv.ParseBool(strings.TrimSpace(val)); err != nil {
+				return res, fmt.Errorf("bulk: unable to convert string to bit: %v", err)
+			}
+		default:
 			err = fmt.Errorf("mssql: invalid type for bit column: %T %s", val, val)
 			return
 		}
 		res.ti.TypeId = typeBitN
 		res.ti.Size = 1
 		res.buffer = make([]byte, 1)
-		if val.(bool) {
+		if bit {
 			res.buffer[0] = 1
 		}
 	case typeDateTime2N:
@@ -421,7 +728,7 @@ func (b *Bulk) makeParam(val DataValue, col columnStruct) (res param, err error)
 			res.ti.Size = len(res.buffer)
 		case string:
 			var t time.Time
-			if t, err = time.Parse(sqlDateTimeFormat, val); err != nil {
+			if t, err = parseBulkTime(val); err != nil {
 				return res, fmt.Errorf("bulk: unable to convert string to date: %v", err)
 			}
 			res.buffer = encodeDateTime2(t, int(col.ti.Scale))
@@ -437,7 +744,7 @@ func (b *Bulk) makeParam(val DataValue, col columnStruct) (res param, err error)
 			res.ti.Size = len(res.buffer)
 		case string:
 			var t time.Time
-			if t, err = time.Parse(sqlDateTimeFormat, val); err != nil {
+			if t, err = parseBulkTime(val); err != nil {
 				return res, fmt.Errorf("bulk: unable to convert string to date: %v", err)
 			}
 			res.buffer = encodeDateTimeOffset(t, int(col.ti.Scale))
@@ -468,7 +775,7 @@ func (b *Bulk) makeParam(val DataValue, col columnStruct) (res param, err error)
 		case time.Time:
 			t = val
 		case string:
-			if t, err = time.Parse(sqlDateTimeFormat, val); err != nil {
+			if t, err = parseBulkTime(val); err != nil {
 				return res, fmt.Errorf("bulk: unable to convert string to date: %v", err)
 			}
 		default:
@@ -501,24 +808,31 @@ func (b *Bulk) makeParam(val DataValue, col columnStruct) (res param, err error)
 			err = fmt.Errorf("mssql: invalid type for time column: %T %s", val, val)
 			return
 		}
-	// case typeMoney, typeMoney4, typeMoneyN:
+	case typeMoney, typeMoney4, typeMoneyN:
+		var money int64
+		if money, err = moneyValue(val); err != nil {
+			return
+		}
+		if col.ti.Size == 4 {
+			if money < math.MinInt32 || money > math.MaxInt32 {
+				return res, fmt.Errorf("smallmoney out of range: %v", val)
+			}
+			res.buffer = make([]byte, 4)
+			binary.LittleEndian.PutUint32(res.buffer, uint32(money))
+		} else {
+			// the high half comes first
+			res.buffer = make([]byte, 8)
+			binary.LittleEndian.PutUint32(res.buffer, uint32(money>>32))
+			binary.LittleEndian.PutUint32(res.buffer[4:], uint32(money))
+		}
+		res.ti.Size = len(res.buffer)
 	case typeDecimal, typeDecimalN, typeNumeric, typeNumericN:
 		prec := col.ti.Prec
 		scale := col.ti.Scale
 		var dec decimal.Decimal
 		switch v := val.(type) {
-		case int:
-			dec = decimal.Int64ToDecimalScale(int64(v), 0)
-		case int8:
-			dec = decimal.Int64ToDecimalScale(int64(v), 0)
-		case int16:
-			dec = decimal.Int64ToDecimalScale(int64(v), 0)
-		case int32:
-			dec = decimal.Int64ToDecimalScale(int64(v), 0)
 		case int64:
-			dec = decimal.Int64ToDecimalScale(int64(v), 0)
-		case float32:
-			dec, err = decimal.Float64ToDecimalScale(float64(v), scale)
+			dec, err = decimal.StringToDecimalScale(strconv.FormatInt(v, 10), scale)
 		case float64:
 			dec, err = decimal.Float64ToDecimalScale(float64(v), scale)
 		case string:
@@ -565,11 +879,14 @@ func (b *Bulk) makeParam(val DataValue, col columnStruct) (res param, err error)
 			buf[i] = ub[j]
 		}
 		res.buffer = buf
-	case typeBigVarBin, typeBigBinary:
+	case typeBigVarBin, typeBigBinary, typeImage:
 		switch val := val.(type) {
 		case []byte:
 			res.ti.Size = len(val)
 			res.buffer = val
+		case string:
+			res.ti.Size = len(val)
+			res.buffer = []byte(val)
 		default:
 			err = fmt.Errorf("mssql: invalid type for Binary column: %T %s", val, val)
 			return
@@ -579,10 +896,23 @@ func (b *Bulk) makeParam(val DataValue, col columnStruct) (res param, err error)
 		case []byte:
 			res.ti.Size = len(val)
 			res.buffer = val
+		case string:
+			var u UniqueIdentifier
+			if err = u.Scan(val); err != nil {
+				return
+			}
+			v, _ := u.Value()
+			res.buffer = v.([]byte)
+			res.ti.Size = len(res.buffer)
 		default:
 			err = fmt.Errorf("mssql: invalid type for Guid column: %T %s", val, val)
 			return
 		}
+	case typeVariant:
+		if res.buffer, err = encodeVariant(val, b.cn.sess.collation); err != nil {
+			return
+		}
+		res.ti.Size = len(res.buffer)
 
 	default:
 		err = fmt.Errorf("mssql: type %x not implemented", col.ti.TypeId)
@@ -591,6 +921,49 @@ func (b *Bulk) makeParam(val DataValue, col columnStruct) (res param, err error)
 
 }
 
+// bulkString converts a scalar value to the text the server converts it
+// to.
+func bulkString(val interface{}) (string, error) {
+	switch val := val.(type) {
+	case string:
+		return val, nil
+	case int64:
+		return strconv.FormatInt(val, 10), nil
+	case float64:
+		return strconv.FormatFloat(val, 'g', -1, 64), nil
+	case bool:
+		if val {
+			return "1", nil
+		}
+		return "0", nil
+	}
+	return "", fmt.Errorf("mssql: cannot convert %T to string", val)
+}
+
+// moneyValue returns a money value in ten-thousandths.
+func moneyValue(val interface{}) (int64, error) {
+	var dec decimal.Decimal
+	var err error
+	switch v := val.(type) {
+	case int64:
+		dec, err = decimal.StringToDecimalScale(strconv.FormatInt(v, 10), 4)
+	case float64:
+		dec, err = decimal.Float64ToDecimalScale(v, 4)
+	case string:
+		dec, err = decimal.StringToDecimalScale(strings.TrimSpace(v), 4)
+	default:
+		return 0, fmt.Errorf("mssql: invalid type for money column: %T %s", val, val)
+	}
+	if err != nil {
+		return 0, err
+	}
+	money := dec.BigInt()
+	if !money.IsInt64() {
+		return 0, fmt.Errorf("money out of range: %v", val)
+	}
+	return money.Int64(), nil
+}
+
 func (b *Bulk) dlogf(ctx context.Context, format string, v ...interface{}) {
 	if b.Debug {
 		b.cn.sess.logger.Log(ctx, msdsn.LogDebug, fmt.Sprintf(format, v...))
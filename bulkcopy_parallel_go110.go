@@ -0,0 +1,208 @@
+// +build go1.10
+
+package mssql
+
+import (
+	"context"
+	"sync"
+)
+
+// ParallelBulkOptions are the options of ParallelBulkCopy.
+type ParallelBulkOptions struct {
+	// BulkOptions are the options of the copy of every connection.
+	// OnProgress gets the rows sent by all connections, in steps of
+	// NotifyAfter rows of a connection. OnProgress and OnRowError are
+	// called from the goroutines of the connections, one at a time.
+	//
+	// Concurrent copies into a heap with Tablock take bulk update locks
+	// that do not block each other. The copies into a table with indexes
+	// and Tablock wait for each other, leave Tablock unset for them.
+	BulkOptions BulkOptions
+	// Connections is the number of concurrent copies, 4 when 0.
+	Connections int
+	// Partition returns the partition of a row. The rows of a partition
+	// are copied by the same connection in their order. Rows go to the
+	// first free connection when Partition is nil.
+	Partition func(row []interface{}) int
+	// QueueRows is the number of rows that may wait for each connection,
+	// 1000 when 0.
+	QueueRows int
+}
+
+// ParallelBulkCopy copies the rows of src into the columns of table over
+// several connections of connector. It returns the number of rows
+// copied by all connections. ParallelBulkCopyPool takes the connections
+// from a *sql.DB instead.
+//
+// Every connection commits its batches as Conn.BulkCopyFrom does. When a
+// connection or src fails, or ctx is cancelled, the unfinished batches of
+// all connections are cancelled and the first error is returned.
+func ParallelBulkCopy(ctx context.Context, connector *Connector, table string, columns []string, src RowSource, options ParallelBulkOptions) (int64, error) {
+	copier := func(ctx context.Context, src RowSource, options BulkOptions) (int64, error) {
+		return copyPartition(ctx, connector, table, columns, src, options)
+	}
+	return parallelBulkCopy(ctx, copier, src, options)
+}
+
+// partitionCopier copies the rows of src over a connection of its own.
+type partitionCopier func(ctx context.Context, src RowSource, options BulkOptions) (int64, error)
+
+// parallelBulkCopy runs copier for every connection of ParallelBulkCopy and
+// distributes the rows of src to them.
+func parallelBulkCopy(ctx context.Context, copier partitionCopier, src RowSource, options ParallelBulkOptions) (int64, error) {
+	n := options.Connections
+	if n <= 0 {
+		n = 4
+	}
+	queue := options.QueueRows
+	if queue <= 0 {
+		queue = 1000
+	}
+	bulkOptions := options.BulkOptions
+	var mu sync.Mutex
+	var sent int64
+	// progressOf returns the OnProgress of a connection, it adds the rows
+	// the connection sent since its last call to the rows of all
+	progressOf := func(onProgress func(int64)) func(int64) {
+		if onProgress == nil {
+			return nil
+		}
+		var last int64
+		return func(rows int64) {
+			mu.Lock()
+			defer mu.Unlock()
+			sent += rows - last
+			last = rows
+			onProgress(sent)
+		}
+	}
+	if onRowError := bulkOptions.OnRowError; onRowError != nil {
+		bulkOptions.OnRowError = func(row int64, values []interface{}, err error) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return onRowError(row, values, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		errMu    sync.Mutex
+		firstErr error
+		rowCount int64
+	)
+	fail := func(err error) {
+		errMu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		errMu.Unlock()
+		cancel()
+	}
+
+	queues := make([]chan []interface{}, n)
+	for i := range queues {
+		// the connections share the queue of rows without partitions
+		if i == 0 || options.Partition != nil {
+			queues[i] = make(chan []interface{}, queue)
+		} else {
+			queues[i] = queues[0]
+		}
+	}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(rows <-chan []interface{}) {
+			defer wg.Done()
+			connOptions := bulkOptions
+			connOptions.OnProgress = progressOf(bulkOptions.OnProgress)
+			copied, err := copier(ctx, &queueRowSource{ctx: ctx, rows: rows}, connOptions)
+			errMu.Lock()
+			rowCount += copied
+			errMu.Unlock()
+			if err != nil {
+				fail(err)
+			}
+		}(queues[i])
+	}
+
+	err := dispatchRows(ctx, src, queues, options.Partition)
+	if options.Partition == nil {
+		close(queues[0])
+	} else {
+		for _, q := range queues {
+			close(q)
+		}
+	}
+	if err != nil {
+		fail(err)
+	}
+	wg.Wait()
+	return rowCount, firstErr
+}
+
+// copyPartition copies the rows of src over a new connection.
+func copyPartition(ctx context.Context, connector *Connector, table string, columns []string, src RowSource, options BulkOptions) (int64, error) {
+	dc, err := connector.Connect(ctx)
+	if err != nil {
+		return 0, err
+	}
+	conn := dc.(*Conn)
+	defer conn.Close()
+	return conn.BulkCopyFrom(ctx, table, columns, src, options)
+}
+
+// dispatchRows sends copies of the rows of src to the queues.
+func dispatchRows(ctx context.Context, src RowSource, queues []chan []interface{}, partition func(row []interface{}) int) error {
+	for src.Next() {
+		row, err := src.Values()
+		if err != nil {
+			return err
+		}
+		q := queues[0]
+		if partition != nil {
+			p := partition(row) % len(queues)
+			if p < 0 {
+				p += len(queues)
+			}
+			q = queues[p]
+		}
+		select {
+		case q <- copyValues(row):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return src.Err()
+}
+
+// queueRowSource reads the rows of a connection of ParallelBulkCopy. The
+// rows end with the error of ctx when it is cancelled, so that the batch
+// being sent is cancelled instead of committed.
+type queueRowSource struct {
+	ctx  context.Context
+	rows <-chan []interface{}
+	row  []interface{}
+	err  error
+}
+
+func (s *queueRowSource) Next() bool {
+	var ok bool
+	select {
+	case s.row, ok = <-s.rows:
+		if !ok {
+			s.err = s.ctx.Err()
+		}
+	case <-s.ctx.Done():
+		s.err = s.ctx.Err()
+	}
+	return ok && s.err == nil
+}
+
+func (s *queueRowSource) Values() ([]interface{}, error) {
+	return s.row, nil
+}
+
+func (s *queueRowSource) Err() error {
+	return s.err
+}
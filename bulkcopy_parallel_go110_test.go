@@ -0,0 +1,125 @@
+// +build go1.10
+
+package mssql
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+)
+
+func TestDispatchRows(t *testing.T) {
+	queues := make([]chan []interface{}, 3)
+	for i := range queues {
+		queues[i] = make(chan []interface{}, 10)
+	}
+	src := &sliceRowSource{rows: [][]interface{}{{1}, {2}, {3}, {4}, {-5}}}
+	partition := func(row []interface{}) int { return row[0].(int) }
+	if err := dispatchRows(context.Background(), src, queues, partition); err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]int{{3}, {1, 4, -5}, {2}}
+	for i, q := range queues {
+		close(q)
+		var got []int
+		for row := range q {
+			got = append(got, row[0].(int))
+		}
+		if len(got) != len(expected[i]) {
+			t.Errorf("expected rows %v in partition %d, got %v", expected[i], i, got)
+			continue
+		}
+		for j := range got {
+			if got[j] != expected[i][j] {
+				t.Errorf("expected rows %v in partition %d, got %v", expected[i], i, got)
+				break
+			}
+		}
+	}
+}
+
+func TestQueueRowSourceCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	rows := make(chan []interface{}, 1)
+	rows <- []interface{}{1}
+	src := &queueRowSource{ctx: ctx, rows: rows}
+	if !src.Next() {
+		t.Fatal("expected a row")
+	}
+	cancel()
+	if src.Next() {
+		t.Fatal("expected the end of the rows")
+	}
+	if src.Err() != context.Canceled {
+		t.Errorf("expected the error of the context, got %v", src.Err())
+	}
+
+	// the end of the rows of an uncancelled copy is not an error
+	close(rows)
+	src = &queueRowSource{ctx: context.Background(), rows: rows}
+	if src.Next() || src.Err() != nil {
+		t.Errorf("expected the end of the rows without an error, got %v", src.Err())
+	}
+}
+
+func TestParallelBulkCopy(t *testing.T) {
+	checkConnStr(t)
+	connector, err := NewConnector(makeConnStr(t).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	dc, err := connector.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := dc.(*Conn)
+	defer conn.Close()
+	// a global temporary table is visible to the connections of the copy
+	err = conn.execSimple(ctx, "if object_id('tempdb..##parallel_bulk') is not null drop table ##parallel_bulk; "+
+		"create table ##parallel_bulk (n int, p int)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.execSimple(ctx, "drop table ##parallel_bulk")
+
+	ch := make(chan []interface{}, 1000)
+	for i := 1; i <= 1000; i++ {
+		ch <- []interface{}{i, i % 7}
+	}
+	close(ch)
+	var progress int64
+	options := ParallelBulkOptions{
+		BulkOptions: BulkOptions{Tablock: true, RowsPerBatch: 100, NotifyAfter: 1,
+			OnProgress: func(rows int64) { progress = rows }},
+		Connections: 3,
+		Partition:   func(row []interface{}) int { return row[1].(int) },
+	}
+	n, err := ParallelBulkCopy(ctx, connector, "##parallel_bulk", []string{"n", "p"}, ChannelRowSource(ch), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1000 {
+		t.Errorf("expected 1000 copied rows, got %d", n)
+	}
+	if progress != 1000 {
+		t.Errorf("expected progress of 1000 rows, got %d", progress)
+	}
+
+	stmt, err := conn.prepareContext(ctx, "select count(*), sum(cast(n as bigint)) from ##parallel_bulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := stmt.QueryContext(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	dest := make([]driver.Value, 2)
+	if err = rows.Next(dest); err != nil {
+		t.Fatal(err)
+	}
+	if dest[0] != int64(1000) || dest[1] != int64(500500) {
+		t.Errorf("unexpected rows in the table: %v", dest)
+	}
+}
@@ -0,0 +1,45 @@
+// +build go1.13
+
+package mssql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// ConnPool provides the connections of ParallelBulkCopyPool, e.g. a
+// *sql.DB of this driver.
+type ConnPool interface {
+	Conn(ctx context.Context) (*sql.Conn, error)
+}
+
+// ParallelBulkCopyPool is ParallelBulkCopy over connections taken from
+// pool. The connections go back to pool when the copy ends, a connection
+// that failed is closed by database/sql.
+func ParallelBulkCopyPool(ctx context.Context, pool ConnPool, table string, columns []string, src RowSource, options ParallelBulkOptions) (int64, error) {
+	copier := func(ctx context.Context, src RowSource, options BulkOptions) (int64, error) {
+		return copyPoolPartition(ctx, pool, table, columns, src, options)
+	}
+	return parallelBulkCopy(ctx, copier, src, options)
+}
+
+// copyPoolPartition copies the rows of src over a connection of pool.
+func copyPoolPartition(ctx context.Context, pool ConnPool, table string, columns []string, src RowSource, options BulkOptions) (int64, error) {
+	conn, err := pool.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	var copied int64
+	err = conn.Raw(func(driverConn interface{}) error {
+		c, ok := driverConn.(*Conn)
+		if !ok {
+			return errors.New("mssql: ParallelBulkCopyPool needs connections of this driver")
+		}
+		var err error
+		copied, err = c.BulkCopyFrom(ctx, table, columns, src, options)
+		return err
+	})
+	return copied, err
+}
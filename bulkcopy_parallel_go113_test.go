@@ -0,0 +1,48 @@
+// +build go1.13
+
+package mssql
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+)
+
+func TestParallelBulkCopyPool(t *testing.T) {
+	checkConnStr(t)
+	connector, err := NewConnector(makeConnStr(t).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	ctx := context.Background()
+	// a global temporary table is visible to the connections of the copy
+	_, err = db.ExecContext(ctx, "if object_id('tempdb..##parallel_pool') is not null drop table ##parallel_pool; "+
+		"create table ##parallel_pool (n int)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.ExecContext(ctx, "drop table ##parallel_pool")
+
+	ch := make(chan []interface{}, 500)
+	for i := 1; i <= 500; i++ {
+		ch <- []interface{}{i}
+	}
+	close(ch)
+	options := ParallelBulkOptions{BulkOptions: BulkOptions{RowsPerBatch: 100}, Connections: 3}
+	n, err := ParallelBulkCopyPool(ctx, db, "##parallel_pool", []string{"n"}, ChannelRowSource(ch), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 500 {
+		t.Errorf("expected 500 copied rows, got %d", n)
+	}
+	var count, sum int64
+	if err = db.QueryRowContext(ctx, "select count(*), sum(n) from ##parallel_pool").Scan(&count, &sum); err != nil {
+		t.Fatal(err)
+	}
+	if count != 500 || sum != 125250 {
+		t.Errorf("unexpected rows in the table: %d rows, sum %d", count, sum)
+	}
+}
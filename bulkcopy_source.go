@@ -0,0 +1,250 @@
+package mssql
+
+import (
+	"context"
+	"database/sql"
+	"io"
+)
+
+// RowSource provides the rows of Conn.BulkCopyFrom.
+type RowSource interface {
+	// Next advances to the next row. It returns false at the end of the
+	// rows or when reading a row failed.
+	Next() bool
+	// Values returns the values of the current row in the order of the
+	// columns. The slice is not used after the next call to Next.
+	Values() ([]interface{}, error)
+	// Err returns the error that stopped Next, if any.
+	Err() error
+}
+
+// BulkCopyFrom copies the rows of src into the columns of table. It
+// returns the number of rows copied.
+//
+// The rows are sent as they are read. A batch ends after
+// options.RowsPerBatch rows or options.KilobytesPerBatch kilobytes when
+// they are set, every batch is committed on its own unless the connection
+// is in a transaction. When src or ctx fails, the unfinished batch is
+// cancelled and the rows of the previous batches are kept.
+// options.UseInternalTransaction also rolls back a batch the server fails.
+// Failed rows and batches return a *BulkError, unless options.OnRowError
+// takes the failing rows.
+func (c *Conn) BulkCopyFrom(ctx context.Context, table string, columns []string, src RowSource, options BulkOptions) (int64, error) {
+	b := c.CreateBulkContext(ctx, table, columns)
+	b.Options = options
+	errorRows := options.OnRowError != nil
+	var rowCount int64
+	var batchRows int
+	// batch holds copies of the rows of the batch in error rows mode
+	var batch []bulkRow
+	endBatch := func() error {
+		n, err := b.Done()
+		rowCount += n
+		if _, ok := err.(*BulkError); ok && errorRows {
+			b.retrying = true
+			n, err = b.retryRows(batch, err)
+			b.retrying = false
+			rowCount += n
+		}
+		batch = batch[:0]
+		batchRows = 0
+		return err
+	}
+	for src.Next() {
+		row, err := src.Values()
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err == nil {
+			err = b.AddRow(row)
+			if _, ok := err.(*BulkError); ok && errorRows {
+				err = options.OnRowError(b.rowOrdinal, copyValues(row), err)
+				if err == nil {
+					continue
+				}
+			}
+		}
+		if err != nil {
+			return rowCount, b.abort(err)
+		}
+		if errorRows {
+			batch = append(batch, bulkRow{ordinal: b.rowOrdinal, values: copyValues(row)})
+		}
+		batchRows++
+		if (options.RowsPerBatch > 0 && batchRows >= options.RowsPerBatch) ||
+			(options.KilobytesPerBatch > 0 && b.batchBytes >= int64(options.KilobytesPerBatch)*1024) {
+			if err := endBatch(); err != nil {
+				return rowCount, err
+			}
+		}
+	}
+	if err := src.Err(); err != nil {
+		return rowCount, b.abort(err)
+	}
+	err := endBatch()
+	return rowCount, err
+}
+
+// bulkRow is a row kept to retry its batch.
+type bulkRow struct {
+	ordinal int64
+	values  []interface{}
+}
+
+func copyValues(row []interface{}) []interface{} {
+	return append([]interface{}(nil), row...)
+}
+
+// retryRows copies the rows of a failed batch again in smaller batches and
+// passes the rows that fail on their own to OnRowError. cause is the error
+// of the batch.
+func (b *Bulk) retryRows(rows []bulkRow, cause error) (int64, error) {
+	if len(rows) == 1 {
+		return 0, b.Options.OnRowError(rows[0].ordinal, rows[0].values, cause)
+	}
+	size := 1
+	if b.Options.BisectErrorRows {
+		size = (len(rows) + 1) / 2
+	}
+	var count int64
+	for len(rows) > 0 {
+		chunk := rows
+		if len(chunk) > size {
+			chunk = chunk[:size]
+		}
+		rows = rows[len(chunk):]
+		n, err := b.copyRows(chunk)
+		count += n
+		if _, ok := err.(*BulkError); ok {
+			n, err = b.retryRows(chunk, err)
+			count += n
+		}
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// copyRows copies rows kept by BulkCopyFrom as a batch of their own.
+func (b *Bulk) copyRows(rows []bulkRow) (int64, error) {
+	for i, row := range rows {
+		b.rowOrdinal = row.ordinal - 1
+		if err := b.AddRow(row.values); err != nil {
+			return 0, b.abort(err)
+		}
+		// the rows left out are numbered like in the first attempt
+		if i > 0 {
+			for o := rows[i-1].ordinal + 1; o < row.ordinal; o++ {
+				b.skipped = append(b.skipped, o)
+			}
+		}
+	}
+	return b.Done()
+}
+
+// abort cancels the batch being sent after a failure and returns the
+// error of the failure.
+func (b *Bulk) abort(cause error) error {
+	if !b.headerSent {
+		return cause
+	}
+	b.headerSent = false
+	buf := b.cn.sess.buf
+	err := buf.FinishPacket()
+	if err == nil {
+		err = sendAttention(buf)
+	}
+	if err != nil {
+		b.cn.connectionGood = false
+		return cause
+	}
+	// the response to the rows may come before the confirmation of the
+	// cancellation
+	for i := 0; i < 2; i++ {
+		tokChan := make(chan tokenStruct, 5)
+		go processSingleResponse(context.Background(), b.cn.sess, tokChan, outputs{})
+		if readCancelConfirmation(tokChan) {
+			b.rollback()
+			return cause
+		}
+	}
+	b.cn.connectionGood = false
+	return cause
+}
+
+type chanRowSource struct {
+	ch  <-chan []interface{}
+	row []interface{}
+}
+
+// ChannelRowSource returns a RowSource with the rows sent to ch. The rows
+// end when ch is closed.
+func ChannelRowSource(ch <-chan []interface{}) RowSource {
+	return &chanRowSource{ch: ch}
+}
+
+func (s *chanRowSource) Next() bool {
+	var ok bool
+	s.row, ok = <-s.ch
+	return ok
+}
+
+func (s *chanRowSource) Values() ([]interface{}, error) {
+	return s.row, nil
+}
+
+func (s *chanRowSource) Err() error {
+	return nil
+}
+
+type sqlRowSource struct {
+	rows   *sql.Rows
+	values []interface{}
+	ptrs   []interface{}
+}
+
+// SQLRowSource returns a RowSource with the rows of a query result, e.g.
+// to copy a table from another server. The columns of the result are
+// copied in their order.
+func SQLRowSource(rows *sql.Rows) RowSource {
+	return &sqlRowSource{rows: rows}
+}
+
+func (s *sqlRowSource) Next() bool {
+	return s.rows.Next()
+}
+
+func (s *sqlRowSource) Values() ([]interface{}, error) {
+	if s.values == nil {
+		cols, err := s.rows.Columns()
+		if err != nil {
+			return nil, err
+		}
+		s.values = make([]interface{}, len(cols))
+		s.ptrs = make([]interface{}, len(cols))
+		for i := range s.values {
+			s.ptrs[i] = &s.values[i]
+		}
+	}
+	if err := s.rows.Scan(s.ptrs...); err != nil {
+		return nil, err
+	}
+	return s.values, nil
+}
+
+func (s *sqlRowSource) Err() error {
+	return s.rows.Err()
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
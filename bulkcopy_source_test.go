@@ -0,0 +1,398 @@
+package mssql
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// doneRows adds a DONE token with the count of rows of a statement.
+func (r *testRPCResponse) doneRows(status uint16, count uint64) {
+	r.b = append(r.b, byte(tokenDone))
+	r.u16(status | doneCount)
+	r.u16(0)
+	r.u32(uint32(count))
+	r.u32(uint32(count >> 32))
+}
+
+// bulkBatches returns the number of rows sent in each bulk load request
+// and the number of attention requests.
+func (t *testRPCTransport) bulkBatches() (batches []int, attentions int) {
+	b := t.requests.Bytes()
+	for len(b) > 0 {
+		size := int(binary.BigEndian.Uint16(b[2:]))
+		typ, packet := packetType(b[0]), b[8:size]
+		b = b[size:]
+		switch typ {
+		case packBulkLoadBCP:
+			// the test rows have a single int column
+			rows := 0
+			for i := 0; i < len(packet); i++ {
+				if packet[i] == byte(tokenRow) && i+6 <= len(packet) && packet[i+1] == 4 {
+					rows++
+					i += 5
+				}
+			}
+			batches = append(batches, rows)
+		case packAttention:
+			attentions++
+		}
+	}
+	t.requests.Reset()
+	return
+}
+
+type sliceRowSource struct {
+	rows [][]interface{}
+	err  error
+	i    int
+}
+
+func (s *sliceRowSource) Next() bool {
+	if s.i >= len(s.rows) {
+		return false
+	}
+	s.i++
+	return true
+}
+
+func (s *sliceRowSource) Values() ([]interface{}, error) {
+	if s.rows[s.i-1] == nil {
+		return nil, s.err
+	}
+	return s.rows[s.i-1], nil
+}
+
+func (s *sliceRowSource) Err() error {
+	return nil
+}
+
+func TestBulkCopyFrom(t *testing.T) {
+	transport := &testRPCTransport{}
+	c := &Conn{
+		sess:           &tdsSession{buf: newTdsBuffer(defaultPacketSize, transport)},
+		connectionGood: true,
+	}
+	ctx := context.Background()
+	var r testRPCResponse
+	// SET FMTONLY ON and the columns of the table
+	r.done(&transport.responses)
+	r.columns("n")
+	r.done(&transport.responses)
+	for _, rows := range []uint64{2, 2, 1} {
+		// INSERT BULK and the rows of the batch
+		r.done(&transport.responses)
+		r.doneRows(doneFinal, rows)
+		r.done(&transport.responses)
+	}
+
+	ch := make(chan []interface{}, 5)
+	for i := 1; i <= 5; i++ {
+		ch <- []interface{}{i}
+	}
+	close(ch)
+	n, err := c.BulkCopyFrom(ctx, "t", []string{"n"}, ChannelRowSource(ch), BulkOptions{RowsPerBatch: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Errorf("expected 5 rows, got %d", n)
+	}
+	batches, _ := transport.bulkBatches()
+	if len(batches) != 3 || batches[0] != 2 || batches[1] != 2 || batches[2] != 1 {
+		t.Errorf("expected batches of 2, 2 and 1 rows, got %v", batches)
+	}
+}
+
+func TestBulkCopyFromAbort(t *testing.T) {
+	transport := &testRPCTransport{}
+	c := &Conn{
+		sess:           &tdsSession{buf: newTdsBuffer(defaultPacketSize, transport)},
+		connectionGood: true,
+	}
+	ctx := context.Background()
+	var r testRPCResponse
+	r.done(&transport.responses)
+	r.columns("n")
+	r.done(&transport.responses)
+	// the first batch
+	r.done(&transport.responses)
+	r.doneRows(doneFinal, 2)
+	r.done(&transport.responses)
+	// the second batch fails on its second row, the server answers the
+	// rows and confirms the cancellation
+	r.done(&transport.responses)
+	r.done(&transport.responses)
+	r.doneRows(doneAttn, 0)
+	r.done(&transport.responses)
+
+	sourceErr := errors.New("source failed")
+	src := &sliceRowSource{rows: [][]interface{}{{1}, {2}, {3}, nil, {5}}, err: sourceErr}
+	n, err := c.BulkCopyFrom(ctx, "t", []string{"n"}, src, BulkOptions{RowsPerBatch: 2})
+	if err != sourceErr {
+		t.Fatalf("expected the source error, got %v", err)
+	}
+	if n != 2 {
+		t.Errorf("expected the 2 rows of the first batch, got %d", n)
+	}
+	batches, attentions := transport.bulkBatches()
+	if len(batches) != 2 || batches[0] != 2 || batches[1] != 1 || attentions != 1 {
+		t.Errorf("expected batches of 2 and 1 rows and an attention, got %v and %d attentions", batches, attentions)
+	}
+	if !c.connectionGood {
+		t.Error("the connection must stay usable after a cancelled batch")
+	}
+}
+
+// requestTypes returns the packet types of the recorded requests.
+func (t *testRPCTransport) requestTypes() []packetType {
+	var types []packetType
+	b := t.requests.Bytes()
+	for len(b) > 0 {
+		size := int(binary.BigEndian.Uint16(b[2:]))
+		// the last packet of a request has the end of message status
+		if b[1]&1 != 0 {
+			types = append(types, packetType(b[0]))
+		}
+		b = b[size:]
+	}
+	return types
+}
+
+func TestBulkCopyFromOptions(t *testing.T) {
+	transport := &testRPCTransport{}
+	c := &Conn{
+		sess:           &tdsSession{buf: newTdsBuffer(defaultPacketSize, transport)},
+		connectionGood: true,
+	}
+	ctx := context.Background()
+	var r testRPCResponse
+	r.done(&transport.responses)
+	r.columns("n")
+	r.done(&transport.responses)
+	for _, rows := range []uint64{2, 1} {
+		// begin, INSERT BULK, the rows and commit
+		r.done(&transport.responses)
+		r.done(&transport.responses)
+		r.doneRows(doneFinal, rows)
+		r.done(&transport.responses)
+		r.done(&transport.responses)
+	}
+
+	var progress []int64
+	options := BulkOptions{
+		RowsPerBatch:           2,
+		KeepIdentity:           true,
+		UseInternalTransaction: true,
+		NotifyAfter:            2,
+		OnProgress:             func(rows int64) { progress = append(progress, rows) },
+	}
+	src := &sliceRowSource{rows: [][]interface{}{{1}, {2}, {3}}}
+	n, err := c.BulkCopyFrom(ctx, "t", []string{"n"}, src, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 rows, got %d", n)
+	}
+	if len(progress) != 1 || progress[0] != 2 {
+		t.Errorf("expected progress after 2 rows, got %v", progress)
+	}
+	if !bytes.Contains(transport.requests.Bytes(), str2ucs2("KEEP_IDENTITY")) {
+		t.Error("expected the KEEP_IDENTITY option in the bulk command")
+	}
+	expected := []packetType{
+		packSQLBatch, packSQLBatch,
+		packTransMgrReq, packSQLBatch, packBulkLoadBCP, packTransMgrReq,
+		packTransMgrReq, packSQLBatch, packBulkLoadBCP, packTransMgrReq,
+	}
+	if types := transport.requestTypes(); !reflect.DeepEqual(types, expected) {
+		t.Errorf("expected requests %v, got %v", expected, types)
+	}
+}
+
+func TestBulkCopyFromInternalTransactionInTransaction(t *testing.T) {
+	transport := &testRPCTransport{}
+	c := &Conn{
+		sess:           &tdsSession{buf: newTdsBuffer(defaultPacketSize, transport), tranid: 1},
+		connectionGood: true,
+	}
+	var r testRPCResponse
+	r.done(&transport.responses)
+	r.columns("n")
+	r.done(&transport.responses)
+
+	src := &sliceRowSource{rows: [][]interface{}{{1}}}
+	_, err := c.BulkCopyFrom(context.Background(), "t", []string{"n"}, src, BulkOptions{UseInternalTransaction: true})
+	if err == nil {
+		t.Fatal("expected an error when the connection is in a transaction")
+	}
+}
+
+func TestCopyInOptions(t *testing.T) {
+	// the progress callback is not part of the statement
+	stmt := CopyIn("t", BulkOptions{KeepIdentity: true, OnProgress: func(int64) {}}, "n")
+	if !strings.Contains(stmt, `"KeepIdentity":true`) {
+		t.Errorf("unexpected statement %s", stmt)
+	}
+}
+
+// serverError adds an ERROR token.
+func (r *testRPCResponse) serverError(number int32, message string) {
+	var tok testRPCResponse
+	tok.u32(uint32(number))
+	tok.b = append(tok.b, 1, 16) // state, class
+	msg := str2ucs2(message)
+	tok.u16(uint16(len(msg) / 2))
+	tok.b = append(tok.b, msg...)
+	tok.b = appendBVarChar(tok.b, "")
+	tok.b = appendBVarChar(tok.b, "")
+	tok.u32(1)
+	r.b = append(r.b, byte(tokenError))
+	r.u16(uint16(len(tok.b)))
+	r.b = append(r.b, tok.b...)
+}
+
+// bulkBatch adds the responses to the bulk command and the rows of a
+// batch, the server fails the batch when message is set.
+func (r *testRPCResponse) bulkBatch(packets *bytes.Buffer, rows uint64, message string) {
+	r.done(packets)
+	if message != "" {
+		r.serverError(4864, message)
+		r.doneRows(doneError, 0)
+	} else {
+		r.doneRows(doneFinal, rows)
+	}
+	r.done(packets)
+}
+
+func TestBulkBatchError(t *testing.T) {
+	b := &Bulk{
+		batch:         2,
+		batchFirstRow: 10,
+		batchLastRow:  14,
+		batchRows:     4,
+		skipped:       []int64{11},
+		bulkColumns:   []columnStruct{{ColName: "a"}, {ColName: "b"}},
+	}
+	e := b.batchError(Error{Message: "Bulk load data conversion error (truncation) for row 2, column 2 (b)."})
+	if e.Row != 12 || e.Column != "b" {
+		t.Errorf("expected row 12 and column b, got row %d and column %q", e.Row, e.Column)
+	}
+	e = b.batchError(Error{Message: "Received an invalid column length from the bcp client for colid 1."})
+	if e.Row != 0 || e.Column != "a" {
+		t.Errorf("expected column a, got row %d and column %q", e.Row, e.Column)
+	}
+	e = b.batchError(Error{Message: "Violation of PRIMARY KEY constraint."})
+	if msg := e.Error(); !strings.Contains(msg, "batch 2, rows 10 to 14") {
+		t.Errorf("expected the rows of the batch in the error, got %s", msg)
+	}
+}
+
+type testRowError struct {
+	row    int64
+	values []interface{}
+	err    error
+}
+
+func TestBulkCopyFromErrorRows(t *testing.T) {
+	for _, bisect := range []bool{false, true} {
+		transport := &testRPCTransport{}
+		c := &Conn{
+			sess:           &tdsSession{buf: newTdsBuffer(defaultPacketSize, transport)},
+			connectionGood: true,
+		}
+		var r testRPCResponse
+		r.done(&transport.responses)
+		r.columns("n")
+		r.done(&transport.responses)
+		// row 4 fails to convert, the server fails the fourth row sent
+		r.bulkBatch(&transport.responses, 0, "Bulk load data conversion error (overflow) for row 4, column 1 (n).")
+		if bisect {
+			// rows 1 and 2, then 3 and 5 and each of them
+			r.bulkBatch(&transport.responses, 2, "")
+			r.bulkBatch(&transport.responses, 0, "Bulk load data conversion error (overflow) for row 2, column 1 (n).")
+			r.bulkBatch(&transport.responses, 1, "")
+		} else {
+			r.bulkBatch(&transport.responses, 1, "")
+			r.bulkBatch(&transport.responses, 1, "")
+			r.bulkBatch(&transport.responses, 1, "")
+		}
+		r.bulkBatch(&transport.responses, 0, "Bulk load data conversion error (overflow) for row 1, column 1 (n).")
+
+		var rowErrors []testRowError
+		var progress []int64
+		options := BulkOptions{
+			BisectErrorRows: bisect,
+			NotifyAfter:     1,
+			OnProgress:      func(rows int64) { progress = append(progress, rows) },
+			OnRowError: func(row int64, values []interface{}, err error) error {
+				rowErrors = append(rowErrors, testRowError{row, values, err})
+				return nil
+			},
+		}
+		src := &sliceRowSource{rows: [][]interface{}{{1}, {2}, {3}, {"x"}, {5}}}
+		n, err := c.BulkCopyFrom(context.Background(), "t", []string{"n"}, src, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 3 {
+			t.Errorf("expected 3 rows, got %d", n)
+		}
+		if len(rowErrors) != 2 {
+			t.Fatalf("expected 2 failed rows, got %v", rowErrors)
+		}
+		if e, ok := rowErrors[0].err.(*BulkError); !ok || rowErrors[0].row != 4 || e.Column != "n" || rowErrors[0].values[0] != "x" {
+			t.Errorf("expected the conversion error of row 4, got %v", rowErrors[0])
+		}
+		if e, ok := rowErrors[1].err.(*BulkError); !ok || rowErrors[1].row != 5 || e.Row != 5 || rowErrors[1].values[0] != 5 {
+			t.Errorf("expected the server error of row 5, got %v", rowErrors[1])
+		}
+		// the retried rows were counted when they were sent first
+		if !reflect.DeepEqual(progress, []int64{1, 2, 3, 4}) {
+			t.Errorf("expected progress [1 2 3 4], got %v", progress)
+		}
+		batches, _ := transport.bulkBatches()
+		expected := []int{4, 1, 1, 1, 1}
+		if bisect {
+			expected = []int{4, 2, 2, 1, 1}
+		}
+		if !reflect.DeepEqual(batches, expected) {
+			t.Errorf("expected batches of %v rows, got %v", expected, batches)
+		}
+	}
+}
+
+func TestBulkCopyFromBatchError(t *testing.T) {
+	transport := &testRPCTransport{}
+	c := &Conn{
+		sess:           &tdsSession{buf: newTdsBuffer(defaultPacketSize, transport)},
+		connectionGood: true,
+	}
+	var r testRPCResponse
+	r.done(&transport.responses)
+	r.columns("n")
+	r.done(&transport.responses)
+	r.bulkBatch(&transport.responses, 2, "")
+	r.bulkBatch(&transport.responses, 0, "Bulk load data conversion error (overflow) for row 2, column 1 (n).")
+
+	src := &sliceRowSource{rows: [][]interface{}{{1}, {2}, {3}, {4}}}
+	n, err := c.BulkCopyFrom(context.Background(), "t", []string{"n"}, src, BulkOptions{RowsPerBatch: 2})
+	if n != 2 {
+		t.Errorf("expected the 2 rows of the first batch, got %d", n)
+	}
+	e, ok := err.(*BulkError)
+	if !ok {
+		t.Fatalf("expected a *BulkError, got %v", err)
+	}
+	if e.Batch != 2 || e.FirstRow != 3 || e.LastRow != 4 || e.Row != 4 || e.Column != "n" {
+		t.Errorf("unexpected error %+v", e)
+	}
+	if _, ok := e.Err.(Error); !ok {
+		t.Errorf("expected the server error, got %v", e.Err)
+	}
+}
@@ -5,12 +5,16 @@ package mssql
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/hex"
+	"fmt"
 	"math"
 	"reflect"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/golang-sql/civil"
 )
 
 func TestBulkcopy(t *testing.T) {
@@ -67,8 +71,8 @@ func TestBulkcopy(t *testing.T) {
 		{"test_intf32", float32(1234.56), 1234},
 		{"test_geom", geom, string(geom)},
 		{"test_uniqueidentifier", uid, string(uid)},
-		// {"test_smallmoney", 1234.56, nil},
-		// {"test_money", 1234.56, nil},
+		{"test_smallmoney", 1234.56, "1234.5600"},
+		{"test_money", 1234.56, "1234.5600"},
 		{"test_decimal_18_0", 1234.0001, "1234"},
 		{"test_decimal_9_2", -1234.560001, "-1234.56"},
 		{"test_decimal_20_0", 1234, "1234"},
@@ -189,6 +193,128 @@ func TestBulkcopy(t *testing.T) {
 	}
 }
 
+func TestBulkcopyKeepIdentity(t *testing.T) {
+	if dsn := makeConnStr(t); strings.HasSuffix(strings.Split(dsn.Host, ":")[0], ".database.windows.net") {
+		t.Skip("TDS level bulk copy is not supported on Azure SQL Server")
+	}
+	pool, logger := open(t)
+	defer pool.Close()
+	defer logger.StopLogging()
+
+	ctx := context.Background()
+	conn, err := pool.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.ExecContext(ctx, "create table #bulk_keep_identity (id int identity(1, 1) primary key, s nvarchar(10))"); err != nil {
+		t.Fatal(err)
+	}
+
+	stmt, err := conn.PrepareContext(ctx, CopyIn("#bulk_keep_identity", BulkOptions{KeepIdentity: true}, "id", "s"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []int{42, 7, 1000}
+	for _, id := range ids {
+		if _, err = stmt.Exec(id, fmt.Sprintf("row %d", id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = stmt.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	stmt.Close()
+
+	rows, err := conn.QueryContext(ctx, "select id, s from #bulk_keep_identity order by id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []int
+	for rows.Next() {
+		var id int
+		var s string
+		if err = rows.Scan(&id, &s); err != nil {
+			t.Fatal(err)
+		}
+		if s != fmt.Sprintf("row %d", id) {
+			t.Errorf("row %d has the value %q of another row", id, s)
+		}
+		got = append(got, id)
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, []int{7, 42, 1000}) {
+		t.Errorf("expected the identity values of the rows, got %v", got)
+	}
+}
+
+func TestBulkMakeParam(t *testing.T) {
+	b := &Bulk{cn: &Conn{sess: &tdsSession{}}}
+	intCol := columnStruct{ColName: "i", ti: typeInfo{TypeId: typeIntN, Size: 4}}
+	nvarcharCol := columnStruct{ColName: "s", ti: typeInfo{TypeId: typeNVarChar, Size: 100}}
+	ts := time.Date(2010, 11, 12, 13, 14, 15, 0, time.FixedZone("", 3600))
+	uid := UniqueIdentifier{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10}
+	uidBytes, _ := uid.Value()
+	tests := []struct {
+		col      columnStruct
+		val      interface{}
+		expected []byte
+	}{
+		{intCol, int8(5), []byte{5, 0, 0, 0}},
+		{intCol, uint16(7), []byte{7, 0, 0, 0}},
+		{intCol, "12", []byte{12, 0, 0, 0}},
+		{intCol, true, []byte{1, 0, 0, 0}},
+		{intCol, sql.NullInt64{Int64: 5, Valid: true}, []byte{5, 0, 0, 0}},
+		{intCol, sql.NullInt64{}, nil},
+		{intCol, (*int)(nil), nil},
+		{nvarcharCol, int64(12), str2ucs2("12")},
+		{nvarcharCol, 1.5, str2ucs2("1.5")},
+		{nvarcharCol, VarChar("abc"), str2ucs2("abc")},
+		{nvarcharCol, sql.NullString{String: "abc", Valid: true}, str2ucs2("abc")},
+		{columnStruct{ti: typeInfo{TypeId: typeBitN, Size: 1}}, int64(2), []byte{1}},
+		{columnStruct{ti: typeInfo{TypeId: typeGuid, Size: 16}}, uid, uidBytes.([]byte)},
+		{columnStruct{ti: typeInfo{TypeId: typeGuid, Size: 16}}, uid.String(), uidBytes.([]byte)},
+		{columnStruct{ti: typeInfo{TypeId: typeDateTimeOffsetN, Scale: 7}}, DateTimeOffset(ts), encodeDateTimeOffset(ts, 7)},
+		{columnStruct{ti: typeInfo{TypeId: typeDateTime2N, Scale: 3}}, civil.DateTimeOf(ts), encodeDateTime2(civil.DateTimeOf(ts).In(time.UTC), 3)},
+		{columnStruct{ti: typeInfo{TypeId: typeDateTime2N, Scale: 3}}, "2010-11-12 13:14:15", encodeDateTime2(time.Date(2010, 11, 12, 13, 14, 15, 0, time.UTC), 3)},
+		{columnStruct{ti: typeInfo{TypeId: typeDateTimeOffsetN, Scale: 7}}, "2010-11-12 13:14:15.0000000 +01:00", encodeDateTimeOffset(ts, 7)},
+		{columnStruct{ti: typeInfo{TypeId: typeDateN}}, civil.DateOf(ts), encodeDate(civil.DateOf(ts).In(time.UTC))},
+		{columnStruct{ti: typeInfo{TypeId: typeTimeN, Scale: 0}}, civil.TimeOf(ts), encodeTime(13, 14, 15, 0, 0)},
+		{columnStruct{ti: typeInfo{TypeId: typeMoneyN, Size: 8}}, "1.5", []byte{0, 0, 0, 0, 0x98, 0x3a, 0, 0}},
+		{columnStruct{ti: typeInfo{TypeId: typeMoneyN, Size: 4}}, int64(-1), []byte{0xf0, 0xd8, 0xff, 0xff}},
+		{columnStruct{ti: typeInfo{TypeId: typeDecimalN, Prec: 9, Scale: 2}}, int64(12), []byte{1, 0xb0, 0x04, 0, 0}},
+		{columnStruct{ti: typeInfo{TypeId: typeVariant}}, int64(1), []byte{typeInt8, 0, 1, 0, 0, 0, 0, 0, 0, 0}},
+		{columnStruct{ti: typeInfo{TypeId: typeVariant}}, "a", []byte{typeNVarChar, 7, 0, 0, 0, 0, 0, 2, 0, 'a', 0}},
+	}
+	for _, test := range tests {
+		p, err := b.makeParam(test.val, test.col)
+		if err != nil {
+			t.Errorf("%T %v: %v", test.val, test.val, err)
+			continue
+		}
+		if !reflect.DeepEqual(p.buffer, test.expected) {
+			t.Errorf("%T %v encoded as % x, expected % x", test.val, test.val, p.buffer, test.expected)
+		}
+	}
+
+	for _, test := range []struct {
+		col columnStruct
+		val interface{}
+	}{
+		{intCol, "abc"},
+		{intCol, []byte{1}},
+		{columnStruct{ti: typeInfo{TypeId: typeMoneyN, Size: 4}}, int64(math.MaxInt32)},
+		{columnStruct{ti: typeInfo{TypeId: typeVariant}}, struct{}{}},
+	} {
+		if _, err := b.makeParam(test.val, test.col); err == nil {
+			t.Errorf("expected an error for %T %v", test.val, test.val)
+		}
+	}
+}
+
 func compareValue(a interface{}, expected interface{}) bool {
 	if got, ok := a.([]uint8); ok {
 		if _, ok := expected.([]uint8); !ok {
@@ -290,3 +416,312 @@ func setupTable(ctx context.Context, t *testing.T, conn *sql.Conn, tableName str
 	}
 	return
 }
+
+func TestBulkCopyFromQuery(t *testing.T) {
+	if dsn := makeConnStr(t); strings.HasSuffix(strings.Split(dsn.Host, ":")[0], ".database.windows.net") {
+		t.Skip("TDS level bulk copy is not supported on Azure SQL Server")
+	}
+	pool, logger := open(t)
+	defer pool.Close()
+	defer logger.StopLogging()
+
+	ctx := context.Background()
+	conn, err := driverWithProcess(t, logger).open(ctx, makeConnStr(t).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stmt, err := conn.prepareContext(ctx, "create table #bulk_source (n int, s nvarchar(10))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stmt.ExecContext(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := pool.QueryContext(ctx, "select n, cast(n as nvarchar(10)) from (values (1), (2), (3), (4), (5)) t(n)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	n, err := conn.BulkCopyFrom(ctx, "#bulk_source", []string{"n", "s"}, SQLRowSource(rows), BulkOptions{RowsPerBatch: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Errorf("expected 5 copied rows, got %d", n)
+	}
+
+	stmt, err = conn.prepareContext(ctx, "select count(*) from #bulk_source where s = cast(n as nvarchar(10))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := stmt.QueryContext(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Close()
+	dest := make([]driver.Value, 1)
+	if err = res.Next(dest); err != nil {
+		t.Fatal(err)
+	}
+	if dest[0] != int64(5) {
+		t.Errorf("expected 5 rows in the table, got %v", dest[0])
+	}
+}
+
+func TestBulkCopyFromKeepIdentity(t *testing.T) {
+	if dsn := makeConnStr(t); strings.HasSuffix(strings.Split(dsn.Host, ":")[0], ".database.windows.net") {
+		t.Skip("TDS level bulk copy is not supported on Azure SQL Server")
+	}
+	pool, logger := open(t)
+	defer pool.Close()
+	defer logger.StopLogging()
+
+	ctx := context.Background()
+	conn, err := driverWithProcess(t, logger).open(ctx, makeConnStr(t).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stmt, err := conn.prepareContext(ctx, "create table #bulk_identity (id int identity(1, 1), s nvarchar(10))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stmt.ExecContext(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var progress []int64
+	options := BulkOptions{
+		KeepIdentity:           true,
+		UseInternalTransaction: true,
+		RowsPerBatch:           2,
+		NotifyAfter:            1,
+		OnProgress:             func(rows int64) { progress = append(progress, rows) },
+	}
+	src := &sliceRowSource{rows: [][]interface{}{{10, "a"}, {20, "b"}, {30, "c"}}}
+	n, err := conn.BulkCopyFrom(ctx, "#bulk_identity", []string{"id", "s"}, src, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 copied rows, got %d", n)
+	}
+	if !reflect.DeepEqual(progress, []int64{1, 2, 3}) {
+		t.Errorf("expected progress after every row, got %v", progress)
+	}
+
+	stmt, err = conn.prepareContext(ctx, "select sum(id), @@trancount from #bulk_identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := stmt.QueryContext(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Close()
+	dest := make([]driver.Value, 2)
+	if err = res.Next(dest); err != nil {
+		t.Fatal(err)
+	}
+	if dest[0] != int64(60) {
+		t.Errorf("expected the identity values of the rows, got a sum of %v", dest[0])
+	}
+	if dest[1] != int64(0) {
+		t.Errorf("expected the internal transactions to be committed, got @@trancount %v", dest[1])
+	}
+}
+
+func TestBulkUpsert(t *testing.T) {
+	if dsn := makeConnStr(t); strings.HasSuffix(strings.Split(dsn.Host, ":")[0], ".database.windows.net") {
+		t.Skip("TDS level bulk copy is not supported on Azure SQL Server")
+	}
+	pool, logger := open(t)
+	defer pool.Close()
+	defer logger.StopLogging()
+
+	ctx := context.Background()
+	conn, err := driverWithProcess(t, logger).open(ctx, makeConnStr(t).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, updateInsert := range []bool{false, true} {
+		err = conn.execSimple(ctx, "if object_id('tempdb..#upsert_target') is not null drop table #upsert_target; "+
+			"create table #upsert_target (id int primary key, name varchar(20), qty int); "+
+			"insert into #upsert_target values (1, 'a', 1), (2, 'b', 2), (3, 'c', 3)")
+		if err != nil {
+			t.Fatal(err)
+		}
+		src := &sliceRowSource{rows: [][]interface{}{{2, "B", 20}, {3, "C", 30}, {4, "D", 40}}}
+		options := UpsertOptions{DeleteMissing: true, UpdateInsert: updateInsert}
+		res, err := conn.BulkUpsert(ctx, "#upsert_target", []string{"id", "name", "qty"}, []string{"id"}, src, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != (UpsertResult{Inserted: 1, Updated: 2, Deleted: 1}) {
+			t.Errorf("unexpected result %+v", res)
+		}
+
+		stmt, err := conn.prepareContext(ctx, "select sum(id), sum(qty), min(name) from #upsert_target")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := stmt.QueryContext(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dest := make([]driver.Value, 3)
+		if err = rows.Next(dest); err != nil {
+			t.Fatal(err)
+		}
+		rows.Close()
+		if dest[0] != int64(9) || dest[1] != int64(90) || dest[2] != "B" {
+			t.Errorf("unexpected rows in the table: %v", dest)
+		}
+	}
+}
+
+func TestBulkUpsertCollation(t *testing.T) {
+	if dsn := makeConnStr(t); strings.HasSuffix(strings.Split(dsn.Host, ":")[0], ".database.windows.net") {
+		t.Skip("TDS level bulk copy is not supported on Azure SQL Server")
+	}
+	pool, logger := open(t)
+	defer pool.Close()
+	defer logger.StopLogging()
+
+	ctx := context.Background()
+	conn, err := driverWithProcess(t, logger).open(ctx, makeConnStr(t).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the key columns of the staging table have the collation of the table,
+	// not the default collation of tempdb
+	err = conn.execSimple(ctx, "if object_id('tempdb..#upsert_collation') is not null drop table #upsert_collation; "+
+		"create table #upsert_collation (code varchar(10) collate Latin1_General_BIN2 primary key, "+
+		"id int identity, name nvarchar(20) collate Japanese_CI_AS); "+
+		"insert into #upsert_collation (code, name) values ('a', N'x')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &sliceRowSource{rows: [][]interface{}{{"a", "y"}, {"A", "z"}}}
+	res, err := conn.BulkUpsert(ctx, "#upsert_collation", []string{"code", "name"}, []string{"code"}, src, UpsertOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != (UpsertResult{Inserted: 1, Updated: 1}) {
+		t.Errorf("unexpected result %+v", res)
+	}
+}
+
+func TestBulkUpsertIdentity(t *testing.T) {
+	if dsn := makeConnStr(t); strings.HasSuffix(strings.Split(dsn.Host, ":")[0], ".database.windows.net") {
+		t.Skip("TDS level bulk copy is not supported on Azure SQL Server")
+	}
+	pool, logger := open(t)
+	defer pool.Close()
+	defer logger.StopLogging()
+
+	ctx := context.Background()
+	conn, err := driverWithProcess(t, logger).open(ctx, makeConnStr(t).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	err = conn.execSimple(ctx, "if object_id('tempdb..#upsert_identity') is not null drop table #upsert_identity; "+
+		"create table #upsert_identity (id int identity primary key, name varchar(20)); "+
+		"insert into #upsert_identity (name) values ('a')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, keepIdentity := range []bool{false, true} {
+		src := &sliceRowSource{rows: [][]interface{}{{1, "A"}, {10, "j"}}}
+		options := UpsertOptions{KeepIdentity: keepIdentity}
+		res, err := conn.BulkUpsert(ctx, "#upsert_identity", []string{"id", "name"}, []string{"id"}, src, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != (UpsertResult{Inserted: 1, Updated: 1}) {
+			t.Errorf("unexpected result %+v", res)
+		}
+	}
+	// the first call inserted j with a generated identity value, the
+	// second one with the value of the row
+	stmt, err := conn.prepareContext(ctx, "select count(*), max(id), min(name) from #upsert_identity where name = 'j'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := stmt.QueryContext(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := make([]driver.Value, 3)
+	if err = rows.Next(dest); err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+	if dest[0] != int64(2) || dest[1] != int64(10) {
+		t.Errorf("unexpected identity rows: %v", dest)
+	}
+}
+
+func TestBulkCopyMars(t *testing.T) {
+	if dsn := makeConnStr(t); strings.HasSuffix(strings.Split(dsn.Host, ":")[0], ".database.windows.net") {
+		t.Skip("TDS level bulk copy is not supported on Azure SQL Server")
+	}
+	pool, logger := open(t)
+	defer pool.Close()
+	defer logger.StopLogging()
+
+	u := makeConnStr(t)
+	q := u.Query()
+	q.Set("multipleactiveresultsets", "true")
+	u.RawQuery = q.Encode()
+	ctx := context.Background()
+	conn, err := driverWithProcess(t, logger).open(ctx, u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.sess.mars == nil {
+		t.Skip("MARS was not negotiated")
+	}
+	sessions := len(conn.sess.mars.sessions)
+
+	if err = conn.execSimple(ctx, "create table #mars_bulk (id int primary key, name varchar(20))"); err != nil {
+		t.Fatal(err)
+	}
+	src := &sliceRowSource{rows: [][]interface{}{{1, "a"}, {2, "b"}, {3, "c"}}}
+	n, err := conn.BulkCopyFrom(ctx, "#mars_bulk", []string{"id", "name"}, src, BulkOptions{RowsPerBatch: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 rows copied, got %d", n)
+	}
+	src = &sliceRowSource{rows: [][]interface{}{{3, "C"}, {4, "d"}}}
+	res, err := conn.BulkUpsert(ctx, "#mars_bulk", []string{"id", "name"}, []string{"id"}, src, UpsertOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != (UpsertResult{Inserted: 1, Updated: 1}) {
+		t.Errorf("unexpected upsert result %+v", res)
+	}
+	rows, err := conn.QueryRaw(ctx, "select count(*) from #mars_bulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := make([]driver.Value, 1)
+	if err = rows.Next(dest); err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+	if !reflect.DeepEqual(dest[0], []byte{4, 0, 0, 0}) {
+		t.Errorf("expected 4 rows, got % x", dest[0])
+	}
+	if len(conn.sess.mars.sessions) != sessions {
+		t.Errorf("internal statements left %d sessions open", len(conn.sess.mars.sessions)-sessions)
+	}
+}
@@ -0,0 +1,252 @@
+package mssql
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+// upsertStagingSeq numbers the session temporary tables the rows of
+// BulkUpsert are copied into, so the staging tables of calls that overlap
+// on a session don't collide.
+var upsertStagingSeq uint64
+
+// UpsertOptions are the options of Conn.BulkUpsert.
+type UpsertOptions struct {
+	// BulkOptions are the options of the copy into the staging table.
+	BulkOptions BulkOptions
+	// DeleteMissing deletes the rows of the table whose keys are not in
+	// the rows copied.
+	DeleteMissing bool
+	// UpdateInsert runs UPDATE, INSERT and DELETE statements instead of a
+	// MERGE statement, in a transaction of their own unless the connection
+	// is in a transaction.
+	UpdateInsert bool
+	// KeepIdentity inserts the values of src into an identity column of
+	// table, with IDENTITY_INSERT set on for the statement. Otherwise new
+	// rows get generated identity values and the column is only used to
+	// match the rows. An identity column is never updated.
+	KeepIdentity bool
+}
+
+// UpsertResult holds the numbers of rows changed by Conn.BulkUpsert.
+type UpsertResult struct {
+	Inserted int64
+	Updated  int64
+	Deleted  int64
+}
+
+// BulkUpsert inserts the rows of src into table or updates the rows of
+// table with the same keys. The rows are copied with bulk copy into a
+// session temporary table with the types and collations of the columns of
+// table first, then merged into table.
+//
+// keyColumns must be a subset of columns that identifies the rows of
+// table, every key may occur once in the rows of src.
+func (c *Conn) BulkUpsert(ctx context.Context, table string, columns, keyColumns []string, src RowSource, options UpsertOptions) (res UpsertResult, err error) {
+	if len(keyColumns) == 0 {
+		return res, errors.New("mssql: BulkUpsert needs key columns")
+	}
+	for _, key := range keyColumns {
+		if !containsString(columns, key) {
+			return res, fmt.Errorf("mssql: key column %s is not one of the columns", key)
+		}
+	}
+	staging := fmt.Sprintf("#bulk_upsert_%d", atomic.AddUint64(&upsertStagingSeq, 1))
+	if err = c.execSimple(ctx, stagingStatement(table, staging, columns)); err != nil {
+		return res, err
+	}
+	defer func() {
+		if c.connectionGood {
+			if derr := c.execSimple(ctx, "drop table "+staging); err == nil {
+				err = derr
+			}
+		}
+	}()
+	identity, err := c.identityColumns(ctx, staging, columns)
+	if err != nil {
+		return res, err
+	}
+	if len(identity) == len(columns) && !options.KeepIdentity {
+		return res, fmt.Errorf("mssql: BulkUpsert has no columns to insert besides the identity column %s", identity[0])
+	}
+	// the staging table has the identity column of table, it gets the
+	// values of src to match the rows
+	bulkOptions := options.BulkOptions
+	bulkOptions.KeepIdentity = true
+	if _, err = c.BulkCopyFrom(ctx, staging, columns, src, bulkOptions); err != nil {
+		return res, err
+	}
+
+	query := upsertStatement(table, staging, columns, keyColumns, identity, options, c.sess.tranid == 0)
+	stmt, err := c.prepareInternal(ctx, query)
+	if err != nil {
+		return res, err
+	}
+	rows, err := stmt.QueryContext(ctx, nil)
+	if err != nil {
+		return res, err
+	}
+	dest := make([]driver.Value, 3)
+	err = rows.Next(dest)
+	if err == io.EOF {
+		err = errors.New("mssql: BulkUpsert got no row counts")
+	}
+	if cerr := rows.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return res, err
+	}
+	res.Inserted, _ = dest[0].(int64)
+	res.Updated, _ = dest[1].(int64)
+	res.Deleted, _ = dest[2].(int64)
+	return res, nil
+}
+
+// identityColumns returns the identity column of staging, which has the
+// identity property of the column of the table, if it is one of columns.
+func (c *Conn) identityColumns(ctx context.Context, staging string, columns []string) ([]string, error) {
+	stmt, err := c.prepareInternal(ctx, fmt.Sprintf(
+		"select name from tempdb.sys.columns where object_id = object_id('tempdb..%s') and is_identity = 1", staging))
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.QueryContext(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	var identity []string
+	dest := make([]driver.Value, 1)
+	for err = rows.Next(dest); err == nil; err = rows.Next(dest) {
+		name, _ := dest[0].(string)
+		for _, col := range columns {
+			if strings.EqualFold(col, name) {
+				identity = append(identity, col)
+			}
+		}
+	}
+	if cerr := rows.Close(); err == io.EOF {
+		err = cerr
+	}
+	return identity, err
+}
+
+// upsertStatement returns the statement that merges the rows of staging
+// into table and selects the numbers of inserted, updated and deleted
+// rows. ownTransaction wraps the statements of UpdateInsert in a
+// transaction. The identity columns are not updated and only inserted
+// with KeepIdentity.
+func upsertStatement(table, staging string, columns, keyColumns, identity []string, options UpsertOptions, ownTransaction bool) string {
+	var on, set, cols, values []string
+	for _, name := range keyColumns {
+		on = append(on, fmt.Sprintf("t.%s = s.%s", quoteName(name), quoteName(name)))
+	}
+	for _, name := range columns {
+		isIdentity := containsString(identity, name)
+		if !isIdentity || options.KeepIdentity {
+			cols = append(cols, quoteName(name))
+			values = append(values, "s."+quoteName(name))
+		}
+		if !isIdentity && !containsString(keyColumns, name) {
+			set = append(set, fmt.Sprintf("%s = s.%s", quoteName(name), quoteName(name)))
+		}
+	}
+	onPart := strings.Join(on, " and ")
+
+	var q bytes.Buffer
+	if options.KeepIdentity && len(identity) > 0 {
+		// IDENTITY_INSERT is set off again also when the statement fails,
+		// a session has it on for one table only
+		fmt.Fprintf(&q, "set identity_insert %s on;\nbegin try\n", table)
+		q.WriteString(upsertStatementBody(table, staging, onPart, set, cols, values, options, ownTransaction))
+		fmt.Fprintf(&q, "\nend try\nbegin catch\nset identity_insert %s off;\nthrow;\nend catch;\nset identity_insert %s off;", table, table)
+		return q.String()
+	}
+	return upsertStatementBody(table, staging, onPart, set, cols, values, options, ownTransaction)
+}
+
+func upsertStatementBody(table, staging, onPart string, set, cols, values []string, options UpsertOptions, ownTransaction bool) string {
+	var q bytes.Buffer
+	if !options.UpdateInsert {
+		q.WriteString("declare @actions table (action nvarchar(10));\n")
+		fmt.Fprintf(&q, "merge %s with (holdlock) as t\nusing %s as s on %s\n", table, staging, onPart)
+		if len(set) > 0 {
+			fmt.Fprintf(&q, "when matched then update set %s\n", strings.Join(set, ", "))
+		}
+		fmt.Fprintf(&q, "when not matched by target then insert (%s) values (%s)\n",
+			strings.Join(cols, ", "), strings.Join(values, ", "))
+		if options.DeleteMissing {
+			q.WriteString("when not matched by source then delete\n")
+		}
+		q.WriteString("output $action into @actions;\n")
+		q.WriteString("select count_big(case when action = 'INSERT' then 1 end), " +
+			"count_big(case when action = 'UPDATE' then 1 end), " +
+			"count_big(case when action = 'DELETE' then 1 end) from @actions;")
+		return q.String()
+	}
+
+	q.WriteString("declare @inserted bigint = 0, @updated bigint = 0, @deleted bigint = 0;\n")
+	if ownTransaction {
+		q.WriteString("begin try\nbegin transaction;\n")
+	}
+	if len(set) > 0 {
+		fmt.Fprintf(&q, "update t set %s from %s as t with (updlock, serializable) join %s as s on %s;\n",
+			strings.Join(set, ", "), table, staging, onPart)
+		q.WriteString("set @updated = @@rowcount;\n")
+	}
+	fmt.Fprintf(&q, "insert into %s (%s) select %s from %s as s where not exists (select 1 from %s as t with (updlock, serializable) where %s);\n",
+		table, strings.Join(cols, ", "), strings.Join(values, ", "), staging, table, onPart)
+	q.WriteString("set @inserted = @@rowcount;\n")
+	if options.DeleteMissing {
+		fmt.Fprintf(&q, "delete t from %s as t where not exists (select 1 from %s as s where %s);\n", table, staging, onPart)
+		q.WriteString("set @deleted = @@rowcount;\n")
+	}
+	if ownTransaction {
+		q.WriteString("commit transaction;\nend try\n" +
+			"begin catch\nif @@trancount > 0 rollback transaction;\nthrow;\nend catch;\n")
+	}
+	q.WriteString("select @inserted, @updated, @deleted;")
+	return q.String()
+}
+
+// stagingStatement returns the statement that creates the staging table
+// with the columns of table. select into copies the types, the collations
+// and the identity property of the columns.
+func stagingStatement(table, staging string, columns []string) string {
+	cols := make([]string, len(columns))
+	for i, name := range columns {
+		cols[i] = quoteName(name)
+	}
+	return fmt.Sprintf("if object_id('tempdb..%s') is not null drop table %s; select top 0 %s into %s from %s",
+		staging, staging, strings.Join(cols, ", "), staging, table)
+}
+
+// execSimple runs a statement without parameters.
+func (c *Conn) execSimple(ctx context.Context, query string) error {
+	stmt, err := c.prepareInternal(ctx, query)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.ExecContext(ctx, nil)
+	return err
+}
+
+// quoteName quotes an identifier with brackets.
+func quoteName(name string) string {
+	return "[" + strings.Replace(name, "]", "]]", -1) + "]"
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
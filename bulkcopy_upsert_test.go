@@ -0,0 +1,86 @@
+package mssql
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUpsertStatement(t *testing.T) {
+	columns := []string{"id", "name", "qty"}
+	keys := []string{"id"}
+
+	q := upsertStatement("dbo.items", "#s", columns, keys, nil, UpsertOptions{DeleteMissing: true}, true)
+	for _, part := range []string{
+		"merge dbo.items with (holdlock) as t\nusing #s as s on t.[id] = s.[id]\n",
+		"when matched then update set [name] = s.[name], [qty] = s.[qty]\n",
+		"when not matched by target then insert ([id], [name], [qty]) values (s.[id], s.[name], s.[qty])\n",
+		"when not matched by source then delete\n",
+		"output $action into @actions;",
+	} {
+		if !strings.Contains(q, part) {
+			t.Errorf("expected %q in the statement:\n%s", part, q)
+		}
+	}
+
+	q = upsertStatement("dbo.items", "#s", columns, keys, nil, UpsertOptions{UpdateInsert: true}, true)
+	for _, part := range []string{
+		"begin transaction;",
+		"update t set [name] = s.[name], [qty] = s.[qty] from dbo.items as t with (updlock, serializable) join #s as s on t.[id] = s.[id];",
+		"insert into dbo.items ([id], [name], [qty]) select s.[id], s.[name], s.[qty] from #s as s where not exists",
+		"commit transaction;",
+		"select @inserted, @updated, @deleted;",
+	} {
+		if !strings.Contains(q, part) {
+			t.Errorf("expected %q in the statement:\n%s", part, q)
+		}
+	}
+	if strings.Contains(q, "delete t") {
+		t.Errorf("unexpected delete in the statement:\n%s", q)
+	}
+
+	// in a transaction of the caller and without other columns than the
+	// keys
+	q = upsertStatement("dbo.items", "#s", keys, keys, nil, UpsertOptions{UpdateInsert: true}, false)
+	if strings.Contains(q, "transaction") || strings.Contains(q, "update t") {
+		t.Errorf("unexpected statement:\n%s", q)
+	}
+}
+
+func TestUpsertStatementIdentity(t *testing.T) {
+	columns := []string{"code", "id", "name"}
+	keys := []string{"code"}
+	identity := []string{"id"}
+
+	// the identity column is neither updated nor inserted
+	q := upsertStatement("dbo.items", "#s", columns, keys, identity, UpsertOptions{}, true)
+	for _, part := range []string{
+		"when matched then update set [name] = s.[name]\n",
+		"when not matched by target then insert ([code], [name]) values (s.[code], s.[name])\n",
+	} {
+		if !strings.Contains(q, part) {
+			t.Errorf("expected %q in the statement:\n%s", part, q)
+		}
+	}
+	if strings.Contains(q, "identity_insert") {
+		t.Errorf("unexpected identity_insert in the statement:\n%s", q)
+	}
+
+	// KeepIdentity inserts it with IDENTITY_INSERT
+	q = upsertStatement("dbo.items", "#s", columns, keys, identity, UpsertOptions{UpdateInsert: true, KeepIdentity: true}, true)
+	for _, part := range []string{
+		"set identity_insert dbo.items on;\nbegin try\n",
+		"update t set [name] = s.[name] from",
+		"insert into dbo.items ([code], [id], [name]) select s.[code], s.[id], s.[name] from #s",
+		"begin catch\nset identity_insert dbo.items off;\nthrow;\nend catch;\nset identity_insert dbo.items off;",
+	} {
+		if !strings.Contains(q, part) {
+			t.Errorf("expected %q in the statement:\n%s", part, q)
+		}
+	}
+}
+
+func TestQuoteName(t *testing.T) {
+	if name := quoteName("a]b"); name != "[a]]b]" {
+		t.Errorf("expected [a]]b], got %s", name)
+	}
+}
@@ -0,0 +1,417 @@
+package bulkfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strings"
+	"time"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/denisenkom/go-mssqldb/internal/cp"
+)
+
+// defaultTimeScale is the scale of time values of unknown columns
+const defaultTimeScale = 7
+
+// BCPOptions are the options of NewBCPReader.
+type BCPOptions struct {
+	// Encoding is the encoding of SQLCHAR fields: "utf-8" when not set,
+	// "raw" to keep the bytes, or a Windows code page such as "1252" or
+	// "cp1252", as given to bcp with -C.
+	Encoding string
+	// Scales are the fractional second scales of the time, datetime2 and
+	// datetimeoffset columns by name. Columns without a scale use the one
+	// of the format file, Load reads them from the table, 7 otherwise.
+	Scales map[string]int
+}
+
+// BCPReader reads the rows of a data file written by bcp in native,
+// character or unicode character format.
+//
+// Character fields are strings or nil for NULL. An empty terminated
+// field is NULL, bcp writes empty strings as a single NUL character.
+// Native fields are converted to the Go type of their host type, decimal
+// and money values are exact strings.
+type BCPReader struct {
+	r        *bufio.Reader
+	fields   []Field
+	codePage int
+	scales   []int
+	columns  []string
+	// index is the field of every column
+	index  []int
+	row    []interface{}
+	values []interface{}
+	rowNum int
+	err    error
+}
+
+// NewBCPReader returns a reader of the data file read from r with the
+// fields of format.
+func NewBCPReader(r io.Reader, format *FormatFile, options BCPOptions) (*BCPReader, error) {
+	codePage, err := parseEncoding(options.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	if codePage == codePageUTF16 {
+		return nil, errors.New("bulkfile: use SQLNCHAR fields for UTF-16 data")
+	}
+	if len(format.Fields) == 0 {
+		return nil, errors.New("bulkfile: the format has no fields")
+	}
+	reader := &BCPReader{
+		r:        bufio.NewReader(r),
+		fields:   format.Fields,
+		codePage: codePage,
+		scales:   make([]int, len(format.Fields)),
+		row:      make([]interface{}, len(format.Fields)),
+	}
+	for i, field := range format.Fields {
+		if _, ok := hostTypeSizes[field.HostType]; !ok {
+			return nil, fmt.Errorf("bulkfile: unsupported host type %s of field %d", field.HostType, i+1)
+		}
+		if field.PrefixLength == 0 && field.Terminator == "" && field.Length <= 0 {
+			return nil, fmt.Errorf("bulkfile: field %d has no prefix, terminator or length", i+1)
+		}
+		reader.scales[i] = field.Scale
+		if scale, ok := options.Scales[field.Name]; ok && field.Scale < 0 {
+			reader.scales[i] = scale
+		}
+		if field.Column > 0 {
+			reader.columns = append(reader.columns, field.Name)
+			reader.index = append(reader.index, i)
+		}
+	}
+	reader.values = make([]interface{}, len(reader.columns))
+	return reader, nil
+}
+
+// setColumnTypes sets the scales of the fields without a scale from the
+// types of their columns.
+func (r *BCPReader) setColumnTypes(types map[string]columnType) {
+	for i, field := range r.fields {
+		if t, ok := types[strings.ToLower(field.Name)]; ok && r.scales[i] < 0 {
+			r.scales[i] = t.scale
+		}
+	}
+}
+
+// Columns returns the destination columns of the values.
+func (r *BCPReader) Columns() []string {
+	return r.columns
+}
+
+// Next reads the next row.
+func (r *BCPReader) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	if _, err := r.r.Peek(1); err == io.EOF {
+		return false
+	}
+	r.rowNum++
+	for i := range r.fields {
+		if r.row[i], r.err = r.readField(i); r.err != nil {
+			if r.err == io.EOF {
+				r.err = io.ErrUnexpectedEOF
+			}
+			r.err = fmt.Errorf("bulkfile: row %d, field %d: %v", r.rowNum, i+1, r.err)
+			return false
+		}
+	}
+	return true
+}
+
+// Values returns the values of the current row.
+func (r *BCPReader) Values() ([]interface{}, error) {
+	for i, field := range r.index {
+		r.values[i] = r.row[field]
+	}
+	return r.values, nil
+}
+
+// Err returns the error that stopped Next.
+func (r *BCPReader) Err() error {
+	return r.err
+}
+
+// readField reads field i of the row.
+func (r *BCPReader) readField(i int) (interface{}, error) {
+	field := &r.fields[i]
+	unicode := field.HostType == "SQLNCHAR" || field.HostType == "SQLNTEXT"
+	var data []byte
+	var err error
+	switch {
+	case field.PrefixLength > 0:
+		var size int64
+		if size, err = r.readPrefix(field.PrefixLength); err != nil {
+			return nil, err
+		}
+		if size >= 0 {
+			data = make([]byte, size)
+			if _, err = io.ReadFull(r.r, data); err != nil {
+				return nil, err
+			}
+		}
+		if err = r.skipTerminator(field.Terminator, unicode); err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+	case field.Terminator != "":
+		last := i == len(r.fields)-1
+		if data, err = r.readTerminated(field.Terminator, unicode, last); err != nil {
+			return nil, err
+		}
+		if len(data) == 0 {
+			return nil, nil
+		}
+		if (unicode && bytes.Equal(data, []byte{0, 0})) || (!unicode && bytes.Equal(data, []byte{0})) {
+			return "", nil
+		}
+	default:
+		data = make([]byte, field.Length)
+		if _, err = io.ReadFull(r.r, data); err != nil {
+			return nil, err
+		}
+	}
+	if field.Column == 0 {
+		return nil, nil
+	}
+	scale := r.scales[i]
+	if scale < 0 {
+		scale = defaultTimeScale
+	}
+	return decodeHostValue(field.HostType, data, r.codePage, scale)
+}
+
+// readPrefix reads a length prefix, it returns -1 for NULL.
+func (r *BCPReader) readPrefix(size int) (int64, error) {
+	var buf [8]byte
+	if size != 1 && size != 2 && size != 4 && size != 8 {
+		return 0, fmt.Errorf("invalid prefix length %d", size)
+	}
+	if _, err := io.ReadFull(r.r, buf[:size]); err != nil {
+		return 0, err
+	}
+	null := true
+	for _, b := range buf[:size] {
+		null = null && b == 0xff
+	}
+	if null {
+		return -1, nil
+	}
+	n := binary.LittleEndian.Uint64(buf[:])
+	if n > math.MaxInt32 {
+		return 0, fmt.Errorf("invalid field length %d", n)
+	}
+	return int64(n), nil
+}
+
+// readTerminated reads the data up to the terminator. The terminator of
+// the last field may be missing at the end of the file.
+func (r *BCPReader) readTerminated(terminator string, unicode, last bool) ([]byte, error) {
+	term := []byte(terminator)
+	step := 1
+	if unicode {
+		term = encodeUTF16(terminator)
+		step = 2
+	}
+	var data []byte
+	for {
+		b, err := r.r.ReadByte()
+		if err != nil {
+			if err == io.EOF && last && len(data) > 0 {
+				return data, nil
+			}
+			return nil, err
+		}
+		data = append(data, b)
+		if len(data)%step == 0 && bytes.HasSuffix(data, term) {
+			return data[:len(data)-len(term)], nil
+		}
+	}
+}
+
+// skipTerminator skips the terminator after the data of a prefixed field.
+func (r *BCPReader) skipTerminator(terminator string, unicode bool) error {
+	if terminator == "" {
+		return nil
+	}
+	term := []byte(terminator)
+	if unicode {
+		term = encodeUTF16(terminator)
+	}
+	buf := make([]byte, len(term))
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return err
+	}
+	if !bytes.Equal(buf, term) {
+		return fmt.Errorf("expected the terminator %q", terminator)
+	}
+	return nil
+}
+
+// hostTypeSizes are the supported host types and the data sizes of the
+// fixed size ones.
+var hostTypeSizes = map[string]int{
+	"SQLCHAR":           0,
+	"SQLNCHAR":          0,
+	"SQLTEXT":           0,
+	"SQLNTEXT":          0,
+	"SQLXML":            0,
+	"SQLBINARY":         0,
+	"SQLVARBIN":         0,
+	"SQLIMAGE":          0,
+	"SQLUDT":            0,
+	"SQLBIT":            1,
+	"SQLTINYINT":        1,
+	"SQLSMALLINT":       2,
+	"SQLINT":            4,
+	"SQLBIGINT":         8,
+	"SQLFLT4":           4,
+	"SQLFLT8":           8,
+	"SQLMONEY4":         4,
+	"SQLMONEY":          8,
+	"SQLDATETIM4":       4,
+	"SQLDATETIME":       8,
+	"SQLDECIMAL":        19,
+	"SQLNUMERIC":        19,
+	"SQLUNIQUEID":       16,
+	"SQLDATE":           3,
+	"SQLTIME":           0,
+	"SQLDATETIME2":      0,
+	"SQLDATETIMEOFFSET": 0,
+}
+
+// decodeHostValue converts the data of a field of the host type.
+func decodeHostValue(hostType string, data []byte, codePage, scale int) (interface{}, error) {
+	if size := hostTypeSizes[hostType]; size > 0 && len(data) != size {
+		return nil, fmt.Errorf("invalid size %d of %s data", len(data), hostType)
+	}
+	switch hostType {
+	case "SQLCHAR", "SQLTEXT":
+		if codePage == codePageRaw {
+			return data, nil
+		}
+		return cp.CodePageToUTF8(codePage, data), nil
+	case "SQLNCHAR", "SQLNTEXT", "SQLXML":
+		if len(data)%2 != 0 {
+			return nil, fmt.Errorf("invalid size %d of %s data", len(data), hostType)
+		}
+		return decodeUTF16(data), nil
+	case "SQLBINARY", "SQLVARBIN", "SQLIMAGE", "SQLUDT":
+		return data, nil
+	case "SQLBIT":
+		return data[0] != 0, nil
+	case "SQLTINYINT":
+		return int64(data[0]), nil
+	case "SQLSMALLINT":
+		return int64(int16(binary.LittleEndian.Uint16(data))), nil
+	case "SQLINT":
+		return int64(int32(binary.LittleEndian.Uint32(data))), nil
+	case "SQLBIGINT":
+		return int64(binary.LittleEndian.Uint64(data)), nil
+	case "SQLFLT4":
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(data))), nil
+	case "SQLFLT8":
+		return math.Float64frombits(binary.LittleEndian.Uint64(data)), nil
+	case "SQLMONEY4":
+		return formatScaled(big.NewInt(int64(int32(binary.LittleEndian.Uint32(data)))), 4), nil
+	case "SQLMONEY":
+		// the high half comes first
+		money := int64(binary.LittleEndian.Uint32(data))<<32 | int64(binary.LittleEndian.Uint32(data[4:]))
+		return formatScaled(big.NewInt(money), 4), nil
+	case "SQLDATETIM4":
+		days := binary.LittleEndian.Uint16(data)
+		minutes := binary.LittleEndian.Uint16(data[2:])
+		return time.Date(1900, 1, 1+int(days), 0, int(minutes), 0, 0, time.UTC), nil
+	case "SQLDATETIME":
+		days := int32(binary.LittleEndian.Uint32(data))
+		ticks := binary.LittleEndian.Uint32(data[4:])
+		ns := int(math.Trunc(float64(ticks%300)/0.3+0.5)) * 1000000
+		return time.Date(1900, 1, 1+int(days), 0, 0, int(ticks/300), ns, time.UTC), nil
+	case "SQLDECIMAL", "SQLNUMERIC":
+		// precision, scale, sign and a 16 byte little endian magnitude
+		mag := make([]byte, 16)
+		for i := range mag {
+			mag[i] = data[18-i]
+		}
+		n := new(big.Int).SetBytes(mag)
+		if data[2] == 0 {
+			n.Neg(n)
+		}
+		return formatScaled(n, int(data[1])), nil
+	case "SQLUNIQUEID":
+		var u mssql.UniqueIdentifier
+		if err := u.Scan(data); err != nil {
+			return nil, err
+		}
+		return u.String(), nil
+	case "SQLDATE":
+		return decodeDate(data), nil
+	case "SQLTIME":
+		if len(data) < 3 || len(data) > 5 {
+			return nil, fmt.Errorf("invalid size %d of %s data", len(data), hostType)
+		}
+		return decodeDate(nil).Add(decodeTime(data, scale)), nil
+	case "SQLDATETIME2":
+		if len(data) < 6 || len(data) > 8 {
+			return nil, fmt.Errorf("invalid size %d of %s data", len(data), hostType)
+		}
+		n := len(data) - 3
+		return decodeDate(data[n:]).Add(decodeTime(data[:n], scale)), nil
+	case "SQLDATETIMEOFFSET":
+		if len(data) < 8 || len(data) > 10 {
+			return nil, fmt.Errorf("invalid size %d of %s data", len(data), hostType)
+		}
+		n := len(data) - 5
+		t := decodeDate(data[n : n+3]).Add(decodeTime(data[:n], scale))
+		offset := int(int16(binary.LittleEndian.Uint16(data[n+3:])))
+		return t.In(time.FixedZone("", offset*60)), nil
+	}
+	return nil, fmt.Errorf("unsupported host type %s", hostType)
+}
+
+// formatScaled formats n scaled by 10^-scale exactly.
+func formatScaled(n *big.Int, scale int) string {
+	s := new(big.Int).Abs(n).String()
+	if scale > 0 {
+		if len(s) <= scale {
+			s = strings.Repeat("0", scale-len(s)+1) + s
+		}
+		s = s[:len(s)-scale] + "." + s[len(s)-scale:]
+	}
+	if n.Sign() < 0 {
+		s = "-" + s
+	}
+	return s
+}
+
+// decodeDate decodes the days since 0001-01-01 in three bytes.
+func decodeDate(data []byte) time.Time {
+	var days int
+	for i := len(data) - 1; i >= 0; i-- {
+		days = days<<8 | int(data[i])
+	}
+	return time.Date(1, 1, 1+days, 0, 0, 0, 0, time.UTC)
+}
+
+// decodeTime decodes the time of day in units of 10^-scale seconds.
+func decodeTime(data []byte, scale int) time.Duration {
+	var units uint64
+	for i := len(data) - 1; i >= 0; i-- {
+		units = units<<8 | uint64(data[i])
+	}
+	for ; scale < 9; scale++ {
+		units *= 10
+	}
+	return time.Duration(units)
+}
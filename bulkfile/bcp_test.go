@@ -0,0 +1,89 @@
+package bulkfile
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBCPReaderNative(t *testing.T) {
+	format := &FormatFile{Fields: []Field{
+		{HostType: "SQLINT", PrefixLength: 1, Column: 1, Name: "id", Scale: -1},
+		{HostType: "SQLNCHAR", PrefixLength: 2, Column: 2, Name: "name", Scale: -1},
+		{HostType: "SQLDECIMAL", PrefixLength: 1, Column: 3, Name: "amount", Scale: -1},
+		{HostType: "SQLMONEY", PrefixLength: 1, Column: 4, Name: "price", Scale: -1},
+		{HostType: "SQLDATETIME2", PrefixLength: 1, Column: 5, Name: "created", Scale: -1},
+		{HostType: "SQLUNIQUEID", PrefixLength: 1, Column: 6, Name: "guid", Scale: -1},
+		{HostType: "SQLBINARY", PrefixLength: 2, Column: 0, Name: "skipped", Scale: -1},
+	}}
+	var data bytes.Buffer
+	// 1, "ab", -12.345, 1.5, 2020-01-02 03:04:05.678, a guid, skipped
+	data.Write([]byte{4, 1, 0, 0, 0})
+	data.Write([]byte{4, 0, 'a', 0, 'b', 0})
+	data.Write([]byte{19, 10, 3, 0, 0x39, 0x30})
+	data.Write(make([]byte, 14))
+	data.Write([]byte{8, 0, 0, 0, 0, 0x98, 0x3a, 0, 0})
+	// 11045678 ms at scale 3 and 737425 days
+	data.Write([]byte{6, 0x2e, 0x8b, 0xa8, 0x91, 0x40, 0x0b})
+	data.Write([]byte{16, 0x67, 0x45, 0x23, 0x01, 0xab, 0x89, 0xef, 0xcd, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef})
+	data.Write([]byte{1, 0, 0xff})
+	// a row of NULLs
+	data.Write([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+
+	r, err := NewBCPReader(&data, format, BCPOptions{Scales: map[string]int{"created": 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cols := r.Columns(); !reflect.DeepEqual(cols, []string{"id", "name", "amount", "price", "created", "guid"}) {
+		t.Errorf("unexpected columns %v", cols)
+	}
+	expected := [][]interface{}{
+		{int64(1), "ab", "-12.345", "1.5000", time.Date(2020, 1, 2, 3, 4, 5, 678000000, time.UTC), "01234567-89AB-CDEF-0123-456789ABCDEF"},
+		{nil, nil, nil, nil, nil, nil},
+	}
+	if rows := readAll(t, r); !reflect.DeepEqual(rows, expected) {
+		t.Errorf("expected rows %v, got %v", expected, rows)
+	}
+}
+
+func TestBCPReaderChar(t *testing.T) {
+	format := CharFormat([]string{"a", "b", "c"}, "|", "\r\n", false)
+	data := "1|caf\xe9|\x00\r\n2||x"
+	r, err := NewBCPReader(strings.NewReader(data), format, BCPOptions{Encoding: "1252"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]interface{}{{"1", "café", ""}, {"2", nil, "x"}}
+	if rows := readAll(t, r); !reflect.DeepEqual(rows, expected) {
+		t.Errorf("expected rows %q, got %q", expected, rows)
+	}
+
+	format = CharFormat([]string{"a", "b"}, "\t", "\n", true)
+	r, err = NewBCPReader(bytes.NewReader(encodeUTF16("1\té\n")), format, BCPOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = [][]interface{}{{"1", "é"}}
+	if rows := readAll(t, r); !reflect.DeepEqual(rows, expected) {
+		t.Errorf("expected rows %q, got %q", expected, rows)
+	}
+}
+
+func TestBCPReaderTruncated(t *testing.T) {
+	format := &FormatFile{Fields: []Field{
+		{HostType: "SQLINT", Length: 4, Column: 1, Name: "id", Scale: -1},
+		{HostType: "SQLINT", Length: 4, Column: 2, Name: "n", Scale: -1},
+	}}
+	r, err := NewBCPReader(bytes.NewReader([]byte{1, 0, 0, 0, 2, 0}), format, BCPOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Next() {
+		t.Fatal("expected no row")
+	}
+	if err = r.Err(); err == nil || !strings.Contains(err.Error(), "row 1, field 2") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
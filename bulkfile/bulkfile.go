@@ -0,0 +1,281 @@
+// Package bulkfile loads CSV files and the data files of the SQL Server bcp
+// utility into tables with bulk copy.
+//
+// CSVReader and BCPReader read the rows of a file as a mssql.RowSource, Load
+// copies them into a table:
+//
+//	f, err := os.Open("orders.csv")
+//	...
+//	src, err := bulkfile.NewCSVReader(f, bulkfile.CSVOptions{Header: true})
+//	...
+//	n, err := bulkfile.Load(ctx, conn, "dbo.orders", src, mssql.BulkOptions{RowsPerBatch: 10000})
+package bulkfile
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/denisenkom/go-mssqldb/internal/cp"
+)
+
+// Source is a mssql.RowSource that knows the columns of its values.
+type Source interface {
+	mssql.RowSource
+	// Columns returns the names of the destination columns of the values.
+	Columns() []string
+}
+
+// Load copies the rows of src into table and returns the number of rows
+// copied.
+//
+// The types of the columns are read from the server first. Text values of
+// binary columns are decoded from hex, as bcp writes them, and the time
+// values of native files get the scale of their column.
+func Load(ctx context.Context, conn *mssql.Conn, table string, src Source, options mssql.BulkOptions) (int64, error) {
+	cols, err := describeTable(ctx, conn, table)
+	if err != nil {
+		return 0, err
+	}
+	types := make(map[string]columnType, len(cols))
+	for _, col := range cols {
+		types[strings.ToLower(col.name)] = col
+	}
+	if r, ok := src.(*BCPReader); ok {
+		r.setColumnTypes(types)
+	}
+	return conn.BulkCopyFrom(ctx, table, src.Columns(), newHexSource(src, types), options)
+}
+
+// TableColumns returns the names of the columns of table in their order.
+func TableColumns(ctx context.Context, conn *mssql.Conn, table string) ([]string, error) {
+	cols, err := describeTable(ctx, conn, table)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(cols))
+	for i, col := range cols {
+		names[i] = col.name
+	}
+	return names, nil
+}
+
+type columnType struct {
+	name string
+	// typeName is the lower case type name without length, e.g. "varbinary"
+	typeName string
+	scale    int
+}
+
+func (t columnType) isBinary() bool {
+	switch t.typeName {
+	case "binary", "varbinary", "image", "timestamp", "rowversion":
+		return true
+	}
+	return false
+}
+
+// describeTable returns the columns of table as described by the server.
+func describeTable(ctx context.Context, conn *mssql.Conn, table string) ([]columnType, error) {
+	stmt, err := conn.PrepareContext(ctx, "exec sp_describe_first_result_set @p1")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.(driver.StmtQueryContext).QueryContext(ctx, []driver.NamedValue{
+		{Ordinal: 1, Value: "select * from " + table},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	nameIdx, typeIdx, scaleIdx := -1, -1, -1
+	names := rows.Columns()
+	for i, name := range names {
+		switch name {
+		case "name":
+			nameIdx = i
+		case "system_type_name":
+			typeIdx = i
+		case "scale":
+			scaleIdx = i
+		}
+	}
+	if nameIdx < 0 || typeIdx < 0 || scaleIdx < 0 {
+		return nil, errors.New("bulkfile: unexpected result of sp_describe_first_result_set")
+	}
+	var cols []columnType
+	dest := make([]driver.Value, len(names))
+	for {
+		if err = rows.Next(dest); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		var col columnType
+		col.name, _ = dest[nameIdx].(string)
+		typeName, _ := dest[typeIdx].(string)
+		if i := strings.IndexByte(typeName, '('); i >= 0 {
+			typeName = typeName[:i]
+		}
+		col.typeName = strings.ToLower(typeName)
+		if scale, ok := dest[scaleIdx].(int64); ok {
+			col.scale = int(scale)
+		}
+		cols = append(cols, col)
+	}
+	return cols, nil
+}
+
+// hexSource decodes the text values of binary columns from hex.
+type hexSource struct {
+	Source
+	binary []bool
+	values []interface{}
+}
+
+func newHexSource(src Source, types map[string]columnType) mssql.RowSource {
+	s := &hexSource{Source: src}
+	var found bool
+	for _, name := range src.Columns() {
+		isBinary := types[strings.ToLower(name)].isBinary()
+		s.binary = append(s.binary, isBinary)
+		found = found || isBinary
+	}
+	if !found {
+		return src
+	}
+	return s
+}
+
+func (s *hexSource) Values() ([]interface{}, error) {
+	row, err := s.Source.Values()
+	if err != nil {
+		return nil, err
+	}
+	s.values = append(s.values[:0], row...)
+	for i, val := range s.values {
+		str, ok := val.(string)
+		if !ok || i >= len(s.binary) || !s.binary[i] {
+			continue
+		}
+		if len(str) > 1 && str[0] == '0' && (str[1] == 'x' || str[1] == 'X') {
+			str = str[2:]
+		}
+		b, err := hex.DecodeString(str)
+		if err != nil {
+			return nil, fmt.Errorf("bulkfile: invalid binary value of column %s: %v", s.Columns()[i], err)
+		}
+		s.values[i] = b
+	}
+	return s.values, nil
+}
+
+// code pages with special handling
+const (
+	codePageRaw   = 0
+	codePageUTF16 = 1200
+	codePageUTF8  = 65001
+)
+
+// parseEncoding returns the code page of an encoding name: "utf-8",
+// "utf-16", "raw", "acp", "oem" or a Windows code page, e.g. "1252",
+// "cp1252" or "windows-1252".
+func parseEncoding(name string) (int, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	switch name {
+	case "", "utf-8", "utf8":
+		return codePageUTF8, nil
+	case "utf-16", "utf-16le", "utf16", "unicode", "widechar":
+		return codePageUTF16, nil
+	case "raw":
+		return codePageRaw, nil
+	case "acp":
+		return 1252, nil
+	case "oem":
+		return 437, nil
+	}
+	number := name
+	for _, prefix := range []string{"windows-", "cp", "ibm"} {
+		number = strings.TrimPrefix(number, prefix)
+	}
+	codePage, err := strconv.Atoi(number)
+	if err != nil || (codePage != codePageUTF16 && !cp.CodePageSupported(codePage)) {
+		return 0, fmt.Errorf("bulkfile: unsupported encoding %q", name)
+	}
+	return codePage, nil
+}
+
+// utf16Reader converts UTF-16LE text to UTF-8 and drops a byte order mark.
+type utf16Reader struct {
+	r     io.Reader
+	in    []byte
+	n     int
+	out   []byte
+	err   error
+	start bool
+}
+
+func newUTF16Reader(r io.Reader) io.Reader {
+	return &utf16Reader{r: r, in: make([]byte, 4096), start: true}
+}
+
+func (r *utf16Reader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		var m int
+		m, r.err = r.r.Read(r.in[r.n:])
+		r.n += m
+		n := r.n &^ 1
+		// keep the high surrogate of a pair split by the read
+		if r.err == nil && n >= 2 {
+			if last := rune(r.in[n-2]) | rune(r.in[n-1])<<8; last >= 0xd800 && last < 0xdc00 {
+				n -= 2
+			}
+		}
+		units := make([]uint16, n/2)
+		for i := range units {
+			units[i] = uint16(r.in[2*i]) | uint16(r.in[2*i+1])<<8
+		}
+		if r.start && len(units) > 0 {
+			r.start = false
+			if units[0] == 0xfeff {
+				units = units[1:]
+			}
+		}
+		r.out = []byte(string(utf16.Decode(units)))
+		r.n = copy(r.in, r.in[n:r.n])
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// decodeUTF16 converts UTF-16LE bytes to a string.
+func decodeUTF16(b []byte) string {
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		units[i] = uint16(b[2*i]) | uint16(b[2*i+1])<<8
+	}
+	return string(utf16.Decode(units))
+}
+
+// encodeUTF16 converts a string to UTF-16LE bytes.
+func encodeUTF16(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		b[2*i] = byte(u)
+		b[2*i+1] = byte(u >> 8)
+	}
+	return b
+}
@@ -0,0 +1,87 @@
+package bulkfile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+func TestParseEncoding(t *testing.T) {
+	tests := map[string]int{
+		"":             codePageUTF8,
+		"UTF-8":        codePageUTF8,
+		"utf-16":       codePageUTF16,
+		"raw":          codePageRaw,
+		"1252":         1252,
+		"cp932":        932,
+		"windows-1251": 1251,
+	}
+	for name, expected := range tests {
+		if codePage, err := parseEncoding(name); err != nil || codePage != expected {
+			t.Errorf("%q: expected code page %d, got %d, %v", name, expected, codePage, err)
+		}
+	}
+	if _, err := parseEncoding("1"); err == nil {
+		t.Error("expected an error for an unsupported code page")
+	}
+}
+
+func TestUTF16Reader(t *testing.T) {
+	in := append([]byte{0xff, 0xfe}, encodeUTF16("a😀é")...)
+	b, err := ioutil.ReadAll(newUTF16Reader(iotest.OneByteReader(bytes.NewReader(in))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "a😀é" {
+		t.Errorf("unexpected conversion %q", b)
+	}
+}
+
+type testSource struct {
+	columns []string
+	rows    [][]interface{}
+	row     []interface{}
+}
+
+func (s *testSource) Columns() []string { return s.columns }
+func (s *testSource) Err() error        { return nil }
+
+func (s *testSource) Next() bool {
+	if len(s.rows) == 0 {
+		return false
+	}
+	s.row, s.rows = s.rows[0], s.rows[1:]
+	return true
+}
+
+func (s *testSource) Values() ([]interface{}, error) {
+	return s.row, nil
+}
+
+func TestHexSource(t *testing.T) {
+	types := map[string]columnType{
+		"data": {name: "Data", typeName: "varbinary"},
+		"name": {name: "Name", typeName: "nvarchar"},
+	}
+	src := &testSource{
+		columns: []string{"Data", "Name"},
+		rows:    [][]interface{}{{"0x0aFF", "0a"}, {"0102", nil}, {nil, "x"}},
+	}
+	rows := readAll(t, newHexSource(src, types).(Source))
+	expected := [][]interface{}{{[]byte{0x0a, 0xff}, "0a"}, {[]byte{1, 2}, nil}, {nil, "x"}}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("expected rows %v, got %v", expected, rows)
+	}
+
+	src = &testSource{columns: []string{"Data"}, rows: [][]interface{}{{"xyz"}}}
+	hex := newHexSource(src, types)
+	hex.Next()
+	if _, err := hex.Values(); err == nil {
+		t.Error("expected an error for invalid hex")
+	}
+	if s := newHexSource(&testSource{columns: []string{"Name"}}, types); s.(*testSource) == nil {
+		t.Error("expected the source without binary columns")
+	}
+}
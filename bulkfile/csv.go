@@ -0,0 +1,147 @@
+package bulkfile
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/denisenkom/go-mssqldb/internal/cp"
+)
+
+// CSVOptions are the options of NewCSVReader.
+type CSVOptions struct {
+	// Comma is the field delimiter, ',' when not set.
+	Comma rune
+	// Comment starts lines that are skipped when set.
+	Comment rune
+	// Header makes the first record the names of the fields.
+	Header bool
+	// Columns are the names of the fields in their order, they replace
+	// the names of the header. An empty name skips the field.
+	Columns []string
+	// ColumnMap maps the names of the fields to destination columns.
+	// Fields missing from the map are skipped when it is set.
+	ColumnMap map[string]string
+	// NullValues are the field values loaded as NULL, e.g. "" or `\N`.
+	NullValues []string
+	// Encoding is the encoding of the file: "utf-8" when not set,
+	// "utf-16" or a Windows code page such as "1252" or "cp1252".
+	Encoding string
+	// LazyQuotes allows quotes in unquoted fields and single quotes in
+	// quoted fields.
+	LazyQuotes bool
+	// TrimLeadingSpace ignores the white space at the start of fields.
+	TrimLeadingSpace bool
+}
+
+// CSVReader reads the rows of an RFC 4180 CSV file. The values are the
+// strings of the fields or nil for NULL, bulk copy converts them to the
+// types of the columns.
+type CSVReader struct {
+	r       *csv.Reader
+	columns []string
+	fields  []int
+	nulls   map[string]bool
+	record  []string
+	row     int
+	values  []interface{}
+	err     error
+}
+
+// NewCSVReader returns a reader of the CSV file read from r. It reads the
+// header when options.Header is set.
+func NewCSVReader(r io.Reader, options CSVOptions) (*CSVReader, error) {
+	codePage, err := parseEncoding(options.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	switch codePage {
+	case codePageUTF16:
+		r = newUTF16Reader(r)
+	case codePageRaw, codePageUTF8:
+	default:
+		r = cp.CodePageReader(r, codePage)
+	}
+	cr := csv.NewReader(r)
+	if options.Comma != 0 {
+		cr.Comma = options.Comma
+	}
+	cr.Comment = options.Comment
+	cr.LazyQuotes = options.LazyQuotes
+	cr.TrimLeadingSpace = options.TrimLeadingSpace
+
+	names := options.Columns
+	if options.Header {
+		header, err := cr.Read()
+		if err != nil {
+			if err == io.EOF {
+				err = errors.New("bulkfile: the CSV file has no header")
+			}
+			return nil, err
+		}
+		if names == nil {
+			names = header
+		}
+	}
+	if names == nil {
+		return nil, errors.New("bulkfile: the columns of the CSV file are not known, set Header or Columns")
+	}
+	reader := &CSVReader{r: cr, nulls: make(map[string]bool, len(options.NullValues))}
+	for i, name := range names {
+		if options.ColumnMap != nil {
+			name = options.ColumnMap[name]
+		}
+		if name == "" {
+			continue
+		}
+		reader.columns = append(reader.columns, name)
+		reader.fields = append(reader.fields, i)
+	}
+	for _, null := range options.NullValues {
+		reader.nulls[null] = true
+	}
+	reader.values = make([]interface{}, len(reader.columns))
+	return reader, nil
+}
+
+// Columns returns the destination columns of the values.
+func (r *CSVReader) Columns() []string {
+	return r.columns
+}
+
+// Next reads the next record.
+func (r *CSVReader) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	r.record, r.err = r.r.Read()
+	if r.err == io.EOF {
+		r.err = nil
+		r.record = nil
+		return false
+	}
+	r.row++
+	return r.err == nil
+}
+
+// Values returns the values of the current record.
+func (r *CSVReader) Values() ([]interface{}, error) {
+	for i, field := range r.fields {
+		if field >= len(r.record) {
+			return nil, fmt.Errorf("bulkfile: record %d has no field %d", r.row, field+1)
+		}
+		val := r.record[field]
+		if r.nulls[val] {
+			r.values[i] = nil
+		} else {
+			r.values[i] = val
+		}
+	}
+	return r.values, nil
+}
+
+// Err returns the error that stopped Next.
+func (r *CSVReader) Err() error {
+	return r.err
+}
@@ -0,0 +1,80 @@
+package bulkfile
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func readAll(t *testing.T, src Source) [][]interface{} {
+	t.Helper()
+	var rows [][]interface{}
+	for src.Next() {
+		row, err := src.Values()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, append([]interface{}(nil), row...))
+	}
+	if err := src.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestCSVReader(t *testing.T) {
+	data := "id;name;note\r\n1;\"a;b\";\\N\r\n2;\"say \"\"hi\"\"\";x\r\n"
+	r, err := NewCSVReader(strings.NewReader(data), CSVOptions{
+		Comma:      ';',
+		Header:     true,
+		ColumnMap:  map[string]string{"id": "ID", "note": "Note"},
+		NullValues: []string{`\N`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cols := r.Columns(); !reflect.DeepEqual(cols, []string{"ID", "Note"}) {
+		t.Errorf("unexpected columns %v", cols)
+	}
+	expected := [][]interface{}{{"1", nil}, {"2", "x"}}
+	if rows := readAll(t, r); !reflect.DeepEqual(rows, expected) {
+		t.Errorf("expected rows %v, got %v", expected, rows)
+	}
+}
+
+func TestCSVReaderColumns(t *testing.T) {
+	r, err := NewCSVReader(strings.NewReader("1,skip,a\n2,skip,b\n"), CSVOptions{Columns: []string{"id", "", "name"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]interface{}{{"1", "a"}, {"2", "b"}}
+	if rows := readAll(t, r); !reflect.DeepEqual(rows, expected) {
+		t.Errorf("expected rows %v, got %v", expected, rows)
+	}
+	if _, err = NewCSVReader(strings.NewReader("1\n"), CSVOptions{}); err == nil {
+		t.Error("expected an error without header and columns")
+	}
+}
+
+func TestCSVReaderEncoding(t *testing.T) {
+	tests := []struct {
+		encoding string
+		data     []byte
+	}{
+		{"cp1252", []byte("name\ncaf\xe9 \x80\n")},
+		{"utf-16", append([]byte{0xff, 0xfe}, encodeUTF16("name\ncafé €\n")...)},
+	}
+	for _, test := range tests {
+		r, err := NewCSVReader(strings.NewReader(string(test.data)), CSVOptions{Header: true, Encoding: test.encoding})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows := readAll(t, r)
+		if len(rows) != 1 || rows[0][0] != "café €" {
+			t.Errorf("%s: unexpected rows %q", test.encoding, rows)
+		}
+	}
+	if _, err := NewCSVReader(strings.NewReader(""), CSVOptions{Encoding: "ebcdic"}); err == nil {
+		t.Error("expected an error for an unsupported encoding")
+	}
+}
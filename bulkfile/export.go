@@ -0,0 +1,435 @@
+package bulkfile
+
+import (
+	"bufio"
+	"context"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+)
+
+// DataFormat is the format of an exported data file.
+type DataFormat int
+
+const (
+	// FormatNative writes the values as stored by the server, like
+	// "bcp -n".
+	FormatNative DataFormat = iota
+	// FormatChar writes the values as text, like "bcp -c".
+	FormatChar
+	// FormatWideChar writes the values as UTF-16 text, like "bcp -w".
+	FormatWideChar
+	// FormatCSV writes an RFC 4180 CSV file.
+	FormatCSV
+)
+
+// ExportOptions are the options of Export.
+type ExportOptions struct {
+	Format DataFormat
+	// FieldTerminator ends the fields of character and CSV files, "\t"
+	// or "," for CSV files when not set. CSV files take a single
+	// character, e.g. "\t" for TSV files.
+	FieldTerminator string
+	// RowTerminator ends the rows of character and CSV files, "\n" when
+	// not set. CSV files take "\n" or "\r\n".
+	RowTerminator string
+	// Header writes the names of the columns as the first record of CSV
+	// files.
+	Header bool
+	// Null is the text of NULL values in CSV files, empty when not set.
+	Null string
+}
+
+// Export runs query and writes its rows to w. It returns the number of rows
+// written and, for native and character files, the format file that
+// describes the data file.
+//
+// The rows are read as sent by the server. Native files keep the values
+// unchanged, text files write decimal and money values exactly, time
+// values with the fractional digits of their column and binary values as
+// hex.
+func Export(ctx context.Context, conn *mssql.Conn, query string, w io.Writer, options ExportOptions) (*FormatFile, int64, error) {
+	rows, err := conn.QueryRaw(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	names := rows.Columns()
+	types := make([]mssql.RawColumnType, len(names))
+	native := &FormatFile{Version: formatVersion}
+	for i, name := range names {
+		types[i] = rows.ColumnRawType(i)
+		field, err := nativeField(types[i])
+		if err != nil {
+			return nil, 0, fmt.Errorf("bulkfile: column %s: %v", name, err)
+		}
+		field.Column = i + 1
+		field.Name = name
+		native.Fields = append(native.Fields, field)
+	}
+
+	bw := bufio.NewWriter(w)
+	var ew exportWriter
+	var format *FormatFile
+	switch options.Format {
+	case FormatNative:
+		format = native
+		ew = &nativeWriter{w: bw, fields: native.Fields, types: types}
+	case FormatChar, FormatWideChar:
+		fieldTerm, rowTerm := options.FieldTerminator, options.RowTerminator
+		if fieldTerm == "" {
+			fieldTerm = "\t"
+		}
+		if rowTerm == "" {
+			rowTerm = "\n"
+		}
+		format = CharFormat(names, fieldTerm, rowTerm, options.Format == FormatWideChar)
+		ew = &charWriter{w: bw, fields: format.Fields, native: native.Fields, types: types}
+	case FormatCSV:
+		cw, err := newCSVWriter(bw, names, options)
+		if err != nil {
+			return nil, 0, err
+		}
+		cw.native, cw.types = native.Fields, types
+		ew = cw
+	default:
+		return nil, 0, fmt.Errorf("bulkfile: unknown data format %d", options.Format)
+	}
+
+	var count int64
+	row := make([]driver.Value, len(names))
+	for {
+		if err = rows.Next(row); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, count, err
+		}
+		if err = ew.writeRow(row); err != nil {
+			return nil, count, err
+		}
+		count++
+	}
+	if err = ew.flush(); err != nil {
+		return nil, count, err
+	}
+	return format, count, bw.Flush()
+}
+
+// formatVersion is the version of generated format files, that of
+// SQL Server 2017.
+const formatVersion = "14.0"
+
+// nativeField returns the field of the native values of a column type.
+func nativeField(t mssql.RawColumnType) (Field, error) {
+	field := Field{PrefixLength: 1, Scale: -1}
+	switch t.TypeName {
+	case "TINYINT":
+		field.HostType, field.Length = "SQLTINYINT", 1
+	case "SMALLINT":
+		field.HostType, field.Length = "SQLSMALLINT", 2
+	case "INT":
+		field.HostType, field.Length = "SQLINT", 4
+	case "BIGINT":
+		field.HostType, field.Length = "SQLBIGINT", 8
+	case "BIT":
+		field.HostType, field.Length = "SQLBIT", 1
+	case "REAL":
+		field.HostType, field.Length = "SQLFLT4", 4
+	case "FLOAT":
+		field.HostType, field.Length = "SQLFLT8", 8
+	case "SMALLMONEY":
+		field.HostType, field.Length = "SQLMONEY4", 4
+	case "MONEY":
+		field.HostType, field.Length = "SQLMONEY", 8
+	case "SMALLDATETIME":
+		field.HostType, field.Length = "SQLDATETIM4", 4
+	case "DATETIME":
+		field.HostType, field.Length = "SQLDATETIME", 8
+	case "DATE":
+		field.HostType, field.Length = "SQLDATE", 3
+	case "TIME", "DATETIME2", "DATETIMEOFFSET":
+		field.HostType = "SQL" + t.TypeName
+		field.Length, field.Scale = t.Size, t.Scale
+	case "DECIMAL":
+		field.HostType, field.Length, field.Scale = "SQLDECIMAL", 19, t.Scale
+	case "UNIQUEIDENTIFIER":
+		field.HostType, field.Length = "SQLUNIQUEID", 16
+	case "CHAR", "VARCHAR", "TEXT":
+		field.HostType = "SQLCHAR"
+	case "NCHAR", "NVARCHAR", "NTEXT", "XML":
+		field.HostType = "SQLNCHAR"
+	case "BINARY", "VARBINARY", "IMAGE":
+		field.HostType = "SQLBINARY"
+	case "UDT":
+		field.HostType = "SQLUDT"
+	default:
+		return field, fmt.Errorf("unsupported type %s", t.TypeName)
+	}
+	switch t.TypeName {
+	case "TEXT", "NTEXT", "IMAGE":
+		field.PrefixLength = 4
+	case "CHAR", "VARCHAR", "NCHAR", "NVARCHAR", "XML", "BINARY", "VARBINARY", "UDT":
+		if t.Size < 0 {
+			field.PrefixLength = 8
+		} else {
+			field.PrefixLength, field.Length = 2, t.Size
+		}
+	}
+	return field, nil
+}
+
+// nativeValue converts a raw value to the native data of its field.
+func nativeValue(field *Field, t mssql.RawColumnType, raw []byte) []byte {
+	if field.HostType != "SQLDECIMAL" {
+		return raw
+	}
+	// the sign and magnitude become precision, scale, sign and a 16
+	// byte magnitude
+	data := make([]byte, 19)
+	data[0], data[1], data[2] = byte(t.Precision), byte(t.Scale), raw[0]
+	copy(data[3:], raw[1:])
+	return data
+}
+
+// textValue formats a raw value as text.
+func textValue(field *Field, t mssql.RawColumnType, raw []byte) (string, error) {
+	val, err := decodeHostValue(field.HostType, nativeValue(field, t, raw), t.CodePage, t.Scale)
+	if err != nil {
+		return "", err
+	}
+	switch val := val.(type) {
+	case string:
+		return val, nil
+	case []byte:
+		return hex.EncodeToString(val), nil
+	case bool:
+		if val {
+			return "1", nil
+		}
+		return "0", nil
+	case int64:
+		return strconv.FormatInt(val, 10), nil
+	case float64:
+		if field.HostType == "SQLFLT4" {
+			return strconv.FormatFloat(val, 'g', -1, 32), nil
+		}
+		return strconv.FormatFloat(val, 'g', -1, 64), nil
+	case time.Time:
+		return val.Format(timeLayout(field.HostType, t.Scale)), nil
+	}
+	return "", fmt.Errorf("unexpected value %T", val)
+}
+
+// timeLayout returns the layout of the text of time values, as written by
+// bcp.
+func timeLayout(hostType string, scale int) string {
+	fraction := ""
+	if scale > 0 {
+		fraction = "." + strings.Repeat("0", scale)
+	}
+	switch hostType {
+	case "SQLDATE":
+		return "2006-01-02"
+	case "SQLDATETIM4":
+		return "2006-01-02 15:04:05"
+	case "SQLDATETIME":
+		return "2006-01-02 15:04:05.000"
+	case "SQLTIME":
+		return "15:04:05" + fraction
+	case "SQLDATETIMEOFFSET":
+		return "2006-01-02 15:04:05" + fraction + " -07:00"
+	}
+	return "2006-01-02 15:04:05" + fraction
+}
+
+type exportWriter interface {
+	writeRow(row []driver.Value) error
+	flush() error
+}
+
+// nativeWriter writes native data files.
+type nativeWriter struct {
+	w      *bufio.Writer
+	fields []Field
+	types  []mssql.RawColumnType
+}
+
+func (w *nativeWriter) writeRow(row []driver.Value) error {
+	var prefix [8]byte
+	for i, val := range row {
+		field := &w.fields[i]
+		raw, _ := val.([]byte)
+		if val == nil {
+			for j := range prefix {
+				prefix[j] = 0xff
+			}
+			w.w.Write(prefix[:field.PrefixLength])
+			continue
+		}
+		data := nativeValue(field, w.types[i], raw)
+		n := uint64(len(data))
+		for j := 0; j < field.PrefixLength; j++ {
+			prefix[j] = byte(n >> (8 * uint(j)))
+		}
+		w.w.Write(prefix[:field.PrefixLength])
+		if _, err := w.w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *nativeWriter) flush() error {
+	return nil
+}
+
+// charWriter writes character and unicode character data files.
+type charWriter struct {
+	w      *bufio.Writer
+	fields []Field
+	native []Field
+	types  []mssql.RawColumnType
+}
+
+func (w *charWriter) writeRow(row []driver.Value) error {
+	for i, val := range row {
+		field := &w.fields[i]
+		var text string
+		if val != nil {
+			var err error
+			if text, err = textValue(&w.native[i], w.types[i], val.([]byte)); err != nil {
+				return fmt.Errorf("bulkfile: column %s: %v", field.Name, err)
+			}
+			if text == "" {
+				// an empty string, NULL is an empty field
+				text = "\x00"
+			}
+		}
+		text += field.Terminator
+		var err error
+		if field.HostType == "SQLNCHAR" {
+			_, err = w.w.Write(encodeUTF16(text))
+		} else {
+			_, err = w.w.WriteString(text)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *charWriter) flush() error {
+	return nil
+}
+
+// csvWriter writes CSV files.
+type csvWriter struct {
+	w      *csv.Writer
+	null   string
+	native []Field
+	types  []mssql.RawColumnType
+	record []string
+}
+
+func newCSVWriter(w io.Writer, names []string, options ExportOptions) (*csvWriter, error) {
+	cw := csv.NewWriter(w)
+	if options.FieldTerminator != "" {
+		comma := []rune(options.FieldTerminator)
+		if len(comma) != 1 {
+			return nil, errors.New("bulkfile: the field terminator of CSV files must be a single character")
+		}
+		cw.Comma = comma[0]
+	}
+	switch options.RowTerminator {
+	case "", "\n":
+	case "\r\n":
+		cw.UseCRLF = true
+	default:
+		return nil, errors.New(`bulkfile: the row terminator of CSV files must be "\n" or "\r\n"`)
+	}
+	if options.Header {
+		if err := cw.Write(names); err != nil {
+			return nil, err
+		}
+	}
+	return &csvWriter{w: cw, null: options.Null, record: make([]string, len(names))}, nil
+}
+
+func (w *csvWriter) writeRow(row []driver.Value) error {
+	for i, val := range row {
+		if val == nil {
+			w.record[i] = w.null
+			continue
+		}
+		var err error
+		if w.record[i], err = textValue(&w.native[i], w.types[i], val.([]byte)); err != nil {
+			return fmt.Errorf("bulkfile: column %d: %v", i+1, err)
+		}
+	}
+	return w.w.Write(w.record)
+}
+
+func (w *csvWriter) flush() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+// WriteTo writes the format file in the non-XML format.
+func (f *FormatFile) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	version := f.Version
+	if version == "" {
+		version = formatVersion
+	}
+	fmt.Fprintf(cw, "%s\r\n%d\r\n", version, len(f.Fields))
+	for i, field := range f.Fields {
+		collation := field.Collation
+		if collation == "" {
+			collation = `""`
+		}
+		fmt.Fprintf(cw, "%-7d %-20s %-7d %-7d %-10s %-5d %-20s %s\r\n",
+			i+1, field.HostType, field.PrefixLength, field.Length,
+			quoteFormatToken(field.Terminator), field.Column, formatName(field.Name), collation)
+	}
+	return cw.n, cw.err
+}
+
+// quoteFormatToken quotes a terminator of a non-XML format file.
+func quoteFormatToken(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\t", `\t`, "\n", `\n`, "\r", `\r`, "\x00", `\0`).Replace(s) + `"`
+}
+
+// formatName quotes column names with white space.
+func formatName(name string) string {
+	if strings.ContainsAny(name, " \t\"") {
+		return quoteFormatToken(name)
+	}
+	return name
+}
+
+// countingWriter counts the bytes written through it and keeps the first
+// error.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	w.err = err
+	return n, err
+}
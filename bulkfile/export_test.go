@@ -0,0 +1,167 @@
+package bulkfile
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+)
+
+// exportColumns are columns of the types of a test table with their raw
+// values.
+var exportColumns = []struct {
+	name string
+	typ  mssql.RawColumnType
+	raw  []byte
+	text string
+}{
+	{"id", mssql.RawColumnType{TypeName: "INT", Size: 4}, []byte{1, 0, 0, 0}, "1"},
+	{"amount", mssql.RawColumnType{TypeName: "DECIMAL", Size: 9, Precision: 10, Scale: 3}, []byte{0, 0x39, 0x30, 0, 0}, "-12.345"},
+	{"price", mssql.RawColumnType{TypeName: "MONEY", Size: 8}, []byte{0, 0, 0, 0, 0x98, 0x3a, 0, 0}, "1.5000"},
+	{"ratio", mssql.RawColumnType{TypeName: "REAL", Size: 4}, []byte{0xcd, 0xcc, 0xcc, 0x3d}, "0.1"},
+	{"created", mssql.RawColumnType{TypeName: "DATETIME2", Size: 6, Scale: 3}, []byte{0x2e, 0x8b, 0xa8, 0x91, 0x40, 0x0b}, "2020-01-02 03:04:05.678"},
+	{"at", mssql.RawColumnType{TypeName: "TIME", Size: 5, Scale: 7}, []byte{0x80, 0x96, 0x98, 0, 0}, "00:00:01.0000000"},
+	{"name", mssql.RawColumnType{TypeName: "VARCHAR", Size: 10, CodePage: 1252}, []byte("caf\xe9"), "café"},
+	{"title", mssql.RawColumnType{TypeName: "NVARCHAR", Size: -1}, []byte{'h', 0, 'i', 0}, "hi"},
+	{"data", mssql.RawColumnType{TypeName: "VARBINARY", Size: 10}, []byte{0x0a, 0xff}, "0aff"},
+	{"empty", mssql.RawColumnType{TypeName: "VARCHAR", Size: 10, CodePage: 1252}, []byte{}, ""},
+}
+
+func exportFields(t *testing.T) ([]Field, []mssql.RawColumnType, []driver.Value) {
+	var fields []Field
+	var types []mssql.RawColumnType
+	var row []driver.Value
+	for i, col := range exportColumns {
+		field, err := nativeField(col.typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		field.Column, field.Name = i+1, col.name
+		fields = append(fields, field)
+		types = append(types, col.typ)
+		row = append(row, col.raw)
+	}
+	return fields, types, row
+}
+
+func TestTextValue(t *testing.T) {
+	fields, types, _ := exportFields(t)
+	for i, col := range exportColumns {
+		text, err := textValue(&fields[i], types[i], col.raw)
+		if err != nil {
+			t.Errorf("%s: %v", col.name, err)
+		} else if text != col.text {
+			t.Errorf("%s: expected %q, got %q", col.name, col.text, text)
+		}
+	}
+	offset := mssql.RawColumnType{TypeName: "DATETIMEOFFSET", Size: 8, Scale: 0}
+	field, _ := nativeField(offset)
+	// 01:00 UTC on 0001-01-01 at +01:00
+	text, err := textValue(&field, offset, []byte{0x10, 0x0e, 0, 0, 0, 0, 60, 0})
+	if err != nil || text != "0001-01-01 02:00:00 +01:00" {
+		t.Errorf("unexpected datetimeoffset %q, %v", text, err)
+	}
+}
+
+func TestExportNativeRoundTrip(t *testing.T) {
+	fields, types, row := exportFields(t)
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	w := &nativeWriter{w: bw, fields: fields, types: types}
+	if err := w.writeRow(row); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.writeRow(make([]driver.Value, len(row))); err != nil {
+		t.Fatal(err)
+	}
+	bw.Flush()
+
+	var fmtFile bytes.Buffer
+	if _, err := (&FormatFile{Fields: fields}).WriteTo(&fmtFile); err != nil {
+		t.Fatal(err)
+	}
+	format, err := ReadFormatFile(&fmtFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range fields {
+		// non-XML format files have no scale
+		fields[i].Scale = -1
+	}
+	if !reflect.DeepEqual(format.Fields, fields) {
+		t.Errorf("expected format %+v, got %+v", fields, format.Fields)
+	}
+	r, err := NewBCPReader(&buf, format, BCPOptions{Encoding: "1252", Scales: map[string]int{"created": 3, "at": 7}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := readAll(t, r)
+	expected := []interface{}{
+		int64(1), "-12.345", "1.5000", float64(float32(0.1)),
+		time.Date(2020, 1, 2, 3, 4, 5, 678000000, time.UTC), time.Date(1, 1, 1, 0, 0, 1, 0, time.UTC),
+		"café", "hi", []byte{0x0a, 0xff}, "",
+	}
+	if len(rows) != 2 || !reflect.DeepEqual(rows[0], expected) {
+		t.Fatalf("expected row %v, got %v", expected, rows)
+	}
+	if !reflect.DeepEqual(rows[1], make([]interface{}, len(fields))) {
+		t.Errorf("expected a row of NULLs, got %v", rows[1])
+	}
+}
+
+func TestExportTextRoundTrip(t *testing.T) {
+	fields, types, row := exportFields(t)
+	var names, texts []string
+	for _, col := range exportColumns {
+		names = append(names, col.name)
+		texts = append(texts, col.text)
+	}
+	nulls := make([]driver.Value, len(row))
+
+	for _, unicode := range []bool{false, true} {
+		var buf bytes.Buffer
+		bw := bufio.NewWriter(&buf)
+		format := CharFormat(names, "\t", "\n", unicode)
+		w := &charWriter{w: bw, fields: format.Fields, native: fields, types: types}
+		if err := w.writeRow(row); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.writeRow(nulls); err != nil {
+			t.Fatal(err)
+		}
+		bw.Flush()
+		r, err := NewBCPReader(&buf, format, BCPOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows := readAll(t, r)
+		if len(rows) != 2 || rows[0][0] != "1" || rows[0][6] != "café" || rows[0][9] != "" || rows[1][0] != nil {
+			t.Errorf("unicode %v: unexpected rows %q", unicode, rows)
+		}
+	}
+
+	var buf bytes.Buffer
+	w, err := newCSVWriter(&buf, names, ExportOptions{Format: FormatCSV, Header: true, Null: `\N`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.native, w.types = fields, types
+	if err = w.writeRow(row); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.writeRow(nulls); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.flush(); err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Join(names, ",") + "\n" + strings.Join(texts, ",") + "\n" + strings.Repeat(`\N,`, len(names)-1) + `\N` + "\n"
+	if buf.String() != expected {
+		t.Errorf("expected CSV %q, got %q", expected, buf.String())
+	}
+}
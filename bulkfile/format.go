@@ -0,0 +1,288 @@
+package bulkfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// FormatFile describes the fields of a bcp data file, it is read from the
+// .fmt or .xml format files written by "bcp format".
+type FormatFile struct {
+	// Version is the bcp version of non-XML format files, e.g. "14.0".
+	Version string
+	Fields  []Field
+}
+
+// Field describes a field of a bcp data file.
+type Field struct {
+	// HostType is the type of the data in the file, e.g. "SQLCHAR",
+	// "SQLNCHAR" or "SQLINT".
+	HostType string
+	// PrefixLength is the size of the length prefix of the field: 0, 1,
+	// 2, 4 or 8.
+	PrefixLength int
+	// Length is the size of fixed length fields and the maximum size of
+	// the others.
+	Length int
+	// Terminator ends the field when set.
+	Terminator string
+	// Column is the position of the column of the field in the table,
+	// fields of column 0 are not loaded.
+	Column int
+	// Name is the name of the column.
+	Name string
+	// Collation is the collation of the column, empty for non-character
+	// columns.
+	Collation string
+	// Scale is the scale of decimal and time columns given by XML format
+	// files and Export, -1 when it is not known.
+	Scale int
+}
+
+// ReadFormatFile reads a non-XML or XML format file.
+func ReadFormatFile(r io.Reader) (*FormatFile, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	// skip a UTF-8 byte order mark
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if len(data) >= 2 && data[0] == 0xff && data[1] == 0xfe {
+		data = []byte(decodeUTF16(data[2:]))
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '<' {
+		return parseXMLFormat(trimmed)
+	}
+	return parseFormat(data)
+}
+
+// CharFormat returns the format of a character data file with the columns
+// in their order, as written by "bcp -c", or "bcp -w" when unicode is set.
+func CharFormat(columns []string, fieldTerminator, rowTerminator string, unicode bool) *FormatFile {
+	hostType := "SQLCHAR"
+	if unicode {
+		hostType = "SQLNCHAR"
+	}
+	f := &FormatFile{}
+	for i, name := range columns {
+		term := fieldTerminator
+		if i == len(columns)-1 {
+			term = rowTerminator
+		}
+		f.Fields = append(f.Fields, Field{
+			HostType:   hostType,
+			Terminator: term,
+			Column:     i + 1,
+			Name:       name,
+			Scale:      -1,
+		})
+	}
+	return f
+}
+
+// parseFormat parses a non-XML format file.
+func parseFormat(data []byte) (*FormatFile, error) {
+	var tokens []string
+	var lines []int
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; s.Scan(); line++ {
+		lineTokens, err := splitFormatLine(s.Text())
+		if err != nil {
+			return nil, fmt.Errorf("bulkfile: format file line %d: %v", line, err)
+		}
+		for range lineTokens {
+			lines = append(lines, line)
+		}
+		tokens = append(tokens, lineTokens...)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(tokens) < 2 {
+		return nil, errors.New("bulkfile: the format file has no fields")
+	}
+	f := &FormatFile{Version: tokens[0]}
+	count, err := strconv.Atoi(tokens[1])
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("bulkfile: invalid field count %q in format file", tokens[1])
+	}
+	tokens, lines = tokens[2:], lines[2:]
+	const fieldTokens = 8
+	if len(tokens) < count*fieldTokens {
+		return nil, fmt.Errorf("bulkfile: the format file describes fewer than %d fields", count)
+	}
+	for i := 0; i < count; i++ {
+		t := tokens[i*fieldTokens : (i+1)*fieldTokens]
+		line := lines[i*fieldTokens]
+		field := Field{HostType: strings.ToUpper(t[1]), Terminator: t[4], Name: t[6], Scale: -1}
+		if t[7] != `""` && t[7] != "" {
+			field.Collation = t[7]
+		}
+		var err error
+		if field.PrefixLength, err = strconv.Atoi(t[2]); err != nil {
+			return nil, fmt.Errorf("bulkfile: format file line %d: invalid prefix length %q", line, t[2])
+		}
+		if field.Length, err = strconv.Atoi(t[3]); err != nil {
+			return nil, fmt.Errorf("bulkfile: format file line %d: invalid length %q", line, t[3])
+		}
+		if field.Column, err = strconv.Atoi(t[5]); err != nil {
+			return nil, fmt.Errorf("bulkfile: format file line %d: invalid column order %q", line, t[5])
+		}
+		f.Fields = append(f.Fields, field)
+	}
+	return f, nil
+}
+
+// splitFormatLine splits a line of a non-XML format file into its tokens.
+// The quotes of the terminator are removed and its escapes replaced.
+func splitFormatLine(line string) ([]string, error) {
+	var tokens []string
+	for {
+		line = strings.TrimLeft(line, " \t\r")
+		if line == "" {
+			return tokens, nil
+		}
+		if line[0] != '"' {
+			end := strings.IndexAny(line, " \t\r")
+			if end < 0 {
+				end = len(line)
+			}
+			tokens = append(tokens, line[:end])
+			line = line[end:]
+			continue
+		}
+		end := 1
+		for end < len(line) && line[end] != '"' {
+			if line[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(line) {
+			return nil, errors.New("unterminated quoted string")
+		}
+		tokens = append(tokens, unescapeTerminator(line[1:end]))
+		line = line[end+1:]
+	}
+}
+
+// unescapeTerminator replaces the escapes of a terminator.
+func unescapeTerminator(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case '0':
+			b.WriteByte(0)
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+type xmlFormat struct {
+	XMLName xml.Name `xml:"BCPFORMAT"`
+	Fields  []struct {
+		ID           string `xml:"ID,attr"`
+		Type         string `xml:"http://www.w3.org/2001/XMLSchema-instance type,attr"`
+		PrefixLength int    `xml:"PREFIX_LENGTH,attr"`
+		Length       int    `xml:"LENGTH,attr"`
+		MaxLength    int    `xml:"MAX_LENGTH,attr"`
+		Terminator   string `xml:"TERMINATOR,attr"`
+		Collation    string `xml:"COLLATION,attr"`
+	} `xml:"RECORD>FIELD"`
+	Columns []struct {
+		Source string `xml:"SOURCE,attr"`
+		Name   string `xml:"NAME,attr"`
+		Type   string `xml:"http://www.w3.org/2001/XMLSchema-instance type,attr"`
+		Scale  string `xml:"SCALE,attr"`
+	} `xml:"ROW>COLUMN"`
+}
+
+// xmlColumnHostTypes maps the column types of XML format files to the host
+// types of their native fields.
+var xmlColumnHostTypes = map[string]string{
+	"SQLVARYCHAR": "SQLCHAR",
+	"SQLNVARCHAR": "SQLNCHAR",
+	"SQLVARYBIN":  "SQLBINARY",
+}
+
+// parseXMLFormat parses an XML format file.
+func parseXMLFormat(data []byte) (*FormatFile, error) {
+	var x xmlFormat
+	if err := xml.Unmarshal(data, &x); err != nil {
+		return nil, fmt.Errorf("bulkfile: invalid XML format file: %v", err)
+	}
+	f := &FormatFile{}
+	index := make(map[string]int, len(x.Fields))
+	for i, xf := range x.Fields {
+		index[xf.ID] = i
+		field := Field{
+			PrefixLength: xf.PrefixLength,
+			Length:       xf.Length,
+			Terminator:   unescapeTerminator(xf.Terminator),
+			Collation:    xf.Collation,
+			Scale:        -1,
+		}
+		if field.Length == 0 {
+			field.Length = xf.MaxLength
+		}
+		switch {
+		case strings.HasPrefix(xf.Type, "NChar"):
+			field.HostType = "SQLNCHAR"
+		case strings.HasPrefix(xf.Type, "Char"):
+			field.HostType = "SQLCHAR"
+		case strings.HasPrefix(xf.Type, "Native"):
+			// the type comes from the column
+		default:
+			return nil, fmt.Errorf("bulkfile: unsupported field type %q in XML format file", xf.Type)
+		}
+		f.Fields = append(f.Fields, field)
+	}
+	for i, col := range x.Columns {
+		fi, ok := index[col.Source]
+		if !ok {
+			return nil, fmt.Errorf("bulkfile: column %s of the XML format file has no field %s", col.Name, col.Source)
+		}
+		field := &f.Fields[fi]
+		field.Column = i + 1
+		field.Name = col.Name
+		if col.Scale != "" {
+			var err error
+			if field.Scale, err = strconv.Atoi(col.Scale); err != nil {
+				return nil, fmt.Errorf("bulkfile: invalid scale %q of column %s", col.Scale, col.Name)
+			}
+		}
+		if field.HostType == "" {
+			field.HostType = col.Type
+			if hostType, ok := xmlColumnHostTypes[col.Type]; ok {
+				field.HostType = hostType
+			}
+		}
+	}
+	for i, field := range f.Fields {
+		if field.HostType == "" {
+			// native fields that are not loaded are read as binary
+			f.Fields[i].HostType = "SQLBINARY"
+		}
+	}
+	return f, nil
+}
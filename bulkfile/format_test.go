@@ -0,0 +1,71 @@
+package bulkfile
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadFormatFile(t *testing.T) {
+	fmtFile := `14.0
+3
+1       SQLINT              1       4       ""             1     id               ""
+2       SQLNCHAR            2       100     ""             2     name             SQL_Latin1_General_CP1_CI_AS
+3       SQLCHAR             0       0       "\r\n"         0     skipped          ""
+`
+	f, err := ReadFormatFile(strings.NewReader(fmtFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &FormatFile{Version: "14.0", Fields: []Field{
+		{HostType: "SQLINT", PrefixLength: 1, Length: 4, Column: 1, Name: "id", Scale: -1},
+		{HostType: "SQLNCHAR", PrefixLength: 2, Length: 100, Column: 2, Name: "name", Collation: "SQL_Latin1_General_CP1_CI_AS", Scale: -1},
+		{HostType: "SQLCHAR", Terminator: "\r\n", Name: "skipped", Scale: -1},
+	}}
+	if !reflect.DeepEqual(f, expected) {
+		t.Errorf("expected %+v, got %+v", expected, f)
+	}
+
+	if _, err = ReadFormatFile(strings.NewReader("14.0\n2\n1 SQLINT 0 4 \"\" 1 id \"\"\n")); err == nil {
+		t.Error("expected an error for a missing field")
+	}
+}
+
+func TestReadXMLFormatFile(t *testing.T) {
+	xmlFile := `<?xml version="1.0"?>
+<BCPFORMAT xmlns="http://schemas.microsoft.com/sqlserver/2004/bulkload/format" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+ <RECORD>
+  <FIELD ID="1" xsi:type="NativeFixed" LENGTH="4"/>
+  <FIELD ID="2" xsi:type="NativePrefix" PREFIX_LENGTH="1"/>
+  <FIELD ID="3" xsi:type="CharTerm" TERMINATOR="\r\n" MAX_LENGTH="30" COLLATION="Latin1_General_CI_AS"/>
+ </RECORD>
+ <ROW>
+  <COLUMN SOURCE="1" NAME="id" xsi:type="SQLINT"/>
+  <COLUMN SOURCE="3" NAME="name" xsi:type="SQLVARYCHAR"/>
+  <COLUMN SOURCE="2" NAME="created" xsi:type="SQLDATETIME2" SCALE="3"/>
+ </ROW>
+</BCPFORMAT>`
+	f, err := ReadFormatFile(strings.NewReader(xmlFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &FormatFile{Fields: []Field{
+		{HostType: "SQLINT", Length: 4, Column: 1, Name: "id", Scale: -1},
+		{HostType: "SQLDATETIME2", PrefixLength: 1, Column: 3, Name: "created", Scale: 3},
+		{HostType: "SQLCHAR", Length: 30, Terminator: "\r\n", Column: 2, Name: "name", Collation: "Latin1_General_CI_AS", Scale: -1},
+	}}
+	if !reflect.DeepEqual(f, expected) {
+		t.Errorf("expected %+v, got %+v", expected, f)
+	}
+}
+
+func TestCharFormat(t *testing.T) {
+	f := CharFormat([]string{"a", "b"}, "\t", "\n", true)
+	expected := []Field{
+		{HostType: "SQLNCHAR", Terminator: "\t", Column: 1, Name: "a", Scale: -1},
+		{HostType: "SQLNCHAR", Terminator: "\n", Column: 2, Name: "b", Scale: -1},
+	}
+	if !reflect.DeepEqual(f.Fields, expected) {
+		t.Errorf("expected %+v, got %+v", expected, f.Fields)
+	}
+}
@@ -0,0 +1,140 @@
+package bulkfile
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+)
+
+// openConn connects to the server of the SQLSERVER_DSN environment
+// variable, the test is skipped when it is not set.
+func openConn(t *testing.T) *mssql.Conn {
+	dsn := os.Getenv("SQLSERVER_DSN")
+	if dsn == "" {
+		t.Skip("no database connection string")
+	}
+	connector, err := mssql.NewConnector(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := connector.Connect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn.(*mssql.Conn)
+}
+
+func query(t *testing.T, conn *mssql.Conn, q string) [][]driver.Value {
+	t.Helper()
+	ctx := context.Background()
+	stmt, err := conn.PrepareContext(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	rows, err := stmt.(driver.StmtQueryContext).QueryContext(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var res [][]driver.Value
+	for {
+		row := make([]driver.Value, len(rows.Columns()))
+		if err = rows.Next(row); err == io.EOF {
+			return res
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, row)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	conn := openConn(t)
+	defer conn.Close()
+	ctx := context.Background()
+	query(t, conn, "create table #bulkfile (id int, name nvarchar(20), data varbinary(10), created datetime2(3))")
+
+	csvData := "id,name,data,created\n1,café,0a0b,2020-01-02 03:04:05.678\n2,,,\n"
+	src, err := NewCSVReader(strings.NewReader(csvData), CSVOptions{Header: true, NullValues: []string{""}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := Load(ctx, conn, "#bulkfile", src, mssql.BulkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 rows copied, got %d", n)
+	}
+	rows := query(t, conn, "select id, name, data, created from #bulkfile order by id")
+	expected := [][]driver.Value{
+		{int64(1), "café", []byte{0x0a, 0x0b}, time.Date(2020, 1, 2, 3, 4, 5, 678000000, time.UTC)},
+		{int64(2), nil, nil, nil},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("expected rows %v, got %v", expected, rows)
+	}
+
+	columns, err := TableColumns(ctx, conn, "#bulkfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(columns, []string{"id", "name", "data", "created"}) {
+		t.Errorf("unexpected columns %v", columns)
+	}
+}
+
+func TestExportLoad(t *testing.T) {
+	conn := openConn(t)
+	defer conn.Close()
+	ctx := context.Background()
+	query(t, conn, `create table #export_src (id int, amount decimal(10, 3), price money, created datetime2(3),
+		at time, offset datetimeoffset(2), name varchar(10), title nvarchar(max), data varbinary(10), guid uniqueidentifier)`)
+	query(t, conn, `insert into #export_src values (1, -12.345, 1.5, '2020-01-02 03:04:05.678', '01:02:03.1234567',
+		'2020-01-02 03:04:05.67 +01:00', 'cafe', N'日本', 0x0aff, '01234567-89ab-cdef-0123-456789abcdef'),
+		(2, null, null, null, null, null, '', null, null, null)`)
+	srcRows := query(t, conn, "select * from #export_src order by id")
+
+	for _, format := range []DataFormat{FormatNative, FormatChar, FormatWideChar, FormatCSV} {
+		query(t, conn, "select top 0 * into #export_dst from #export_src")
+		var buf bytes.Buffer
+		options := ExportOptions{Format: format, Header: true, Null: `\N`}
+		fmtFile, n, err := Export(ctx, conn, "select * from #export_src", &buf, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Errorf("format %d: expected 2 rows exported, got %d", format, n)
+		}
+		var src Source
+		if format == FormatCSV {
+			src, err = NewCSVReader(&buf, CSVOptions{Header: true, NullValues: []string{`\N`}})
+		} else {
+			// native char data is in the code page of the column
+			bcpOptions := BCPOptions{}
+			if format == FormatNative {
+				bcpOptions.Encoding = "raw"
+			}
+			src, err = NewBCPReader(&buf, fmtFile, bcpOptions)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = Load(ctx, conn, "#export_dst", src, mssql.BulkOptions{}); err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		if rows := query(t, conn, "select * from #export_dst order by id"); !reflect.DeepEqual(rows, srcRows) {
+			t.Errorf("format %d: expected rows %v, got %v", format, srcRows, rows)
+		}
+		query(t, conn, "drop table #export_dst")
+	}
+}
@@ -0,0 +1,267 @@
+// gobcp copies data between SQL Server tables and data files like the bcp
+// utility.
+//
+// Usage:
+//
+//	gobcp table in datafile [-S server] [-U login] [-P password] [-d database]
+//	      [-f formatfile | -c | -w | -csv] [-t field_term] [-r row_term]
+//	      [-C code_page] [-header] [-null marker] [-b batch_size] [-tablock] [-E]
+//	      [-e err_file] [-m max_errors]
+//	gobcp table out datafile [-n | -c | -w | -csv] [-f formatfile] ...
+//	gobcp query queryout datafile [-n | -c | -w | -csv] [-f formatfile] ...
+//
+// Native files are written with a format file, datafile.fmt unless -f is
+// set. Loading them with -C RAW keeps char data in the code page of the
+// column.
+//
+// Rows that fail to load are written to the error file set with -e and
+// skipped, the load stops after max_errors failed rows.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/denisenkom/go-mssqldb/bulkfile"
+)
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "gobcp:", err)
+		os.Exit(1)
+	}
+}
+
+func usage(flags *flag.FlagSet) {
+	fmt.Fprintln(os.Stderr, "usage: gobcp table in|out datafile [flags]")
+	fmt.Fprintln(os.Stderr, "       gobcp query queryout datafile [flags]")
+	flags.PrintDefaults()
+}
+
+func run(args []string) error {
+	flags := flag.NewFlagSet("gobcp", flag.ExitOnError)
+	var (
+		server     = flags.String("S", "localhost", "server_name[\\instance_name]")
+		userid     = flags.String("U", "", "login_id")
+		password   = flags.String("P", "", "password")
+		database   = flags.String("d", "", "db_name")
+		dsn        = flags.String("dsn", "", "connection string, replaces -S, -U, -P and -d")
+		formatFile = flags.String("f", "", "format file of the data file")
+		native     = flags.Bool("n", false, "native data file, loading needs a format file")
+		wide       = flags.Bool("w", false, "unicode character data file")
+		csvFile    = flags.Bool("csv", false, "RFC 4180 CSV data file")
+		fieldTerm  = flags.String("t", "", "field terminator, \\t or , for CSV files by default")
+		rowTerm    = flags.String("r", `\n`, "row terminator")
+		codePage   = flags.String("C", "", "code page of character data, e.g. 1252, RAW or UTF-16 for CSV files")
+		header     = flags.Bool("header", false, "the first line of the CSV file holds the column names")
+		null       = flags.String("null", "", "marker of NULL values in CSV files")
+		batchSize  = flags.Int("b", 0, "rows per batch, all rows in one batch by default")
+		tablock    = flags.Bool("tablock", false, "lock the table during the copy")
+		identity   = flags.Bool("E", false, "keep the identity values of the data file")
+		errFile    = flags.String("e", "", "file of the rows that fail to load, the load stops at the first one if not set")
+		maxErrors  = flags.Int("m", 10, "number of failed rows that stops the load")
+	)
+	char := flags.Bool("c", false, "character data file, the default of in")
+	if len(args) < 3 {
+		usage(flags)
+		os.Exit(2)
+	}
+	table, direction, dataFile := args[0], args[1], args[2]
+	flags.Parse(args[3:])
+	switch direction {
+	case "in", "out", "queryout":
+	default:
+		return fmt.Errorf("unsupported direction %q, use in, out or queryout", direction)
+	}
+	if direction == "in" && *native && *formatFile == "" {
+		return fmt.Errorf("native data files need a format file, set -f")
+	}
+
+	if *dsn == "" {
+		*dsn = "server=" + *server + ";user id=" + *userid + ";password=" + *password + ";database=" + *database
+	}
+	connector, err := mssql.NewConnector(*dsn)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	driverConn, err := connector.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	conn := driverConn.(*mssql.Conn)
+	defer conn.Close()
+
+	if direction != "in" {
+		options := bulkfile.ExportOptions{
+			FieldTerminator: unescape(*fieldTerm),
+			RowTerminator:   unescape(*rowTerm),
+			Header:          *header,
+			Null:            *null,
+		}
+		switch {
+		case *csvFile:
+			options.Format = bulkfile.FormatCSV
+		case *wide:
+			options.Format = bulkfile.FormatWideChar
+		case *char:
+			options.Format = bulkfile.FormatChar
+		case *native:
+			options.Format = bulkfile.FormatNative
+		default:
+			return fmt.Errorf("set the format of the data file with -n, -c, -w or -csv")
+		}
+		query := table
+		if direction == "out" {
+			query = "select * from " + table
+		}
+		return export(ctx, conn, query, dataFile, *formatFile, options)
+	}
+
+	f, err := os.Open(dataFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var src bulkfile.Source
+	switch {
+	case *csvFile:
+		options := bulkfile.CSVOptions{Header: *header, Encoding: *codePage}
+		if term := unescape(*fieldTerm); term != "" {
+			if len([]rune(term)) != 1 {
+				return fmt.Errorf("the field terminator of CSV files must be a single character")
+			}
+			options.Comma = []rune(term)[0]
+		}
+		if flagSet(flags, "null") {
+			options.NullValues = []string{*null}
+		}
+		if !*header {
+			if options.Columns, err = bulkfile.TableColumns(ctx, conn, table); err != nil {
+				return err
+			}
+		}
+		src, err = bulkfile.NewCSVReader(f, options)
+	default:
+		var format *bulkfile.FormatFile
+		if *formatFile != "" {
+			ff, err := os.Open(*formatFile)
+			if err != nil {
+				return err
+			}
+			format, err = bulkfile.ReadFormatFile(ff)
+			ff.Close()
+			if err != nil {
+				return err
+			}
+		} else {
+			columns, err := bulkfile.TableColumns(ctx, conn, table)
+			if err != nil {
+				return err
+			}
+			term := *fieldTerm
+			if term == "" {
+				term = `\t`
+			}
+			format = bulkfile.CharFormat(columns, unescape(term), unescape(*rowTerm), *wide)
+		}
+		src, err = bulkfile.NewBCPReader(f, format, bulkfile.BCPOptions{Encoding: *codePage})
+	}
+	if err != nil {
+		return err
+	}
+
+	options := mssql.BulkOptions{
+		RowsPerBatch: *batchSize,
+		Tablock:      *tablock,
+		KeepIdentity: *identity,
+		NotifyAfter:  *batchSize,
+		OnProgress: func(rows int64) {
+			fmt.Printf("%d rows sent to SQL Server.\n", rows)
+		},
+	}
+	if *errFile != "" {
+		ef, err := os.Create(*errFile)
+		if err != nil {
+			return err
+		}
+		defer ef.Close()
+		failed := 0
+		options.BisectErrorRows = true
+		options.OnRowError = func(row int64, values []interface{}, err error) error {
+			fmt.Fprintf(ef, "#@ Row %d: %v\n%s\n", row, err, formatRow(values))
+			failed++
+			if failed >= *maxErrors {
+				return fmt.Errorf("stopped after %d failed rows: %v", failed, err)
+			}
+			return nil
+		}
+	}
+	n, err := bulkfile.Load(ctx, conn, table, src, options)
+	fmt.Printf("%d rows copied.\n", n)
+	return err
+}
+
+// formatRow returns the values of a failed row separated by tabs.
+func formatRow(values []interface{}) string {
+	fields := make([]string, len(values))
+	for i, val := range values {
+		if val != nil {
+			fields[i] = fmt.Sprint(val)
+		}
+	}
+	return strings.Join(fields, "\t")
+}
+
+// export writes the rows of query to dataFile and the format file of native
+// data files or when formatFile is set.
+func export(ctx context.Context, conn *mssql.Conn, query, dataFile, formatFile string, options bulkfile.ExportOptions) error {
+	f, err := os.Create(dataFile)
+	if err != nil {
+		return err
+	}
+	format, n, err := bulkfile.Export(ctx, conn, query, f, options)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d rows copied.\n", n)
+	if format == nil || (formatFile == "" && options.Format != bulkfile.FormatNative) {
+		return nil
+	}
+	if formatFile == "" {
+		formatFile = dataFile + ".fmt"
+	}
+	ff, err := os.Create(formatFile)
+	if err != nil {
+		return err
+	}
+	_, err = format.WriteTo(ff)
+	if cerr := ff.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// unescape replaces the escapes of terminators given like to bcp.
+func unescape(s string) string {
+	return strings.NewReplacer(`\t`, "\t", `\n`, "\n", `\r`, "\r", `\0`, "\x00", `\\`, `\`).Replace(s)
+}
+
+// flagSet reports whether the flag was given.
+func flagSet(flags *flag.FlagSet, name string) bool {
+	set := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
@@ -0,0 +1,614 @@
+package mssql
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+)
+
+// Always Encrypted
+// https://docs.microsoft.com/en-us/sql/relational-databases/security/encryption/always-encrypted-database-engine
+
+// version of the COLUMNENCRYPTION feature extension
+const columnEncryptionVersion = 0x01
+
+// cell encryption algorithm ids
+const (
+	cipherAlgorithmCustom                  = 0
+	cipherAlgorithmAeadAes256CbcHmacSha256 = 2
+)
+
+const cipherNormalizationVersion = 0x01
+
+// minimal number of columns of the sp_describe_parameter_encryption results
+const (
+	describeParameterEncryptionCekColumns    = 9
+	describeParameterEncryptionParamsColumns = 6
+)
+
+type featureExtColumnEncryption struct{}
+
+func (e *featureExtColumnEncryption) featureID() byte {
+	return featExtCOLUMNENCRYPTION
+}
+
+func (e *featureExtColumnEncryption) toBytes() []byte {
+	return []byte{columnEncryptionVersion}
+}
+
+// encryptedKeyValue is a column encryption key encrypted by one column
+// master key.
+type encryptedKeyValue struct {
+	encryptedKey []byte
+	keyStoreName string
+	keyPath      string
+	algorithm    string
+}
+
+// cekEntry is an entry of the CEK table, a column encryption key with all
+// its encrypted values.
+type cekEntry struct {
+	databaseID   uint32
+	cekID        uint32
+	cekVersion   uint32
+	cekMDVersion [8]byte
+	values       []encryptedKeyValue
+}
+
+// cryptoMetadata describes how a column or parameter is encrypted.
+type cryptoMetadata struct {
+	cek            *cekEntry
+	userType       uint32
+	algorithm      byte
+	algorithmName  string
+	encryptionType byte
+	normVersion    byte
+	// baseTi is the type of the plain value
+	baseTi typeInfo
+	// cipherTi is the type of the encrypted value on the wire
+	cipherTi typeInfo
+}
+
+// CekTable of COLMETADATA
+func parseCekTable(r *tdsBuffer) []cekEntry {
+	table := make([]cekEntry, r.uint16())
+	for i := range table {
+		e := &table[i]
+		e.databaseID = r.uint32()
+		e.cekID = r.uint32()
+		e.cekVersion = r.uint32()
+		r.ReadFull(e.cekMDVersion[:])
+		e.values = make([]encryptedKeyValue, r.byte())
+		for j := range e.values {
+			v := &e.values[j]
+			v.encryptedKey = make([]byte, r.uint16())
+			r.ReadFull(v.encryptedKey)
+			v.keyStoreName = r.BVarChar()
+			v.keyPath = r.UsVarChar()
+			v.algorithm = r.BVarChar()
+		}
+	}
+	return table
+}
+
+// parseCryptoMetadata reads CryptoMetaData. Columns reference their key by
+// an ordinal into the CEK table, return values carry no key reference.
+func parseCryptoMetadata(r *tdsBuffer, cekTable []cekEntry, cipherTi typeInfo) *cryptoMetadata {
+	cm := &cryptoMetadata{cipherTi: cipherTi}
+	if cekTable != nil {
+		ordinal := int(r.uint16())
+		if ordinal >= len(cekTable) {
+			badStreamPanicf("invalid column encryption key ordinal %d", ordinal)
+		}
+		cm.cek = &cekTable[ordinal]
+	}
+	cm.userType = r.uint32()
+	cm.baseTi = readTypeInfo(r)
+	cm.algorithm = r.byte()
+	if cm.algorithm == cipherAlgorithmCustom {
+		cm.algorithmName = r.BVarChar()
+	}
+	cm.encryptionType = r.byte()
+	cm.normVersion = r.byte()
+	return cm
+}
+
+// columnEncryptionKeys caches algorithm instances by decrypted column
+// encryption key, so key store providers are asked once per key.
+var columnEncryptionKeys = &cekCache{m: map[string]*aeadAes256CbcHmacSha256{}}
+
+type cekCache struct {
+	mu sync.Mutex
+	m  map[string]*aeadAes256CbcHmacSha256
+}
+
+func (c *cekCache) clear() {
+	c.mu.Lock()
+	c.m = map[string]*aeadAes256CbcHmacSha256{}
+	c.mu.Unlock()
+}
+
+// algorithm decrypts the column encryption key with the first key store
+// provider that is registered and succeeds.
+func (c *cekCache) algorithm(cek *cekEntry) (*aeadAes256CbcHmacSha256, error) {
+	if cek == nil {
+		return nil, errors.New("mssql: missing column encryption key")
+	}
+	var lastErr error
+	for _, v := range cek.values {
+		cacheKey := v.keyStoreName + "\x00" + v.keyPath + "\x00" + string(v.encryptedKey)
+		c.mu.Lock()
+		alg, ok := c.m[cacheKey]
+		c.mu.Unlock()
+		if ok {
+			return alg, nil
+		}
+		provider, ok := getKeyStoreProvider(v.keyStoreName)
+		if !ok {
+			lastErr = fmt.Errorf("mssql: no key store provider registered for %q", v.keyStoreName)
+			continue
+		}
+		key, err := provider.DecryptColumnEncryptionKey(v.keyPath, v.algorithm, v.encryptedKey)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		alg, err = newAeadAes256CbcHmacSha256(key)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		c.mu.Lock()
+		c.m[cacheKey] = alg
+		c.mu.Unlock()
+		return alg, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("mssql: column encryption key has no encrypted values")
+	}
+	return nil, lastErr
+}
+
+func (cm *cryptoMetadata) cipher() (*aeadAes256CbcHmacSha256, error) {
+	if cm.algorithm != cipherAlgorithmAeadAes256CbcHmacSha256 {
+		return nil, fmt.Errorf("mssql: unsupported column encryption algorithm %d %s", cm.algorithm, cm.algorithmName)
+	}
+	if cm.normVersion != cipherNormalizationVersion {
+		return nil, fmt.Errorf("mssql: unsupported normalization version %d", cm.normVersion)
+	}
+	return columnEncryptionKeys.algorithm(cm.cek)
+}
+
+// decryptRow replaces the encrypted values of a row by their plain values.
+func decryptRow(cols []columnStruct, row []driver.Value) error {
+	for i := range cols {
+		if i >= len(row) {
+			break
+		}
+		col := &cols[i]
+		if col.cryptoMeta == nil || row[i] == nil {
+			continue
+		}
+		v, err := decryptValue(col.cryptoMeta, row[i])
+		if err != nil {
+			return fmt.Errorf("mssql: cannot decrypt column %q: %v", col.ColName, err)
+		}
+		row[i] = v
+	}
+	return nil
+}
+
+func decryptValue(cm *cryptoMetadata, v interface{}) (interface{}, error) {
+	cell, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected encrypted value type %T", v)
+	}
+	alg, err := cm.cipher()
+	if err != nil {
+		return nil, err
+	}
+	plain, err := alg.decrypt(cell)
+	if err != nil {
+		return nil, err
+	}
+	return decodeNormalized(&cm.baseTi, plain)
+}
+
+// decryptReturnValue decrypts an output parameter with the key of the
+// parameter, return values don't reference a key.
+func decryptReturnValue(cm *cryptoMetadata, pe *paramEncryption, v interface{}) (interface{}, error) {
+	if pe == nil {
+		return nil, errors.New("mssql: encrypted output parameter was not sent encrypted")
+	}
+	cm.cek = pe.cek
+	return decryptValue(cm, v)
+}
+
+var errNormalizedLength = errors.New("invalid length of decrypted value")
+
+// decodeNormalized decodes a decrypted value. Values are encrypted in
+// their wire format, except that all integer types are stored as 8 bytes.
+func decodeNormalized(ti *typeInfo, buf []byte) (interface{}, error) {
+	size := func(sizes ...int) error {
+		for _, s := range sizes {
+			if len(buf) == s {
+				return nil
+			}
+		}
+		return errNormalizedLength
+	}
+	switch ti.TypeId {
+	case typeInt1, typeInt2, typeInt4, typeInt8, typeIntN:
+		if err := size(8); err != nil {
+			return nil, err
+		}
+		return int64(binary.LittleEndian.Uint64(buf)), nil
+	case typeBit, typeBitN:
+		if err := size(8); err != nil {
+			return nil, err
+		}
+		return buf[0] != 0, nil
+	case typeFlt4, typeFlt8, typeFltN:
+		if err := size(4, 8); err != nil {
+			return nil, err
+		}
+		if len(buf) == 4 {
+			return float64(math.Float32frombits(binary.LittleEndian.Uint32(buf))), nil
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(buf)), nil
+	case typeMoney, typeMoney4, typeMoneyN:
+		if err := size(4, 8); err != nil {
+			return nil, err
+		}
+		if len(buf) == 4 {
+			return decodeMoney4(buf), nil
+		}
+		return decodeMoney(buf), nil
+	case typeDecimal, typeNumeric, typeDecimalN, typeNumericN:
+		if err := size(5, 9, 13, 17); err != nil {
+			return nil, err
+		}
+		return decodeDecimal(ti.Prec, ti.Scale, buf), nil
+	case typeDateTim4, typeDateTime, typeDateTimeN:
+		if err := size(4, 8); err != nil {
+			return nil, err
+		}
+		if len(buf) == 4 {
+			return decodeDateTim4(buf), nil
+		}
+		return decodeDateTime(buf), nil
+	case typeDateN:
+		if err := size(3); err != nil {
+			return nil, err
+		}
+		return decodeDate(buf), nil
+	case typeTimeN:
+		if err := size(calcTimeSize(int(ti.Scale))); err != nil {
+			return nil, err
+		}
+		return decodeTime(ti.Scale, buf), nil
+	case typeDateTime2N:
+		if err := size(calcTimeSize(int(ti.Scale)) + 3); err != nil {
+			return nil, err
+		}
+		return decodeDateTime2(ti.Scale, buf), nil
+	case typeDateTimeOffsetN:
+		if err := size(calcTimeSize(int(ti.Scale)) + 5); err != nil {
+			return nil, err
+		}
+		return decodeDateTimeOffset(ti.Scale, buf), nil
+	case typeGuid:
+		if err := size(16); err != nil {
+			return nil, err
+		}
+		return decodeGuid(buf), nil
+	case typeChar, typeVarChar, typeBigChar, typeBigVarChar, typeText:
+		return decodeChar(ti.Collation, buf), nil
+	case typeNChar, typeNVarChar, typeNText:
+		return decodeNChar(buf), nil
+	case typeBinary, typeVarBinary, typeBigBinary, typeBigVarBin, typeImage:
+		return buf, nil
+	}
+	return nil, fmt.Errorf("unsupported encrypted type %#x", ti.TypeId)
+}
+
+// normalizeParam returns the value of a parameter the way it is encrypted,
+// nil for NULL.
+func normalizeParam(p *param) ([]byte, error) {
+	buf := p.buffer
+	switch p.ti.TypeId {
+	case typeNull:
+		return nil, nil
+	case typeInt1, typeInt2, typeInt4, typeInt8, typeIntN, typeBit, typeBitN:
+		if len(buf) == 0 {
+			return nil, nil
+		}
+		var v int64
+		switch len(buf) {
+		case 1:
+			v = int64(buf[0])
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(buf)))
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(buf)))
+		case 8:
+			v = int64(binary.LittleEndian.Uint64(buf))
+		default:
+			return nil, errNormalizedLength
+		}
+		res := make([]byte, 8)
+		binary.LittleEndian.PutUint64(res, uint64(v))
+		return res, nil
+	case typeDecimal, typeNumeric, typeDecimalN, typeNumericN:
+		if len(buf) == 0 {
+			return nil, nil
+		}
+		// sign and 16 bytes of mantissa
+		res := make([]byte, 17)
+		copy(res, buf)
+		return res, nil
+	case typeFltN, typeMoneyN, typeDateTimeN, typeDateN, typeTimeN,
+		typeDateTime2N, typeDateTimeOffsetN, typeGuid:
+		if len(buf) == 0 {
+			return nil, nil
+		}
+		return buf, nil
+	case typeTvp, typeUdt, typeXml, typeVariant:
+		return nil, fmt.Errorf("mssql: parameters of type %#x can't be encrypted", p.ti.TypeId)
+	}
+	// strings and binary values, an empty value is not NULL
+	if buf == nil {
+		return nil, nil
+	}
+	return buf, nil
+}
+
+// paramEncryption is the result of sp_describe_parameter_encryption
+// for one parameter.
+type paramEncryption struct {
+	cek            *cekEntry
+	algorithm      byte
+	encryptionType byte
+	normVersion    byte
+}
+
+// describeParameterEncryption asks the server which parameters of a
+// statement have to be encrypted, results are keyed by parameter name.
+func (s *Stmt) describeParameterEncryption(ctx context.Context, sess *tdsSession, query string, decls string) (map[string]*paramEncryption, error) {
+	if res, ok := s.paramEncryption[decls]; ok {
+		return res, nil
+	}
+	headers := []headerStruct{
+		{hdrtype: dataStmHdrTransDescr,
+			data: transDescrHdr{s.c.sess.tranid, 1}.pack()},
+	}
+	proc := procId{name: "sp_describe_parameter_encryption"}
+	params := []param{makeStrParam(query), makeStrParam(decls)}
+	reset := s.c.resetSession
+	s.c.resetSession = false
+	if err := sendRpc(sess.buf, headers, proc, 0, params, reset); err != nil {
+		s.c.connectionGood = false
+		return nil, fmt.Errorf("failed to send RPC: %v", err)
+	}
+
+	reader := startReading(sess, ctx, outputs{})
+	var (
+		resultSet int
+		ceks      = map[int64]*cekEntry{}
+		res       = map[string]*paramEncryption{}
+		parseErr  error
+	)
+	for {
+		tok, err := reader.nextToken()
+		if err != nil {
+			return nil, s.c.checkBadConn(ctx, err, false)
+		}
+		if tok == nil {
+			break
+		}
+		switch token := tok.(type) {
+		case []columnStruct:
+			resultSet++
+			if resultSet == 1 && len(token) < describeParameterEncryptionCekColumns ||
+				resultSet == 2 && len(token) < describeParameterEncryptionParamsColumns {
+				parseErr = errors.New("mssql: unexpected result of sp_describe_parameter_encryption")
+			}
+		case []interface{}:
+			if parseErr != nil {
+				continue
+			}
+			switch resultSet {
+			case 1:
+				parseErr = parseDescribeCekRow(token, ceks)
+			case 2:
+				parseErr = parseDescribeParamRow(token, ceks, res)
+			}
+		case doneStruct:
+			if token.isError() {
+				return nil, s.c.checkBadConn(ctx, token.getError(), false)
+			}
+		}
+	}
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	if s.paramEncryption == nil {
+		s.paramEncryption = map[string]map[string]*paramEncryption{}
+	}
+	s.paramEncryption[decls] = res
+	return res, nil
+}
+
+// encryptProcParams encrypts the parameters of a stored procedure call.
+// The call is described as an EXEC statement, which requires all
+// parameters to be named.
+func (s *Stmt) encryptProcParams(ctx context.Context, sess *tdsSession, args []namedValue, params []param, decls []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	query := make([]string, len(args))
+	for i, a := range args {
+		if len(a.Name) == 0 {
+			// positional parameters can't be matched to the description
+			return nil
+		}
+		query[i] = "@" + a.Name + "=@" + a.Name
+		if isOutputValue(a.Value) {
+			query[i] += " OUTPUT"
+		}
+	}
+	enc, err := s.describeParameterEncryption(ctx, sess, "EXEC "+s.query+" "+strings.Join(query, ","), strings.Join(decls, ","))
+	if err != nil {
+		return err
+	}
+	if err = encryptParams(params, enc); err != nil {
+		return err
+	}
+	s.c.outs.paramEncryption = enc
+	return nil
+}
+
+// column_encryption_key_ordinal, database_id, column_encryption_key_id,
+// column_encryption_key_version, column_encryption_key_metadata_version,
+// column_encryption_key_encrypted_value, column_master_key_store_provider_name,
+// column_master_key_path, column_encryption_key_encryption_algorithm_name
+func parseDescribeCekRow(row []interface{}, ceks map[int64]*cekEntry) error {
+	ordinal, ok1 := row[0].(int64)
+	dbID, ok2 := row[1].(int64)
+	cekID, ok3 := row[2].(int64)
+	cekVersion, ok4 := row[3].(int64)
+	mdVersion, ok5 := row[4].([]byte)
+	encryptedKey, ok6 := row[5].([]byte)
+	keyStoreName, ok7 := row[6].(string)
+	keyPath, ok8 := row[7].(string)
+	algorithm, ok9 := row[8].(string)
+	if !(ok1 && ok2 && ok3 && ok4 && ok5 && ok6 && ok7 && ok8 && ok9) {
+		return errors.New("mssql: unexpected column encryption key row of sp_describe_parameter_encryption")
+	}
+	cek, ok := ceks[ordinal]
+	if !ok {
+		cek = &cekEntry{
+			databaseID: uint32(dbID),
+			cekID:      uint32(cekID),
+			cekVersion: uint32(cekVersion),
+		}
+		copy(cek.cekMDVersion[:], mdVersion)
+		ceks[ordinal] = cek
+	}
+	cek.values = append(cek.values, encryptedKeyValue{
+		encryptedKey: encryptedKey,
+		keyStoreName: keyStoreName,
+		keyPath:      keyPath,
+		algorithm:    algorithm,
+	})
+	return nil
+}
+
+// parameter_ordinal, parameter_name, column_encryption_algorithm,
+// column_encryption_type, column_encryption_key_ordinal,
+// column_encryption_normalization_rule_version
+func parseDescribeParamRow(row []interface{}, ceks map[int64]*cekEntry, res map[string]*paramEncryption) error {
+	name, ok1 := row[1].(string)
+	algorithm, ok2 := row[2].(int64)
+	encryptionType, ok3 := row[3].(int64)
+	if !(ok1 && ok2 && ok3) {
+		return errors.New("mssql: unexpected parameter row of sp_describe_parameter_encryption")
+	}
+	if encryptionType == encryptionPlaintext {
+		return nil
+	}
+	ordinal, ok1 := row[4].(int64)
+	normVersion, ok2 := row[5].(int64)
+	cek, ok3 := ceks[ordinal]
+	if !(ok1 && ok2 && ok3) {
+		return fmt.Errorf("mssql: no column encryption key for parameter %s", name)
+	}
+	res[name] = &paramEncryption{
+		cek:            cek,
+		algorithm:      byte(algorithm),
+		encryptionType: byte(encryptionType),
+		normVersion:    byte(normVersion),
+	}
+	return nil
+}
+
+// encryptParams encrypts the parameters sp_describe_parameter_encryption
+// reported as encrypted.
+func encryptParams(params []param, enc map[string]*paramEncryption) error {
+	for i := range params {
+		p := &params[i]
+		pe, ok := enc[p.Name]
+		if !ok {
+			continue
+		}
+		if p.reader != nil {
+			return fmt.Errorf("mssql: streamed parameter %s can't be encrypted", p.Name)
+		}
+		cm := &cryptoMetadata{
+			cek:            pe.cek,
+			algorithm:      pe.algorithm,
+			encryptionType: pe.encryptionType,
+			normVersion:    pe.normVersion,
+		}
+		alg, err := cm.cipher()
+		if err != nil {
+			return err
+		}
+		plain, err := normalizeParam(p)
+		if err != nil {
+			return err
+		}
+		var cell []byte
+		if plain != nil {
+			if cell, err = alg.encrypt(plain, pe.encryptionType); err != nil {
+				return err
+			}
+		}
+		cm.cipherTi = typeInfo{TypeId: typeBigVarBin, Size: len(cell)}
+		if len(cell) > 8000 {
+			// varbinary(max)
+			cm.cipherTi.Size = 0
+		}
+		p.cipher = cm
+		p.cipherValue = cell
+		p.Flags |= fEncrypted
+	}
+	return nil
+}
+
+// writeEncryptedParam writes the encrypted value of a parameter followed
+// by ParamCipherInfo, which describes the plain value.
+func writeEncryptedParam(buf *tdsBuffer, p *param) (err error) {
+	ti := p.cipher.cipherTi
+	if err = writeTypeInfo(buf, &ti); err != nil {
+		return
+	}
+	if err = ti.Writer(buf, ti, p.cipherValue); err != nil {
+		return
+	}
+	plainTi := p.ti
+	if err = writeTypeInfo(buf, &plainTi); err != nil {
+		return
+	}
+	cm := p.cipher
+	info := []byte{cm.algorithm}
+	if cm.algorithm == cipherAlgorithmCustom {
+		info = append(info, byte(len(str2ucs2(cm.algorithmName))/2))
+		info = append(info, str2ucs2(cm.algorithmName)...)
+	}
+	info = append(info, cm.encryptionType)
+	var ek [20]byte
+	binary.LittleEndian.PutUint32(ek[0:], cm.cek.databaseID)
+	binary.LittleEndian.PutUint32(ek[4:], cm.cek.cekID)
+	binary.LittleEndian.PutUint32(ek[8:], cm.cek.cekVersion)
+	copy(ek[12:], cm.cek.cekMDVersion[:])
+	info = append(info, ek[:]...)
+	info = append(info, cm.normVersion)
+	_, err = buf.Write(info)
+	return
+}
@@ -0,0 +1,122 @@
+package mssql
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+)
+
+// AEAD_AES_256_CBC_HMAC_SHA256 is the cell encryption algorithm of
+// Always Encrypted. A cell holds a version byte, the HMAC-SHA256
+// authentication tag, the IV and the AES-256-CBC ciphertext.
+const (
+	aeadAlgorithmName = "AEAD_AES_256_CBC_HMAC_SHA256"
+	aeadVersion       = 0x01
+	aeadKeySize       = 32
+	aeadTagSize       = sha256.Size
+	aeadMinCellSize   = 1 + aeadTagSize + aes.BlockSize + aes.BlockSize
+)
+
+// encryption types of encrypted columns
+const (
+	encryptionPlaintext     = 0
+	encryptionDeterministic = 1
+	encryptionRandomized    = 2
+)
+
+var errAeadAuthentication = errors.New("mssql: authentication tag of encrypted value does not match")
+
+// aeadAes256CbcHmacSha256 holds the keys derived from a column encryption key.
+type aeadAes256CbcHmacSha256 struct {
+	encKey []byte
+	macKey []byte
+	ivKey  []byte
+}
+
+func newAeadAes256CbcHmacSha256(rootKey []byte) (*aeadAes256CbcHmacSha256, error) {
+	if len(rootKey) != aeadKeySize {
+		return nil, errors.New("mssql: column encryption key must be 32 bytes long")
+	}
+	const suffix = " key with encryption algorithm:" + aeadAlgorithmName + " and key length:256"
+	return &aeadAes256CbcHmacSha256{
+		encKey: hmacSha256(rootKey, str2ucs2("Microsoft SQL Server cell encryption"+suffix)),
+		macKey: hmacSha256(rootKey, str2ucs2("Microsoft SQL Server cell MAC"+suffix)),
+		ivKey:  hmacSha256(rootKey, str2ucs2("Microsoft SQL Server cell IV"+suffix)),
+	}, nil
+}
+
+func hmacSha256(key []byte, data ...[]byte) []byte {
+	h := hmac.New(sha256.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func (a *aeadAes256CbcHmacSha256) tag(iv, ciphertext []byte) []byte {
+	return hmacSha256(a.macKey, []byte{aeadVersion}, iv, ciphertext, []byte{1})
+}
+
+// encrypt encrypts plaintext. Deterministic encryption derives the IV from
+// the plaintext, so equal values give equal cells.
+func (a *aeadAes256CbcHmacSha256) encrypt(plaintext []byte, encryptionType byte) ([]byte, error) {
+	var iv []byte
+	switch encryptionType {
+	case encryptionDeterministic:
+		iv = hmacSha256(a.ivKey, plaintext)[:aes.BlockSize]
+	case encryptionRandomized:
+		iv = make([]byte, aes.BlockSize)
+		if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("mssql: invalid column encryption type")
+	}
+	block, err := aes.NewCipher(a.encKey)
+	if err != nil {
+		return nil, err
+	}
+	// PKCS #7 padding
+	pad := aes.BlockSize - len(plaintext)%aes.BlockSize
+	ciphertext := make([]byte, len(plaintext)+pad)
+	copy(ciphertext, plaintext)
+	copy(ciphertext[len(plaintext):], bytes.Repeat([]byte{byte(pad)}, pad))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, ciphertext)
+
+	res := make([]byte, 0, 1+aeadTagSize+len(iv)+len(ciphertext))
+	res = append(res, aeadVersion)
+	res = append(res, a.tag(iv, ciphertext)...)
+	res = append(res, iv...)
+	return append(res, ciphertext...), nil
+}
+
+func (a *aeadAes256CbcHmacSha256) decrypt(cell []byte) ([]byte, error) {
+	if len(cell) < aeadMinCellSize || (len(cell)-1-aeadTagSize)%aes.BlockSize != 0 {
+		return nil, errors.New("mssql: invalid length of encrypted value")
+	}
+	if cell[0] != aeadVersion {
+		return nil, errors.New("mssql: invalid version of encrypted value")
+	}
+	tag := cell[1 : 1+aeadTagSize]
+	iv := cell[1+aeadTagSize : 1+aeadTagSize+aes.BlockSize]
+	ciphertext := cell[1+aeadTagSize+aes.BlockSize:]
+	if !hmac.Equal(tag, a.tag(iv, ciphertext)) {
+		return nil, errAeadAuthentication
+	}
+	block, err := aes.NewCipher(a.encKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	pad := int(plaintext[len(plaintext)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return nil, errors.New("mssql: invalid padding of encrypted value")
+	}
+	return plaintext[:len(plaintext)-pad], nil
+}
@@ -0,0 +1,257 @@
+package mssql
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/binary"
+	"testing"
+)
+
+// testKeyStoreProvider returns encrypted keys unchanged.
+type testKeyStoreProvider struct{}
+
+func (testKeyStoreProvider) DecryptColumnEncryptionKey(masterKeyPath string, encryptionAlgorithm string, encryptedKey []byte) ([]byte, error) {
+	return encryptedKey, nil
+}
+
+const testKeyStoreProviderName = "TEST_KEY_STORE"
+
+var testColumnEncryptionKey = bytes.Repeat([]byte{7}, 32)
+
+func TestAeadAes256CbcHmacSha256(t *testing.T) {
+	alg, err := newAeadAes256CbcHmacSha256(testColumnEncryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := []byte("some plain text value")
+	c1, err := alg.encrypt(plain, encryptionDeterministic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := alg.encrypt(plain, encryptionDeterministic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(c1, c2) {
+		t.Error("deterministic encryption must give equal cells")
+	}
+	r1, err := alg.encrypt(plain, encryptionRandomized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := alg.encrypt(plain, encryptionRandomized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(r1, r2) {
+		t.Error("randomized encryption must give different cells")
+	}
+	for _, cell := range [][]byte{c1, r1} {
+		res, err := alg.decrypt(cell)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(res, plain) {
+			t.Errorf("unexpected plain text %q", res)
+		}
+	}
+
+	c1[len(c1)-1] ^= 1
+	if _, err = alg.decrypt(c1); err != errAeadAuthentication {
+		t.Errorf("expected authentication error, got %v", err)
+	}
+	if _, err = alg.decrypt(c1[:10]); err == nil {
+		t.Error("expected error for short cell")
+	}
+	if _, err = newAeadAes256CbcHmacSha256([]byte{1}); err == nil {
+		t.Error("expected error for short key")
+	}
+}
+
+func TestNormalizeParam(t *testing.T) {
+	values := []interface{}{int64(-5), true, "text", []byte{1, 2}, 1.5}
+	s := &Stmt{c: &Conn{sess: &tdsSession{}}}
+	for _, v := range values {
+		p, err := s.makeParam(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := normalizeParam(&p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := decodeNormalized(&p.ti, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v == true {
+			if res != true {
+				t.Errorf("unexpected value %v", res)
+			}
+			continue
+		}
+		if b, ok := v.([]byte); ok {
+			if !bytes.Equal(res.([]byte), b) {
+				t.Errorf("unexpected value %v", res)
+			}
+			continue
+		}
+		if res != v {
+			t.Errorf("expected %v, got %v (%T)", v, res, res)
+		}
+	}
+	p := param{ti: typeInfo{TypeId: typeIntN, Size: 8}}
+	if buf, err := normalizeParam(&p); err != nil || buf != nil {
+		t.Errorf("NULL must normalize to nil, got % x, %v", buf, err)
+	}
+}
+
+func testCekEntry() cekEntry {
+	return cekEntry{
+		databaseID:   5,
+		cekID:        1,
+		cekVersion:   1,
+		cekMDVersion: [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		values: []encryptedKeyValue{{
+			encryptedKey: testColumnEncryptionKey,
+			keyStoreName: testKeyStoreProviderName,
+			keyPath:      "key",
+			algorithm:    "RSA_OAEP",
+		}},
+	}
+}
+
+func TestParseColMetadataEncrypted(t *testing.T) {
+	RegisterKeyStoreProvider(testKeyStoreProviderName, testKeyStoreProvider{})
+	alg, err := newAeadAes256CbcHmacSha256(testColumnEncryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := make([]byte, 8)
+	binary.LittleEndian.PutUint64(plain, 42)
+	cell, err := alg.encrypt(plain, encryptionDeterministic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b []byte
+	u16 := func(v uint16) { b = append(b, byte(v), byte(v>>8)) }
+	u32 := func(v uint32) { b = append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24)) }
+	u16(1) // column count
+	// CEK table
+	u16(1)
+	u32(5)
+	u32(1)
+	u32(1)
+	b = append(b, 1, 2, 3, 4, 5, 6, 7, 8)
+	b = append(b, 1) // value count
+	u16(uint16(len(testColumnEncryptionKey)))
+	b = append(b, testColumnEncryptionKey...)
+	b = appendBVarChar(b, testKeyStoreProviderName)
+	u16(3)
+	b = append(b, str2ucs2("key")...)
+	b = appendBVarChar(b, "RSA_OAEP")
+	// column
+	u32(0)                                  // UserType
+	u16(colFlagNullable | colFlagEncrypted) // Flags
+	b = append(b, typeBigVarBin)
+	u16(8000)
+	u16(0) // CEK ordinal
+	u32(0) // UserType
+	b = append(b, typeIntN, 8)
+	b = append(b, cipherAlgorithmAeadAes256CbcHmacSha256, encryptionDeterministic, cipherNormalizationVersion)
+	b = appendBVarChar(b, "c")
+	// row
+	u16(uint16(len(cell)))
+	b = append(b, cell...)
+
+	r := &tdsBuffer{
+		packetSize: len(b),
+		rbuf:       b,
+		rsize:      len(b),
+	}
+	cols := parseColMetadata72(r, &tdsSession{alwaysEncrypted: true})
+	if len(cols) != 1 || cols[0].ColName != "c" || cols[0].cryptoMeta == nil {
+		t.Fatalf("unexpected columns %+v", cols)
+	}
+	if cols[0].ti.TypeId != typeIntN {
+		t.Errorf("column must have the plain type, got %#x", cols[0].ti.TypeId)
+	}
+	row := make([]interface{}, 1)
+	parseRow(r, cols, row)
+	dest := []driver.Value{row[0]}
+	if err = decryptRow(cols, dest); err != nil {
+		t.Fatal(err)
+	}
+	if dest[0] != int64(42) {
+		t.Errorf("unexpected value %v", dest[0])
+	}
+}
+
+func TestColumnEncryptionFeatureExt(t *testing.T) {
+	fe := &featureExtColumnEncryption{}
+	if fe.featureID() != featExtCOLUMNENCRYPTION {
+		t.Fatalf("unexpected feature id %d", fe.featureID())
+	}
+	if b := fe.toBytes(); !bytes.Equal(b, []byte{columnEncryptionVersion}) {
+		t.Errorf("unexpected feature data % x", b)
+	}
+}
+
+func TestEncryptParams(t *testing.T) {
+	RegisterKeyStoreProvider(testKeyStoreProviderName, testKeyStoreProvider{})
+	cek := testCekEntry()
+	enc := map[string]*paramEncryption{
+		"@p1": {
+			cek:            &cek,
+			algorithm:      cipherAlgorithmAeadAes256CbcHmacSha256,
+			encryptionType: encryptionDeterministic,
+			normVersion:    cipherNormalizationVersion,
+		},
+	}
+	s := &Stmt{c: &Conn{sess: &tdsSession{}}}
+	params, _, err := s.makeRPCParams([]namedValue{{Ordinal: 1, Value: int64(1)}, {Ordinal: 2, Value: int64(2)}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = encryptParams(params[2:], enc); err != nil {
+		t.Fatal(err)
+	}
+	p := params[2]
+	if p.cipher == nil || p.Flags&fEncrypted == 0 || params[3].cipher != nil {
+		t.Fatalf("only @p1 must be encrypted")
+	}
+
+	out := &bytes.Buffer{}
+	buf := newTdsBuffer(defaultPacketSize, closableBuffer{out})
+	buf.BeginPacket(packRPCRequest, false)
+	if err = writeEncryptedParam(buf, &p); err != nil {
+		t.Fatal(err)
+	}
+	if err = buf.FinishPacket(); err != nil {
+		t.Fatal(err)
+	}
+	b := out.Bytes()[8:]
+	cellLen := len(p.cipherValue)
+	expected := []byte{typeBigVarBin, byte(cellLen), byte(cellLen >> 8), byte(cellLen), byte(cellLen >> 8)}
+	expected = append(expected, p.cipherValue...)
+	expected = append(expected, typeIntN, 8)
+	expected = append(expected, cipherAlgorithmAeadAes256CbcHmacSha256, encryptionDeterministic)
+	expected = append(expected, 5, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8)
+	expected = append(expected, cipherNormalizationVersion)
+	if !bytes.Equal(b, expected) {
+		t.Errorf("unexpected parameter\n got % x\nwant % x", b, expected)
+	}
+
+	alg, err := p.cipher.cipher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := alg.decrypt(p.cipherValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := decodeNormalized(&p.ti, plain); err != nil || v != int64(1) {
+		t.Errorf("unexpected encrypted value %v, %v", v, err)
+	}
+}
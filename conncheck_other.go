@@ -0,0 +1,10 @@
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package mssql
+
+import "net"
+
+// connCheck can't detect closed connections on this platform.
+func connCheck(conn net.Conn) error {
+	return nil
+}
@@ -0,0 +1,411 @@
+// +build go1.9
+
+package mssql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/denisenkom/go-mssqldb/msdsn"
+)
+
+// scroll options of sp_cursoropen
+const (
+	cursorScrollKeyset            = 0x0001
+	cursorScrollDynamic           = 0x0002
+	cursorScrollForwardOnly       = 0x0004
+	cursorScrollStatic            = 0x0008
+	cursorScrollParameterizedStmt = 0x1000
+)
+
+// concurrency option of sp_cursoropen, cursors are opened read only
+const cursorConcurrencyReadOnly = 0x0001
+
+// fetch types of sp_cursorfetch
+const (
+	cursorFetchFirst    = 0x0001
+	cursorFetchNext     = 0x0002
+	cursorFetchPrev     = 0x0004
+	cursorFetchLast     = 0x0008
+	cursorFetchAbsolute = 0x0010
+	cursorFetchRelative = 0x0020
+)
+
+// sp_cursorfetch adds the ROWSTAT column with the status of each row
+const (
+	cursorRowStatColumn = "ROWSTAT"
+	cursorRowMissing    = 0x0002
+)
+
+const defaultCursorFetchSize = 100
+
+var (
+	errCursorClosed = errors.New("mssql: cursor is closed")
+	errCursorLost   = errors.New("mssql: cursor was lost when the session was recovered or reset")
+)
+
+// CursorType is the type of a server cursor.
+type CursorType int
+
+const (
+	// CursorForwardOnly can only be fetched from with FetchNext.
+	CursorForwardOnly CursorType = iota
+	// CursorStatic works on a copy of the result made in tempdb when the
+	// cursor is opened.
+	CursorStatic
+	// CursorKeyset keeps the keys of the result rows, it sees changes of
+	// the rows but not inserted rows. Deleted rows are skipped by fetches.
+	CursorKeyset
+	// CursorDynamic sees all changes of the result.
+	CursorDynamic
+)
+
+func (t CursorType) scrollOpt() (int32, error) {
+	switch t {
+	case CursorForwardOnly:
+		return cursorScrollForwardOnly, nil
+	case CursorStatic:
+		return cursorScrollStatic, nil
+	case CursorKeyset:
+		return cursorScrollKeyset, nil
+	case CursorDynamic:
+		return cursorScrollDynamic, nil
+	}
+	return 0, fmt.Errorf("mssql: invalid cursor type %d", t)
+}
+
+func cursorTypeOf(scrollOpt int32) CursorType {
+	switch {
+	case scrollOpt&cursorScrollKeyset != 0:
+		return CursorKeyset
+	case scrollOpt&cursorScrollDynamic != 0:
+		return CursorDynamic
+	case scrollOpt&cursorScrollStatic != 0:
+		return CursorStatic
+	}
+	return CursorForwardOnly
+}
+
+// CursorOptions are the options of Conn.OpenCursor.
+type CursorOptions struct {
+	Type CursorType
+	// FetchSize is the number of rows a fetch returns, 100 when zero.
+	FetchSize int
+}
+
+// Cursor is a read only server cursor opened with sp_cursoropen. The
+// server keeps the result and the position of the cursor between fetches,
+// no response is left open on the connection.
+//
+// Each fetch reads a block of rows, they are then iterated with Next and
+// Scan.
+type Cursor struct {
+	c         *Conn
+	handle    int32
+	typ       CursorType
+	rowCount  int64
+	fetchSize int
+	cols      []columnStruct
+	rows      [][]interface{}
+	row       []interface{}
+	// sess is the session the cursor was opened on, epoch the
+	// connection's session epoch at the time
+	sess  *tdsSession
+	epoch int
+}
+
+// OpenCursor opens a server cursor for a query. Query parameters are
+// passed in args as @p1 to @pN, or by name with sql.Named.
+//
+// The server may open the cursor with another type than requested, e.g.
+// when a query can't be used with a keyset cursor, see Cursor.Type.
+//
+// The cursor belongs to the connection, use it with sql.Conn.Raw and
+// close it before the connection is returned to the pool.
+func (c *Conn) OpenCursor(ctx context.Context, query string, opts CursorOptions, args ...interface{}) (*Cursor, error) {
+	if !c.connectionGood {
+		return nil, driver.ErrBadConn
+	}
+	scrollOpt, err := opts.Type.scrollOpt()
+	if err != nil {
+		return nil, err
+	}
+	cur := &Cursor{c: c, fetchSize: opts.FetchSize}
+	if cur.fetchSize <= 0 {
+		cur.fetchSize = defaultCursorFetchSize
+	}
+	var argParams []param
+	var decls []string
+	if len(args) > 0 {
+		scrollOpt |= cursorScrollParameterizedStmt
+		if argParams, decls, err = c.makeCursorParams(args); err != nil {
+			return nil, err
+		}
+	}
+	params := []param{
+		makeIntParam(0, true),
+		makeStrParam(query),
+		makeIntParam(scrollOpt, true),
+		makeIntParam(cursorConcurrencyReadOnly, true),
+		makeIntParam(0, true),
+	}
+	if len(args) > 0 {
+		params = append(params, makeStrParam(strings.Join(decls, ",")))
+		params = append(params, argParams...)
+	}
+	if err = c.recoverIdleConn(ctx); err != nil {
+		return nil, c.checkBadConn(ctx, err, false)
+	}
+	if c.sess.logFlags&logSQL != 0 {
+		c.sess.logger.Log(ctx, msdsn.LogSQL, query)
+	}
+	var resScrollOpt, resConcurrency int32
+	outs := outputs{returnValues: []interface{}{&cur.handle, &resScrollOpt, &resConcurrency, &cur.rowCount}}
+	if cur.cols, _, err = c.cursorCall(ctx, sp_CursorOpen, params, outs); err != nil {
+		return nil, err
+	}
+	if cur.handle == 0 {
+		return nil, errors.New("mssql: server did not return a cursor")
+	}
+	cur.typ = cursorTypeOf(resScrollOpt)
+	cur.sess = c.sess
+	cur.epoch = c.sessionEpoch
+	return cur, nil
+}
+
+// makeCursorParams makes the parameters of a cursor query. They are sent
+// in the order of their declarations, without names.
+func (c *Conn) makeCursorParams(args []interface{}) ([]param, []string, error) {
+	s := &Stmt{c: c}
+	params := make([]param, len(args))
+	decls := make([]string, len(args))
+	for i, arg := range args {
+		name := fmt.Sprintf("@p%d", i+1)
+		if na, ok := arg.(sql.NamedArg); ok {
+			name = "@" + na.Name
+			arg = na.Value
+		}
+		v, err := convertInputParameter(arg)
+		if err != nil {
+			return nil, nil, err
+		}
+		if params[i], err = s.makeParam(v); err != nil {
+			return nil, nil, err
+		}
+		decls[i] = fmt.Sprintf("%s %s", name, makeDecl(params[i].ti))
+	}
+	return params, decls, nil
+}
+
+// cursorCall calls a cursor procedure, it returns the columns and rows
+// of the last result set of the response.
+func (c *Conn) cursorCall(ctx context.Context, proc procId, params []param, outs outputs) (cols []columnStruct, rows [][]interface{}, err error) {
+	if !c.connectionGood {
+		return nil, nil, driver.ErrBadConn
+	}
+	headers := []headerStruct{
+		{hdrtype: dataStmHdrTransDescr,
+			data: transDescrHdr{c.sess.tranid, 1}.pack()},
+	}
+	reset := c.resetSession
+	c.resetSession = false
+	if err = sendRpc(c.sess.buf, headers, proc, 0, params, reset); err != nil {
+		if c.sess.logFlags&logErrors != 0 {
+			c.sess.logger.Log(ctx, msdsn.LogErrors, fmt.Sprintf("Failed to send Rpc with %v", err))
+		}
+		c.connectionGood = false
+		return nil, nil, c.checkBadConn(ctx, fmt.Errorf("failed to send RPC: %v", err), false)
+	}
+	reader := startReading(c.sess, ctx, outs)
+	var firstError error
+	for {
+		tok, err := reader.nextToken()
+		if err != nil {
+			return nil, nil, c.checkBadConn(ctx, err, false)
+		}
+		if tok == nil {
+			break
+		}
+		switch token := tok.(type) {
+		case []columnStruct:
+			cols = token
+			rows = nil
+		case []interface{}:
+			rows = append(rows, token)
+		case doneStruct:
+			if token.isError() && firstError == nil {
+				firstError = token.getError()
+			}
+		}
+	}
+	if firstError != nil {
+		return nil, nil, c.checkBadConn(ctx, firstError, false)
+	}
+	return cols, rows, nil
+}
+
+// Type returns the type the cursor was opened with by the server.
+func (cur *Cursor) Type() CursorType {
+	return cur.typ
+}
+
+// RowCount returns the number of rows of the cursor, -1 if it isn't known,
+// e.g. for dynamic cursors.
+func (cur *Cursor) RowCount() int64 {
+	return cur.rowCount
+}
+
+// SetFetchSize sets the number of rows returned by the next fetches.
+func (cur *Cursor) SetFetchSize(n int) {
+	if n <= 0 {
+		n = defaultCursorFetchSize
+	}
+	cur.fetchSize = n
+}
+
+// Columns returns the column names.
+func (cur *Cursor) Columns() []string {
+	res := make([]string, len(cur.cols))
+	for i, col := range cur.cols {
+		res[i] = col.ColName
+	}
+	return res
+}
+
+// FetchNext fetches the rows following the current block, it returns the
+// number of rows fetched, 0 at the end of the cursor.
+func (cur *Cursor) FetchNext(ctx context.Context) (int, error) {
+	return cur.fetch(ctx, cursorFetchNext, 0)
+}
+
+// FetchPrior fetches the rows preceding the current block.
+func (cur *Cursor) FetchPrior(ctx context.Context) (int, error) {
+	return cur.fetch(ctx, cursorFetchPrev, 0)
+}
+
+// FetchFirst fetches the first rows of the cursor.
+func (cur *Cursor) FetchFirst(ctx context.Context) (int, error) {
+	return cur.fetch(ctx, cursorFetchFirst, 0)
+}
+
+// FetchLast fetches the last rows of the cursor.
+func (cur *Cursor) FetchLast(ctx context.Context) (int, error) {
+	return cur.fetch(ctx, cursorFetchLast, 0)
+}
+
+// FetchAbsolute fetches the rows starting at row n, counted from 1.
+// A negative n counts from the end of the cursor.
+func (cur *Cursor) FetchAbsolute(ctx context.Context, n int) (int, error) {
+	return cur.fetch(ctx, cursorFetchAbsolute, int32(n))
+}
+
+// FetchRelative fetches the rows starting n rows from the first row of
+// the current block.
+func (cur *Cursor) FetchRelative(ctx context.Context, n int) (int, error) {
+	return cur.fetch(ctx, cursorFetchRelative, int32(n))
+}
+
+// valid reports whether the cursor is open on the current session of the
+// connection. A session recovered after a lost connection or a reset
+// session has closed the cursors of the session before.
+func (cur *Cursor) valid() bool {
+	return cur.sess == cur.c.sess && cur.epoch == cur.c.sessionEpoch
+}
+
+func (cur *Cursor) fetch(ctx context.Context, fetchType int32, rowNum int32) (int, error) {
+	cur.rows = nil
+	cur.row = nil
+	if cur.c == nil {
+		return 0, errCursorClosed
+	}
+	if !cur.valid() {
+		return 0, errCursorLost
+	}
+	params := []param{
+		makeIntParam(cur.handle, false),
+		makeIntParam(fetchType, false),
+		makeIntParam(rowNum, false),
+		makeIntParam(int32(cur.fetchSize), false),
+	}
+	cols, rows, err := cur.c.cursorCall(ctx, sp_CursorFetch, params, outputs{})
+	if err != nil {
+		return 0, err
+	}
+	rowStat := len(cols) > 0 && cols[len(cols)-1].ColName == cursorRowStatColumn
+	if rowStat {
+		cols = cols[:len(cols)-1]
+	}
+	if cols != nil {
+		cur.cols = cols
+	}
+	for _, row := range rows {
+		if rowStat {
+			if st, ok := row[len(row)-1].(int64); ok && st&cursorRowMissing != 0 {
+				continue
+			}
+			row = row[:len(row)-1]
+		}
+		vals := make([]driver.Value, len(row))
+		for i := range row {
+			vals[i] = row[i]
+		}
+		if err = decryptRow(cur.cols, vals); err != nil {
+			return 0, err
+		}
+		for i := range row {
+			row[i] = vals[i]
+		}
+		cur.rows = append(cur.rows, row)
+	}
+	return len(cur.rows), nil
+}
+
+// Next moves to the next row of the fetched block.
+func (cur *Cursor) Next() bool {
+	if len(cur.rows) == 0 {
+		cur.row = nil
+		return false
+	}
+	cur.row = cur.rows[0]
+	cur.rows = cur.rows[1:]
+	return true
+}
+
+// Scan copies the columns of the current row into dest, the same way
+// sql.Rows.Scan does.
+func (cur *Cursor) Scan(dest ...interface{}) error {
+	if cur.row == nil {
+		return errors.New("mssql: Scan called without calling Next")
+	}
+	if len(dest) != len(cur.row) {
+		return fmt.Errorf("mssql: expected %d destination arguments in Scan, not %d", len(cur.row), len(dest))
+	}
+	for i := range dest {
+		if err := convertAssign(dest[i], cur.row[i]); err != nil {
+			return fmt.Errorf("mssql: Scan error on column %s: %v", cur.cols[i].ColName, err)
+		}
+	}
+	return nil
+}
+
+// Close closes the cursor on the server.
+func (cur *Cursor) Close(ctx context.Context) error {
+	if cur.c == nil {
+		return nil
+	}
+	valid := cur.valid()
+	c := cur.c
+	cur.c = nil
+	cur.rows = nil
+	cur.row = nil
+	if !valid {
+		// the handle belongs to a session that is gone
+		return nil
+	}
+	_, _, err := c.cursorCall(ctx, sp_CursorClose, []param{makeIntParam(cur.handle, false)}, outputs{})
+	return err
+}
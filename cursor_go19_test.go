@@ -0,0 +1,118 @@
+// +build go1.9
+
+package mssql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"testing"
+)
+
+func TestCursor(t *testing.T) {
+	var packets bytes.Buffer
+	var r testRPCResponse
+	// sp_cursoropen, a static cursor was opened instead of a keyset cursor
+	r.columns("id", "value")
+	r.returnValue(180150003)
+	r.returnValue(cursorScrollStatic | cursorScrollParameterizedStmt)
+	r.returnValue(cursorConcurrencyReadOnly)
+	r.returnValue(3)
+	r.done(&packets)
+	// sp_cursorfetch
+	r.columns("id", "value", "ROWSTAT")
+	r.row(1, 10, 1)
+	r.row(2, 20, cursorRowMissing)
+	r.row(3, 30, 1)
+	r.done(&packets)
+	// sp_cursorfetch at the end of the cursor
+	r.columns("id", "value", "ROWSTAT")
+	r.done(&packets)
+	// sp_cursorclose
+	r.done(&packets)
+
+	c := &Conn{
+		sess:           &tdsSession{buf: newTdsBuffer(defaultPacketSize, closableBuffer{&packets})},
+		connectionGood: true,
+	}
+	ctx := context.Background()
+	cur, err := c.OpenCursor(ctx, "select id, value from t where id > @min", CursorOptions{Type: CursorKeyset, FetchSize: 2}, sql.Named("min", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur.handle != 180150003 || cur.Type() != CursorStatic || cur.RowCount() != 3 {
+		t.Errorf("unexpected cursor handle %d, type %d, row count %d", cur.handle, cur.Type(), cur.RowCount())
+	}
+
+	n, err := cur.FetchNext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 rows, the missing row skipped, got %d", n)
+	}
+	if cols := cur.Columns(); len(cols) != 2 || cols[0] != "id" || cols[1] != "value" {
+		t.Errorf("unexpected columns %v", cols)
+	}
+	var ids []int
+	for cur.Next() {
+		var id, value int
+		if err = cur.Scan(&id, &value); err != nil {
+			t.Fatal(err)
+		}
+		if value != id*10 {
+			t.Errorf("unexpected value %d of row %d", value, id)
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) != 2 || ids[0] != 1 || ids[1] != 3 {
+		t.Errorf("unexpected rows %v", ids)
+	}
+
+	if n, err = cur.FetchNext(ctx); err != nil || n != 0 {
+		t.Errorf("expected the end of the cursor, got %d rows, %v", n, err)
+	}
+	if cur.Next() {
+		t.Error("Next must return false at the end of the cursor")
+	}
+	if err = cur.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cur.FetchNext(ctx); err != errCursorClosed {
+		t.Errorf("expected errCursorClosed, got %v", err)
+	}
+}
+
+func TestCursorInvalidType(t *testing.T) {
+	c := &Conn{sess: &tdsSession{}, connectionGood: true}
+	if _, err := c.OpenCursor(context.Background(), "select 1", CursorOptions{Type: CursorType(10)}); err == nil {
+		t.Error("expected an error for an invalid cursor type")
+	}
+}
+
+func TestCursorLostWithSession(t *testing.T) {
+	transport := &testRPCTransport{}
+	old := &tdsSession{buf: newTdsBuffer(defaultPacketSize, transport)}
+	c := &Conn{sess: old, connectionGood: true}
+	cur := &Cursor{c: c, handle: 1, fetchSize: defaultCursorFetchSize, sess: old}
+
+	// a recovered session replaces the session of the connection
+	c.sess = &tdsSession{buf: newTdsBuffer(defaultPacketSize, transport)}
+	ctx := context.Background()
+	if _, err := cur.FetchNext(ctx); err != errCursorLost {
+		t.Errorf("expected errCursorLost, got %v", err)
+	}
+	if err := cur.Close(ctx); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if n := len(transport.rpcRequests()); n != 0 {
+		t.Errorf("expected no requests for a lost cursor, got %d", n)
+	}
+
+	// a reset session closes the cursors of the session as well
+	cur = &Cursor{c: c, handle: 2, fetchSize: defaultCursorFetchSize, sess: c.sess}
+	c.sessionEpoch++
+	if _, err := cur.FetchNext(ctx); err != errCursorLost {
+		t.Errorf("expected errCursorLost after a reset, got %v", err)
+	}
+}
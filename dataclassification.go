@@ -0,0 +1,141 @@
+package mssql
+
+// Data classification returns the sensitivity labels and information types
+// assigned to the columns of a result set with ADD SENSITIVITY CLASSIFICATION.
+
+// highest DATACLASSIFICATION feature extension version the driver
+// understands, version 2 adds sensitivity ranks
+const dataClassificationVersion = 0x02
+
+// no label or information type
+const sensitivityIndexNone = 0xffff
+
+// SensitivityRank is the rank of a sensitivity classification.
+type SensitivityRank int
+
+const (
+	SensitivityRankNotDefined SensitivityRank = -1
+	SensitivityRankNone       SensitivityRank = 0
+	SensitivityRankLow        SensitivityRank = 10
+	SensitivityRankMedium     SensitivityRank = 20
+	SensitivityRankHigh       SensitivityRank = 30
+	SensitivityRankCritical   SensitivityRank = 40
+)
+
+// SensitivityLabel is a sensitivity label, e.g. Confidential.
+type SensitivityLabel struct {
+	Name string
+	ID   string
+}
+
+// InformationType is the type of information held by a column, e.g. Financial.
+type InformationType struct {
+	Name string
+	ID   string
+}
+
+// SensitivityProperty is a classification of a column. Label or
+// InformationType may be nil when only one of them is assigned.
+type SensitivityProperty struct {
+	Label           *SensitivityLabel
+	InformationType *InformationType
+	Rank            SensitivityRank
+}
+
+// SensitivityClassification is the classification of a result set.
+type SensitivityClassification struct {
+	// Rank is the highest rank of the result set columns,
+	// SensitivityRankNotDefined for servers that don't report ranks.
+	Rank SensitivityRank
+	// Columns holds the classifications of each column
+	Columns [][]SensitivityProperty
+}
+
+type featureExtDataClassification struct{}
+
+func (e *featureExtDataClassification) featureID() byte {
+	return featExtDATACLASSIFICATION
+}
+
+func (e *featureExtDataClassification) toBytes() []byte {
+	return []byte{dataClassificationVersion}
+}
+
+// DATACLASSIFICATION token
+func parseDataClassification(r *tdsBuffer, version byte) *SensitivityClassification {
+	labels := make([]SensitivityLabel, r.uint16())
+	for i := range labels {
+		labels[i].Name = r.UsVarChar()
+		labels[i].ID = r.UsVarChar()
+	}
+	types := make([]InformationType, r.uint16())
+	for i := range types {
+		types[i].Name = r.UsVarChar()
+		types[i].ID = r.UsVarChar()
+	}
+	res := &SensitivityClassification{Rank: SensitivityRankNotDefined}
+	if version >= 2 {
+		res.Rank = SensitivityRank(r.int32())
+	}
+	res.Columns = make([][]SensitivityProperty, r.uint16())
+	for i := range res.Columns {
+		props := make([]SensitivityProperty, r.uint16())
+		for j := range props {
+			p := &props[j]
+			if idx := int(r.uint16()); idx != sensitivityIndexNone {
+				if idx >= len(labels) {
+					badStreamPanicf("invalid sensitivity label index %d", idx)
+				}
+				p.Label = &labels[idx]
+			}
+			if idx := int(r.uint16()); idx != sensitivityIndexNone {
+				if idx >= len(types) {
+					badStreamPanicf("invalid information type index %d", idx)
+				}
+				p.InformationType = &types[idx]
+			}
+			p.Rank = SensitivityRankNotDefined
+			if version >= 2 {
+				p.Rank = SensitivityRank(r.int32())
+			}
+		}
+		res.Columns[i] = props
+	}
+	return res
+}
+
+// readDataClassification reads the DATACLASSIFICATION token that may
+// follow COLMETADATA and attaches it to the columns before they are
+// handed to the reader.
+func readDataClassification(sess *tdsSession, columns []columnStruct) {
+	if sess.dataClassificationVersion == 0 || len(columns) == 0 {
+		return
+	}
+	if token(sess.buf.byte()) != tokenDataClassification {
+		if err := sess.buf.UnreadByte(); err != nil {
+			badStreamPanic(err)
+		}
+		return
+	}
+	dc := parseDataClassification(sess.buf, sess.dataClassificationVersion)
+	if len(dc.Columns) != len(columns) {
+		badStreamPanicf("data classification for %d columns, result has %d", len(dc.Columns), len(columns))
+	}
+	for i := range columns {
+		columns[i].classification = dc
+	}
+}
+
+func columnSensitivity(cols []columnStruct, index int) []SensitivityProperty {
+	if cols[index].classification == nil {
+		return nil
+	}
+	return cols[index].classification.Columns[index]
+}
+
+func sensitivityClassification(cols []columnStruct) *SensitivityClassification {
+	if len(cols) == 0 {
+		return nil
+	}
+	return cols[0].classification
+}
@@ -0,0 +1,126 @@
+package mssql
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testDataClassificationToken(version byte) []byte {
+	var b []byte
+	u16 := func(v uint16) { b = append(b, byte(v), byte(v>>8)) }
+	u32 := func(v uint32) { b = append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24)) }
+	usVarChar := func(s string) {
+		u16(uint16(len(s)))
+		b = append(b, str2ucs2(s)...)
+	}
+	b = append(b, byte(tokenDataClassification))
+	u16(1)
+	usVarChar("Confidential")
+	usVarChar("l1")
+	u16(1)
+	usVarChar("Financial")
+	usVarChar("t1")
+	if version >= 2 {
+		u32(uint32(SensitivityRankHigh))
+	}
+	u16(2) // columns
+	u16(1)
+	u16(0)
+	u16(0)
+	if version >= 2 {
+		u32(uint32(SensitivityRankHigh))
+	}
+	u16(1)
+	u16(sensitivityIndexNone)
+	u16(0)
+	if version >= 2 {
+		u32(uint32(SensitivityRankLow))
+	}
+	return b
+}
+
+func TestParseDataClassification(t *testing.T) {
+	label := &SensitivityLabel{Name: "Confidential", ID: "l1"}
+	infoType := &InformationType{Name: "Financial", ID: "t1"}
+	for _, version := range []byte{1, 2} {
+		b := testDataClassificationToken(version)
+		r := &tdsBuffer{
+			packetSize: len(b),
+			rbuf:       b,
+			rpos:       1,
+			rsize:      len(b),
+		}
+		dc := parseDataClassification(r, version)
+		rank, colRank1, colRank2 := SensitivityRankNotDefined, SensitivityRankNotDefined, SensitivityRankNotDefined
+		if version >= 2 {
+			rank, colRank1, colRank2 = SensitivityRankHigh, SensitivityRankHigh, SensitivityRankLow
+		}
+		expected := &SensitivityClassification{
+			Rank: rank,
+			Columns: [][]SensitivityProperty{
+				{{Label: label, InformationType: infoType, Rank: colRank1}},
+				{{InformationType: infoType, Rank: colRank2}},
+			},
+		}
+		if !reflect.DeepEqual(dc, expected) {
+			t.Errorf("version %d: unexpected classification %+v", version, dc)
+		}
+		if r.rpos != r.rsize {
+			t.Errorf("version %d: %d bytes not read", version, r.rsize-r.rpos)
+		}
+	}
+}
+
+func TestReadDataClassification(t *testing.T) {
+	b := append(testDataClassificationToken(2), byte(tokenRow))
+	sess := &tdsSession{
+		buf: &tdsBuffer{
+			packetSize: len(b),
+			rbuf:       b,
+			rsize:      len(b),
+		},
+		dataClassificationVersion: 2,
+	}
+	cols := make([]columnStruct, 2)
+	readDataClassification(sess, cols)
+	r := &Rows{cols: cols}
+	if p := r.ColumnSensitivity(1); len(p) != 1 || p[0].Label != nil || p[0].InformationType.Name != "Financial" {
+		t.Errorf("unexpected column sensitivity %+v", p)
+	}
+	if dc := r.SensitivityClassification(); dc == nil || dc.Rank != SensitivityRankHigh {
+		t.Errorf("unexpected classification %+v", dc)
+	}
+
+	// any other token is left for the token loop
+	readDataClassification(sess, cols)
+	if token(sess.buf.byte()) != tokenRow {
+		t.Error("token following COLMETADATA must not be consumed")
+	}
+	r = &Rows{cols: make([]columnStruct, 1)}
+	if r.ColumnSensitivity(0) != nil || r.SensitivityClassification() != nil {
+		t.Error("unclassified result must have no classification")
+	}
+}
+
+func TestParseFeatureExtAckDataClassification(t *testing.T) {
+	for _, tst := range []struct {
+		data    []byte
+		version interface{}
+	}{
+		{[]byte{2, 1}, byte(2)},
+		{[]byte{1, 1}, byte(1)},
+		{[]byte{2, 0}, nil},
+	} {
+		b := append([]byte{featExtDATACLASSIFICATION, 2, 0, 0, 0}, tst.data...)
+		b = append(b, featExtTERMINATOR)
+		r := &tdsBuffer{
+			packetSize: len(b),
+			rbuf:       b,
+			rsize:      len(b),
+		}
+		ack := parseFeatureExtAck(r)
+		if ack[featExtDATACLASSIFICATION] != tst.version {
+			t.Errorf("% x: expected version %v, got %v", tst.data, tst.version, ack[featExtDATACLASSIFICATION])
+		}
+	}
+}
@@ -0,0 +1,34 @@
+// +build go1.9
+
+package mssql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// PropagateTransaction enlists the session of conn in the distributed
+// transaction of the DTC transaction cookie, as exported by the
+// transaction manager for this server. Statements on conn then run in the
+// distributed transaction until it ends or PropagateTransaction is called
+// with an empty cookie, which defects the session from it.
+func PropagateTransaction(ctx context.Context, conn *sql.Conn, cookie []byte) error {
+	if len(cookie) > 0xffff {
+		return errors.New("mssql: DTC transaction cookie is too long")
+	}
+	_, err := conn.ExecContext(ctx, "", tranRequest{rqType: tmPropagateXact, cookie: cookie})
+	return err
+}
+
+// PromoteTransaction promotes the local transaction tx to a distributed
+// transaction coordinated by MS DTC. It returns the DTC token of the
+// transaction, which other resource managers use to enlist in it.
+func PromoteTransaction(ctx context.Context, tx *sql.Tx) ([]byte, error) {
+	var token []byte
+	_, err := tx.ExecContext(ctx, "", tranRequest{rqType: tmPromoteXact, dtcToken: &token})
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
@@ -0,0 +1,39 @@
+// +build go1.9
+
+package mssql
+
+import (
+	"context"
+	"database/sql/driver"
+	"reflect"
+	"testing"
+)
+
+func TestTranRequestArgument(t *testing.T) {
+	transport := &testRPCTransport{}
+	c := &Conn{
+		sess:           &tdsSession{buf: newTdsBuffer(defaultPacketSize, transport), },
+		connectionGood: true,
+	}
+	req := tranRequest{rqType: tmPropagateXact, cookie: []byte{0xc0, 0x0c}}
+	nv := driver.NamedValue{Ordinal: 1, Value: req}
+	if err := c.CheckNamedValue(&nv); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(nv.Value, req) || !reflect.DeepEqual(c.outs, outputs{}) {
+		t.Fatalf("the request must stay an argument of the statement, got %#v", nv.Value)
+	}
+
+	// a statement after a request that was never executed, e.g. because
+	// the check of another argument failed, is sent as it is
+	ctx := context.Background()
+	var r testRPCResponse
+	r.done(&transport.responses)
+	s, _ := c.prepareContext(ctx, "select 1")
+	if _, err := s.exec(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if types := transport.requestTypes(); !reflect.DeepEqual(types, []packetType{packSQLBatch}) {
+		t.Errorf("expected an SQL batch, got %v", types)
+	}
+}
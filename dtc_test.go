@@ -0,0 +1,72 @@
+package mssql
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// envChange adds an ENVCHANGE token with the given type and values.
+func (r *testRPCResponse) envChange(envtype byte, values ...byte) {
+	r.b = append(r.b, byte(tokenEnvChange))
+	r.u16(uint16(1 + len(values)))
+	r.b = append(r.b, envtype)
+	r.b = append(r.b, values...)
+}
+
+func TestDistributedTransaction(t *testing.T) {
+	transport := &testRPCTransport{}
+	c := &Conn{
+		sess:           &tdsSession{buf: newTdsBuffer(defaultPacketSize, transport)},
+		connectionGood: true,
+	}
+	ctx := context.Background()
+	var r testRPCResponse
+	exec := func(req tranRequest) error {
+		s, _ := c.prepareContext(ctx, "")
+		_, err := s.exec(ctx, []namedValue{{Ordinal: 1, Value: req}})
+		return err
+	}
+
+	r.envChange(envEnlistDTC, 8, 1, 2, 3, 4, 5, 6, 7, 8, 0)
+	r.done(&transport.responses)
+	if err := exec(tranRequest{rqType: tmPropagateXact, cookie: []byte{0xc0, 0x0c}}); err != nil {
+		t.Fatal(err)
+	}
+	if c.sess.tranid != 0x0807060504030201 {
+		t.Errorf("expected the enlisted transaction, got %x", c.sess.tranid)
+	}
+	expected := []byte{byte(tmPropagateXact), 0, 2, 0, 0xc0, 0x0c}
+	if !bytes.HasSuffix(transport.requests.Bytes(), expected) {
+		t.Errorf("unexpected propagate request % x", transport.requests.Bytes())
+	}
+
+	// promoting returns the L_VARBYTE token of the environment change
+	r.envChange(envPromoteTran, 3, 0, 0, 0, 't', 'o', 'k', 0)
+	r.done(&transport.responses)
+	var token []byte
+	if err := exec(tranRequest{rqType: tmPromoteXact, dtcToken: &token}); err != nil {
+		t.Fatal(err)
+	}
+	if string(token) != "tok" {
+		t.Errorf("unexpected DTC token %q", token)
+	}
+
+	transport.requests.Reset()
+	r.envChange(envDefectTran, 8, 1, 2, 3, 4, 5, 6, 7, 8, 0)
+	r.done(&transport.responses)
+	if err := exec(tranRequest{rqType: tmPropagateXact}); err != nil {
+		t.Fatal(err)
+	}
+	if c.sess.tranid != 0 {
+		t.Errorf("expected no transaction after the defect, got %x", c.sess.tranid)
+	}
+	if !bytes.HasSuffix(transport.requests.Bytes(), []byte{byte(tmPropagateXact), 0, 0, 0}) {
+		t.Errorf("unexpected defect request % x", transport.requests.Bytes())
+	}
+
+	r.done(&transport.responses)
+	if err := exec(tranRequest{rqType: tmPromoteXact, dtcToken: &token}); err == nil {
+		t.Error("expected an error for a promote response without a DTC token")
+	}
+}
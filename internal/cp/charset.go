@@ -1,11 +1,24 @@
 package cp
 
+import (
+	"io"
+	"sync"
+	"unicode/utf8"
+)
+
 type charsetMap struct {
 	sb [256]rune    // single byte runes, -1 for a double byte character lead byte
 	db map[int]rune // double byte runes
+
+	encodeOnce sync.Once
+	enc        map[rune]int // codes of the runes, made when first encoding
 }
 
 func collation2charset(col Collation) *charsetMap {
+	if col.IsUTF8() {
+		// UTF-8 needs no conversion
+		return nil
+	}
 	// http://msdn.microsoft.com/en-us/library/ms144250.aspx
 	// http://msdn.microsoft.com/en-us/library/ms144250(v=sql.105).aspx
 	switch col.SortId {
@@ -91,17 +104,63 @@ func CharsetToUTF8(col Collation, s []byte) string {
 	if cm == nil {
 		return string(s)
 	}
-	buf := make([]rune, 0, len(s))
+	buf, _ := cm.decode(make([]rune, 0, len(s)), s, true)
+	return string(buf)
+}
+
+// UTF8ToCharset converts s to the charset of the collation. Characters
+// the charset doesn't have are replaced with '?', like the server does.
+func UTF8ToCharset(col Collation, s string) []byte {
+	cm := collation2charset(col)
+	if cm == nil {
+		return []byte(s)
+	}
+	return cm.encode(make([]byte, 0, len(s)), s)
+}
+
+// encode appends the codes of the runes of s to buf.
+func (cm *charsetMap) encode(buf []byte, s string) []byte {
+	cm.encodeOnce.Do(func() {
+		cm.enc = make(map[rune]int, 256+len(cm.db))
+		for code, ch := range cm.db {
+			cm.enc[ch] = code
+		}
+		for code := len(cm.sb) - 1; code >= 0; code-- {
+			if ch := cm.sb[code]; ch != -1 {
+				cm.enc[ch] = code
+			}
+		}
+	})
+	for _, ch := range s {
+		code, ok := cm.enc[ch]
+		switch {
+		case !ok || ch == utf8.RuneError:
+			buf = append(buf, '?')
+		case code > 0xff:
+			buf = append(buf, byte(code>>8), byte(code))
+		default:
+			buf = append(buf, byte(code))
+		}
+	}
+	return buf
+}
+
+// decode appends the runes of s to buf. Unless final is set, a lead byte
+// at the end of s is not decoded, n is the number of bytes decoded.
+func (cm *charsetMap) decode(buf []rune, s []byte, final bool) (_ []rune, n int) {
 	for i := 0; i < len(s); i++ {
 		ch := cm.sb[s[i]]
 		if ch == -1 {
 			if i+1 == len(s) {
+				if !final {
+					return buf, i
+				}
 				ch = 0xfffd
 			} else {
-				n := int(s[i+1]) + (int(s[i]) << 8)
+				code := int(s[i+1]) + (int(s[i]) << 8)
 				i++
 				var ok bool
-				ch, ok = cm.db[n]
+				ch, ok = cm.db[code]
 				if !ok {
 					ch = 0xfffd
 				}
@@ -109,5 +168,119 @@ func CharsetToUTF8(col Collation, s []byte) string {
 		}
 		buf = append(buf, ch)
 	}
+	return buf, len(s)
+}
+
+// codePage2charset returns the charset of a Windows code page, nil for
+// UTF-8.
+func codePage2charset(codePage int) (cm *charsetMap, ok bool) {
+	switch codePage {
+	case 437:
+		return cp437, true
+	case 850:
+		return cp850, true
+	case 874:
+		return cp874, true
+	case 932:
+		return cp932, true
+	case 936:
+		return cp936, true
+	case 949:
+		return cp949, true
+	case 950:
+		return cp950, true
+	case 1250:
+		return cp1250, true
+	case 1251:
+		return cp1251, true
+	case 1252:
+		return cp1252, true
+	case 1253:
+		return cp1253, true
+	case 1254:
+		return cp1254, true
+	case 1255:
+		return cp1255, true
+	case 1256:
+		return cp1256, true
+	case 1257:
+		return cp1257, true
+	case 1258:
+		return cp1258, true
+	case 65001:
+		return nil, true
+	}
+	return nil, false
+}
+
+// CodePageSupported reports whether text in the Windows code page can be
+// converted to UTF-8.
+func CodePageSupported(codePage int) bool {
+	_, ok := codePage2charset(codePage)
+	return ok
+}
+
+// CodePageToUTF8 converts s from the Windows code page to UTF-8. Bytes of
+// unsupported code pages are returned unchanged.
+func CodePageToUTF8(codePage int, s []byte) string {
+	cm, _ := codePage2charset(codePage)
+	if cm == nil {
+		return string(s)
+	}
+	buf, _ := cm.decode(make([]rune, 0, len(s)), s, true)
 	return string(buf)
 }
+
+type codePageReader struct {
+	r     io.Reader
+	cm    *charsetMap
+	in    []byte
+	n     int
+	out   []byte
+	err   error
+	runes []rune
+}
+
+// CodePageReader returns a reader converting the text read from r from the
+// Windows code page to UTF-8. Readers of UTF-8 and unsupported code pages
+// are returned unchanged.
+func CodePageReader(r io.Reader, codePage int) io.Reader {
+	cm, _ := codePage2charset(codePage)
+	if cm == nil {
+		return r
+	}
+	return &codePageReader{r: r, cm: cm, in: make([]byte, 4096)}
+}
+
+func (r *codePageReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		var m int
+		m, r.err = r.r.Read(r.in[r.n:])
+		r.n += m
+		var n int
+		r.runes, n = r.cm.decode(r.runes[:0], r.in[:r.n], r.err != nil)
+		// keep a lead byte split from its trail byte
+		r.n = copy(r.in, r.in[n:r.n])
+		r.out = []byte(string(r.runes))
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// codePages are the supported Windows code pages other than UTF-8.
+var codePages = []int{437, 850, 874, 932, 936, 949, 950, 1250, 1251, 1252, 1253, 1254, 1255, 1256, 1257, 1258}
+
+// CodePage returns the Windows code page of char data of the collation.
+func (c Collation) CodePage() int {
+	cm := collation2charset(c)
+	for _, codePage := range codePages {
+		if other, _ := codePage2charset(codePage); other == cm {
+			return codePage
+		}
+	}
+	return 65001
+}
@@ -0,0 +1,68 @@
+package cp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+)
+
+func TestCharsetToUTF8(t *testing.T) {
+	// SQL_Latin1_General_CP1_CI_AS
+	latin1 := Collation{LcidAndFlags: 0x00d00409, SortId: 52}
+	if s := CharsetToUTF8(latin1, []byte{0x61, 0xe9, 0x80}); s != "aé€" {
+		t.Errorf("unexpected cp1252 conversion %q", s)
+	}
+	// Latin1_General_100_CI_AS_SC_UTF8
+	utf8 := Collation{LcidAndFlags: 0x24d00409}
+	if !utf8.IsUTF8() || latin1.IsUTF8() {
+		t.Fatal("IsUTF8 reports wrong value")
+	}
+	if s := CharsetToUTF8(utf8, []byte("aé€😀")); s != "aé€😀" {
+		t.Errorf("unexpected UTF-8 conversion %q", s)
+	}
+	if latin1.CodePage() != 1252 || utf8.CodePage() != 65001 {
+		t.Errorf("unexpected code pages %d and %d", latin1.CodePage(), utf8.CodePage())
+	}
+}
+
+func TestUTF8ToCharset(t *testing.T) {
+	// SQL_Latin1_General_CP1_CI_AS
+	latin1 := Collation{LcidAndFlags: 0x00d00409, SortId: 52}
+	if b := UTF8ToCharset(latin1, "aé€😀"); !bytes.Equal(b, []byte{0x61, 0xe9, 0x80, '?'}) {
+		t.Errorf("unexpected cp1252 conversion % x", b)
+	}
+	// Japanese_CI_AS, double byte characters
+	japanese := Collation{LcidAndFlags: 0x00d00411}
+	if s := CharsetToUTF8(japanese, UTF8ToCharset(japanese, "aあ日本")); s != "aあ日本" {
+		t.Errorf("unexpected cp932 round trip %q", s)
+	}
+	utf8 := Collation{LcidAndFlags: 0x24d00409}
+	if b := UTF8ToCharset(utf8, "aé€😀"); string(b) != "aé€😀" {
+		t.Errorf("unexpected UTF-8 conversion %q", b)
+	}
+}
+
+func TestCodePageToUTF8(t *testing.T) {
+	if s := CodePageToUTF8(1252, []byte{0x61, 0xe9, 0x80}); s != "aé€" {
+		t.Errorf("unexpected cp1252 conversion %q", s)
+	}
+	if s := CodePageToUTF8(65001, []byte("aé€")); s != "aé€" {
+		t.Errorf("unexpected UTF-8 conversion %q", s)
+	}
+	if !CodePageSupported(932) || CodePageSupported(1) {
+		t.Error("CodePageSupported reports wrong value")
+	}
+}
+
+func TestCodePageReader(t *testing.T) {
+	// 日本 in cp932, read one byte at a time to split the characters
+	in := []byte{0x93, 0xfa, 0x96, 0x7b, 0x2c, 0x61}
+	b, err := ioutil.ReadAll(CodePageReader(iotest.OneByteReader(bytes.NewReader(in)), 932))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "日本,a" {
+		t.Errorf("unexpected cp932 conversion %q", b)
+	}
+}
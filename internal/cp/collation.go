@@ -2,6 +2,9 @@ package cp
 
 // http://msdn.microsoft.com/en-us/library/dd340437.aspx
 
+// fUTF8 marks collations storing char data as UTF-8 (code page 65001)
+const fUTF8 = 0x04000000
+
 type Collation struct {
 	LcidAndFlags uint32
 	SortId       uint8
@@ -18,3 +21,8 @@ func (c Collation) getFlags() uint32 {
 func (c Collation) getVersion() uint32 {
 	return (c.LcidAndFlags & 0xf0000000) >> 28
 }
+
+// IsUTF8 reports whether char data of the collation is encoded as UTF-8.
+func (c Collation) IsUTF8() bool {
+	return c.LcidAndFlags&fUTF8 != 0
+}
@@ -0,0 +1,205 @@
+package mssql
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+// KeyStoreProvider gives the driver access to column master keys (CMK) kept
+// in a key store. The driver asks it to decrypt the column encryption keys
+// (CEK) of Always Encrypted columns.
+//
+// Providers are looked up by the key store provider name the column master
+// key was created with, see RegisterKeyStoreProvider.
+type KeyStoreProvider interface {
+	// DecryptColumnEncryptionKey decrypts encryptedKey with the column
+	// master key at masterKeyPath and returns the plain column encryption key.
+	// encryptionAlgorithm names the algorithm the key was encrypted with,
+	// e.g. RSA_OAEP.
+	DecryptColumnEncryptionKey(masterKeyPath string, encryptionAlgorithm string, encryptedKey []byte) ([]byte, error)
+}
+
+var keyStoreProviders = struct {
+	sync.RWMutex
+	m map[string]KeyStoreProvider
+}{m: map[string]KeyStoreProvider{}}
+
+// RegisterKeyStoreProvider makes a key store provider available under name
+// for all connections using column encryption. A provider registered
+// earlier under the same name is replaced.
+func RegisterKeyStoreProvider(name string, provider KeyStoreProvider) {
+	if provider == nil {
+		panic("mssql: RegisterKeyStoreProvider provider is nil")
+	}
+	keyStoreProviders.Lock()
+	keyStoreProviders.m[name] = provider
+	keyStoreProviders.Unlock()
+	// keys decrypted by the previous provider must not be used anymore
+	columnEncryptionKeys.clear()
+}
+
+func getKeyStoreProvider(name string) (KeyStoreProvider, bool) {
+	keyStoreProviders.RLock()
+	defer keyStoreProviders.RUnlock()
+	p, ok := keyStoreProviders.m[name]
+	return p, ok
+}
+
+// CertificateStoreProviderName is the key store provider name of column
+// master keys kept in a certificate store.
+const CertificateStoreProviderName = "MSSQL_CERTIFICATE_STORE"
+
+const keyEncryptionAlgorithmRSAOAEP = "RSA_OAEP"
+
+// version of the encrypted column encryption key format
+const encryptedKeyVersion = 0x01
+
+// CertificateKeyStoreProvider is a KeyStoreProvider for column master keys
+// held by certificates the application loads from local PEM or PFX files.
+//
+// The keys are added under the master key path used in the database,
+// e.g. "CurrentUser/My/<thumbprint>" for keys created in the Windows
+// certificate store, so the provider can be registered under
+// CertificateStoreProviderName. Paths are case insensitive.
+type CertificateKeyStoreProvider struct {
+	mu   sync.RWMutex
+	keys map[string]*rsa.PrivateKey
+}
+
+// NewCertificateKeyStoreProvider returns a provider without keys.
+func NewCertificateKeyStoreProvider() *CertificateKeyStoreProvider {
+	return &CertificateKeyStoreProvider{keys: map[string]*rsa.PrivateKey{}}
+}
+
+// AddKey adds the private key of a column master key.
+func (p *CertificateKeyStoreProvider) AddKey(masterKeyPath string, key *rsa.PrivateKey) {
+	p.mu.Lock()
+	p.keys[strings.ToLower(masterKeyPath)] = key
+	p.mu.Unlock()
+}
+
+// LoadPEM adds the RSA private key found in PEM data, the data may also
+// hold the certificate. Keys are accepted in PKCS #1 and PKCS #8 form.
+func (p *CertificateKeyStoreProvider) LoadPEM(masterKeyPath string, data []byte) error {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return errors.New("mssql: no private key found in PEM data")
+		}
+		var key interface{}
+		var err error
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("mssql: cannot parse private key: %v", err)
+		}
+		return p.addKey(masterKeyPath, key)
+	}
+}
+
+// LoadPFX adds the private key of a PFX (PKCS #12) file.
+func (p *CertificateKeyStoreProvider) LoadPFX(masterKeyPath string, data []byte, password string) error {
+	key, _, err := pkcs12.Decode(data, password)
+	if err != nil {
+		return fmt.Errorf("mssql: cannot decode PFX data: %v", err)
+	}
+	return p.addKey(masterKeyPath, key)
+}
+
+func (p *CertificateKeyStoreProvider) addKey(masterKeyPath string, key interface{}) error {
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return fmt.Errorf("mssql: column master key must be an RSA key, got %T", key)
+	}
+	p.AddKey(masterKeyPath, rsaKey)
+	return nil
+}
+
+func (p *CertificateKeyStoreProvider) key(masterKeyPath string, encryptionAlgorithm string) (*rsa.PrivateKey, error) {
+	if !strings.EqualFold(encryptionAlgorithm, keyEncryptionAlgorithmRSAOAEP) {
+		return nil, fmt.Errorf("mssql: unsupported key encryption algorithm %q", encryptionAlgorithm)
+	}
+	p.mu.RLock()
+	key, ok := p.keys[strings.ToLower(masterKeyPath)]
+	p.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("mssql: no column master key for path %q", masterKeyPath)
+	}
+	return key, nil
+}
+
+// DecryptColumnEncryptionKey implements KeyStoreProvider.
+//
+// The encrypted key holds a version byte, the lengths of the key path and
+// the ciphertext, the lower case key path in UTF-16, the RSA-OAEP
+// ciphertext and a signature of all of the above.
+func (p *CertificateKeyStoreProvider) DecryptColumnEncryptionKey(masterKeyPath string, encryptionAlgorithm string, encryptedKey []byte) ([]byte, error) {
+	key, err := p.key(masterKeyPath, encryptionAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	if len(encryptedKey) < 5 || encryptedKey[0] != encryptedKeyVersion {
+		return nil, errors.New("mssql: invalid encrypted column encryption key")
+	}
+	pathLen := int(binary.LittleEndian.Uint16(encryptedKey[1:]))
+	cipherLen := int(binary.LittleEndian.Uint16(encryptedKey[3:]))
+	signed := 5 + pathLen + cipherLen
+	if cipherLen != key.Size() || len(encryptedKey) != signed+key.Size() {
+		return nil, errors.New("mssql: invalid length of encrypted column encryption key")
+	}
+	digest := sha256.Sum256(encryptedKey[:signed])
+	if err = rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], encryptedKey[signed:]); err != nil {
+		return nil, fmt.Errorf("mssql: invalid signature of column encryption key for master key %q", masterKeyPath)
+	}
+	cek, err := rsa.DecryptOAEP(sha1.New(), nil, key, encryptedKey[5+pathLen:signed], nil)
+	if err != nil {
+		return nil, fmt.Errorf("mssql: cannot decrypt column encryption key: %v", err)
+	}
+	return cek, nil
+}
+
+// EncryptColumnEncryptionKey encrypts a column encryption key with the
+// column master key at masterKeyPath. The result can be used as the
+// ENCRYPTED_VALUE of CREATE COLUMN ENCRYPTION KEY.
+func (p *CertificateKeyStoreProvider) EncryptColumnEncryptionKey(masterKeyPath string, encryptionAlgorithm string, columnEncryptionKey []byte) ([]byte, error) {
+	key, err := p.key(masterKeyPath, encryptionAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, &key.PublicKey, columnEncryptionKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	path := str2ucs2(strings.ToLower(masterKeyPath))
+	res := make([]byte, 5, 5+len(path)+len(ciphertext)+key.Size())
+	res[0] = encryptedKeyVersion
+	binary.LittleEndian.PutUint16(res[1:], uint16(len(path)))
+	binary.LittleEndian.PutUint16(res[3:], uint16(len(ciphertext)))
+	res = append(res, path...)
+	res = append(res, ciphertext...)
+	digest := sha256.Sum256(res)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	return append(res, signature...), nil
+}
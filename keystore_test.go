@@ -0,0 +1,53 @@
+package mssql
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+)
+
+const testMasterKeyPath = "CurrentUser/My/0123456789ABCDEF"
+
+func TestCertificateKeyStoreProvider(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewCertificateKeyStoreProvider()
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err = p.LoadPEM(testMasterKeyPath, data); err != nil {
+		t.Fatal(err)
+	}
+
+	cek := bytes.Repeat([]byte{0x42}, 32)
+	encrypted, err := p.EncryptColumnEncryptionKey(testMasterKeyPath, "RSA_OAEP", cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// paths are case insensitive
+	decrypted, err := p.DecryptColumnEncryptionKey("currentuser/my/0123456789abcdef", "RSA_OAEP", encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, cek) {
+		t.Errorf("unexpected column encryption key % x", decrypted)
+	}
+
+	tampered := append([]byte(nil), encrypted...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err = p.DecryptColumnEncryptionKey(testMasterKeyPath, "RSA_OAEP", tampered); err == nil {
+		t.Error("expected error for invalid signature")
+	}
+	if _, err = p.DecryptColumnEncryptionKey(testMasterKeyPath, "RSA_PKCS1", encrypted); err == nil {
+		t.Error("expected error for unsupported algorithm")
+	}
+	if _, err = p.DecryptColumnEncryptionKey("CurrentUser/My/other", "RSA_OAEP", encrypted); err == nil {
+		t.Error("expected error for unknown master key")
+	}
+	if err = p.LoadPEM(testMasterKeyPath, []byte("no key")); err == nil {
+		t.Error("expected error for PEM data without key")
+	}
+}
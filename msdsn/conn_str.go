@@ -16,16 +16,36 @@ import (
 )
 
 type (
-	Encryption int
-	Log        uint64
+	Encryption    int
+	Log           uint64
+	PrepareMethod int
 )
 
 const (
 	EncryptionOff      = 0
 	EncryptionRequired = 1
 	EncryptionDisabled = 3
+	// EncryptionStrict negotiates TLS before any TDS traffic (TDS 8.0).
+	EncryptionStrict = 4
 )
 
+// DefaultConnectRetryInterval is the time between reconnect attempts when
+// ConnectRetryInterval is not set.
+const DefaultConnectRetryInterval = 10 * time.Second
+
+const (
+	// PrepareExecuteSQL sends every execution of a prepared statement
+	// with sp_executesql.
+	PrepareExecuteSQL PrepareMethod = 0
+	// PreparePrepExec prepares a statement with sp_prepexec and runs it
+	// by handle with sp_execute afterwards. Without a statement cache the
+	// statement is prepared on its second execution.
+	PreparePrepExec PrepareMethod = 1
+)
+
+// TDS8ALPN is the ALPN protocol of TDS 8.0 connections.
+const TDS8ALPN = "tds/8.0"
+
 const (
 	LogErrors      Log = 1
 	LogMessages    Log = 2
@@ -57,6 +77,10 @@ type Config struct {
 	// NOTE: This does not make queries to most databases read-only.
 	ReadOnlyIntent bool
 
+	// MultipleActiveResultSets enables MARS. With MARS several statements
+	// of one connection may have pending results at the same time.
+	MultipleActiveResultSets bool
+
 	LogFlags Log
 
 	ServerSPN   string
@@ -67,6 +91,26 @@ type Config struct {
 	// that start on bad connections.
 	DisableRetry bool
 
+	// ConnectRetryCount is the number of attempts to reconnect an idle
+	// connection whose network link was dropped and restore its session.
+	// Defaults to 1, 0 disables session recovery.
+	ConnectRetryCount int
+	// ConnectRetryInterval is the time between reconnect attempts.
+	// Defaults to 10s, also when it is zero.
+	ConnectRetryInterval time.Duration
+
+	// ColumnEncryption enables Always Encrypted. Keys are decrypted by
+	// the key store providers registered with the driver.
+	ColumnEncryption bool
+
+	// PrepareMethod is how prepared statements are executed.
+	PrepareMethod PrepareMethod
+	// StatementCacheSize is the number of statement handles kept by a
+	// connection after their statements are closed, so statements
+	// prepared again don't have to be compiled again. 0 disables the
+	// cache, it is used only with PreparePrepExec.
+	StatementCacheSize int
+
 	// Do not use the following.
 
 	DialTimeout time.Duration // DialTimeout defaults to 15s. Set negative to disable.
@@ -224,6 +268,8 @@ func Parse(dsn string) (Config, map[string]string, error) {
 	if ok {
 		if strings.EqualFold(encrypt, "DISABLE") {
 			p.Encryption = EncryptionDisabled
+		} else if strings.EqualFold(encrypt, "STRICT") {
+			p.Encryption = EncryptionStrict
 		} else {
 			e, err := strconv.ParseBool(encrypt)
 			if err != nil {
@@ -246,6 +292,10 @@ func Parse(dsn string) (Config, map[string]string, error) {
 			return p, params, fmt.Errorf(f, trust, err.Error())
 		}
 	}
+	if p.Encryption == EncryptionStrict {
+		// strict encryption always validates the server certificate
+		trustServerCert = false
+	}
 	certificate = params["certificate"]
 	hostInCertificate, ok = params["hostnameincertificate"]
 	if ok {
@@ -274,12 +324,19 @@ func Parse(dsn string) (Config, map[string]string, error) {
 		}
 	}
 
+	if p.Encryption == EncryptionStrict && tlsMinVer < tls.VersionTLS12 {
+		tlsMinVer = tls.VersionTLS12
+	}
+
 	if p.Encryption != EncryptionDisabled {
 		var err error
 		p.TLSConfig, err = SetupTLS(certificate, trustServerCert, hostInCertificate, tlsMinVer)
 		if err != nil {
 			return p, params, fmt.Errorf("failed to setup TLS: %w", err)
 		}
+		if p.Encryption == EncryptionStrict {
+			p.TLSConfig.NextProtos = []string{TDS8ALPN}
+		}
 	}
 
 	serverSPN, ok := params["serverspn"]
@@ -342,6 +399,77 @@ func Parse(dsn string) (Config, map[string]string, error) {
 		p.DisableRetry = disableRetryDefault
 	}
 
+	mars, ok := params["multipleactiveresultsets"]
+	if ok {
+		var err error
+		p.MultipleActiveResultSets, err = strconv.ParseBool(mars)
+		if err != nil {
+			f := "invalid multipleActiveResultSets '%s': %s"
+			return p, params, fmt.Errorf(f, mars, err.Error())
+		}
+	}
+
+	p.ConnectRetryCount = 1
+	if retryCount, ok := params["connectretrycount"]; ok {
+		count, err := strconv.ParseUint(retryCount, 10, 8)
+		if err != nil {
+			f := "invalid connectRetryCount '%s': %s"
+			return p, params, fmt.Errorf(f, retryCount, err.Error())
+		}
+		p.ConnectRetryCount = int(count)
+	}
+
+	p.ConnectRetryInterval = DefaultConnectRetryInterval
+	if retryInterval, ok := params["connectretryinterval"]; ok {
+		interval, err := strconv.ParseUint(retryInterval, 10, 64)
+		if err != nil {
+			f := "invalid connectRetryInterval '%s': %s"
+			return p, params, fmt.Errorf(f, retryInterval, err.Error())
+		}
+		if interval < 1 || interval > 60 {
+			f := "invalid connectRetryInterval '%s': must be between 1 and 60 seconds"
+			return p, params, fmt.Errorf(f, retryInterval)
+		}
+		p.ConnectRetryInterval = time.Duration(interval) * time.Second
+	}
+
+	if columnEncryption, ok := params["columnencryption"]; ok {
+		switch {
+		case strings.EqualFold(columnEncryption, "enabled"):
+			p.ColumnEncryption = true
+		case strings.EqualFold(columnEncryption, "disabled"):
+			p.ColumnEncryption = false
+		default:
+			var err error
+			p.ColumnEncryption, err = strconv.ParseBool(columnEncryption)
+			if err != nil {
+				f := "invalid columnEncryption '%s': %s"
+				return p, params, fmt.Errorf(f, columnEncryption, err.Error())
+			}
+		}
+	}
+
+	if prepareMethod, ok := params["preparemethod"]; ok {
+		switch strings.ToLower(prepareMethod) {
+		case "executesql":
+			p.PrepareMethod = PrepareExecuteSQL
+		case "prepexec":
+			p.PrepareMethod = PreparePrepExec
+		default:
+			f := "invalid prepareMethod '%s': must be executesql or prepexec"
+			return p, params, fmt.Errorf(f, prepareMethod)
+		}
+	}
+
+	if cacheSize, ok := params["statementcachesize"]; ok {
+		size, err := strconv.ParseUint(cacheSize, 10, 16)
+		if err != nil {
+			f := "invalid statementCacheSize '%s': %s"
+			return p, params, fmt.Errorf(f, cacheSize, err.Error())
+		}
+		p.StatementCacheSize = int(size)
+	}
+
 	return p, params, nil
 }
 
@@ -20,6 +20,16 @@ func TestInvalidConnectionString(t *testing.T) {
 		"failoverport=invalid",
 		"applicationintent=ReadOnly",
 		"disableretry=invalid",
+		"multipleactiveresultsets=invalid",
+		"connectretrycount=invalid",
+		"connectretrycount=256",
+		"connectretryinterval=invalid",
+		"connectretryinterval=0",
+		"connectretryinterval=61",
+		"columnencryption=invalid",
+		"preparemethod=prepare",
+		"statementcachesize=-1",
+		"statementcachesize=65536",
 
 		// ODBC mode
 		"odbc:password={",
@@ -62,6 +72,11 @@ func TestValidConnectionString(t *testing.T) {
 		{"encrypt=disable", func(p Config) bool { return p.Encryption == EncryptionDisabled }},
 		{"encrypt=true", func(p Config) bool { return p.Encryption == EncryptionRequired }},
 		{"encrypt=false", func(p Config) bool { return p.Encryption == EncryptionOff }},
+		{"encrypt=strict", func(p Config) bool {
+			return p.Encryption == EncryptionStrict && p.TLSConfig.NextProtos[0] == TDS8ALPN &&
+				p.TLSConfig.MinVersion == tls.VersionTLS12
+		}},
+		{"encrypt=Strict;trustservercertificate=true", func(p Config) bool { return !p.TLSConfig.InsecureSkipVerify }},
 		{"connection timeout=3;dial timeout=4;keepalive=5", func(p Config) bool {
 			return p.ConnTimeout == 3*time.Second && p.DialTimeout == 4*time.Second && p.KeepAlive == 5*time.Second
 		}},
@@ -77,6 +92,22 @@ func TestValidConnectionString(t *testing.T) {
 		{"disableretry=1", func(p Config) bool { return p.DisableRetry }},
 		{"disableretry=0", func(p Config) bool { return !p.DisableRetry }},
 		{"", func(p Config) bool { return p.DisableRetry == disableRetryDefault }},
+		{"multipleactiveresultsets=true", func(p Config) bool { return p.MultipleActiveResultSets }},
+		{"MultipleActiveResultSets=false", func(p Config) bool { return !p.MultipleActiveResultSets }},
+		{"", func(p Config) bool { return !p.MultipleActiveResultSets }},
+		{"", func(p Config) bool { return p.ConnectRetryCount == 1 && p.ConnectRetryInterval == 10*time.Second }},
+		{"connectretrycount=0", func(p Config) bool { return p.ConnectRetryCount == 0 }},
+		{"ConnectRetryCount=255", func(p Config) bool { return p.ConnectRetryCount == 255 }},
+		{"connectretryinterval=1", func(p Config) bool { return p.ConnectRetryInterval == time.Second }},
+		{"ConnectRetryInterval=60", func(p Config) bool { return p.ConnectRetryInterval == time.Minute }},
+		{"ColumnEncryption=Enabled", func(p Config) bool { return p.ColumnEncryption }},
+		{"columnencryption=disabled", func(p Config) bool { return !p.ColumnEncryption }},
+		{"columnencryption=true", func(p Config) bool { return p.ColumnEncryption }},
+		{"", func(p Config) bool { return !p.ColumnEncryption }},
+		{"", func(p Config) bool { return p.PrepareMethod == PrepareExecuteSQL && p.StatementCacheSize == 0 }},
+		{"PrepareMethod=PrepExec", func(p Config) bool { return p.PrepareMethod == PreparePrepExec }},
+		{"preparemethod=executesql", func(p Config) bool { return p.PrepareMethod == PrepareExecuteSQL }},
+		{"statementcachesize=100", func(p Config) bool { return p.StatementCacheSize == 100 }},
 
 		// those are supported currently, but maybe should not be
 		{"someparam", func(p Config) bool { return true }},
@@ -15,6 +15,7 @@ import (
 	"time"
 	"unicode"
 
+	"github.com/denisenkom/go-mssqldb/internal/cp"
 	"github.com/denisenkom/go-mssqldb/internal/querytext"
 	"github.com/denisenkom/go-mssqldb/msdsn"
 	"github.com/golang-sql/sqlexp"
@@ -179,6 +180,16 @@ type Connector struct {
 	// Dialer sets a custom dialer for all network operations.
 	// If Dialer is not set, normal net dialers are used.
 	Dialer Dialer
+
+	// ReadOnlyTxIsolation is the isolation level of transactions begun
+	// with ReadOnly set in the transaction options and without an isolation
+	// level, e.g. sql.LevelSnapshot, which requires ALLOW_SNAPSHOT_ISOLATION
+	// on the database. When not present, read-only transactions use the
+	// isolation level of the session.
+	//
+	// SQL Server has no read-only transactions, their writes are not
+	// blocked. Writes only fail on a readable secondary replica.
+	ReadOnlyTxIsolation sql.IsolationLevel
 }
 
 type Dialer interface {
@@ -202,12 +213,31 @@ type Conn struct {
 	connectionGood   bool
 
 	outs outputs
+
+	// sessionEpoch changes when the session is reset, handles of
+	// prepared statements are valid only within one epoch
+	sessionEpoch int
+	stmtCache    *stmtCache
+
+	// collations holds the collations of TVP columns looked up by name
+	collations map[string]cp.Collation
 }
 
 type outputs struct {
 	params       map[string]interface{}
 	returnStatus *ReturnStatus
 	msgq         *sqlexp.ReturnMessage
+	// paramEncryption holds the keys of encrypted parameters
+	paramEncryption map[string]*paramEncryption
+	// streamPLP makes rows stream large values of the last column
+	streamPLP bool
+	// returnValues receives the values of output parameters sent
+	// without a name, in the order of the parameters
+	returnValues []interface{}
+	// rawRows makes rows hold the values as sent by the server
+	rawRows bool
+	// returnVariants makes rows return sql_variant values as Variant
+	returnVariants bool
 }
 
 // IsValid satisfies the driver.Validator interface.
@@ -245,6 +275,10 @@ func (c *Conn) checkBadConn(ctx context.Context, err error, mayRetry bool) error
 		c.connectionGood = false
 	}
 
+	if _, ok := err.(streamSendError); ok {
+		mayRetry = false
+	}
+
 	if !c.connectionGood && mayRetry && !c.connector.params.DisableRetry {
 		if c.sess.logFlags&logRetries != 0 {
 			c.sess.logger.Log(ctx, msdsn.LogRetries, err.Error())
@@ -333,6 +367,9 @@ func (c *Conn) begin(ctx context.Context, tdsIsolation isoLevel) (tx driver.Tx,
 	if !c.connectionGood {
 		return nil, driver.ErrBadConn
 	}
+	if err = c.recoverIdleConn(ctx); err != nil {
+		return nil, c.checkBadConn(ctx, err, true)
+	}
 	err = c.sendBeginRequest(ctx, tdsIsolation)
 	if err != nil {
 		return nil, c.checkBadConn(ctx, err, true)
@@ -352,7 +389,7 @@ func (c *Conn) sendBeginRequest(ctx context.Context, tdsIsolation isoLevel) erro
 	}
 	reset := c.resetSession
 	c.resetSession = false
-	if err := sendBeginXact(c.sess.buf, headers, tdsIsolation, "", reset); err != nil {
+	if err := sendBeginXact(c.sess.buf, headers, tdsIsolation, transactionName(ctx), reset); err != nil {
 		if c.sess.logFlags&logErrors != 0 {
 			c.sess.logger.Log(ctx, msdsn.LogErrors, fmt.Sprintf("Failed to send BeginXact with %v", err))
 		}
@@ -413,14 +450,58 @@ func (d *Driver) connect(ctx context.Context, c *Connector, params msdsn.Config)
 }
 
 func (c *Conn) Close() error {
+	if c.sess.mars != nil {
+		return c.sess.mars.Close()
+	}
 	return c.sess.buf.transport.Close()
 }
 
+// newMarsSession opens another logical session on a MARS connection.
+// It shares the login state of the connection's primary session.
+func (c *Conn) newMarsSession() (*tdsSession, error) {
+	transport, err := c.sess.mars.openSession()
+	if err != nil {
+		return nil, err
+	}
+	return &tdsSession{
+		buf:      newTdsBuffer(uint16(c.sess.buf.PackageSize()), transport),
+		loginAck: c.sess.loginAck,
+		database: c.sess.database,
+		tranid:   c.sess.tranid,
+		logFlags: c.sess.logFlags,
+		logger:   c.sess.logger,
+		mars:     c.sess.mars,
+		parent:   c.sess,
+
+		alwaysEncrypted: c.sess.alwaysEncrypted,
+		utf8:            c.sess.utf8,
+
+		dataClassificationVersion: c.sess.dataClassificationVersion,
+	}, nil
+}
+
 type Stmt struct {
 	c          *Conn
 	query      string
 	paramCount int
 	notifSub   *queryNotifSub
+
+	// sess is the statement's own MARS session, nil until the statement
+	// is first executed on a MARS connection.
+	sess *tdsSession
+	// connSession runs the statement on the connection's session also
+	// with MARS, see prepareInternal.
+	connSession bool
+
+	// paramEncryption caches sp_describe_parameter_encryption results
+	// by parameter declarations.
+	paramEncryption map[string]map[string]*paramEncryption
+
+	// prepared is the handle of the statement with msdsn.PreparePrepExec
+	prepared preparedHandle
+	// executed is set by the first execution with msdsn.PreparePrepExec,
+	// see prepareCall
+	executed bool
 }
 
 type queryNotifSub struct {
@@ -444,11 +525,64 @@ func (c *Conn) prepareContext(ctx context.Context, query string) (*Stmt, error)
 	if c.processQueryText {
 		query, paramCount = querytext.ParseParams(query)
 	}
-	return &Stmt{c, query, paramCount, nil}, nil
+	return &Stmt{c: c, query: query, paramCount: paramCount}, nil
+}
+
+// prepareInternal prepares a statement the driver runs itself. It is
+// executed on the connection's session also with MARS, so it needs no
+// session of its own and shares the session with requests sent there
+// directly, like the rows of bulk copy.
+func (c *Conn) prepareInternal(ctx context.Context, query string) (*Stmt, error) {
+	s, err := c.prepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	s.connSession = true
+	return s, nil
 }
 
 func (s *Stmt) Close() error {
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), unprepareTimeout)
+	defer cancel()
+	err := s.unprepare(ctx)
+	if s.sess != nil {
+		// the MARS session is closed also when unprepare failed
+		if closeErr := s.sess.buf.transport.Close(); closeErr != nil {
+			if err != nil {
+				err = fmt.Errorf("%v, closing the session failed too: %v", err, closeErr)
+			} else {
+				err = closeErr
+			}
+		}
+		s.sess = nil
+	}
+	return err
+}
+
+// session returns the TDS session the statement is executed on.
+// Without MARS all statements share the connection's session. With MARS
+// each statement gets a session of its own, so results of several
+// statements may be read at the same time.
+func (s *Stmt) session() (*tdsSession, error) {
+	if s.c.sess.mars == nil || s.connSession {
+		return s.c.sess, nil
+	}
+	if s.sess == nil {
+		sess, err := s.c.newMarsSession()
+		if err != nil {
+			return nil, err
+		}
+		s.sess = sess
+	}
+	return s.sess, nil
+}
+
+// sessionOrConn returns the session a request of the statement was sent on.
+func (s *Stmt) sessionOrConn() *tdsSession {
+	if s.sess != nil {
+		return s.sess
+	}
+	return s.c.sess
 }
 
 func (s *Stmt) SetQueryNotification(id, options string, timeout time.Duration) {
@@ -467,6 +601,12 @@ func (s *Stmt) NumInput() int {
 }
 
 func (s *Stmt) sendQuery(ctx context.Context, args []namedValue) (err error) {
+	sess, err := s.session()
+	if err != nil {
+		s.c.connectionGood = false
+		return err
+	}
+
 	headers := []headerStruct{
 		{hdrtype: dataStmHdrTransDescr,
 			data: transDescrHdr{s.c.sess.tranid, 1}.pack()},
@@ -500,11 +640,14 @@ func (s *Stmt) sendQuery(ctx context.Context, args []namedValue) (err error) {
 		}
 	}
 
+	if err = s.resolveTVPCollations(ctx, sess, args); err != nil {
+		return
+	}
 	reset := conn.resetSession
 	conn.resetSession = false
 	isProc := isProc(s.query)
 	if len(args) == 0 && !isProc {
-		if err = sendSqlBatch72(conn.sess.buf, s.query, headers, reset); err != nil {
+		if err = sendSqlBatch72(sess.buf, s.query, headers, reset); err != nil {
 			if conn.sess.logFlags&logErrors != 0 {
 				conn.sess.logger.Log(ctx, msdsn.LogErrors, fmt.Sprintf("Failed to send SqlBatch with %v", err))
 			}
@@ -516,30 +659,77 @@ func (s *Stmt) sendQuery(ctx context.Context, args []namedValue) (err error) {
 		var params []param
 		if isProc {
 			proc.name = s.query
-			params, _, err = s.makeRPCParams(args, true)
+			var decls []string
+			params, decls, err = s.makeRPCParams(args, true)
 			if err != nil {
 				return
 			}
+			if sess.alwaysEncrypted {
+				if err = s.encryptProcParams(ctx, sess, args, params, decls); err != nil {
+					return
+				}
+			}
 		} else {
 			var decls []string
 			params, decls, err = s.makeRPCParams(args, false)
 			if err != nil {
 				return
 			}
+			if sess.alwaysEncrypted {
+				var enc map[string]*paramEncryption
+				enc, err = s.describeParameterEncryption(ctx, sess, s.query, strings.Join(decls, ","))
+				if err != nil {
+					return
+				}
+				if err = encryptParams(params[2:], enc); err != nil {
+					return
+				}
+				conn.outs.paramEncryption = enc
+			}
 			params[0] = makeStrParam(s.query)
 			params[1] = makeStrParam(strings.Join(decls, ","))
+			if s.c.prepareMethod() == msdsn.PreparePrepExec {
+				proc, params = s.prepareCall(ctx, sess, params, strings.Join(decls, ","))
+			}
 		}
-		if err = sendRpc(conn.sess.buf, headers, proc, 0, params, reset); err != nil {
+		if err = sendRpc(sess.buf, headers, proc, 0, params, reset); err != nil {
 			if conn.sess.logFlags&logErrors != 0 {
 				conn.sess.logger.Log(ctx, msdsn.LogErrors, fmt.Sprintf("Failed to send Rpc with %v", err))
 			}
 			conn.connectionGood = false
-			return fmt.Errorf("failed to send RPC: %v", err)
+			err = fmt.Errorf("failed to send RPC: %v", err)
+			if streamedParams(params) {
+				return streamSendError{err}
+			}
+			return err
 		}
 	}
 	return
 }
 
+// streamSendError is the failure to send a request whose parameters were
+// read from streams as it was sent. The request is not retried, the
+// streams were read in part and sending them again would send what is
+// left of them.
+type streamSendError struct {
+	err error
+}
+
+func (e streamSendError) Error() string {
+	return e.err.Error()
+}
+
+// streamedParams reports whether params are read from streams as they
+// are sent.
+func streamedParams(params []param) bool {
+	for i := range params {
+		if params[i].reader != nil || params[i].encoder != nil {
+			return true
+		}
+	}
+	return false
+}
+
 // isProc takes the query text in s and determines if it is a stored proc name
 // or SQL text.
 func isProc(s string) bool {
@@ -659,6 +849,9 @@ func (s *Stmt) queryContext(ctx context.Context, args []namedValue) (rows driver
 	if !s.c.connectionGood {
 		return nil, driver.ErrBadConn
 	}
+	if err = s.c.recoverIdleConn(ctx); err != nil {
+		return nil, s.c.checkBadConn(ctx, err, true)
+	}
 	if err = s.sendQuery(ctx, args); err != nil {
 		return nil, s.c.checkBadConn(ctx, err, true)
 	}
@@ -667,7 +860,7 @@ func (s *Stmt) queryContext(ctx context.Context, args []namedValue) (rows driver
 
 func (s *Stmt) processQueryResponse(ctx context.Context) (res driver.Rows, err error) {
 	ctx, cancel := context.WithCancel(ctx)
-	reader := startReading(s.c.sess, ctx, s.c.outs)
+	reader := startReading(s.sessionOrConn(), ctx, s.c.outs)
 	s.c.clearOuts()
 	// For apps using a message queue, return right away and let Rowsq do all the work
 	if reader.outs.msgq != nil {
@@ -726,6 +919,15 @@ func (s *Stmt) exec(ctx context.Context, args []namedValue) (res driver.Result,
 	if !s.c.connectionGood {
 		return nil, driver.ErrBadConn
 	}
+	if err = s.c.recoverIdleConn(ctx); err != nil {
+		return nil, s.c.checkBadConn(ctx, err, true)
+	}
+	if req, ok := tranRequestArg(args); ok {
+		if err = s.c.sendTranRequest(ctx, s.sessionOrConn(), req); err != nil {
+			return nil, err
+		}
+		return driver.RowsAffected(0), nil
+	}
 	if err = s.sendQuery(ctx, args); err != nil {
 		return nil, s.c.checkBadConn(ctx, err, true)
 	}
@@ -736,7 +938,7 @@ func (s *Stmt) exec(ctx context.Context, args []namedValue) (res driver.Result,
 }
 
 func (s *Stmt) processExec(ctx context.Context) (res driver.Result, err error) {
-	reader := startReading(s.c.sess, ctx, s.c.outs)
+	reader := startReading(s.sessionOrConn(), ctx, s.c.outs)
 	s.c.clearOuts()
 	err = reader.iterateResponse()
 	if err != nil {
@@ -752,12 +954,22 @@ type Rows struct {
 	reader   *tokenProcessor
 	nextCols []columnStruct
 	cancel   func()
+	// closeStmt is set when the rows own their statement, which is
+	// closed with them
+	closeStmt bool
 }
 
-func (rc *Rows) Close() error {
+func (rc *Rows) Close() (err error) {
 	// need to add a test which returns lots of rows
 	// and check closing after reading only few rows
 	rc.cancel()
+	if rc.closeStmt {
+		defer func() {
+			if stmtErr := rc.stmt.Close(); err == nil {
+				err = stmtErr
+			}
+		}()
+	}
 
 	for {
 		tok, err := rc.reader.nextToken()
@@ -809,7 +1021,10 @@ func (rc *Rows) Next(dest []driver.Value) error {
 					for i := range dest {
 						dest[i] = tokdata[i]
 					}
-					return nil
+					if rc.reader.outs.rawRows {
+						return nil
+					}
+					return decryptRow(rc.cols, dest)
 				case doneStruct:
 					if tokdata.isError() {
 						return rc.stmt.c.checkBadConn(rc.reader.ctx, tokdata.getError(), false)
@@ -891,6 +1106,18 @@ func (r *Rows) ColumnTypeNullable(index int) (nullable, ok bool) {
 	return
 }
 
+// ColumnSensitivity returns the data classification of a column, nil if the
+// column is not classified or the server doesn't send classifications.
+func (r *Rows) ColumnSensitivity(index int) []SensitivityProperty {
+	return columnSensitivity(r.cols, index)
+}
+
+// SensitivityClassification returns the data classification of the current
+// result set, nil if the result set is not classified.
+func (r *Rows) SensitivityClassification() *SensitivityClassification {
+	return sensitivityClassification(r.cols)
+}
+
 func makeStrParam(val string) (res param) {
 	res.ti.TypeId = typeNVarChar
 	res.buffer = str2ucs2(val)
@@ -898,6 +1125,19 @@ func makeStrParam(val string) (res param) {
 	return
 }
 
+// makeIntParam makes an int parameter, output parameters are sent by
+// reference.
+func makeIntParam(val int32, output bool) (res param) {
+	res.ti.TypeId = typeIntN
+	res.ti.Size = 4
+	res.buffer = make([]byte, 4)
+	binary.LittleEndian.PutUint32(res.buffer, uint32(val))
+	if output {
+		res.Flags = fByRevValue
+	}
+	return
+}
+
 func (s *Stmt) makeParam(val driver.Value) (res param, err error) {
 	if val == nil {
 		res.ti.TypeId = typeNull
@@ -963,6 +1203,13 @@ func (s *Stmt) makeParam(val driver.Value) (res param, err error) {
 			res.buffer = encodeDateTime(val)
 			res.ti.Size = len(res.buffer)
 		}
+	case VarBinaryStream:
+		res = makeStreamParam(typeBigVarBin, val.R)
+	case NVarCharStream:
+		res = makeStreamParam(typeNVarChar, nil)
+		if val.R != nil {
+			res.reader = newUcs2Reader(val.R)
+		}
 	default:
 		return s.makeParamExtra(val)
 	}
@@ -985,7 +1232,8 @@ func (c *Conn) Ping(ctx context.Context) error {
 	if !c.connectionGood {
 		return driver.ErrBadConn
 	}
-	stmt := &Stmt{c, `select 1;`, 0, nil}
+	stmt := &Stmt{c: c, query: `select 1;`, connSession: true}
+	defer stmt.Close()
 	_, err := stmt.ExecContext(ctx, nil)
 	return err
 }
@@ -1015,16 +1263,26 @@ func convertIsolationLevel(level sql.IsolationLevel) (isoLevel, error) {
 	}
 }
 
+// readOnlyTxIsolation returns the isolation level of a read-only
+// transaction begun with the given level.
+func (c *Conn) readOnlyTxIsolation(level sql.IsolationLevel) sql.IsolationLevel {
+	if level == sql.LevelDefault && c.connector != nil {
+		return c.connector.ReadOnlyTxIsolation
+	}
+	return level
+}
+
 // BeginTx satisfies ConnBeginTx.
 func (c *Conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
 	if !c.connectionGood {
 		return nil, driver.ErrBadConn
 	}
+	isolation := sql.IsolationLevel(opts.Isolation)
 	if opts.ReadOnly {
-		return nil, errors.New("read-only transactions are not supported")
+		isolation = c.readOnlyTxIsolation(isolation)
 	}
 
-	tdsIsolation, err := convertIsolationLevel(sql.IsolationLevel(opts.Isolation))
+	tdsIsolation, err := convertIsolationLevel(isolation)
 	if err != nil {
 		return nil, err
 	}
@@ -1150,7 +1408,10 @@ func (rc *Rowsq) Next(dest []driver.Value) error {
 					for i := range dest {
 						dest[i] = tokdata[i]
 					}
-					return nil
+					if rc.reader.outs.rawRows {
+						return nil
+					}
+					return decryptRow(rc.cols, dest)
 				case doneStruct:
 					if tokdata.Status&doneMore == 0 {
 						rc.requestDone = true
@@ -1278,3 +1539,15 @@ func (r *Rowsq) ColumnTypeNullable(index int) (nullable, ok bool) {
 	ok = true
 	return
 }
+
+// ColumnSensitivity returns the data classification of a column, nil if the
+// column is not classified or the server doesn't send classifications.
+func (r *Rowsq) ColumnSensitivity(index int) []SensitivityProperty {
+	return columnSensitivity(r.cols, index)
+}
+
+// SensitivityClassification returns the data classification of the current
+// result set, nil if the result set is not classified.
+func (r *Rowsq) SensitivityClassification() *SensitivityClassification {
+	return sensitivityClassification(r.cols)
+}
@@ -16,12 +16,14 @@ func (c *Conn) ResetSession(ctx context.Context) error {
 		return driver.ErrBadConn
 	}
 	c.resetSession = true
+	// the reset unprepares the statements of the session
+	c.sessionEpoch++
 
 	if c.connector == nil || len(c.connector.SessionInitSQL) == 0 {
 		return nil
 	}
 
-	s, err := c.prepareContext(ctx, c.connector.SessionInitSQL)
+	s, err := c.prepareInternal(ctx, c.connector.SessionInitSQL)
 	if err != nil {
 		return driver.ErrBadConn
 	}
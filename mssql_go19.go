@@ -3,13 +3,16 @@
 package mssql
 
 import (
+	"bytes"
 	"database/sql"
 	"database/sql/driver"
 	"errors"
 	"fmt"
+	"io"
 	"reflect"
 	"time"
 
+	"github.com/denisenkom/go-mssqldb/internal/cp"
 	"github.com/golang-sql/sqlexp"
 
 	// "github.com/cockroachdb/apd"
@@ -34,6 +37,18 @@ type VarChar string
 type NVarCharMax string
 type VarCharMax string
 
+// utf8Collation is Latin1_General_100_CI_AS_SC_UTF8. VarChar parameters
+// are sent with it when the server supports UTF-8, so the server reads
+// them as the UTF-8 they are.
+var utf8Collation = cp.Collation{LcidAndFlags: 0x24d00409}
+
+func (s *Stmt) varCharCollation() cp.Collation {
+	if s.c.sess.utf8 {
+		return utf8Collation
+	}
+	return cp.Collation{}
+}
+
 // DateTime1 encodes parameters to original DateTime SQL types.
 type DateTime1 time.Time
 
@@ -58,6 +73,17 @@ func convertInputParameter(val interface{}) (interface{}, error) {
 		return val, nil
 	case civil.Time:
 		return val, nil
+	case VarBinaryStream:
+		return val, nil
+	case NVarCharStream:
+		return val, nil
+	case Variant:
+		return val, nil
+	case io.Reader:
+		if _, ok := val.(driver.Valuer); ok {
+			return driver.DefaultParameterConverter.ConvertValue(v)
+		}
+		return VarBinaryStream{R: v}, nil
 		// case *apd.Decimal:
 		// 	return nil
 	default:
@@ -65,6 +91,30 @@ func convertInputParameter(val interface{}) (interface{}, error) {
 	}
 }
 
+// bulkValueExtra converts the parameter types of this package to the
+// types bulk copy encodes.
+func bulkValueExtra(val interface{}) (interface{}, bool) {
+	switch v := val.(type) {
+	case VarChar:
+		return string(v), true
+	case VarCharMax:
+		return string(v), true
+	case NVarCharMax:
+		return string(v), true
+	case DateTime1:
+		return time.Time(v), true
+	case DateTimeOffset:
+		return time.Time(v), true
+	case civil.Date:
+		return v.In(time.UTC), true
+	case civil.DateTime:
+		return v.In(time.UTC), true
+	case civil.Time:
+		return time.Date(1, 1, 1, v.Hour, v.Minute, v.Second, v.Nanosecond, time.UTC), true
+	}
+	return nil, false
+}
+
 func (c *Conn) CheckNamedValue(nv *driver.NamedValue) error {
 	switch v := nv.Value.(type) {
 	case sql.Out:
@@ -120,6 +170,16 @@ func (c *Conn) CheckNamedValue(nv *driver.NamedValue) error {
 		sqlexp.ReturnMessageInit(v)
 		c.outs.msgq = v
 		return driver.ErrRemoveArgument
+	case StreamPLP:
+		c.outs.streamPLP = true
+		return driver.ErrRemoveArgument
+	case ReturnVariants:
+		c.outs.returnVariants = true
+		return driver.ErrRemoveArgument
+	case tranRequest:
+		// kept as the argument, a request that fails before it is
+		// executed leaves nothing on the connection
+		return nil
 	default:
 		var err error
 		nv.Value, err = convertInputParameter(nv.Value)
@@ -133,10 +193,12 @@ func (s *Stmt) makeParamExtra(val driver.Value) (res param, err error) {
 		res.ti.TypeId = typeBigVarChar
 		res.buffer = []byte(val)
 		res.ti.Size = len(res.buffer)
+		res.ti.Collation = s.varCharCollation()
 	case VarCharMax:
 		res.ti.TypeId = typeBigVarChar
 		res.buffer = []byte(val)
 		res.ti.Size = 0 // currently zero forces varchar(max)
+		res.ti.Collation = s.varCharCollation()
 	case NVarCharMax:
 		res.ti.TypeId = typeNVarChar
 		res.buffer = str2ucs2(string(val))
@@ -165,6 +227,14 @@ func (s *Stmt) makeParamExtra(val driver.Value) (res param, err error) {
 		res.ti.Scale = 7
 		res.buffer = encodeTime(val.Hour, val.Minute, val.Second, val.Nanosecond, int(res.ti.Scale))
 		res.ti.Size = len(res.buffer)
+	case Variant:
+		res.ti.TypeId = typeVariant
+		res.ti.Size = variantMaxSize
+		col := s.c.sess.collation
+		if s.c.sess.utf8 {
+			col = utf8Collation
+		}
+		res.buffer, err = val.encode(col)
 	case sql.Out:
 		res, err = s.makeParam(val.Dest)
 		res.Flags = fByRevValue
@@ -180,11 +250,39 @@ func (s *Stmt) makeParamExtra(val driver.Value) (res param, err error) {
 		res.ti.UdtInfo.TypeName = name
 		res.ti.UdtInfo.SchemaName = schema
 		res.ti.TypeId = typeTvp
+		if rows := val.rows(); rows != nil {
+			var columnStr []columnStruct
+			columnStr, err = val.definedColumnTypes()
+			if err != nil {
+				return
+			}
+			if err = s.setTVPCollation(columnStr, val.collationNames(), val.Columns); err != nil {
+				return
+			}
+			if val.inMemory() {
+				// a row that doesn't convert fails here, not while the
+				// request is sent
+				var buf bytes.Buffer
+				if err = val.encodeRows(&buf, schema, name, columnStr, rows); err != nil {
+					return
+				}
+				res.buffer = buf.Bytes()
+				res.ti.Size = len(res.buffer)
+				return
+			}
+			res.encoder = func(w io.Writer) error {
+				return val.encodeRows(w, schema, name, columnStr, rows)
+			}
+			return
+		}
 		columnStr, tvpFieldIndexes, errCalTypes := val.columnTypes()
 		if errCalTypes != nil {
 			err = errCalTypes
 			return
 		}
+		if err = s.setTVPCollation(columnStr, val.collationNames(), val.Columns); err != nil {
+			return
+		}
 		res.buffer, err = val.encode(schema, name, columnStr, tvpFieldIndexes)
 		if err != nil {
 			return
@@ -197,6 +295,30 @@ func (s *Stmt) makeParamExtra(val driver.Value) (res param, err error) {
 	return
 }
 
+// setTVPCollation sets the collation of the char columns of a TVP from
+// the collation names of the columns, see TVP.collationNames. The values
+// of columns without a collation are sent as UTF-8 like VarChar
+// parameters.
+func (s *Stmt) setTVPCollation(columnStr []columnStruct, names []string, columns []TVPColumn) error {
+	for i := range columnStr {
+		switch columnStr[i].ti.TypeId {
+		case typeBigChar, typeBigVarChar:
+		default:
+			continue
+		}
+		if i >= len(names) || names[i] == "" {
+			columnStr[i].ti.Collation = s.varCharCollation()
+			continue
+		}
+		col := s.c.collation(names[i], columns, i)
+		if col == (cp.Collation{}) {
+			return fmt.Errorf("mssql: collation %s of TVP column %d is not known or has a code page that cannot be sent", names[i], i)
+		}
+		columnStr[i].ti.Collation = col
+	}
+	return nil
+}
+
 func scanIntoOut(name string, fromServer, scanInto interface{}) error {
 	return convertAssign(scanInto, fromServer)
 }
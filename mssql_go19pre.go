@@ -3,6 +3,7 @@
 package mssql
 
 import (
+	"context"
 	"database/sql/driver"
 	"fmt"
 )
@@ -11,6 +12,10 @@ func (s *Stmt) makeParamExtra(val driver.Value) (param, error) {
 	return param{}, fmt.Errorf("mssql: unknown type for %T", val)
 }
 
+func bulkValueExtra(val interface{}) (interface{}, bool) {
+	return nil, false
+}
+
 func scanIntoOut(name string, fromServer, scanInto interface{}) error {
 	return fmt.Errorf("mssql: unsupported OUTPUT type, use a newer Go version")
 }
@@ -18,3 +23,7 @@ func scanIntoOut(name string, fromServer, scanInto interface{}) error {
 func isOutputValue(val driver.Value) bool {
 	return false
 }
+
+func (s *Stmt) resolveTVPCollations(ctx context.Context, sess *tdsSession, args []namedValue) error {
+	return nil
+}
@@ -247,3 +247,37 @@ func TestBadConnRejection(t *testing.T) {
 	}
 
 }
+
+func TestBeginTxReadOnly(t *testing.T) {
+	tests := []struct {
+		connector *Connector
+		opts      driver.TxOptions
+		expected  isoLevel
+	}{
+		// by default a read-only transaction is begun like any other
+		{nil, driver.TxOptions{ReadOnly: true}, isolationUseCurrent},
+		{&Connector{}, driver.TxOptions{ReadOnly: true}, isolationUseCurrent},
+		{&Connector{}, driver.TxOptions{ReadOnly: true, Isolation: driver.IsolationLevel(sql.LevelSerializable)}, isolationSerializable},
+		{&Connector{ReadOnlyTxIsolation: sql.LevelSnapshot}, driver.TxOptions{ReadOnly: true}, isolationSnapshot},
+		{&Connector{ReadOnlyTxIsolation: sql.LevelSnapshot}, driver.TxOptions{ReadOnly: true, Isolation: driver.IsolationLevel(sql.LevelReadCommitted)}, isolationReadCommited},
+		{&Connector{ReadOnlyTxIsolation: sql.LevelSnapshot}, driver.TxOptions{}, isolationUseCurrent},
+	}
+	for i, test := range tests {
+		transport := &testRPCTransport{}
+		c := &Conn{
+			connector:      test.connector,
+			sess:           &tdsSession{buf: newTdsBuffer(defaultPacketSize, transport)},
+			connectionGood: true,
+		}
+		var r testRPCResponse
+		r.done(&transport.responses)
+		if _, err := c.BeginTx(context.Background(), test.opts); err != nil {
+			t.Fatalf("test %d: %v", i, err)
+		}
+		// the isolation level follows the request type of the begin request
+		b := transport.requests.Bytes()
+		if got := isoLevel(b[8+22+2]); got != test.expected {
+			t.Errorf("test %d: expected isolation level %d, got %d", i, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// +build go1.9
+
+package mssql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// message types of the Service Broker queue of query notifications
+const (
+	qnMessageType        = "http://schemas.microsoft.com/SQL/Notifications/QueryNotification"
+	qnEndDialogType      = "http://schemas.microsoft.com/SQL/ServiceBroker/EndDialog"
+	qnErrorType          = "http://schemas.microsoft.com/SQL/ServiceBroker/Error"
+	qnDefaultWaitTimeout = time.Minute
+)
+
+// Notification is a query notification sent by the server when the result
+// of a query subscribed with Stmt.SetQueryNotification changes.
+type Notification struct {
+	// ID is the id the query was subscribed with.
+	ID string
+	// Type is "change" for changed results and "subscribe" when the
+	// subscription failed.
+	Type string
+	// Source is the cause of the notification, e.g. "data", "timeout",
+	// "object" or "statement".
+	Source string
+	// Info describes the cause, e.g. "insert", "update", "delete",
+	// "truncate", "expired" or "invalid".
+	Info string
+	// DatabaseID is the id of the database of the query.
+	DatabaseID int
+}
+
+type xmlQueryNotification struct {
+	XMLName    xml.Name `xml:"http://schemas.microsoft.com/SQL/Notifications/QueryNotification QueryNotification"`
+	Type       string   `xml:"type,attr"`
+	Source     string   `xml:"source,attr"`
+	Info       string   `xml:"info,attr"`
+	DatabaseID int      `xml:"database_id,attr"`
+	Message    string   `xml:"http://schemas.microsoft.com/SQL/Notifications/QueryNotification Message"`
+}
+
+func parseNotification(body string) (Notification, error) {
+	var n xmlQueryNotification
+	if err := xml.Unmarshal([]byte(body), &n); err != nil {
+		return Notification{}, fmt.Errorf("mssql: invalid query notification: %v", err)
+	}
+	return Notification{
+		ID:         n.Message,
+		Type:       n.Type,
+		Source:     n.Source,
+		Info:       n.Info,
+		DatabaseID: n.DatabaseID,
+	}, nil
+}
+
+// NotificationListener receives query notifications from a Service Broker
+// queue and dispatches them by the id of their subscription.
+//
+// The queue must belong to the service named in the options of
+// Stmt.SetQueryNotification, e.g. "service=WebCacheNotifications".
+type NotificationListener struct {
+	db    *sql.DB
+	queue string
+
+	// WaitTimeout limits how long a single RECEIVE waits for messages,
+	// one minute when not set.
+	WaitTimeout time.Duration
+
+	// OnError is called with the error of a message of the queue that is
+	// not a valid query notification. The message is dropped, it was
+	// already removed from the queue, and Listen goes on with the others.
+	OnError func(error)
+
+	mu       sync.Mutex
+	handlers map[string]func(context.Context, Notification)
+}
+
+// NewNotificationListener returns a listener for the queue, the name is
+// used as written in T-SQL, e.g. "[dbo].[WebCacheMessages]".
+func NewNotificationListener(db *sql.DB, queue string) *NotificationListener {
+	return &NotificationListener{
+		db:       db,
+		queue:    queue,
+		handlers: make(map[string]func(context.Context, Notification)),
+	}
+}
+
+// Subscribe calls fn with the notifications of the subscription id. It
+// replaces the previous handler of the id. fn is called on the goroutine
+// running Listen.
+func (l *NotificationListener) Subscribe(id string, fn func(Notification)) {
+	l.subscribe(id, func(ctx context.Context, n Notification) {
+		fn(n)
+	})
+}
+
+// SubscribeChan sends the notifications of the subscription id to ch.
+// Listen blocks until ch accepts the notification or the context of
+// Listen is done, the notification is dropped then.
+func (l *NotificationListener) SubscribeChan(id string, ch chan<- Notification) {
+	l.subscribe(id, func(ctx context.Context, n Notification) {
+		select {
+		case ch <- n:
+		case <-ctx.Done():
+		}
+	})
+}
+
+func (l *NotificationListener) subscribe(id string, fn func(context.Context, Notification)) {
+	l.mu.Lock()
+	l.handlers[id] = fn
+	l.mu.Unlock()
+}
+
+// Unsubscribe removes the handler of the subscription id. Notifications
+// without a handler are dropped.
+func (l *NotificationListener) Unsubscribe(id string) {
+	l.mu.Lock()
+	delete(l.handlers, id)
+	l.mu.Unlock()
+}
+
+func (l *NotificationListener) dispatch(ctx context.Context, n Notification) {
+	l.mu.Lock()
+	fn := l.handlers[n.ID]
+	l.mu.Unlock()
+	if fn != nil {
+		fn(ctx, n)
+	}
+}
+
+// notification parses the body of a query notification message. A body
+// that can't be parsed is reported to OnError.
+func (l *NotificationListener) notification(body string) (Notification, bool) {
+	n, err := parseNotification(body)
+	if err != nil {
+		if l.OnError != nil {
+			l.OnError(err)
+		}
+		return n, false
+	}
+	return n, true
+}
+
+// Listen receives messages from the queue on a dedicated connection and
+// dispatches the notifications until ctx is done or receiving fails.
+func (l *NotificationListener) Listen(ctx context.Context) error {
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	timeout := l.WaitTimeout
+	if timeout <= 0 {
+		timeout = qnDefaultWaitTimeout
+	}
+	query := fmt.Sprintf("waitfor (receive message_type_name, cast(message_body as xml), conversation_handle from %s), timeout %d",
+		l.queue, timeout/time.Millisecond)
+	for {
+		if err = l.receive(ctx, conn, query); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+	}
+}
+
+// receive runs one RECEIVE and dispatches the messages it returned.
+func (l *NotificationListener) receive(ctx context.Context, conn *sql.Conn, query string) error {
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	var notifications []Notification
+	var ended []UniqueIdentifier
+	for rows.Next() {
+		var msgType string
+		var body sql.NullString
+		var handle UniqueIdentifier
+		if err = rows.Scan(&msgType, &body, &handle); err != nil {
+			rows.Close()
+			return err
+		}
+		switch msgType {
+		case qnMessageType:
+			// the other messages of the batch are dispatched also when
+			// one of them is malformed
+			if n, ok := l.notification(body.String); ok {
+				notifications = append(notifications, n)
+			}
+		case qnEndDialogType, qnErrorType:
+			ended = append(ended, handle)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, handle := range ended {
+		if _, err = conn.ExecContext(ctx, fmt.Sprintf("end conversation '%s'", handle)); err != nil {
+			return err
+		}
+	}
+	for _, n := range notifications {
+		l.dispatch(ctx, n)
+	}
+	return nil
+}
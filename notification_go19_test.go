@@ -0,0 +1,67 @@
+// +build go1.9
+
+package mssql
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParseNotification(t *testing.T) {
+	body := `<qn:QueryNotification xmlns:qn="http://schemas.microsoft.com/SQL/Notifications/QueryNotification" id="11" type="change" source="data" info="insert" database_id="5" sid="0x01"><qn:Message>orders</qn:Message></qn:QueryNotification>`
+	n, err := parseNotification(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Notification{ID: "orders", Type: "change", Source: "data", Info: "insert", DatabaseID: 5}
+	if n != expected {
+		t.Errorf("expected %+v, got %+v", expected, n)
+	}
+	if _, err = parseNotification("<other/>"); err == nil {
+		t.Error("expected an error for a message that is not a query notification")
+	}
+}
+
+func TestNotificationDispatch(t *testing.T) {
+	l := NewNotificationListener(nil, "queue")
+	var got []string
+	l.Subscribe("a", func(n Notification) { got = append(got, "a:"+n.Info) })
+	ch := make(chan Notification, 1)
+	l.SubscribeChan("b", ch)
+
+	ctx := context.Background()
+	l.dispatch(ctx, Notification{ID: "a", Info: "insert"})
+	l.dispatch(ctx, Notification{ID: "b", Info: "delete"})
+	l.dispatch(ctx, Notification{ID: "c", Info: "update"})
+	l.Unsubscribe("a")
+	l.dispatch(ctx, Notification{ID: "a", Info: "truncate"})
+
+	if len(got) != 1 || got[0] != "a:insert" {
+		t.Errorf("unexpected notifications of a: %v", got)
+	}
+	if n := <-ch; n.Info != "delete" {
+		t.Errorf("unexpected notification of b: %+v", n)
+	}
+}
+
+func TestNotificationChanFull(t *testing.T) {
+	l := NewNotificationListener(nil, "queue")
+	ch := make(chan Notification)
+	l.SubscribeChan("b", ch)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// nobody reads ch, the send gives up when the context is done
+	l.dispatch(ctx, Notification{ID: "b", Info: "delete"})
+}
+
+func TestNotificationMalformed(t *testing.T) {
+	l := NewNotificationListener(nil, "queue")
+	if _, ok := l.notification("<other/>"); ok {
+		t.Fatal("a malformed message must be skipped")
+	}
+	var reported []error
+	l.OnError = func(err error) { reported = append(reported, err) }
+	if _, ok := l.notification("<other/>"); ok || len(reported) != 1 {
+		t.Errorf("a malformed message must be reported to OnError, got %v", reported)
+	}
+}
@@ -0,0 +1,245 @@
+package mssql
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// StreamPLP, passed as a query argument, makes Rows return a large value
+// in the last column of a result set as a *PLPReader, which reads the value
+// from the connection as it is consumed instead of loading it into memory.
+//
+// Large values are varchar(max), nvarchar(max), varbinary(max), xml and
+// CLR types. Values are streamed only from the last column, select large
+// values last, e.g.
+//
+//	rows, err := db.QueryContext(ctx, "select name, content from files", mssql.StreamPLP{})
+//	...
+//	var name string
+//	var content io.Reader
+//	err = rows.Scan(&name, &content)
+//
+// A NULL value is returned as nil instead of a reader.
+type StreamPLP struct{}
+
+var errPLPReaderReleased = errors.New("mssql: PLPReader used after Rows.Next, Rows.NextResultSet or Rows.Close")
+
+// PLPReader streams the value of a large column. It reads the raw value:
+// binary data as is, varchar in the code page of the column collation,
+// nvarchar and xml in UTF-16LE.
+//
+// The reader is valid until the next call to Next, NextResultSet or Close
+// of the Rows it was returned by. The part of the value not read by then
+// is skipped.
+type PLPReader struct {
+	// mu guards against Rows.Close being called while the value is read,
+	// e.g. when the query context is canceled
+	mu   sync.Mutex
+	buf  *tdsBuffer
+	size uint64
+	// left is the number of bytes left in the current chunk
+	left uint32
+	// eof is set when the terminating chunk was read
+	eof      bool
+	closed   bool
+	released bool
+	// err is the stream error, the connection can't be used after it
+	err  error
+	done chan struct{}
+}
+
+// newPLPReader reads the length of a PLP value. It returns nil for NULL.
+func newPLPReader(r *tdsBuffer) *PLPReader {
+	size := r.uint64()
+	if size == _PLP_NULL {
+		return nil
+	}
+	return &PLPReader{
+		buf:  r,
+		size: size,
+		done: make(chan struct{}),
+	}
+}
+
+// Size returns the length of the value in bytes, -1 if the server did
+// not send the length up front.
+func (p *PLPReader) Size() int64 {
+	if p.size == _UNKNOWN_PLP_LEN {
+		return -1
+	}
+	return int64(p.size)
+}
+
+// Read implements io.Reader.
+func (p *PLPReader) Read(b []byte) (n int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.released {
+		return 0, errPLPReaderReleased
+	}
+	if p.closed {
+		return 0, errors.New("mssql: read from closed PLPReader")
+	}
+	return p.read(b)
+}
+
+func (p *PLPReader) read(b []byte) (n int, err error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			if e, ok := v.(error); ok {
+				p.err = e
+			} else {
+				p.err = fmt.Errorf("%v", v)
+			}
+			err = p.err
+		}
+	}()
+	for p.left == 0 {
+		if p.eof {
+			return 0, io.EOF
+		}
+		p.left = p.buf.uint32()
+		if p.left == 0 {
+			p.eof = true
+		}
+	}
+	if len(b) > int(p.left) {
+		b = b[:p.left]
+	}
+	n, err = p.buf.Read(b)
+	p.left -= uint32(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		p.err = err
+	}
+	return n, err
+}
+
+// Close marks the value as consumed, the rest of it is skipped.
+func (p *PLPReader) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	return nil
+}
+
+// release reads the rest of the value and hands the connection back to
+// the response reader.
+func (p *PLPReader) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.released {
+		return
+	}
+	p.released = true
+	if p.err == nil {
+		_, _ = io.Copy(ioutil.Discard, readerFunc(p.read))
+	}
+	close(p.done)
+}
+
+// wait blocks the response reader until the value was consumed.
+func (p *PLPReader) wait() error {
+	<-p.done
+	return p.err
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(b []byte) (int, error) {
+	return f(b)
+}
+
+// isPLP reports whether values of a type are sent as PLP.
+func isPLP(ti *typeInfo) bool {
+	switch ti.TypeId {
+	case typeXml, typeUdt:
+		return true
+	case typeBigVarBin, typeBigVarChar, typeNVarChar:
+		return ti.Size == 0xffff
+	}
+	return false
+}
+
+// streamedColumn reports whether the last column is streamed.
+func streamedColumn(columns []columnStruct, stream bool) bool {
+	if !stream || len(columns) == 0 {
+		return false
+	}
+	last := &columns[len(columns)-1]
+	return last.cryptoMeta == nil && isPLP(&last.ti)
+}
+
+// parseRowStream is parseRow for rows whose last column is streamed.
+func parseRowStream(r *tdsBuffer, columns []columnStruct, row []interface{}) *PLPReader {
+	last := len(columns) - 1
+	parseRow(r, columns[:last], row[:last])
+	return setStream(row, newPLPReader(r))
+}
+
+// parseNbcRowStream is parseNbcRow for rows whose last column is streamed.
+func parseNbcRowStream(r *tdsBuffer, columns []columnStruct, row []interface{}) *PLPReader {
+	bitlen := (len(columns) + 7) / 8
+	pres := make([]byte, bitlen)
+	r.ReadFull(pres)
+	last := len(columns) - 1
+	for i := range columns {
+		if pres[i/8]&(1<<(uint(i)%8)) != 0 {
+			row[i] = nil
+			continue
+		}
+		if i == last {
+			return setStream(row, newPLPReader(r))
+		}
+		ti := columns[i].wireTypeInfo()
+		row[i] = ti.Reader(ti, r)
+	}
+	return nil
+}
+
+func setStream(row []interface{}, p *PLPReader) *PLPReader {
+	if p == nil {
+		row[len(row)-1] = nil
+	} else {
+		row[len(row)-1] = p
+	}
+	return p
+}
+
+// rowStream returns the reader streaming the last column of a row.
+func rowStream(tok tokenStruct) *PLPReader {
+	row, ok := tok.([]interface{})
+	if !ok || len(row) == 0 {
+		return nil
+	}
+	p, _ := row[len(row)-1].(*PLPReader)
+	return p
+}
+
+// releaseStream hands the connection back to the response reader when
+// the previous row was streamed.
+func (sess *tdsSession) releaseStream() {
+	if sess.stream != nil {
+		sess.stream.release()
+		sess.stream = nil
+	}
+}
+
+// waitStream blocks the response reader until a streamed value was
+// consumed. A broken stream leaves the connection unusable.
+func waitStream(p *PLPReader) {
+	if p == nil {
+		return
+	}
+	if err := p.wait(); err != nil {
+		badStreamPanic(err)
+	}
+}
@@ -0,0 +1,138 @@
+package mssql
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// testPLPResponse returns a response with an int and a varbinary(max)
+// column, the second column of each row holds the given chunks, nil
+// chunks for NULL.
+func testPLPResponse(rows ...[]string) *tdsSession {
+	var b []byte
+	u16 := func(v uint16) { b = append(b, byte(v), byte(v>>8)) }
+	u32 := func(v uint32) { b = append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24)) }
+	u64 := func(v uint64) { u32(uint32(v)); u32(uint32(v >> 32)) }
+	b = append(b, byte(tokenColMetadata))
+	u16(2)
+	u32(0)
+	u16(0)
+	b = append(b, typeIntN, 4)
+	b = appendBVarChar(b, "id")
+	u32(0)
+	u16(colFlagNullable)
+	b = append(b, typeBigVarBin)
+	u16(0xffff)
+	b = appendBVarChar(b, "content")
+	for i, chunks := range rows {
+		b = append(b, byte(tokenRow), 4)
+		u32(uint32(i))
+		if chunks == nil {
+			u64(_PLP_NULL)
+			continue
+		}
+		u64(_UNKNOWN_PLP_LEN)
+		for _, c := range chunks {
+			u32(uint32(len(c)))
+			b = append(b, c...)
+		}
+		u32(0)
+	}
+	b = append(b, byte(tokenDone))
+	u16(doneCount)
+	u16(0)
+	u64(uint64(len(rows)))
+
+	packet := []byte{byte(packReply), 1, 0, 0, 0, 0, 1, 0}
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)+len(b)))
+	packet = append(packet, b...)
+	return &tdsSession{
+		buf: newTdsBuffer(defaultPacketSize, closableBuffer{bytes.NewBuffer(packet)}),
+	}
+}
+
+func TestPLPReaderStreaming(t *testing.T) {
+	sess := testPLPResponse([]string{"hello", " ", "world"}, []string{"abcdef", "ghi"}, nil, []string{"last"})
+	reader := startReading(sess, context.Background(), outputs{streamPLP: true})
+
+	var rows [][]interface{}
+	for {
+		tok, err := reader.nextToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tok == nil {
+			break
+		}
+		row, ok := tok.([]interface{})
+		if !ok {
+			continue
+		}
+		rows = append(rows, row)
+		switch len(rows) {
+		case 1:
+			p := row[1].(*PLPReader)
+			if p.Size() != -1 {
+				t.Errorf("unexpected size %d", p.Size())
+			}
+			content, err := ioutil.ReadAll(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != "hello world" {
+				t.Errorf("unexpected content %q", content)
+			}
+		case 2:
+			// the rest is skipped by the next row
+			buf := make([]byte, 2)
+			if _, err := io.ReadFull(row[1].(*PLPReader), buf); err != nil {
+				t.Fatal(err)
+			}
+			if string(buf) != "ab" {
+				t.Errorf("unexpected content %q", buf)
+			}
+		case 3:
+			if row[1] != nil {
+				t.Errorf("NULL must not be streamed, got %v", row[1])
+			}
+		case 4:
+			// left unread, released at the end of the response
+			row[1].(*PLPReader).Close()
+		}
+	}
+	if len(rows) != 4 {
+		t.Fatalf("expected 4 rows, got %d", len(rows))
+	}
+	if _, err := rows[0][1].(*PLPReader).Read(make([]byte, 1)); err != errPLPReaderReleased {
+		t.Errorf("expected error for released reader, got %v", err)
+	}
+	if id, ok := rows[3][0].(int64); !ok || id != 3 {
+		t.Errorf("unexpected id %v", rows[3][0])
+	}
+}
+
+func TestPLPReaderNotRead(t *testing.T) {
+	// exec ignores rows, streams must not block the response
+	sess := testPLPResponse([]string{"abc"}, []string{"def"})
+	reader := startReading(sess, context.Background(), outputs{streamPLP: true})
+	if err := reader.iterateResponse(); err != nil {
+		t.Fatal(err)
+	}
+	if reader.rowCount != 2 {
+		t.Errorf("unexpected row count %d", reader.rowCount)
+	}
+
+	// without streaming values are read into memory
+	sess = testPLPResponse([]string{"abc", "def"})
+	reader = startReading(sess, context.Background(), outputs{})
+	if err := reader.iterateResponse(); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := reader.lastRow[1].([]byte); !ok || string(v) != "abcdef" {
+		t.Errorf("unexpected value %v", reader.lastRow[1])
+	}
+}
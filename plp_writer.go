@@ -0,0 +1,104 @@
+package mssql
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"unicode"
+	"unicode/utf16"
+)
+
+// VarBinaryStream is a varbinary(max) parameter read from R as the request
+// is sent, so the value doesn't have to be held in memory. A nil R sends
+// NULL. A plain io.Reader parameter is sent as VarBinaryStream.
+//
+// An error returned by R leaves the connection unusable, the request can't
+// be completed once part of it was sent. The request is not retried on
+// another connection, R was read in part.
+type VarBinaryStream struct {
+	R io.Reader
+}
+
+// NVarCharStream is an nvarchar(max) parameter read from R as the request
+// is sent. R returns UTF-8 text, it is converted to UTF-16 on the fly.
+// A nil R sends NULL.
+type NVarCharStream struct {
+	R io.Reader
+}
+
+func makeStreamParam(typeId uint8, r io.Reader) (res param) {
+	res.ti.TypeId = typeId
+	// zero size forces (max) types, which are sent as PLP
+	res.ti.Size = 0
+	res.reader = r
+	return
+}
+
+// writePLPStream writes the value read from r as PLP of unknown length,
+// in chunks of chunkSize bytes.
+func writePLPStream(w io.Writer, r io.Reader, chunkSize int) (err error) {
+	if err = binary.Write(w, binary.LittleEndian, uint64(_UNKNOWN_PLP_LEN)); err != nil {
+		return
+	}
+	chunk := make([]byte, chunkSize)
+	for {
+		n, rerr := io.ReadFull(r, chunk)
+		if n > 0 {
+			if err = binary.Write(w, binary.LittleEndian, uint32(n)); err != nil {
+				return
+			}
+			if _, err = w.Write(chunk[:n]); err != nil {
+				return
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+	return binary.Write(w, binary.LittleEndian, uint32(_PLP_TERMINATOR))
+}
+
+// ucs2Reader converts UTF-8 text to UTF-16LE, the way str2ucs2 does for
+// strings. Invalid UTF-8 is replaced with U+FFFD.
+type ucs2Reader struct {
+	r    *bufio.Reader
+	pend []byte
+	tmp  [4]byte
+}
+
+func newUcs2Reader(r io.Reader) *ucs2Reader {
+	return &ucs2Reader{r: bufio.NewReader(r)}
+}
+
+func (u *ucs2Reader) Read(b []byte) (n int, err error) {
+	for n < len(b) {
+		if len(u.pend) == 0 {
+			// don't block on the source once there is something to return
+			if n > 0 && u.r.Buffered() == 0 {
+				return n, nil
+			}
+			var r rune
+			if r, _, err = u.r.ReadRune(); err != nil {
+				return n, err
+			}
+			u.pend = u.encode(r)
+		}
+		c := copy(b[n:], u.pend)
+		u.pend = u.pend[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (u *ucs2Reader) encode(r rune) []byte {
+	if r1, r2 := utf16.EncodeRune(r); r1 != unicode.ReplacementChar {
+		binary.LittleEndian.PutUint16(u.tmp[0:], uint16(r1))
+		binary.LittleEndian.PutUint16(u.tmp[2:], uint16(r2))
+		return u.tmp[:4]
+	}
+	binary.LittleEndian.PutUint16(u.tmp[0:], uint16(r))
+	return u.tmp[:2]
+}
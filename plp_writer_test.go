@@ -0,0 +1,123 @@
+package mssql
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestWritePLPStream(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writePLPStream(&buf, strings.NewReader("abcdefghij"), 4); err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{
+		0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		4, 0, 0, 0, 'a', 'b', 'c', 'd',
+		4, 0, 0, 0, 'e', 'f', 'g', 'h',
+		2, 0, 0, 0, 'i', 'j',
+		0, 0, 0, 0,
+	}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("unexpected PLP stream\n% x\nexpected\n% x", buf.Bytes(), expected)
+	}
+
+	buf.Reset()
+	if err := writePLPStream(&buf, strings.NewReader(""), 4); err != nil {
+		t.Fatal(err)
+	}
+	expected = []byte{0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("unexpected empty PLP stream % x", buf.Bytes())
+	}
+
+	if err := writePLPStream(&buf, iotest.TimeoutReader(strings.NewReader("abcdefghij")), 4); err != iotest.ErrTimeout {
+		t.Errorf("expected the reader error, got %v", err)
+	}
+}
+
+func TestUcs2Reader(t *testing.T) {
+	for _, s := range []string{"", "hello", "žluťoučký kůň", "emoji 😀 and more", "invalid \xff utf-8"} {
+		var out bytes.Buffer
+		r := iotest.OneByteReader(newUcs2Reader(iotest.OneByteReader(strings.NewReader(s))))
+		if _, err := out.ReadFrom(r); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), str2ucs2(s)) {
+			t.Errorf("%q converted to % x, expected % x", s, out.Bytes(), str2ucs2(s))
+		}
+	}
+}
+
+func TestStreamParam(t *testing.T) {
+	s := &Stmt{c: &Conn{sess: &tdsSession{}}}
+	send := func(p param) []byte {
+		var out bytes.Buffer
+		buf := newTdsBuffer(defaultPacketSize, closableBuffer{&out})
+		if err := sendRpc(buf, nil, sp_ExecuteSql, 0, []param{p}, false); err != nil {
+			t.Fatal(err)
+		}
+		return out.Bytes()
+	}
+
+	p, err := s.makeParam(VarBinaryStream{R: strings.NewReader("abc")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if makeDecl(p.ti) != "varbinary(max)" {
+		t.Errorf("VarBinaryStream declared as %s", makeDecl(p.ti))
+	}
+	expected := param{ti: typeInfo{TypeId: typeBigVarBin}, buffer: []byte("abc")}
+	if got, exp := send(p), send(expected); !bytes.Equal(got, exp) {
+		t.Errorf("streamed parameter sent as\n% x\nexpected\n% x", got, exp)
+	}
+
+	p, err = s.makeParam(NVarCharStream{R: strings.NewReader("ü")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if makeDecl(p.ti) != "nvarchar(max)" {
+		t.Errorf("NVarCharStream declared as %s", makeDecl(p.ti))
+	}
+	expected = param{ti: typeInfo{TypeId: typeNVarChar}, buffer: str2ucs2("ü")}
+	if got, exp := send(p), send(expected); !bytes.Equal(got, exp) {
+		t.Errorf("streamed parameter sent as\n% x\nexpected\n% x", got, exp)
+	}
+
+	p, err = s.makeParam(NVarCharStream{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = param{ti: typeInfo{TypeId: typeNVarChar}}
+	if got, exp := send(p), send(expected); !bytes.Equal(got, exp) {
+		t.Errorf("NULL stream sent as\n% x\nexpected\n% x", got, exp)
+	}
+}
+
+func TestStreamParamSendError(t *testing.T) {
+	transport := &testRPCTransport{}
+	c := &Conn{
+		connector:      &Connector{},
+		sess:           &tdsSession{buf: newTdsBuffer(defaultPacketSize, transport)},
+		connectionGood: true,
+	}
+	s := &Stmt{c: c, query: "select datalength(@p1)"}
+	// the reader fails after the first chunk was sent
+	r := iotest.TimeoutReader(strings.NewReader(strings.Repeat("x", 10000)))
+	_, err := s.exec(context.Background(), []namedValue{{Name: "p1", Ordinal: 1, Value: VarBinaryStream{R: r}}})
+	if err == nil {
+		t.Fatal("expected the reader error")
+	}
+	if _, retryable := err.(RetryableError); retryable || err == driver.ErrBadConn {
+		t.Errorf("a partly read stream must not be retried, got %#v", err)
+	}
+	if !strings.Contains(err.Error(), iotest.ErrTimeout.Error()) {
+		t.Errorf("expected the reader error, got %v", err)
+	}
+	if c.connectionGood {
+		t.Error("the connection must be marked bad")
+	}
+}
@@ -0,0 +1,200 @@
+package mssql
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/denisenkom/go-mssqldb/msdsn"
+)
+
+// Statements of connections using msdsn.PreparePrepExec are prepared with
+// sp_prepexec and run by handle with sp_execute afterwards. A handle belongs
+// to the query text and the declarations of its parameters, the statement
+// is prepared again when the parameter types change.
+//
+// database/sql prepares a statement for every query that is not prepared
+// by the application too, so without a statement cache a statement is
+// prepared on its second execution only. Its first execution uses
+// sp_executesql, a handle used once would only add the round trip of
+// sp_unprepare.
+//
+// Handles don't survive a reset or a recovery of the session, they are
+// dropped then without calling sp_unprepare.
+
+// unprepareTimeout limits the sp_unprepare call of Stmt.Close, which has
+// no context to cancel it.
+const unprepareTimeout = 5 * time.Second
+
+// preparedHandle is the handle of a prepared statement.
+type preparedHandle struct {
+	handle int32
+	// key is the query text and the parameter declarations
+	key string
+	// sess is the session the statement was prepared on, epoch the
+	// connection's session epoch at the time
+	sess  *tdsSession
+	epoch int
+}
+
+func (c *Conn) prepareMethod() msdsn.PrepareMethod {
+	if c.connector == nil {
+		return msdsn.PrepareExecuteSQL
+	}
+	return c.connector.params.PrepareMethod
+}
+
+// valid reports whether the server still knows the handle.
+func (h *preparedHandle) valid(c *Conn, sess *tdsSession) bool {
+	return h.handle != 0 && h.sess == sess && h.epoch == c.sessionEpoch
+}
+
+// prepareCall turns an sp_executesql call into sp_prepexec or, once the
+// statement is prepared, sp_execute. params are the sp_executesql
+// parameters: the query, the declarations and the arguments.
+//
+// Without a statement cache the first execution of a statement stays an
+// sp_executesql call: database/sql prepares the statements of Exec and
+// Query calls too and closes them after one execution, preparing them
+// would add an sp_unprepare round trip to each of those calls.
+func (s *Stmt) prepareCall(ctx context.Context, sess *tdsSession, params []param, decls string) (procId, []param) {
+	key := s.query + "\x00" + decls
+	if s.prepared.handle != 0 && (s.prepared.key != key || !s.prepared.valid(s.c, sess)) {
+		// the parameter types changed or the handle is gone, the
+		// statement is prepared again also when the old handle can't be
+		// released
+		if err := s.unprepare(ctx); err != nil && s.c.sess.logFlags&logErrors != 0 {
+			s.c.sess.logger.Log(ctx, msdsn.LogErrors, fmt.Sprintf("Failed to unprepare statement: %v", err))
+		}
+	}
+	var cache *stmtCache
+	if s.sess == nil {
+		cache = s.c.statementCache()
+	}
+	if s.prepared.handle == 0 && cache != nil {
+		if handle := cache.take(key); handle != 0 {
+			s.prepared = preparedHandle{handle: handle, key: key, sess: sess, epoch: s.c.sessionEpoch}
+		}
+	}
+	if s.prepared.handle != 0 {
+		res := make([]param, 0, len(params)-1)
+		res = append(res, makeIntParam(s.prepared.handle, false))
+		return sp_Execute, append(res, params[2:]...)
+	}
+	if cache == nil && !s.executed {
+		s.executed = true
+		return sp_ExecuteSql, params
+	}
+	s.prepared = preparedHandle{key: key, sess: sess, epoch: s.c.sessionEpoch}
+	s.c.outs.returnValues = append(s.c.outs.returnValues, &s.prepared.handle)
+	res := make([]param, 0, len(params)+1)
+	res = append(res, makeIntParam(0, true), params[1], params[0])
+	return sp_PrepExec, append(res, params[2:]...)
+}
+
+// unprepare releases the handle of the statement. The handle is kept in
+// the statement cache of the connection when there is one.
+func (s *Stmt) unprepare(ctx context.Context) error {
+	h := s.prepared
+	s.prepared = preparedHandle{}
+	if !h.valid(s.c, s.sessionOrConn()) || !s.c.connectionGood {
+		return nil
+	}
+	if s.sess == nil {
+		if cache := s.c.statementCache(); cache != nil {
+			for _, evicted := range cache.put(h.key, h.handle) {
+				if err := s.c.sendUnprepare(ctx, h.sess, evicted); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return s.c.sendUnprepare(ctx, h.sess, h.handle)
+}
+
+func (c *Conn) sendUnprepare(ctx context.Context, sess *tdsSession, handle int32) error {
+	headers := []headerStruct{
+		{hdrtype: dataStmHdrTransDescr,
+			data: transDescrHdr{c.sess.tranid, 1}.pack()},
+	}
+	reset := c.resetSession
+	c.resetSession = false
+	if err := sendRpc(sess.buf, headers, sp_Unprepare, 0, []param{makeIntParam(handle, false)}, reset); err != nil {
+		if c.sess.logFlags&logErrors != 0 {
+			c.sess.logger.Log(ctx, msdsn.LogErrors, fmt.Sprintf("Failed to send Rpc with %v", err))
+		}
+		c.connectionGood = false
+		return fmt.Errorf("failed to send RPC: %v", err)
+	}
+	reader := startReading(sess, ctx, outputs{})
+	return c.checkBadConn(ctx, reader.iterateResponse(), false)
+}
+
+// statementCache returns the statement cache of the connection, nil if
+// it is disabled. Statements of MARS sessions are not cached.
+func (c *Conn) statementCache() *stmtCache {
+	if c.connector == nil || c.connector.params.StatementCacheSize <= 0 || c.sess.mars != nil {
+		return nil
+	}
+	if c.stmtCache == nil || c.stmtCache.sess != c.sess || c.stmtCache.epoch != c.sessionEpoch {
+		c.stmtCache = newStmtCache(c.connector.params.StatementCacheSize, c.sess, c.sessionEpoch)
+	}
+	return c.stmtCache
+}
+
+// stmtCache is an LRU cache of the handles of closed statements, keyed by
+// the query text and the parameter declarations.
+type stmtCache struct {
+	size    int
+	sess    *tdsSession
+	epoch   int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type stmtCacheEntry struct {
+	key    string
+	handle int32
+}
+
+func newStmtCache(size int, sess *tdsSession, epoch int) *stmtCache {
+	return &stmtCache{
+		size:    size,
+		sess:    sess,
+		epoch:   epoch,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// take removes the handle of a statement from the cache, it returns 0 if
+// the statement is not cached.
+func (c *stmtCache) take(key string) int32 {
+	e, ok := c.entries[key]
+	if !ok {
+		return 0
+	}
+	c.order.Remove(e)
+	delete(c.entries, key)
+	return e.Value.(*stmtCacheEntry).handle
+}
+
+// put adds the handle of a statement to the cache. It returns the handles
+// that don't fit in the cache anymore, they have to be unprepared.
+func (c *stmtCache) put(key string, handle int32) (evicted []int32) {
+	if e, ok := c.entries[key]; ok {
+		// another statement with the same query was closed before
+		c.order.MoveToFront(e)
+		return []int32{handle}
+	}
+	c.entries[key] = c.order.PushFront(&stmtCacheEntry{key: key, handle: handle})
+	for c.order.Len() > c.size {
+		e := c.order.Back()
+		entry := c.order.Remove(e).(*stmtCacheEntry)
+		delete(c.entries, entry.key)
+		evicted = append(evicted, entry.handle)
+	}
+	return evicted
+}
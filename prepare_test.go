@@ -0,0 +1,178 @@
+package mssql
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/denisenkom/go-mssqldb/msdsn"
+)
+
+func TestPrepExec(t *testing.T) {
+	transport := &testRPCTransport{}
+	c := &Conn{
+		connector:      &Connector{params: msdsn.Config{PrepareMethod: msdsn.PreparePrepExec, StatementCacheSize: 1}},
+		sess:           &tdsSession{buf: newTdsBuffer(defaultPacketSize, transport)},
+		connectionGood: true,
+	}
+	ctx := context.Background()
+	var r testRPCResponse
+	exec := func(s *Stmt, arg interface{}) {
+		t.Helper()
+		if _, err := s.exec(ctx, []namedValue{{Ordinal: 1, Value: arg}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(step string, expected ...testRPCRequest) {
+		t.Helper()
+		got := transport.rpcRequests()
+		if len(got) != len(expected) {
+			t.Fatalf("%s: expected requests %v, got %v", step, expected, got)
+		}
+		for i := range got {
+			if got[i].proc != expected[i].proc || (expected[i].firstInt != 0 && got[i].firstInt != expected[i].firstInt) {
+				t.Errorf("%s: expected requests %v, got %v", step, expected, got)
+			}
+		}
+	}
+	prepExec := testRPCRequest{proc: sp_PrepExec.id}
+	execute := func(handle int32) testRPCRequest {
+		return testRPCRequest{proc: sp_Execute.id, firstInt: handle}
+	}
+	unprepare := func(handle int32) testRPCRequest {
+		return testRPCRequest{proc: sp_Unprepare.id, firstInt: handle}
+	}
+
+	s1, _ := c.prepareContext(ctx, "select @p1")
+	r.returnValue(5)
+	r.done(&transport.responses)
+	exec(s1, int64(1))
+	expect("first execution", prepExec)
+
+	r.done(&transport.responses)
+	exec(s1, int64(2))
+	expect("second execution", execute(5))
+
+	r.returnValue(6)
+	r.done(&transport.responses)
+	exec(s1, "text")
+	expect("execution with other parameter types", prepExec)
+	r.done(&transport.responses)
+	if err := s1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expect("close, the handle of the first parameter types is evicted", unprepare(5))
+
+	s2, _ := c.prepareContext(ctx, "select @p1")
+	r.done(&transport.responses)
+	exec(s2, "text")
+	expect("execution of a cached statement", execute(6))
+
+	s3, _ := c.prepareContext(ctx, "select @p1 + 1")
+	r.returnValue(7)
+	r.done(&transport.responses)
+	exec(s3, int64(1))
+	expect("execution of another statement", prepExec)
+	if err := s3.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r.done(&transport.responses)
+	if err := s2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expect("close with a full cache", unprepare(7))
+
+	c.sessionEpoch++
+	s4, _ := c.prepareContext(ctx, "select @p1")
+	r.returnValue(8)
+	r.done(&transport.responses)
+	exec(s4, "text")
+	expect("execution after a session reset", prepExec)
+}
+
+func TestPrepExecWithoutCache(t *testing.T) {
+	for _, method := range []msdsn.PrepareMethod{msdsn.PrepareExecuteSQL, msdsn.PreparePrepExec} {
+		transport := &testRPCTransport{}
+		c := &Conn{
+			connector:      &Connector{params: msdsn.Config{PrepareMethod: method}},
+			sess:           &tdsSession{buf: newTdsBuffer(defaultPacketSize, transport)},
+			connectionGood: true,
+		}
+		ctx := context.Background()
+		var r testRPCResponse
+		exec := func(s *Stmt) {
+			t.Helper()
+			if _, err := s.exec(ctx, []namedValue{{Ordinal: 1, Value: int64(1)}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// a statement executed once, like the queries database/sql
+		// prepares itself
+		s, _ := c.prepareContext(ctx, "select @p1")
+		r.done(&transport.responses)
+		exec(s)
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		got := transport.rpcRequests()
+		if len(got) != 1 || got[0].proc != sp_ExecuteSql.id {
+			t.Errorf("%v: expected sp_executesql without unprepare, got %v", method, got)
+		}
+
+		s, _ = c.prepareContext(ctx, "select @p1")
+		r.done(&transport.responses)
+		exec(s)
+		r.returnValue(5)
+		r.done(&transport.responses)
+		exec(s)
+		r.done(&transport.responses)
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		got = transport.rpcRequests()
+		switch method {
+		case msdsn.PrepareExecuteSQL:
+			if len(got) != 2 || got[0].proc != sp_ExecuteSql.id || got[1].proc != sp_ExecuteSql.id {
+				t.Errorf("expected sp_executesql twice without unprepare, got %v", got)
+			}
+		case msdsn.PreparePrepExec:
+			if len(got) != 3 || got[0].proc != sp_ExecuteSql.id || got[1].proc != sp_PrepExec.id ||
+				got[2].proc != sp_Unprepare.id || got[2].firstInt != 5 {
+				t.Errorf("expected sp_executesql, sp_prepexec and sp_unprepare of handle 5, got %v", got)
+			}
+		}
+	}
+}
+
+// failingWriteTransport fails all writes and records whether it was closed.
+type failingWriteTransport struct {
+	testRPCTransport
+	closed bool
+}
+
+func (t *failingWriteTransport) Write(b []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func (t *failingWriteTransport) Close() error {
+	t.closed = true
+	return nil
+}
+
+func TestStmtCloseUnprepareError(t *testing.T) {
+	c := &Conn{
+		connector:      &Connector{params: msdsn.Config{PrepareMethod: msdsn.PreparePrepExec}},
+		sess:           &tdsSession{buf: newTdsBuffer(defaultPacketSize, &testRPCTransport{})},
+		connectionGood: true,
+	}
+	transport := &failingWriteTransport{}
+	sess := &tdsSession{buf: newTdsBuffer(defaultPacketSize, transport)}
+	s := &Stmt{c: c, sess: sess, prepared: preparedHandle{handle: 1, sess: sess}}
+	if err := s.Close(); err == nil {
+		t.Error("Close must report the unprepare error")
+	}
+	if !transport.closed || s.sess != nil {
+		t.Error("the MARS session of the statement must be closed")
+	}
+}
@@ -5,10 +5,12 @@ package mssql
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/denisenkom/go-mssqldb/msdsn"
 	"github.com/golang-sql/civil"
 )
 
@@ -257,3 +259,67 @@ func TestIdentity(t *testing.T) {
 		t.Error("Expected -1 for identity, got ", n)
 	}
 }
+
+func TestPrepExecStatements(t *testing.T) {
+	cp := testConnParams(t)
+	cp.PrepareMethod = msdsn.PreparePrepExec
+	cp.StatementCacheSize = 2
+	db := sql.OpenDB(NewConnectorConfig(cp))
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	stmt, err := db.Prepare("select @p1 + 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		var res int64
+		if err = stmt.QueryRow(int64(i)).Scan(&res); err != nil {
+			t.Fatal(err)
+		}
+		if res != int64(i)+1 {
+			t.Errorf("expected %d, got %d", i+1, res)
+		}
+	}
+	var s string
+	if err = stmt.QueryRow("a").Scan(&s); err == nil {
+		t.Error("expected a conversion error for the changed parameter type")
+	}
+	if err = stmt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		var res int64
+		if err = db.QueryRow(fmt.Sprintf("select @p1 * %d", i), int64(2)).Scan(&res); err != nil {
+			t.Fatal(err)
+		}
+		if res != int64(2*i) {
+			t.Errorf("expected %d, got %d", 2*i, res)
+		}
+	}
+}
+
+func TestBeginTxReadOnlyIsolation(t *testing.T) {
+	checkConnStr(t)
+	connector, err := NewConnector(makeConnStr(t).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	connector.ReadOnlyTxIsolation = sql.LevelSerializable
+	conn := sql.OpenDB(connector)
+	defer conn.Close()
+
+	tx, err := conn.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	var level int
+	err = tx.QueryRow("select transaction_isolation_level from sys.dm_exec_sessions where session_id = @@spid").Scan(&level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if level != 4 {
+		t.Errorf("expected the serializable isolation level 4, got %d", level)
+	}
+}
@@ -7,8 +7,11 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"reflect"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
@@ -1368,3 +1371,346 @@ func TestCancelWithNoResults(t *testing.T) {
 		t.Fatalf("Unexpected error: %v", r.Err())
 	}
 }
+
+func TestStreamPLP(t *testing.T) {
+	conn, logger := open(t)
+	defer conn.Close()
+	defer logger.StopLogging()
+
+	rows, err := conn.Query(`select 1, cast(replicate(cast('x' as varchar(max)), 100000) as varbinary(max))
+		union all select 2, null
+		union all select 3, cast('abc' as varbinary(max))
+		select 'next'`, StreamPLP{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var sizes []int
+	for rows.Next() {
+		var id int
+		var content io.Reader
+		if err = rows.Scan(&id, &content); err != nil {
+			t.Fatal(err)
+		}
+		if content == nil {
+			sizes = append(sizes, -1)
+			continue
+		}
+		if id == 3 {
+			// left unread
+			continue
+		}
+		n, err := io.Copy(ioutil.Discard, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, int(n))
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sizes, []int{100000, -1}) {
+		t.Errorf("unexpected sizes %v", sizes)
+	}
+	if !rows.NextResultSet() || !rows.Next() {
+		t.Fatalf("next result set missing: %v", rows.Err())
+	}
+	var s string
+	if err = rows.Scan(&s); err != nil || s != "next" {
+		t.Errorf("unexpected value %q, %v", s, err)
+	}
+}
+
+func TestStreamParamQuery(t *testing.T) {
+	conn, logger := open(t)
+	defer conn.Close()
+	defer logger.StopLogging()
+
+	data := bytes.Repeat([]byte("0123456789"), 100000)
+	var binLen, textLen int64
+	var text string
+	err := conn.QueryRow("select datalength(@p1), datalength(@p2), left(@p2, 5)",
+		bytes.NewReader(data), NVarCharStream{R: strings.NewReader("héllo world")}).Scan(&binLen, &textLen, &text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binLen != int64(len(data)) {
+		t.Errorf("streamed %d bytes, server received %d", len(data), binLen)
+	}
+	if textLen != 22 || text != "héllo" {
+		t.Errorf("unexpected nvarchar stream %q of %d bytes", text, textLen)
+	}
+}
+
+func TestServerCursor(t *testing.T) {
+	checkConnStr(t)
+	tl := testLogger{t: t}
+	defer tl.StopLogging()
+	drv := driverWithProcess(t, &tl)
+	conn, err := drv.open(context.Background(), makeConnStr(t).String())
+	if err != nil {
+		t.Fatalf("Open failed with error %v", err)
+	}
+	defer conn.Close()
+
+	ctx := context.Background()
+	query := "select n from (values (1), (2), (3), (4), (5)) t(n) where n >= @p1 order by n"
+	for _, typ := range []CursorType{CursorStatic, CursorKeyset, CursorDynamic} {
+		cur, err := conn.OpenCursor(ctx, query, CursorOptions{Type: typ, FetchSize: 2}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fetch := func(n int, err error) []int {
+			if err != nil {
+				t.Fatal(err)
+			}
+			var res []int
+			for cur.Next() {
+				var v int
+				if err = cur.Scan(&v); err != nil {
+					t.Fatal(err)
+				}
+				res = append(res, v)
+			}
+			if len(res) != n {
+				t.Errorf("fetch returned %d rows, read %d", n, len(res))
+			}
+			return res
+		}
+		if got := fetch(cur.FetchNext(ctx)); !reflect.DeepEqual(got, []int{1, 2}) {
+			t.Errorf("cursor type %d: FetchNext returned %v", typ, got)
+		}
+		if got := fetch(cur.FetchAbsolute(ctx, 4)); !reflect.DeepEqual(got, []int{4, 5}) {
+			t.Errorf("cursor type %d: FetchAbsolute returned %v", typ, got)
+		}
+		if got := fetch(cur.FetchPrior(ctx)); !reflect.DeepEqual(got, []int{2, 3}) {
+			t.Errorf("cursor type %d: FetchPrior returned %v", typ, got)
+		}
+		if got := fetch(cur.FetchRelative(ctx, -1)); !reflect.DeepEqual(got, []int{1, 2}) {
+			t.Errorf("cursor type %d: FetchRelative returned %v", typ, got)
+		}
+		if err = cur.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cur, err := conn.OpenCursor(ctx, query, CursorOptions{}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cur.Close(ctx)
+	var got []int
+	for {
+		n, err := cur.FetchNext(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			break
+		}
+		for cur.Next() {
+			var v int
+			if err = cur.Scan(&v); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, v)
+		}
+	}
+	if !reflect.DeepEqual(got, []int{3, 4, 5}) {
+		t.Errorf("forward only cursor returned %v", got)
+	}
+}
+
+func TestSavepoint(t *testing.T) {
+	conn, logger := open(t)
+	defer conn.Close()
+	defer logger.StopLogging()
+
+	ctx := context.Background()
+	tx, err := conn.BeginTx(WithTransactionName(ctx, "savepoint_test"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	var name string
+	err = tx.QueryRowContext(ctx, "select name from sys.dm_tran_active_transactions where transaction_id = current_transaction_id()").Scan(&name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "savepoint_test" {
+		t.Errorf("expected the transaction name savepoint_test, got %q", name)
+	}
+
+	if _, err = tx.ExecContext(ctx, "create table #savepoint (n int)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tx.ExecContext(ctx, "insert into #savepoint values (1)"); err != nil {
+		t.Fatal(err)
+	}
+	if err = Savepoint(ctx, tx, "step2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tx.ExecContext(ctx, "insert into #savepoint values (2)"); err != nil {
+		t.Fatal(err)
+	}
+	if err = RollbackTo(ctx, tx, "step2"); err != nil {
+		t.Fatal(err)
+	}
+	if err = RollbackTo(ctx, tx, "unknown"); err == nil {
+		t.Error("expected an error rolling back to an unknown savepoint")
+	}
+	var count, sum int
+	if err = tx.QueryRowContext(ctx, "select count(*), sum(n) from #savepoint").Scan(&count, &sum); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || sum != 1 {
+		t.Errorf("expected only the row inserted before the savepoint, got %d rows", count)
+	}
+	if err = RollbackTo(ctx, tx, ""); err != errSavepointName {
+		t.Errorf("expected errSavepointName, got %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNotificationListener(t *testing.T) {
+	conn, logger := open(t)
+	defer conn.Close()
+	defer logger.StopLogging()
+
+	var brokerEnabled bool
+	if err := conn.QueryRow("select is_broker_enabled from sys.databases where database_id = db_id()").Scan(&brokerEnabled); err != nil {
+		t.Fatal(err)
+	}
+	if !brokerEnabled {
+		t.Skip("Service Broker is not enabled in the test database")
+	}
+	setup := []string{
+		"create table dbo.go_mssqldb_qn (id int)",
+		"create queue dbo.go_mssqldb_qn_queue",
+		"create service go_mssqldb_qn_service on queue dbo.go_mssqldb_qn_queue ([http://schemas.microsoft.com/SQL/Notifications/PostQueryNotification])",
+	}
+	for _, query := range setup {
+		if _, err := conn.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer conn.Exec("drop service go_mssqldb_qn_service; drop queue dbo.go_mssqldb_qn_queue; drop table dbo.go_mssqldb_qn")
+
+	// subscribe a query
+	drv := driverWithProcess(t, logger)
+	cn, err := drv.open(context.Background(), makeConnStr(t).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+	stmt, err := cn.prepareContext(context.Background(), "select id from dbo.go_mssqldb_qn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt.SetQueryNotification("go-mssqldb-test", "service=go_mssqldb_qn_service", time.Minute)
+	rows, err := stmt.Query(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+
+	l := NewNotificationListener(conn, "dbo.go_mssqldb_qn_queue")
+	l.WaitTimeout = time.Second
+	ch := make(chan Notification, 1)
+	l.SubscribeChan("go-mssqldb-test", ch)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- l.Listen(ctx) }()
+
+	if _, err = conn.Exec("insert into dbo.go_mssqldb_qn values (1)"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-ch:
+		if n.Type != "change" || n.Info != "insert" {
+			t.Errorf("unexpected notification %+v", n)
+		}
+	case err = <-done:
+		t.Fatal(err)
+	}
+	cancel()
+	if err = <-done; err != context.Canceled {
+		t.Errorf("expected Listen to stop with context.Canceled, got %v", err)
+	}
+}
+
+func TestVariant(t *testing.T) {
+	conn, logger := open(t)
+	defer conn.Close()
+	defer logger.StopLogging()
+
+	day := time.Date(2020, 5, 1, 12, 30, 15, 125000000, time.UTC)
+	values := []Variant{
+		{Value: 42, BaseType: "int"},
+		{Value: "12.5", BaseType: "decimal(10, 2)"},
+		{Value: "abc", BaseType: "varchar(20)"},
+		{Value: day, BaseType: "datetime2(3)"},
+		{Value: "x"},
+		{BaseType: "int"},
+	}
+	args := []interface{}{ReturnVariants{}}
+	for _, v := range values {
+		args = append(args, v)
+	}
+	rows, err := conn.Query(`declare @settings table (id int identity, value sql_variant);
+insert into @settings (value) values (@p1), (@p2), (@p3), (@p4), (@p5), (@p6);
+select value, cast(sql_variant_property(value, 'BaseType') as nvarchar(128)) from @settings order by id`, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	want := []Variant{
+		{Value: int64(42), BaseType: "int"},
+		{Value: []byte("12.50"), BaseType: "decimal(10, 2)"},
+		{Value: "abc", BaseType: "varchar(20)"},
+		{Value: day, BaseType: "datetime2(3)"},
+		{Value: "x", BaseType: "nvarchar(1)"},
+		{},
+	}
+	var got []Variant
+	for rows.Next() {
+		var v Variant
+		var baseType sql.NullString
+		if err = rows.Scan(&v, &baseType); err != nil {
+			t.Fatal(err)
+		}
+		if baseType.Valid && !strings.HasPrefix(v.BaseType, baseType.String) {
+			t.Errorf("base type %s reported as %s", baseType.String, v.BaseType)
+		}
+		if tm, ok := v.Value.(time.Time); ok {
+			v.Value = tm.UTC()
+		}
+		got = append(got, v)
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+
+	out := Variant{BaseType: "int"}
+	_, err = conn.Exec("set @out = cast(cast(1.5 as decimal(5, 1)) as sql_variant)", sql.Named("out", sql.Out{Dest: &out}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, Variant{Value: []byte("1.5"), BaseType: "decimal(5, 1)"}) {
+		t.Errorf("unexpected output parameter %#v", out)
+	}
+	var plain interface{}
+	if err = conn.QueryRow("select cast(cast(7 as smallint) as sql_variant)").Scan(&plain); err != nil {
+		t.Fatal(err)
+	}
+	if plain != int64(7) {
+		t.Errorf("values without ReturnVariants must stay plain, got %#v", plain)
+	}
+}
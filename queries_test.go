@@ -1791,14 +1791,18 @@ func TestContext(t *testing.T) {
 	defer stmt.Close()
 }
 
-func TestBeginTxtReadOnlyNotSupported(t *testing.T) {
+func TestBeginTxReadOnlyDefault(t *testing.T) {
 	conn, logger := open(t)
 	defer conn.Close()
 	defer logger.StopLogging()
-	opts := &sql.TxOptions{ReadOnly: true}
-	_, err := conn.BeginTx(context.Background(), opts)
-	if err == nil {
-		t.Error("BeginTx expected to fail for read only transaction because MSSQL doesn't support it, but it succeeded")
+	tx, err := conn.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal("BeginTx failed for a read only transaction:", err)
+	}
+	defer tx.Rollback()
+	var n int
+	if err = tx.QueryRow("select 1").Scan(&n); err != nil {
+		t.Fatal(err)
 	}
 }
 
@@ -0,0 +1,167 @@
+package mssql
+
+import (
+	"bytes"
+	"context"
+	"io"
+)
+
+// QueryRaw runs query and returns its rows with the values as the server
+// sent them: []byte in the wire format of the column type or nil for NULL.
+// It is meant for exports that copy values without converting them, the
+// columns are described by Rows.ColumnRawType. Values of encrypted columns
+// are not decrypted. With MARS the query gets a session of its own like
+// the queries of database/sql, which is released by Rows.Close.
+func (c *Conn) QueryRaw(ctx context.Context, query string) (*Rows, error) {
+	s, err := c.prepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	c.outs.rawRows = true
+	rows, err := s.queryContext(ctx, nil)
+	if err != nil {
+		c.clearOuts()
+		s.Close()
+		return nil, err
+	}
+	res := rows.(*Rows)
+	res.closeStmt = true
+	return res, nil
+}
+
+// RawColumnType describes the values of a column read with Conn.QueryRaw.
+type RawColumnType struct {
+	// TypeName is the name of the type as returned by
+	// Rows.ColumnTypeDatabaseTypeName, "UDT" for CLR types.
+	TypeName string
+	// Size is the size of fixed size values and the maximum size of the
+	// others in bytes, -1 for max, text, xml and CLR types.
+	Size int
+	// Precision and Scale are those of decimal values, Scale is also the
+	// number of fractional second digits of time values.
+	Precision int
+	Scale     int
+	// CodePage is the Windows code page of char, varchar and text values.
+	CodePage int
+	Nullable bool
+}
+
+// ColumnRawType returns the type of the raw values of a column.
+func (r *Rows) ColumnRawType(index int) RawColumnType {
+	ti := r.cols[index].ti
+	t := RawColumnType{
+		Size:      ti.Size,
+		Precision: int(ti.Prec),
+		Scale:     int(ti.Scale),
+		Nullable:  r.cols[index].Flags&colFlagNullable != 0,
+	}
+	switch ti.TypeId {
+	case typeUdt:
+		t.TypeName = "UDT"
+	default:
+		t.TypeName = makeGoLangTypeName(ti)
+	}
+	switch ti.TypeId {
+	case typeXml, typeUdt, typeText, typeNText, typeImage:
+		t.Size = -1
+	case typeBigVarBin, typeBigVarChar, typeBigBinary, typeBigChar, typeNVarChar, typeNChar:
+		if ti.Size == 0xffff {
+			t.Size = -1
+		}
+	}
+	switch ti.TypeId {
+	case typeBigVarChar, typeBigChar, typeVarChar, typeChar, typeText:
+		t.CodePage = ti.Collation.CodePage()
+	}
+	return t
+}
+
+// parseRawRow reads a ROW or NBCROW token without decoding the values.
+func parseRawRow(r *tdsBuffer, columns []columnStruct, row []interface{}, nbc bool) {
+	var pres []byte
+	if nbc {
+		pres = make([]byte, (len(columns)+7)/8)
+		r.ReadFull(pres)
+	}
+	for i := range columns {
+		if nbc && pres[i/8]&(1<<(uint(i)%8)) != 0 {
+			row[i] = nil
+			continue
+		}
+		row[i] = readRawValue(columns[i].wireTypeInfo(), r)
+	}
+}
+
+// readRawValue reads the bytes of a value, nil for NULL.
+func readRawValue(ti *typeInfo, r *tdsBuffer) interface{} {
+	var size int
+	switch ti.TypeId {
+	case typeNull:
+		return nil
+	case typeInt1, typeBit, typeInt2, typeInt4, typeDateTim4,
+		typeFlt4, typeMoney, typeDateTime, typeFlt8, typeMoney4, typeInt8:
+		size = ti.Size
+	case typeText, typeNText, typeImage:
+		textptrsize := int(r.byte())
+		if textptrsize == 0 {
+			return nil
+		}
+		r.ReadFull(make([]byte, textptrsize))
+		r.uint64() // timestamp
+		n := r.int32()
+		if n == -1 {
+			return nil
+		}
+		size = int(n)
+	case typeVariant:
+		size = int(r.int32())
+		if size == 0 {
+			return nil
+		}
+	case typeXml, typeUdt:
+		return readRawPLP(r)
+	case typeBigVarBin, typeBigVarChar, typeBigBinary, typeBigChar, typeNVarChar, typeNChar:
+		if ti.Size == 0xffff {
+			return readRawPLP(r)
+		}
+		n := r.uint16()
+		if n == 0xffff {
+			return nil
+		}
+		size = int(n)
+	default:
+		// byte length types
+		n := r.byte()
+		if n == 0 {
+			return nil
+		}
+		size = int(n)
+	}
+	buf := make([]byte, size)
+	r.ReadFull(buf)
+	return buf
+}
+
+// readRawPLP reads the chunks of a PLP value, nil for NULL.
+func readRawPLP(r *tdsBuffer) interface{} {
+	size := r.uint64()
+	var buf *bytes.Buffer
+	switch size {
+	case _PLP_NULL:
+		return nil
+	case _UNKNOWN_PLP_LEN:
+		buf = bytes.NewBuffer(make([]byte, 0, 1000))
+	default:
+		buf = bytes.NewBuffer(make([]byte, 0, size))
+	}
+	for {
+		chunksize := r.uint32()
+		if chunksize == 0 {
+			break
+		}
+		if _, err := io.CopyN(buf, r, int64(chunksize)); err != nil {
+			badStreamPanicf("Reading PLP type failed: %s", err.Error())
+		}
+	}
+	return buf.Bytes()
+}
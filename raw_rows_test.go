@@ -0,0 +1,79 @@
+package mssql
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestQueryRaw(t *testing.T) {
+	transport := &testRPCTransport{}
+	c := &Conn{
+		sess:           &tdsSession{buf: newTdsBuffer(defaultPacketSize, transport)},
+		connectionGood: true,
+	}
+	latin1 := []byte{0x09, 0x04, 0xd0, 0x00, 0x34}
+	var r testRPCResponse
+	r.b = append(r.b, byte(tokenColMetadata))
+	r.u16(4)
+	column := func(name string, typeInfo ...byte) {
+		r.u32(0)
+		r.u16(colFlagNullable)
+		r.b = append(r.b, typeInfo...)
+		r.b = appendBVarChar(r.b, name)
+	}
+	column("i", typeIntN, 4)
+	column("d", typeDecimalN, 9, 10, 2)
+	column("n", append([]byte{typeNVarChar, 20, 0}, latin1...)...)
+	column("v", append([]byte{typeBigVarChar, 0xff, 0xff}, latin1...)...)
+	r.b = append(r.b, byte(tokenRow))
+	r.b = append(r.b, 4, 1, 0, 0, 0)
+	r.b = append(r.b, 5, 1, 0x39, 0x30, 0, 0)
+	r.b = append(r.b, 4, 0, 'h', 0, 'i', 0)
+	r.b = append(r.b, 2, 0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0, 'a', 0xe9, 0, 0, 0, 0)
+	r.b = append(r.b, byte(tokenNbcRow), 0x0f)
+	r.done(&transport.responses)
+
+	rows, err := c.QueryRaw(context.Background(), "select i, d, n, v from t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.outs.rawRows {
+		t.Error("the raw rows flag was not cleared")
+	}
+	expectedTypes := []RawColumnType{
+		{TypeName: "INT", Size: 4, Nullable: true},
+		{TypeName: "DECIMAL", Size: 9, Precision: 10, Scale: 2, Nullable: true},
+		{TypeName: "NVARCHAR", Size: 20, Nullable: true},
+		{TypeName: "VARCHAR", Size: -1, CodePage: 1252, Nullable: true},
+	}
+	for i, expected := range expectedTypes {
+		if got := rows.ColumnRawType(i); got != expected {
+			t.Errorf("column %d: expected %+v, got %+v", i, expected, got)
+		}
+	}
+	expected := [][]driver.Value{
+		{[]byte{1, 0, 0, 0}, []byte{1, 0x39, 0x30, 0, 0}, []byte{'h', 0, 'i', 0}, []byte{'a', 0xe9}},
+		{nil, nil, nil, nil},
+	}
+	for _, expectedRow := range expected {
+		row := make([]driver.Value, 4)
+		if err = rows.Next(row); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(row, expectedRow) {
+			t.Errorf("expected row %v, got %v", expectedRow, row)
+		}
+	}
+	if err = rows.Next(make([]driver.Value, 4)); err != io.EOF {
+		t.Errorf("expected the end of the rows, got %v", err)
+	}
+	if !rows.closeStmt {
+		t.Error("the rows must close the statement of the raw query")
+	}
+	if err = rows.Close(); err != nil {
+		t.Error(err)
+	}
+}
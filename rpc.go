@@ -2,6 +2,7 @@ package mssql
 
 import (
 	"encoding/binary"
+	"io"
 )
 
 type procId struct {
@@ -13,6 +14,7 @@ type procId struct {
 const (
 	fByRevValue   = 1
 	fDefaultValue = 2
+	fEncrypted    = 8
 )
 
 type param struct {
@@ -20,6 +22,16 @@ type param struct {
 	Flags  uint8
 	ti     typeInfo
 	buffer []byte
+	// reader is set for parameters streamed as PLP instead of buffer
+	reader io.Reader
+	// encoder writes the value instead of buffer, it is set for TVPs with
+	// rows read while the request is sent
+	encoder func(w io.Writer) error
+
+	// cipher is set for parameters sent encrypted, ti and buffer then
+	// describe the plain value.
+	cipher      *cryptoMetadata
+	cipherValue []byte
 }
 
 var (
@@ -34,6 +46,7 @@ var (
 	sp_CursorClose     = procId{9, ""}
 	sp_ExecuteSql      = procId{10, ""}
 	sp_Prepare         = procId{11, ""}
+	sp_Execute         = procId{12, ""}
 	sp_PrepExec        = procId{13, ""}
 	sp_PrepExecRpc     = procId{14, ""}
 	sp_Unprepare       = procId{15, ""}
@@ -70,11 +83,23 @@ func sendRpc(buf *tdsBuffer, headers []headerStruct, proc procId, flags uint16,
 		if err = binary.Write(buf, binary.LittleEndian, param.Flags); err != nil {
 			return
 		}
+		if param.cipher != nil {
+			if err = writeEncryptedParam(buf, &param); err != nil {
+				return
+			}
+			continue
+		}
 		err = writeTypeInfo(buf, &param.ti)
 		if err != nil {
 			return
 		}
-		err = param.ti.Writer(buf, param.ti, param.buffer)
+		if param.encoder != nil {
+			err = param.encoder(buf)
+		} else if param.reader != nil {
+			err = writePLPStream(buf, param.reader, buf.PackageSize())
+		} else {
+			err = param.ti.Writer(buf, param.ti, param.buffer)
+		}
 		if err != nil {
 			return
 		}
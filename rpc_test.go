@@ -0,0 +1,112 @@
+package mssql
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// testRPCResponse builds the responses of a fake server to RPC requests.
+type testRPCResponse struct {
+	b []byte
+}
+
+func (r *testRPCResponse) u16(v uint16) {
+	r.b = append(r.b, byte(v), byte(v>>8))
+}
+
+func (r *testRPCResponse) u32(v uint32) {
+	r.b = append(r.b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func (r *testRPCResponse) returnValue(v int32) {
+	r.b = append(r.b, byte(tokenReturnValue))
+	r.u16(0)
+	r.b = appendBVarChar(r.b, "")
+	r.b = append(r.b, 1)
+	r.u32(0)
+	r.u16(colFlagNullable)
+	r.b = append(r.b, typeIntN, 4, 4)
+	r.u32(uint32(v))
+}
+
+func (r *testRPCResponse) columns(names ...string) {
+	r.b = append(r.b, byte(tokenColMetadata))
+	r.u16(uint16(len(names)))
+	for _, name := range names {
+		r.u32(0)
+		r.u16(colFlagNullable)
+		r.b = append(r.b, typeIntN, 4)
+		r.b = appendBVarChar(r.b, name)
+	}
+}
+
+func (r *testRPCResponse) row(values ...int32) {
+	r.b = append(r.b, byte(tokenRow))
+	for _, v := range values {
+		r.b = append(r.b, 4)
+		r.u32(uint32(v))
+	}
+}
+
+// done ends a response and packs it.
+func (r *testRPCResponse) done(packets *bytes.Buffer) {
+	r.b = append(r.b, byte(tokenDoneProc))
+	r.u16(0)
+	r.u16(0)
+	r.u32(0)
+	r.u32(0)
+	header := []byte{byte(packReply), 1, 0, 0, 0, 0, 1, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(header)+len(r.b)))
+	packets.Write(header)
+	packets.Write(r.b)
+	r.b = nil
+}
+
+// testRPCTransport reads responses prepared with testRPCResponse and
+// records the requests.
+type testRPCTransport struct {
+	responses bytes.Buffer
+	requests  bytes.Buffer
+}
+
+func (t *testRPCTransport) Read(b []byte) (int, error) {
+	return t.responses.Read(b)
+}
+
+func (t *testRPCTransport) Write(b []byte) (int, error) {
+	return t.requests.Write(b)
+}
+
+func (t *testRPCTransport) Close() error {
+	return nil
+}
+
+// testRPCRequest is an RPC request sent by procedure id.
+type testRPCRequest struct {
+	proc uint16
+	// firstInt is the value of the first parameter if it is an int
+	firstInt int32
+}
+
+// rpcRequests parses the recorded single packet RPC requests.
+func (t *testRPCTransport) rpcRequests() []testRPCRequest {
+	var res []testRPCRequest
+	b := t.requests.Bytes()
+	for len(b) > 0 {
+		size := int(binary.BigEndian.Uint16(b[2:]))
+		packet := b[8:size]
+		b = b[size:]
+		// skip ALL_HEADERS and the 0xffff procedure id switch
+		packet = packet[binary.LittleEndian.Uint32(packet)+2:]
+		req := testRPCRequest{proc: binary.LittleEndian.Uint16(packet)}
+		// option flags, name, status flags
+		p := packet[4:]
+		p = p[1+int(p[0])*2+1:]
+		if p[0] == typeIntN && p[1] == 4 && p[2] == 4 {
+			req.firstInt = int32(binary.LittleEndian.Uint32(p[3:]))
+		}
+		res = append(res, req)
+	}
+	t.requests.Reset()
+	return res
+}
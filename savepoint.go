@@ -0,0 +1,111 @@
+package mssql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/denisenkom/go-mssqldb/msdsn"
+)
+
+type transactionNameKey struct{}
+
+// WithTransactionName returns a context that makes BeginTx start a
+// transaction with the given name. The name shows up in
+// sys.dm_tran_active_transactions.
+func WithTransactionName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, transactionNameKey{}, name)
+}
+
+func transactionName(ctx context.Context) string {
+	name, _ := ctx.Value(transactionNameKey{}).(string)
+	return name
+}
+
+// tranRequest is passed as a query argument to run a transaction manager
+// request on the connection of a transaction or an sql.Conn instead of
+// the query. It stays an argument of the statement, so nothing is left on
+// the connection when the request fails before it is executed.
+type tranRequest struct {
+	rqType uint16
+	// name is the savepoint name
+	name string
+	// cookie is the DTC transaction cookie to propagate
+	cookie []byte
+	// dtcToken receives the token of a promoted transaction
+	dtcToken *[]byte
+}
+
+var errSavepointName = errors.New("mssql: savepoint name must not be empty")
+
+// Savepoint sets a savepoint with the given name in the transaction.
+// Setting a savepoint with the name of an existing one moves it.
+func Savepoint(ctx context.Context, tx *sql.Tx, name string) error {
+	if name == "" {
+		return errSavepointName
+	}
+	_, err := tx.ExecContext(ctx, "", tranRequest{rqType: tmSaveXact, name: name})
+	return err
+}
+
+// RollbackTo rolls the transaction back to the savepoint with the given
+// name. The transaction stays open and the savepoint remains set.
+func RollbackTo(ctx context.Context, tx *sql.Tx, name string) error {
+	if name == "" {
+		// a rollback without a name would roll back the whole transaction
+		return errSavepointName
+	}
+	_, err := tx.ExecContext(ctx, "", tranRequest{rqType: tmRollbackXact, name: name})
+	return err
+}
+
+// tranRequestArg returns the transaction manager request in args.
+func tranRequestArg(args []namedValue) (tranRequest, bool) {
+	for _, arg := range args {
+		if req, ok := arg.Value.(tranRequest); ok {
+			return req, true
+		}
+	}
+	return tranRequest{}, false
+}
+
+func (c *Conn) sendTranRequest(ctx context.Context, sess *tdsSession, req tranRequest) error {
+	headers := []headerStruct{
+		{hdrtype: dataStmHdrTransDescr,
+			data: transDescrHdr{sess.tranid, 1}.pack()},
+	}
+	reset := c.resetSession
+	c.resetSession = false
+	var err error
+	switch req.rqType {
+	case tmSaveXact:
+		err = sendSaveXact(sess.buf, headers, req.name, reset)
+	case tmRollbackXact:
+		err = sendRollbackXact(sess.buf, headers, req.name, 0, 0, "", reset)
+	case tmPropagateXact:
+		err = sendPropagateXact(sess.buf, headers, req.cookie, reset)
+	case tmPromoteXact:
+		sess.dtcToken = nil
+		err = sendPromoteXact(sess.buf, headers, reset)
+	}
+	if err != nil {
+		if c.sess.logFlags&logErrors != 0 {
+			c.sess.logger.Log(ctx, msdsn.LogErrors, fmt.Sprintf("Failed to send transaction manager request with %v", err))
+		}
+		c.connectionGood = false
+		return c.checkBadConn(ctx, fmt.Errorf("failed to send transaction manager request: %v", err), true)
+	}
+	reader := startReading(sess, ctx, c.outs)
+	c.clearOuts()
+	if err = reader.iterateResponse(); err != nil {
+		return c.checkBadConn(ctx, err, false)
+	}
+	if req.rqType == tmPromoteXact {
+		if sess.dtcToken == nil {
+			return errors.New("mssql: the server did not return a DTC token")
+		}
+		*req.dtcToken = sess.dtcToken
+	}
+	return nil
+}
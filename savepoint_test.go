@@ -0,0 +1,79 @@
+package mssql
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+)
+
+// tranRequests returns the request types and names of the transaction
+// manager requests sent to the transport.
+func (t *testRPCTransport) tranRequests() (types []uint16, names []string) {
+	b := t.requests.Bytes()
+	for len(b) > 0 {
+		size := int(binary.BigEndian.Uint16(b[2:]))
+		typ, packet := packetType(b[0]), b[8:size]
+		b = b[size:]
+		if typ != packTransMgrReq {
+			continue
+		}
+		// skip the headers
+		packet = packet[binary.LittleEndian.Uint32(packet):]
+		rqType := binary.LittleEndian.Uint16(packet)
+		var name string
+		if rqType == tmSaveXact || rqType == tmRollbackXact {
+			name, _ = ucs22str(packet[3 : 3+2*int(packet[2])])
+		}
+		types = append(types, rqType)
+		names = append(names, name)
+	}
+	return
+}
+
+func TestSavepointRequests(t *testing.T) {
+	transport := &testRPCTransport{}
+	c := &Conn{
+		sess:           &tdsSession{buf: newTdsBuffer(defaultPacketSize, transport), tranid: 1},
+		connectionGood: true,
+	}
+	ctx := context.Background()
+	var r testRPCResponse
+	for _, req := range []tranRequest{{rqType: tmSaveXact, name: "step1"}, {rqType: tmRollbackXact, name: "step1"}} {
+		s, _ := c.prepareContext(ctx, "")
+		r.done(&transport.responses)
+		if _, err := s.exec(ctx, []namedValue{{Ordinal: 1, Value: req}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	types, names := transport.tranRequests()
+	if len(types) != 2 || types[0] != tmSaveXact || types[1] != tmRollbackXact {
+		t.Fatalf("expected save and rollback requests, got %v", types)
+	}
+	if names[0] != "step1" || names[1] != "step1" {
+		t.Errorf("unexpected savepoint names %q", names)
+	}
+	// the rollback to a savepoint keeps the transaction open
+	packet := transport.requests.Bytes()
+	if !bytes.HasSuffix(packet, append([]byte{byte(tmRollbackXact), 0, 5}, append(str2ucs2("step1"), 0)...)) {
+		t.Errorf("unexpected rollback request % x", packet)
+	}
+}
+
+func TestTransactionName(t *testing.T) {
+	var out bytes.Buffer
+	c := &Conn{
+		sess:           &tdsSession{buf: newTdsBuffer(defaultPacketSize, closableBuffer{&out})},
+		connectionGood: true,
+	}
+	if err := c.sendBeginRequest(WithTransactionName(context.Background(), "import"), isolationUseCurrent); err != nil {
+		t.Fatal(err)
+	}
+	expected := append([]byte{byte(tmBeginXact), 0, byte(isolationUseCurrent), 6}, str2ucs2("import")...)
+	if !bytes.HasSuffix(out.Bytes(), expected) {
+		t.Errorf("unexpected begin request % x", out.Bytes())
+	}
+	if transactionName(context.Background()) != "" {
+		t.Error("expected no transaction name by default")
+	}
+}
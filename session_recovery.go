@@ -0,0 +1,294 @@
+package mssql
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/denisenkom/go-mssqldb/internal/cp"
+	"github.com/denisenkom/go-mssqldb/msdsn"
+)
+
+// Session recovery (connection resiliency) lets the driver reconnect an
+// idle connection whose network link was dropped and have the server
+// restore the session state of the lost connection.
+
+// SESSIONSTATE token status
+const fSessionRecoverable = 0x01
+
+var errSessionNotRecovered = errors.New("mssql: server did not recover the session")
+
+// sessionRecoveryData is a snapshot of the session state.
+type sessionRecoveryData struct {
+	database  string
+	collation cp.Collation
+	language  string
+	// states holds the session state values, e.g. SET options, by state id
+	states map[byte][]byte
+}
+
+// sessionRecovery tracks what is needed to recover a session.
+type sessionRecovery struct {
+	// initial is the state right after login
+	initial sessionRecoveryData
+	// deltas holds state values that changed after login
+	deltas map[byte][]byte
+	// recoverable is false while the server reports that the session
+	// state can't be recovered, e.g. during a transaction
+	recoverable bool
+	// acked is set when the server accepted session recovery at login
+	acked bool
+}
+
+func newSessionRecovery() *sessionRecovery {
+	return &sessionRecovery{
+		deltas:      map[byte][]byte{},
+		recoverable: true,
+	}
+}
+
+// inherit keeps the state of a recovered session, the server reports the
+// restored state as initial state of the new session.
+func (r *sessionRecovery) inherit(old *sessionRecovery) {
+	deltas := make(map[byte][]byte, len(old.deltas)+len(r.deltas))
+	for id, v := range old.deltas {
+		deltas[id] = v
+	}
+	for id, v := range r.deltas {
+		deltas[id] = v
+	}
+	r.initial = old.initial
+	r.deltas = deltas
+}
+
+// featureExtSessionRecovery requests session recovery during login.
+// On the first login it is empty, when a session is recovered it carries
+// the initial and the current state of the lost session.
+type featureExtSessionRecovery struct {
+	recover bool
+	initial sessionRecoveryData
+	current sessionRecoveryData
+}
+
+func (e *featureExtSessionRecovery) featureID() byte {
+	return featExtSESSIONRECOVERY
+}
+
+func (e *featureExtSessionRecovery) toBytes() []byte {
+	if !e.recover {
+		return nil
+	}
+	d := appendSessionRecoveryData(nil, e.initial)
+	return appendSessionRecoveryData(d, e.current)
+}
+
+func appendSessionRecoveryData(b []byte, d sessionRecoveryData) []byte {
+	start := len(b)
+	b = append(b, 0, 0, 0, 0) // Length DWORD, filled in below
+	b = appendBVarChar(b, d.database)
+	if d.collation == (cp.Collation{}) {
+		b = append(b, 0)
+	} else {
+		b = append(b, 5)
+		b = appendCollation(b, d.collation)
+	}
+	b = appendBVarChar(b, d.language)
+
+	ids := make(keySlice, 0, len(d.states))
+	for id := range d.states {
+		ids = append(ids, id)
+	}
+	sort.Sort(ids)
+	for _, id := range ids {
+		b = appendSessionState(b, id, d.states[id])
+	}
+	binary.LittleEndian.PutUint32(b[start:], uint32(len(b)-start-4))
+	return b
+}
+
+func appendBVarChar(b []byte, s string) []byte {
+	ucs := str2ucs2(s)
+	b = append(b, byte(len(ucs)/2))
+	return append(b, ucs...)
+}
+
+func appendCollation(b []byte, c cp.Collation) []byte {
+	var cb [5]byte
+	binary.LittleEndian.PutUint32(cb[:], c.LcidAndFlags)
+	cb[4] = c.SortId
+	return append(b, cb[:]...)
+}
+
+// SessionStateData: StateId BYTE, StateLen BYTE or 0xFF followed by DWORD, StateValue
+func appendSessionState(b []byte, id byte, v []byte) []byte {
+	b = append(b, id)
+	if len(v) < 0xff {
+		b = append(b, byte(len(v)))
+	} else {
+		var l [5]byte
+		l[0] = 0xff
+		binary.LittleEndian.PutUint32(l[1:], uint32(len(v)))
+		b = append(b, l[:]...)
+	}
+	return append(b, v...)
+}
+
+func parseSessionStates(b []byte) (map[byte][]byte, error) {
+	states := map[byte][]byte{}
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return nil, errors.New("truncated session state")
+		}
+		id := b[0]
+		l := int(b[1])
+		b = b[2:]
+		if l == 0xff {
+			if len(b) < 4 {
+				return nil, errors.New("truncated session state length")
+			}
+			l = int(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		}
+		if l > len(b) {
+			return nil, fmt.Errorf("session state %d length %d exceeds data", id, l)
+		}
+		v := make([]byte, l)
+		copy(v, b)
+		states[id] = v
+		b = b[l:]
+	}
+	return states, nil
+}
+
+type sessionStateStruct struct {
+	SeqNo  uint32
+	Status uint8
+	States map[byte][]byte
+}
+
+// SESSIONSTATE token
+// Length DWORD, SeqNo DWORD, Status BYTE, SessionStateDataSet
+func parseSessionState(r *tdsBuffer) sessionStateStruct {
+	length := r.uint32()
+	if length < 5 {
+		badStreamPanicf("invalid SESSIONSTATE length %d", length)
+	}
+	st := sessionStateStruct{
+		SeqNo:  r.uint32(),
+		Status: r.byte(),
+	}
+	var err error
+	st.States, err = parseSessionStates(readTokenData(r, length-5))
+	if err != nil {
+		badStreamPanic(err)
+	}
+	return st
+}
+
+// readTokenData reads length bytes of token data. The data is not
+// allocated up front, a length the stream doesn't have fails with the end
+// of the stream rather than allocating it.
+func readTokenData(r *tdsBuffer, length uint32) []byte {
+	var data bytes.Buffer
+	n, err := data.ReadFrom(io.LimitReader(r, int64(length)))
+	if err != nil {
+		badStreamPanic(err)
+	}
+	if n != int64(length) {
+		badStreamPanic(io.ErrUnexpectedEOF)
+	}
+	return data.Bytes()
+}
+
+func (sess *tdsSession) applySessionState(st sessionStateStruct) {
+	if sess.recovery == nil {
+		return
+	}
+	sess.recovery.recoverable = st.Status&fSessionRecoverable != 0
+	for id, v := range st.States {
+		sess.recovery.deltas[id] = v
+	}
+}
+
+// currentRecoveryData returns the session state to restore.
+func (sess *tdsSession) currentRecoveryData() sessionRecoveryData {
+	return sessionRecoveryData{
+		database:  sess.database,
+		collation: sess.collation,
+		language:  sess.language,
+		states:    sess.recovery.deltas,
+	}
+}
+
+// canRecover reports whether the session could be restored on a new
+// connection. Sessions in a transaction and MARS sessions are not.
+func (c *Conn) canRecover() bool {
+	sess := c.sess
+	return sess.recovery != nil && sess.recovery.recoverable &&
+		sess.tranid == 0 && sess.mars == nil && sess.netConn != nil &&
+		c.connector != nil && c.connector.params.ConnectRetryCount > 0
+}
+
+// connectRetryInterval returns the time between session recovery
+// attempts, the default when a Config made in code doesn't set it.
+func connectRetryInterval(p msdsn.Config) time.Duration {
+	if p.ConnectRetryInterval <= 0 {
+		return msdsn.DefaultConnectRetryInterval
+	}
+	return p.ConnectRetryInterval
+}
+
+// recoverIdleConn checks whether the server side of an idle connection
+// was closed, and if so reconnects and restores the session before the
+// next request is sent. Handles of prepared statements and server cursors
+// are not restored, they check the session they were made on.
+func (c *Conn) recoverIdleConn(ctx context.Context) error {
+	if !c.canRecover() {
+		return nil
+	}
+	if err := connCheck(c.sess.netConn); err == nil {
+		return nil
+	} else if c.sess.logFlags&logRetries != 0 {
+		c.sess.logger.Log(ctx, msdsn.LogRetries, fmt.Sprintf("connection lost, recovering session: %v", err))
+	}
+
+	old := c.sess
+	old.buf.transport.Close()
+
+	p := c.connector.params
+	interval := connectRetryInterval(p)
+	var err error
+	for attempt := 0; attempt < p.ConnectRetryCount; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				c.connectionGood = false
+				return ctx.Err()
+			case <-time.After(interval):
+			}
+		}
+		var sess *tdsSession
+		sess, err = connectSession(ctx, c.connector, old.logger, p, old)
+		if err == nil && sess.recovery == nil {
+			// a server that doesn't acknowledge recovery has started a new
+			// session, continuing on it would lose the session state
+			sess.buf.transport.Close()
+			err = errSessionNotRecovered
+		}
+		if err == nil {
+			sess.recovery.inherit(old.recovery)
+			c.sess = sess
+			return nil
+		}
+		if old.logFlags&logRetries != 0 {
+			old.logger.Log(ctx, msdsn.LogRetries, fmt.Sprintf("session recovery attempt %d failed: %v", attempt+1, err))
+		}
+	}
+	c.connectionGood = false
+	return err
+}
@@ -0,0 +1,193 @@
+package mssql
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/denisenkom/go-mssqldb/internal/cp"
+	"github.com/denisenkom/go-mssqldb/msdsn"
+)
+
+func TestSessionRecoveryFeatureExt(t *testing.T) {
+	fe := &featureExtSessionRecovery{}
+	if fe.featureID() != featExtSESSIONRECOVERY {
+		t.Fatalf("unexpected feature id %d", fe.featureID())
+	}
+	if b := fe.toBytes(); len(b) != 0 {
+		t.Errorf("login without recovery must send no recovery data, got % x", b)
+	}
+
+	fe = &featureExtSessionRecovery{
+		recover: true,
+		initial: sessionRecoveryData{
+			database: "db",
+			states:   map[byte][]byte{2: {1}, 1: {0}},
+		},
+		current: sessionRecoveryData{
+			database:  "x",
+			collation: cp.Collation{LcidAndFlags: 0x00d00409, SortId: 0x34},
+			language:  "us",
+		},
+	}
+	expected := []byte{
+		// initial
+		13, 0, 0, 0, // length
+		2, 'd', 0, 'b', 0, // database
+		0,       // no collation
+		0,       // no language
+		1, 1, 0, // state 1
+		2, 1, 1, // state 2
+		// current
+		14, 0, 0, 0, // length
+		1, 'x', 0, // database
+		5, 0x09, 0x04, 0xd0, 0x00, 0x34, // collation
+		2, 'u', 0, 's', 0, // language
+	}
+	if b := fe.toBytes(); !bytes.Equal(b, expected) {
+		t.Errorf("unexpected recovery data\n got % x\nwant % x", b, expected)
+	}
+}
+
+func TestSessionStatesRoundTrip(t *testing.T) {
+	long := bytes.Repeat([]byte{7}, 300)
+	states := map[byte][]byte{0: {}, 3: {1, 2}, 9: long}
+	var b []byte
+	for _, id := range []byte{0, 3, 9} {
+		b = appendSessionState(b, id, states[id])
+	}
+	if b[len(b)-len(long)-5] != 0xff {
+		t.Fatal("long state value must use the DWORD length")
+	}
+	parsed, err := parseSessionStates(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, states) {
+		t.Errorf("unexpected states %v", parsed)
+	}
+
+	for _, bad := range [][]byte{{1}, {1, 0xff, 0}, {1, 3, 0}} {
+		if _, err := parseSessionStates(bad); err == nil {
+			t.Errorf("expected error for % x", bad)
+		}
+	}
+}
+
+func TestParseFeatureExtAckSessionRecovery(t *testing.T) {
+	b := []byte{featExtSESSIONRECOVERY, 6, 0, 0, 0, 1, 1, 0, 2, 1, 1, featExtTERMINATOR}
+	r := &tdsBuffer{
+		packetSize: len(b),
+		rbuf:       b,
+		rsize:      len(b),
+	}
+	ack := parseFeatureExtAck(r)
+	states, ok := ack[featExtSESSIONRECOVERY].(map[byte][]byte)
+	if !ok {
+		t.Fatalf("session recovery ack not parsed: %v", ack)
+	}
+	if !reflect.DeepEqual(states, map[byte][]byte{1: {0}, 2: {1}}) {
+		t.Errorf("unexpected initial states %v", states)
+	}
+}
+
+func TestParseFeatureExtAckBadLength(t *testing.T) {
+	// the length of the recovery data is far beyond the end of the stream
+	b := []byte{featExtSESSIONRECOVERY, 0xff, 0xff, 0xff, 0xff, 1, 1, 0}
+	r := &tdsBuffer{
+		packetSize: len(b),
+		rbuf:       b,
+		rsize:      len(b),
+		transport:  &testRPCTransport{},
+	}
+	defer func() {
+		if _, ok := recover().(StreamError); !ok {
+			t.Error("expected a stream error")
+		}
+	}()
+	parseFeatureExtAck(r)
+	t.Error("parseFeatureExtAck must fail")
+}
+
+func TestConnectRetryInterval(t *testing.T) {
+	if d := connectRetryInterval(msdsn.Config{ConnectRetryCount: 2}); d != msdsn.DefaultConnectRetryInterval {
+		t.Errorf("unset interval = %v, want the default", d)
+	}
+	if d := connectRetryInterval(msdsn.Config{ConnectRetryInterval: time.Second}); d != time.Second {
+		t.Errorf("interval = %v, want 1s", d)
+	}
+}
+
+func TestApplySessionState(t *testing.T) {
+	sess := &tdsSession{recovery: newSessionRecovery()}
+	sess.applySessionState(sessionStateStruct{Status: 0, States: map[byte][]byte{1: {1}}})
+	if sess.recovery.recoverable {
+		t.Error("session must not be recoverable when the server says so")
+	}
+	sess.applySessionState(sessionStateStruct{Status: fSessionRecoverable, States: map[byte][]byte{1: {2}, 4: {3}}})
+	if !sess.recovery.recoverable {
+		t.Error("session must be recoverable")
+	}
+	if !reflect.DeepEqual(sess.recovery.deltas, map[byte][]byte{1: {2}, 4: {3}}) {
+		t.Errorf("unexpected deltas %v", sess.recovery.deltas)
+	}
+
+	old := sess.recovery
+	old.initial.database = "first"
+	r := newSessionRecovery()
+	r.deltas[4] = []byte{5}
+	r.inherit(old)
+	if r.initial.database != "first" || !reflect.DeepEqual(r.deltas, map[byte][]byte{1: {2}, 4: {5}}) {
+		t.Errorf("unexpected inherited state %+v", r)
+	}
+
+	// session recovery not negotiated
+	sess = &tdsSession{}
+	sess.applySessionState(sessionStateStruct{Status: fSessionRecoverable})
+}
+
+func TestConnCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	server, ok := <-accepted
+	if !ok {
+		t.Fatal("accept failed")
+	}
+
+	if err = connCheck(conn); err != nil {
+		t.Fatalf("idle connection reported as broken: %v", err)
+	}
+	server.Close()
+	switch runtime.GOOS {
+	case "linux", "darwin", "dragonfly", "freebsd", "netbsd", "openbsd":
+	default:
+		t.Skip("closed connections are not detected on " + runtime.GOOS)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for connCheck(conn) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("closed connection not detected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,329 @@
+package mssql
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Session Multiplex Protocol (SMP) is the framing layer used by MARS.
+// It carries several logical TDS sessions over a single transport.
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/mc-smp/
+const (
+	smpID         = 0x53
+	smpHeaderSize = 16
+
+	smpSYN  = 0x01
+	smpACK  = 0x02
+	smpFIN  = 0x04
+	smpDATA = 0x08
+
+	// smpWindow is the number of DATA packets the peer is allowed to send
+	// ahead of our acknowledgements.
+	smpWindow = 4
+
+	// largest packet accepted from the server, TDS packets are limited to 32767 bytes
+	smpMaxPacket = smpHeaderSize + 32767
+)
+
+var errSmpClosed = errors.New("mars: connection is closed")
+var errSmpSessionClosed = errors.New("mars: session is closed")
+
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/mc-smp/04c42f0d-6d2b-4c47-a548-3e0e0e2be5a8
+type smpHeader struct {
+	SMID   uint8
+	Flags  uint8
+	SID    uint16
+	Length uint32
+	SeqNum uint32
+	Window uint32
+}
+
+func (h smpHeader) pack(b []byte) {
+	b[0] = h.SMID
+	b[1] = h.Flags
+	binary.LittleEndian.PutUint16(b[2:], h.SID)
+	binary.LittleEndian.PutUint32(b[4:], h.Length)
+	binary.LittleEndian.PutUint32(b[8:], h.SeqNum)
+	binary.LittleEndian.PutUint32(b[12:], h.Window)
+}
+
+func unpackSmpHeader(b []byte) smpHeader {
+	return smpHeader{
+		SMID:   b[0],
+		Flags:  b[1],
+		SID:    binary.LittleEndian.Uint16(b[2:]),
+		Length: binary.LittleEndian.Uint32(b[4:]),
+		SeqNum: binary.LittleEndian.Uint32(b[8:]),
+		Window: binary.LittleEndian.Uint32(b[12:]),
+	}
+}
+
+// smpMux multiplexes logical sessions over a transport.
+//
+// There is no background reader. A session that needs data from the
+// transport (or a send window update) reads packets itself and hands
+// packets meant for other sessions over to them. Only one session reads
+// at a time, the others wait on cond. This keeps the transport idle
+// between requests, which matters while the login packet is the only
+// encrypted packet and the transport is switched right after it.
+type smpMux struct {
+	// transport may only be replaced while no session is active
+	transport io.ReadWriteCloser
+
+	// wmu serializes writes to the transport
+	wmu sync.Mutex
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	reading  bool
+	sessions map[uint16]*smpSession
+	nextSID  uint16
+	err      error
+}
+
+func newSmpMux(transport io.ReadWriteCloser) *smpMux {
+	m := &smpMux{
+		transport: transport,
+		sessions:  make(map[uint16]*smpSession),
+	}
+	m.cond = sync.NewCond(&m.mu)
+	return m
+}
+
+// openSession sends SYN for a new session id and returns the session.
+func (m *smpMux) openSession() (*smpSession, error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	s := &smpSession{
+		mux:        m,
+		sid:        m.nextSID,
+		peerWindow: smpWindow,
+		window:     smpWindow,
+		acked:      smpWindow,
+	}
+	m.nextSID++
+	m.sessions[s.sid] = s
+	m.mu.Unlock()
+
+	if err := m.writePacket(smpSYN, s.sid, 0, smpWindow, nil); err != nil {
+		m.mu.Lock()
+		delete(m.sessions, s.sid)
+		m.mu.Unlock()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the transport. All sessions fail afterwards.
+func (m *smpMux) Close() error {
+	m.mu.Lock()
+	if m.err == nil {
+		m.err = errSmpClosed
+	}
+	m.cond.Broadcast()
+	m.mu.Unlock()
+	return m.transport.Close()
+}
+
+func (m *smpMux) writePacket(flags uint8, sid uint16, seq, window uint32, payload []byte) error {
+	pkt := make([]byte, smpHeaderSize+len(payload))
+	smpHeader{
+		SMID:   smpID,
+		Flags:  flags,
+		SID:    sid,
+		Length: uint32(len(pkt)),
+		SeqNum: seq,
+		Window: window,
+	}.pack(pkt)
+	copy(pkt[smpHeaderSize:], payload)
+
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	_, err := m.transport.Write(pkt)
+	return err
+}
+
+func (m *smpMux) readPacket() (smpHeader, []byte, error) {
+	var hbuf [smpHeaderSize]byte
+	if _, err := io.ReadFull(m.transport, hbuf[:]); err != nil {
+		return smpHeader{}, nil, err
+	}
+	h := unpackSmpHeader(hbuf[:])
+	if h.SMID != smpID {
+		return h, nil, StreamError{InnerError: fmt.Errorf("invalid SMP packet id %#x", h.SMID)}
+	}
+	if h.Length < smpHeaderSize || h.Length > smpMaxPacket {
+		return h, nil, StreamError{InnerError: fmt.Errorf("invalid SMP packet length %d", h.Length)}
+	}
+	payload := make([]byte, h.Length-smpHeaderSize)
+	if _, err := io.ReadFull(m.transport, payload); err != nil {
+		return h, nil, err
+	}
+	return h, payload, nil
+}
+
+// dispatch hands a packet over to its session, must be called with mu held.
+func (m *smpMux) dispatch(h smpHeader, payload []byte) {
+	s, ok := m.sessions[h.SID]
+	if !ok {
+		// session was closed locally, drop whatever still arrives for it
+		return
+	}
+	if h.Window > s.peerWindow {
+		s.peerWindow = h.Window
+	}
+	switch {
+	case h.Flags&smpDATA != 0:
+		s.pending = append(s.pending, payload)
+	case h.Flags&smpFIN != 0:
+		s.finReceived = true
+	}
+}
+
+// wait blocks until ready returns true, reading packets from the transport
+// when no other session does. ready is called with mu held.
+func (m *smpMux) wait(ready func() bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for !ready() {
+		if m.err != nil {
+			return m.err
+		}
+		if m.reading {
+			m.cond.Wait()
+			continue
+		}
+		m.reading = true
+		m.mu.Unlock()
+		h, payload, err := m.readPacket()
+		m.mu.Lock()
+		m.reading = false
+		if err != nil {
+			m.err = err
+		} else {
+			m.dispatch(h, payload)
+		}
+		m.cond.Broadcast()
+	}
+	return nil
+}
+
+// smpSession is a logical session of a MARS connection. It is used as the
+// transport of a tdsBuffer. Each Write is sent as a single DATA packet.
+type smpSession struct {
+	mux *smpMux
+	sid uint16
+
+	// send side, sequence number of the last DATA packet sent and
+	// the highest sequence number the peer accepts
+	seqNum     uint32
+	peerWindow uint32
+
+	// receive side
+	pending     [][]byte
+	cur         []byte
+	window      uint32 // highest sequence number we accept
+	acked       uint32 // window last advertised to the peer
+	finReceived bool
+
+	closed bool
+}
+
+func (s *smpSession) Read(b []byte) (int, error) {
+	m := s.mux
+	for {
+		err := m.wait(func() bool {
+			return len(s.cur) > 0 || len(s.pending) > 0 || s.finReceived || s.closed
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		m.mu.Lock()
+		for len(s.cur) == 0 && len(s.pending) > 0 {
+			s.cur = s.pending[0]
+			s.pending = s.pending[1:]
+			// the packet is consumed, let the peer send another one
+			s.window++
+		}
+		if len(s.cur) > 0 {
+			break
+		}
+		closed, fin := s.closed, s.finReceived
+		m.mu.Unlock()
+		if closed {
+			return 0, errSmpSessionClosed
+		}
+		if fin {
+			return 0, io.EOF
+		}
+	}
+	n := copy(b, s.cur)
+	s.cur = s.cur[n:]
+	var sendAck bool
+	if s.window-s.acked >= smpWindow/2 {
+		s.acked = s.window
+		sendAck = true
+	}
+	seq, window := s.seqNum, s.window
+	m.mu.Unlock()
+
+	if sendAck {
+		if err := m.writePacket(smpACK, s.sid, seq, window, nil); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (s *smpSession) Write(b []byte) (int, error) {
+	m := s.mux
+	err := m.wait(func() bool {
+		return s.closed || s.finReceived || s.seqNum < s.peerWindow
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	if s.closed || s.finReceived {
+		m.mu.Unlock()
+		return 0, errSmpSessionClosed
+	}
+	s.seqNum++
+	seq, window := s.seqNum, s.window
+	s.acked = window
+	m.mu.Unlock()
+
+	if err := m.writePacket(smpDATA, s.sid, seq, window, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close sends FIN for the session. The transport stays open.
+func (s *smpSession) Close() error {
+	m := s.mux
+	m.mu.Lock()
+	if s.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	delete(m.sessions, s.sid)
+	seq, window := s.seqNum, s.window
+	err := m.err
+	m.cond.Broadcast()
+	m.mu.Unlock()
+
+	if err != nil {
+		return nil
+	}
+	return m.writePacket(smpFIN, s.sid, seq, window, nil)
+}
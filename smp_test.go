@@ -0,0 +1,273 @@
+package mssql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/denisenkom/go-mssqldb/msdsn"
+)
+
+func TestSmpHeaderRoundTrip(t *testing.T) {
+	h := smpHeader{SMID: smpID, Flags: smpDATA, SID: 3, Length: 20, SeqNum: 7, Window: 11}
+	var b [smpHeaderSize]byte
+	h.pack(b[:])
+	expected := []byte{0x53, 0x08, 3, 0, 20, 0, 0, 0, 7, 0, 0, 0, 11, 0, 0, 0}
+	if !bytes.Equal(b[:], expected) {
+		t.Fatalf("unexpected header bytes % x", b)
+	}
+	if got := unpackSmpHeader(b[:]); got != h {
+		t.Fatalf("header round trip failed, got %+v", got)
+	}
+}
+
+// smpPeer is the server end of an SMP connection used in tests.
+type smpPeer struct {
+	conn net.Conn
+}
+
+func (p smpPeer) read() (smpHeader, []byte, error) {
+	var hbuf [smpHeaderSize]byte
+	if _, err := io.ReadFull(p.conn, hbuf[:]); err != nil {
+		return smpHeader{}, nil, err
+	}
+	h := unpackSmpHeader(hbuf[:])
+	payload := make([]byte, h.Length-smpHeaderSize)
+	if _, err := io.ReadFull(p.conn, payload); err != nil {
+		return h, nil, err
+	}
+	return h, payload, nil
+}
+
+func (p smpPeer) expect(flags uint8, sid uint16, payload string) error {
+	h, b, err := p.read()
+	if err != nil {
+		return err
+	}
+	if h.Flags != flags || h.SID != sid || string(b) != payload {
+		return fmt.Errorf("expected flags %d sid %d payload %q, got flags %d sid %d payload %q", flags, sid, payload, h.Flags, h.SID, b)
+	}
+	return nil
+}
+
+func (p smpPeer) write(flags uint8, sid uint16, seq, window uint32, payload string) error {
+	pkt := make([]byte, smpHeaderSize+len(payload))
+	smpHeader{SMID: smpID, Flags: flags, SID: sid, Length: uint32(len(pkt)), SeqNum: seq, Window: window}.pack(pkt)
+	copy(pkt[smpHeaderSize:], payload)
+	_, err := p.conn.Write(pkt)
+	return err
+}
+
+func TestSmpSessions(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	peer := smpPeer{server}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- func() error {
+			for sid := uint16(0); sid < 2; sid++ {
+				if err := peer.expect(smpSYN, sid, ""); err != nil {
+					return err
+				}
+			}
+			// data for the second session arrives before data for the first one
+			if err := peer.write(smpDATA, 1, 1, smpWindow, "one"); err != nil {
+				return err
+			}
+			if err := peer.write(smpDATA, 0, 1, smpWindow, "zero"); err != nil {
+				return err
+			}
+			if err := peer.expect(smpDATA, 0, "hello"); err != nil {
+				return err
+			}
+			// the client may send 4 packets before it has to wait for an ACK
+			for i := 0; i < smpWindow; i++ {
+				if err := peer.expect(smpDATA, 1, fmt.Sprint(i)); err != nil {
+					return err
+				}
+			}
+			if err := peer.write(smpACK, 1, 1, 2*smpWindow, ""); err != nil {
+				return err
+			}
+			if err := peer.expect(smpDATA, 1, fmt.Sprint(smpWindow)); err != nil {
+				return err
+			}
+			return peer.expect(smpFIN, 1, "")
+		}()
+	}()
+
+	mux := newSmpMux(client)
+	s0, err := mux.openSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1, err := mux.openSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 10)
+	n, err := s0.Read(buf)
+	if err != nil || string(buf[:n]) != "zero" {
+		t.Fatalf("session 0 read %q, %v", buf[:n], err)
+	}
+	n, err = s1.Read(buf)
+	if err != nil || string(buf[:n]) != "one" {
+		t.Fatalf("session 1 read %q, %v", buf[:n], err)
+	}
+
+	if _, err = s0.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= smpWindow; i++ {
+		if _, err = s1.Write([]byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = s1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s1.Write([]byte("closed")); err != errSmpSessionClosed {
+		t.Fatalf("expected write on a closed session to fail, got %v", err)
+	}
+	if err = mux.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s0.Read(buf); err != errSmpClosed {
+		t.Fatalf("expected read on a closed connection to fail, got %v", err)
+	}
+}
+
+func TestSmpSessionAcknowledgesData(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	peer := smpPeer{server}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- func() error {
+			if err := peer.expect(smpSYN, 0, ""); err != nil {
+				return err
+			}
+			for i := uint32(1); i <= smpWindow/2; i++ {
+				if err := peer.write(smpDATA, 0, i, smpWindow, "x"); err != nil {
+					return err
+				}
+			}
+			h, _, err := peer.read()
+			if err != nil {
+				return err
+			}
+			if h.Flags != smpACK || h.Window != smpWindow+smpWindow/2 {
+				return fmt.Errorf("expected ACK with window %d, got %+v", smpWindow+smpWindow/2, h)
+			}
+			return peer.write(smpFIN, 0, smpWindow/2, smpWindow, "")
+		}()
+	}()
+
+	mux := newSmpMux(client)
+	s, err := mux.openSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "xx" {
+		t.Fatalf("unexpected data %q", data)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMarsPreloginFields(t *testing.T) {
+	fields := preparePreloginFields(msdsn.Config{MultipleActiveResultSets: true}, &featureExtFedAuth{})
+	if !bytes.Equal(fields[preloginMARS], []byte{1}) {
+		t.Errorf("expected MARS to be requested, got %v", fields[preloginMARS])
+	}
+	fields = preparePreloginFields(msdsn.Config{}, &featureExtFedAuth{})
+	if !bytes.Equal(fields[preloginMARS], []byte{0}) {
+		t.Errorf("expected MARS to be off, got %v", fields[preloginMARS])
+	}
+	if marsAccepted(map[uint8][]byte{preloginMARS: {0}}) || marsAccepted(map[uint8][]byte{}) {
+		t.Error("MARS must not be used unless the server accepts it")
+	}
+	if !marsAccepted(map[uint8][]byte{preloginMARS: {1}}) {
+		t.Error("MARS accepted by the server was not detected")
+	}
+}
+
+func TestMarsExecWhileRowsOpen(t *testing.T) {
+	u := makeConnStr(t)
+	q := u.Query()
+	q.Set("multipleactiveresultsets", "true")
+	u.RawQuery = q.Encode()
+	db, err := sql.Open("sqlserver", u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec("create table #mars (id int)"); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := tx.Query("select n from (values (1), (2), (3)) v(n)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var n int
+		if err = rows.Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		// the result set above is still pending
+		if _, err = tx.Exec("insert into #mars (id) values (@p1)", n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err = tx.QueryRow("select count(*) from #mars").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("expected 3 rows inserted, got %d", count)
+	}
+}
+
+func TestInternalStmtSession(t *testing.T) {
+	c := &Conn{sess: &tdsSession{mars: newSmpMux(nil)}}
+	s, err := c.prepareInternal(context.Background(), "select 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := s.session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess != c.sess || s.sess != nil || len(c.sess.mars.sessions) != 0 {
+		t.Error("internal statements must run on the connection's session")
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"unicode/utf16"
 	"unicode/utf8"
 
+	"github.com/denisenkom/go-mssqldb/internal/cp"
 	"github.com/denisenkom/go-mssqldb/msdsn"
 )
 
@@ -78,6 +79,7 @@ const (
 	verTDS73     = verTDS73A
 	verTDS73B    = 0x730B0003
 	verTDS74     = 0x74000004
+	verTDS80     = 0x08000000
 )
 
 // packet types
@@ -143,6 +145,43 @@ type tdsSession struct {
 	logger       ContextLogger
 	routedServer string
 	routedPort   uint16
+	language     string
+	collation    cp.Collation
+
+	// netConn is the network connection the session was dialed on,
+	// used to check an idle connection before it is reused.
+	netConn net.Conn
+	// recovery holds the session state the server returned for session
+	// recovery, nil when the server doesn't support it.
+	recovery *sessionRecovery
+	// alwaysEncrypted is set when column encryption was negotiated
+	alwaysEncrypted bool
+	// utf8 is set when the server supports UTF-8 collations
+	utf8 bool
+	// dataClassificationVersion is the negotiated data classification
+	// version, 0 when the server doesn't send classifications
+	dataClassificationVersion byte
+	// stream is the value of the last row that is being streamed,
+	// reading the response waits until it is released
+	stream *PLPReader
+	// dtcToken is the DTC token of the last promoted transaction
+	dtcToken []byte
+
+	// mars is set when MARS was negotiated, buf then reads and writes
+	// a logical session of it.
+	mars *smpMux
+	// parent is the connection's primary session for sessions created
+	// for MARS statements.
+	parent *tdsSession
+}
+
+// setTranID records the current transaction descriptor. MARS sessions
+// share the transaction of the connection's primary session.
+func (sess *tdsSession) setTranID(id uint64) {
+	sess.tranid = id
+	if sess.parent != nil {
+		sess.parent.tranid = id
+	}
 }
 
 const (
@@ -158,6 +197,11 @@ type columnStruct struct {
 	Flags    uint16
 	ColName  string
 	ti       typeInfo
+
+	// cryptoMeta is set for Always Encrypted columns
+	cryptoMeta *cryptoMetadata
+	// classification is the data classification of the result set
+	classification *SensitivityClassification
 }
 
 type keySlice []uint8
@@ -335,9 +379,15 @@ func (e featureExts) toBytes() []byte {
 	if len(e.features) == 0 {
 		return nil
 	}
+	// write the features in a stable order
+	ids := make(keySlice, 0, len(e.features))
+	for featureID := range e.features {
+		ids = append(ids, featureID)
+	}
+	sort.Sort(ids)
 	var d []byte
-	for featureID, f := range e.features {
-		featureData := f.toBytes()
+	for _, featureID := range ids {
+		featureData := e.features[featureID].toBytes()
 
 		hdr := make([]byte, 5)
 		hdr[0] = featureID                                               // FedAuth feature extension BYTE
@@ -352,6 +402,17 @@ func (e featureExts) toBytes() []byte {
 	return d
 }
 
+// featureExtUTF8Support advertises that the client accepts UTF-8 collations.
+type featureExtUTF8Support struct{}
+
+func (e *featureExtUTF8Support) featureID() byte {
+	return featExtUTF8SUPPORT
+}
+
+func (e *featureExtUTF8Support) toBytes() []byte {
+	return nil
+}
+
 // featureExtFedAuth tracks federated authentication state before and during login
 type featureExtFedAuth struct {
 	// FedAuthLibrary is populated by the federated authentication provider.
@@ -923,18 +984,26 @@ func preparePreloginFields(p msdsn.Config, fe *featureExtFedAuth) map[uint8][]by
 		panic(fmt.Errorf("Unsupported Encryption Config %v", p.Encryption))
 	case msdsn.EncryptionDisabled:
 		encrypt = encryptNotSup
+	case msdsn.EncryptionStrict:
+		// the connection is encrypted already, no in-band TLS handshake
+		encrypt = encryptNotSup
 	case msdsn.EncryptionRequired:
 		encrypt = encryptOn
 	case msdsn.EncryptionOff:
 		encrypt = encryptOff
 	}
 
+	var mars byte
+	if p.MultipleActiveResultSets {
+		mars = 1
+	}
+
 	fields := map[uint8][]byte{
 		preloginVERSION:    {0, 0, 0, 0, 0, 0},
 		preloginENCRYPTION: {encrypt},
 		preloginINSTOPT:    instance_buf,
 		preloginTHREADID:   {0, 0, 0, 0},
-		preloginMARS:       {0}, // MARS disabled
+		preloginMARS:       {mars},
 	}
 
 	if fe.FedAuthLibrary != FedAuthLibraryReserved {
@@ -964,6 +1033,9 @@ func interpretPreloginResponse(p msdsn.Config, fe *featureExtFedAuth, fields map
 		return 0, fmt.Errorf("encrypt negotiation failed")
 	}
 	encrypt = encryptBytes[0]
+	if p.Encryption == msdsn.EncryptionStrict {
+		return encryptNotSup, nil
+	}
 	if p.Encryption == msdsn.EncryptionRequired && (encrypt == encryptNotSup || encrypt == encryptOff) {
 		return 0, fmt.Errorf("server does not support encryption")
 	}
@@ -971,6 +1043,12 @@ func interpretPreloginResponse(p msdsn.Config, fe *featureExtFedAuth, fields map
 	return
 }
 
+// marsAccepted reports whether the PRELOGIN response switched MARS on.
+func marsAccepted(fields map[uint8][]byte) bool {
+	mars, ok := fields[preloginMARS]
+	return ok && len(mars) == 1 && mars[0] != 0
+}
+
 func prepareLogin(ctx context.Context, c *Connector, p msdsn.Config, logger ContextLogger, auth auth, fe *featureExtFedAuth, packetSize uint32) (l *login, err error) {
 	var typeFlags uint8
 	if p.ReadOnlyIntent {
@@ -994,6 +1072,9 @@ func prepareLogin(ctx context.Context, c *Connector, p msdsn.Config, logger Cont
 		AppName:      p.AppName,
 		TypeFlags:    typeFlags,
 	}
+	if p.Encryption == msdsn.EncryptionStrict {
+		l.TDSVersion = verTDS80
+	}
 	switch {
 	case fe.FedAuthLibrary == FedAuthLibrarySecurityToken:
 		if uint64(p.LogFlags)&logDebug != 0 {
@@ -1040,6 +1121,12 @@ func prepareLogin(ctx context.Context, c *Connector, p msdsn.Config, logger Cont
 }
 
 func connect(ctx context.Context, c *Connector, logger ContextLogger, p msdsn.Config) (res *tdsSession, err error) {
+	return connectSession(ctx, c, logger, p, nil)
+}
+
+// connectSession connects and logs in. When lost is not nil, the server
+// is asked to restore the session state of the lost session.
+func connectSession(ctx context.Context, c *Connector, logger ContextLogger, p msdsn.Config, lost *tdsSession) (res *tdsSession, err error) {
 	dialCtx := ctx
 	if p.DialTimeout >= 0 {
 		dt := p.DialTimeout
@@ -1060,11 +1147,28 @@ initiate_connection:
 
 	toconn := newTimeoutConn(conn, p.ConnTimeout)
 
-	outbuf := newTdsBuffer(p.PacketSize, toconn)
+	var transport io.ReadWriteCloser = toconn
+	if p.Encryption == msdsn.EncryptionStrict {
+		// TDS 8.0: TLS is negotiated before any TDS packet is sent
+		config, err := prepareStrictTLSConfig(p)
+		if err != nil {
+			toconn.Close()
+			return nil, err
+		}
+		tlsConn := tls.Client(toconn, config)
+		if err = tlsConn.Handshake(); err != nil {
+			toconn.Close()
+			return nil, fmt.Errorf("TLS Handshake failed: %v", err)
+		}
+		transport = tlsConn
+	}
+
+	outbuf := newTdsBuffer(p.PacketSize, transport)
 	sess := tdsSession{
 		buf:      outbuf,
 		logger:   logger,
 		logFlags: uint64(p.LogFlags),
+		netConn:  conn,
 	}
 
 	fedAuth := &featureExtFedAuth{
@@ -1113,6 +1217,24 @@ initiate_connection:
 		}
 	}
 
+	// The server answers with MARS on only if it supports it,
+	// otherwise continue with a plain connection.
+	if p.MultipleActiveResultSets && marsAccepted(fields) {
+		sess.mars = newSmpMux(outbuf.transport)
+		marsSess, err := sess.mars.openSession()
+		if err != nil {
+			return nil, err
+		}
+		if outbuf.afterFirst != nil {
+			// login-only encryption, the SMP layer sits on top of the
+			// encrypted stream until the login packet is sent
+			outbuf.afterFirst = func() {
+				sess.mars.transport = toconn
+			}
+		}
+		outbuf.transport = marsSess
+	}
+
 	auth, authOk := getAuth(p.User, p.Password, p.ServerSPN, p.Workstation)
 	if authOk {
 		defer auth.Free()
@@ -1124,6 +1246,29 @@ initiate_connection:
 	if err != nil {
 		return nil, err
 	}
+	if p.ConnectRetryCount > 0 {
+		recovery := &featureExtSessionRecovery{}
+		if lost != nil && lost.recovery != nil {
+			recovery.recover = true
+			recovery.initial = lost.recovery.initial
+			recovery.current = lost.currentRecoveryData()
+		}
+		if err = login.FeatureExt.Add(recovery); err != nil {
+			return nil, err
+		}
+		sess.recovery = newSessionRecovery()
+	}
+	if p.ColumnEncryption {
+		if err = login.FeatureExt.Add(&featureExtColumnEncryption{}); err != nil {
+			return nil, err
+		}
+	}
+	if err = login.FeatureExt.Add(&featureExtUTF8Support{}); err != nil {
+		return nil, err
+	}
+	if err = login.FeatureExt.Add(&featureExtDataClassification{}); err != nil {
+		return nil, err
+	}
 
 	err = sendLogin(outbuf, login)
 	if err != nil {
@@ -1191,6 +1336,20 @@ initiate_connection:
 			case loginAckStruct:
 				sess.loginAck = token
 				loginAck = true
+			case map[byte]interface{}:
+				if states, ok := token[featExtSESSIONRECOVERY].(map[byte][]byte); ok && sess.recovery != nil {
+					sess.recovery.acked = true
+					sess.recovery.initial.states = states
+				}
+				if version, ok := token[featExtCOLUMNENCRYPTION].(byte); ok && version >= columnEncryptionVersion {
+					sess.alwaysEncrypted = true
+				}
+				if supported, ok := token[featExtUTF8SUPPORT].(bool); ok {
+					sess.utf8 = supported
+				}
+				if version, ok := token[featExtDATACLASSIFICATION].(byte); ok {
+					sess.dataClassificationVersion = version
+				}
 			case doneStruct:
 				if token.isError() {
 					tokenErr := token.getError()
@@ -1218,6 +1377,16 @@ initiate_connection:
 		}
 		goto initiate_connection
 	}
+	if sess.recovery != nil {
+		if !sess.recovery.acked {
+			// server doesn't support session recovery
+			sess.recovery = nil
+		} else {
+			sess.recovery.initial.database = sess.database
+			sess.recovery.initial.language = sess.language
+			sess.recovery.initial.collation = sess.collation
+		}
+	}
 	return &sess, nil
 }
 
@@ -1249,6 +1418,26 @@ func prepareTLSConfig(p msdsn.Config) (config *tls.Config) {
 	return
 }
 
+// prepareStrictTLSConfig returns the TLS configuration of strict
+// encryption, which always validates the server certificate, also when
+// the configuration skips the verification. The certificate is verified
+// for the ServerName of the configuration or else the host.
+func prepareStrictTLSConfig(p msdsn.Config) (*tls.Config, error) {
+	config := prepareTLSConfig(p).Clone()
+	config.InsecureSkipVerify = false
+	if config.ServerName == "" {
+		config.ServerName = p.Host
+	}
+	if config.ServerName == "" {
+		return nil, errors.New("strict encryption needs the server name to verify the certificate")
+	}
+	config.NextProtos = []string{msdsn.TDS8ALPN}
+	if config.MinVersion < tls.VersionTLS12 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	return config, nil
+}
+
 func prepareMSDSN(dialCtx context.Context, c *Connector, logger ContextLogger, p *msdsn.Config) (err error) {
 
 	// if instance is specified use instance resolution service
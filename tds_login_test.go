@@ -2,14 +2,25 @@ package mssql
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/big"
 	"net"
 	"regexp"
+	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/denisenkom/go-mssqldb/msdsn"
 )
@@ -132,18 +143,19 @@ func TestLoginWithSQLServerAuth(t *testing.T) {
 			"  12 01 00 2f 00 00 01 00  00 00 1a 00 06 01 00 20\n" +
 				"00 01 02 00 21 00 01 03  00 22 00 04 04 00 26 00\n" +
 				"01 ff 00 00 00 00 00 00  00 00 00 00 00 00 00\n",
-			"  10 01 00 b2 00 00 01 00  aa 00 00 00 04 00 00 74\n" +
+			"  10 01 00 c7 00 00 01 00  bf 00 00 00 04 00 00 74\n" +
 				"00 10 00 00 00 00 00 00  00 00 00 00 00 00 00 00\n" +
-				"A0 02 00 00 00 00 00 00  00 00 00 00 5e 00 09 00\n" +
+				"A0 02 00 10 00 00 00 00  00 00 00 00 5e 00 09 00\n" +
 				"70 00 04 00 78 00 06 00  84 00 0a 00 98 00 09 00\n" +
-				"00 00 00 00 aa 00 00 00  aa 00 00 00 aa 00 00 00\n" +
+				"aa 00 04 00 aa 00 00 00  aa 00 00 00 aa 00 00 00\n" +
 				"00 00 00 00 00 00 aa 00  00 00 aa 00 00 00 aa 00\n" +
 				"00 00 00 00 00 00 6c 00  6f 00 63 00 61 00 6c 00\n" +
 				"68 00 6f 00 73 00 74 00  74 00 65 00 73 00 74 00\n" +
 				"92 a5 f3 a5 93 a5 82 a5  f3 a5 e2 a5 67 00 6f 00\n" +
 				"2d 00 6d 00 73 00 73 00  71 00 6c 00 64 00 62 00\n" +
 				"6c 00 6f 00 63 00 61 00  6c 00 68 00 6f 00 73 00\n" +
-				"74 00\n",
+				"74 00 ae 00 00 00 01 00  00 00 00 09 01 00 00 00\n" +
+				"02 0a 00 00 00 00 ff\n",
 		},
 		[]string{
 			"  04 01 00 20  00 00 01 00   00 00 10 00  06 01 00 16\n" +
@@ -193,7 +205,7 @@ func TestLoginWithSecurityTokenAuth(t *testing.T) {
 				"00 01 02 00 26 00 01 03  00 27 00 04 04 00 2B 00\n" +
 				"01 06 00 2c 00 01 ff 00  00 00 00 00 00 00 00 00\n" +
 				"00 00 00 00 01\n",
-			"  10 01 00 BB 00 00 01 00  B3 00 00 00 04 00 00 74\n" +
+			"  10 01 00 CB 00 00 01 00  C3 00 00 00 04 00 00 74\n" +
 				"00 10 00 00 00 00 00 00  00 00 00 00 00 00 00 00\n" +
 				"A0 02 00 10 00 00 00 00  00 00 00 00 5E 00 09 00\n" +
 				"70 00 00 00 70 00 00 00  70 00 0A 00 84 00 09 00\n" +
@@ -203,8 +215,9 @@ func TestLoginWithSecurityTokenAuth(t *testing.T) {
 				"68 00 6F 00 73 00 74 00  67 00 6F 00 2D 00 6D 00\n" +
 				"73 00 73 00 71 00 6C 00  64 00 62 00 6C 00 6F 00\n" +
 				"63 00 61 00 6C 00 68 00  6F 00 73 00 74 00 9A 00\n" +
-				"00 00 02 13 00 00 00 03  0E 00 00 00 3C 00 74 00\n" +
-				"6F 00 6B 00 65 00 6E 00  3E 00 FF\n",
+				"00 00 01 00 00 00 00 02  13 00 00 00 03 0E 00 00\n" +
+				"00 3C 00 74 00 6F 00 6B  00 65 00 6E 00 3E 00 09\n" +
+				"01 00 00 00 02 0A 00 00  00 00 FF\n",
 		},
 		[]string{
 			"  04 01 00 20  00 00 01 00   00 00 10 00  06 01 00 16\n" +
@@ -256,7 +269,7 @@ func TestLoginWithADALUsernamePasswordAuth(t *testing.T) {
 				"00 01 02 00 26 00 01 03  00 27 00 04 04 00 2B 00\n" +
 				"01 06 00 2C 00 01 ff 00  00 00 00 00 00 00 00 00\n" +
 				"00 00 00 00 01\n",
-			"  10 01 00 aa 00 00 01 00  a2 00 00 00 04 00 00 74\n" +
+			"  10 01 00 ba 00 00 01 00  b2 00 00 00 04 00 00 74\n" +
 				"00 10 00 00 00 00 00 00  00 00 00 00 00 00 00 00\n" +
 				"A0 02 00 10 00 00 00 00  00 00 00 00 5e 00 09 00\n" +
 				"70 00 00 00 70 00 00 00  70 00 0a 00 84 00 09 00\n" +
@@ -266,7 +279,8 @@ func TestLoginWithADALUsernamePasswordAuth(t *testing.T) {
 				"68 00 6f 00 73 00 74 00  67 00 6f 00 2d 00 6d 00\n" +
 				"73 00 73 00 71 00 6c 00  64 00 62 00 6c 00 6f 00\n" +
 				"63 00 61 00 6c 00 68 00  6f 00 73 00 74 00 9a 00\n" +
-				"00 00 02 02 00 00 00 05  01 ff\n",
+				"00 00 01 00 00 00 00 02  02 00 00 00 05 01 09 01\n" +
+				"00 00 00 02 0a 00 00 00  00 ff\n",
 			"  08 01 00 1e 00 00 01 00  12 00 00 00 0e 00 00 00\n" +
 				"3c 00 74 00 6f 00 6b 00  65 00 6e 00 3e 00\n",
 		},
@@ -330,7 +344,7 @@ func TestLoginWithADALManagedIdentityAuth(t *testing.T) {
 				"00 01 02 00 26 00 01 03  00 27 00 04 04 00 2B 00\n" +
 				"01 06 00 2C 00 01 ff 00  00 00 00 00 00 00 00 00\n" +
 				"00 00 00 00 01\n",
-			"  10 01 00 aa 00 00 01 00  a2 00 00 00 04 00 00 74\n" +
+			"  10 01 00 ba 00 00 01 00  b2 00 00 00 04 00 00 74\n" +
 				"00 10 00 00 00 00 00 00  00 00 00 00 00 00 00 00\n" +
 				"A0 02 00 10 00 00 00 00  00 00 00 00 5e 00 09 00\n" +
 				"70 00 00 00 70 00 00 00  70 00 0a 00 84 00 09 00\n" +
@@ -340,7 +354,8 @@ func TestLoginWithADALManagedIdentityAuth(t *testing.T) {
 				"68 00 6f 00 73 00 74 00  67 00 6f 00 2d 00 6d 00\n" +
 				"73 00 73 00 71 00 6c 00  64 00 62 00 6c 00 6f 00\n" +
 				"63 00 61 00 6c 00 68 00  6f 00 73 00 74 00 9a 00\n" +
-				"00 00 02 02 00 00 00 05  03 ff\n",
+				"00 00 01 00 00 00 00 02  02 00 00 00 05 03 09 01\n" +
+				"00 00 00 02 0a 00 00 00  00 ff\n",
 			"  08 01 00 1e 00 00 01 00  12 00 00 00 0e 00 00 00\n" +
 				"3c 00 74 00 6f 00 6b 00  65 00 6e 00 3e 00\n",
 		},
@@ -377,3 +392,111 @@ func TestLoginWithADALManagedIdentityAuth(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+type strictEncryptionDialer struct {
+	conn net.Conn
+}
+
+func (d strictEncryptionDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	return d.conn, nil
+}
+
+func testServerCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestLoginWithStrictEncryption(t *testing.T) {
+	cert, pool := testServerCertificate(t)
+	for _, trusted := range []bool{true, false} {
+		conn, err := NewConnector("sqlserver://localhost:1433?encrypt=strict&TrustServerCertificate=true")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if trusted {
+			conn.params.TLSConfig.RootCAs = pool
+		} else {
+			conn.params.TLSConfig.RootCAs = x509.NewCertPool()
+		}
+		server, client := net.Pipe()
+		conn.Dialer = strictEncryptionDialer{client}
+
+		result := make(chan error, 1)
+		go func() {
+			defer server.Close()
+			tlsConn := tls.Server(server, &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				NextProtos:   []string{msdsn.TDS8ALPN},
+			})
+			if err := tlsConn.Handshake(); err != nil {
+				result <- err
+				return
+			}
+			if p := tlsConn.ConnectionState().NegotiatedProtocol; p != msdsn.TDS8ALPN {
+				result <- fmt.Errorf("unexpected ALPN protocol %q", p)
+				return
+			}
+			// PRELOGIN is sent over TLS and doesn't ask for in-band encryption
+			buf := newTdsBuffer(defaultPacketSize, tlsConn)
+			packetType, err := buf.BeginRead()
+			if err != nil {
+				result <- err
+				return
+			}
+			if packetType != packPrelogin {
+				result <- fmt.Errorf("unexpected packet type %d", packetType)
+				return
+			}
+			b, err := ioutil.ReadAll(buf)
+			if err != nil {
+				result <- err
+				return
+			}
+			for i := 0; b[i] != preloginTERMINATOR; i += 5 {
+				if b[i] == preloginENCRYPTION {
+					if e := b[binary.BigEndian.Uint16(b[i+1:])]; e != encryptNotSup {
+						result <- fmt.Errorf("unexpected PRELOGIN encryption %d", e)
+						return
+					}
+				}
+			}
+			result <- nil
+		}()
+
+		_, err = connect(context.Background(), conn, driverInstanceNoProcess.logger, conn.params)
+		if err == nil {
+			t.Fatal("connect must fail when the server closes the connection")
+		}
+		serverErr := <-result
+		if trusted && serverErr != nil {
+			t.Errorf("strict encryption login failed: %v", serverErr)
+		}
+		if !trusted && (serverErr == nil || !strings.Contains(err.Error(), "TLS Handshake failed")) {
+			t.Errorf("untrusted server certificate must be rejected, got %v", err)
+		}
+	}
+}
@@ -785,6 +785,24 @@ func Test_prepareTLSConfig(t *testing.T) {
 	}
 }
 
+func Test_prepareStrictTLSConfig(t *testing.T) {
+	p := msdsn.Config{Host: "testserver", TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+	config, err := prepareStrictTLSConfig(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.InsecureSkipVerify || config.ServerName != "testserver" || config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("prepareStrictTLSConfig() = %+v, want a verifying TLS 1.2 configuration for testserver", config)
+	}
+	if !p.TLSConfig.InsecureSkipVerify {
+		t.Error("the TLS configuration of the connection string must not be changed")
+	}
+	p.Host = ""
+	if _, err = prepareStrictTLSConfig(p); err == nil {
+		t.Error("strict encryption without a server name must fail")
+	}
+}
+
 func Test_prepareMSDSN(t *testing.T) {
 
 	tl := testLogger{t: t}
@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"strconv"
 
+	"github.com/denisenkom/go-mssqldb/internal/cp"
 	"github.com/denisenkom/go-mssqldb/msdsn"
 	"github.com/golang-sql/sqlexp"
 )
@@ -19,22 +20,24 @@ type token byte
 
 // token ids
 const (
-	tokenReturnStatus  token = 121 // 0x79
-	tokenColMetadata   token = 129 // 0x81
-	tokenOrder         token = 169 // 0xA9
-	tokenError         token = 170 // 0xAA
-	tokenInfo          token = 171 // 0xAB
-	tokenReturnValue   token = 0xAC
-	tokenLoginAck      token = 173 // 0xad
-	tokenFeatureExtAck token = 174 // 0xae
-	tokenRow           token = 209 // 0xd1
-	tokenNbcRow        token = 210 // 0xd2
-	tokenEnvChange     token = 227 // 0xE3
-	tokenSSPI          token = 237 // 0xED
-	tokenFedAuthInfo   token = 238 // 0xEE
-	tokenDone          token = 253 // 0xFD
-	tokenDoneProc      token = 254
-	tokenDoneInProc    token = 255
+	tokenReturnStatus       token = 121 // 0x79
+	tokenColMetadata        token = 129 // 0x81
+	tokenDataClassification token = 163 // 0xA3
+	tokenOrder              token = 169 // 0xA9
+	tokenError              token = 170 // 0xAA
+	tokenInfo               token = 171 // 0xAB
+	tokenReturnValue        token = 0xAC
+	tokenLoginAck           token = 173 // 0xad
+	tokenFeatureExtAck      token = 174 // 0xae
+	tokenRow                token = 209 // 0xd1
+	tokenNbcRow             token = 210 // 0xd2
+	tokenEnvChange          token = 227 // 0xE3
+	tokenSessionState       token = 228 // 0xE4
+	tokenSSPI               token = 237 // 0xED
+	tokenFedAuthInfo        token = 238 // 0xEE
+	tokenDone               token = 253 // 0xFD
+	tokenDoneProc           token = 254
+	tokenDoneInProc         token = 255
 )
 
 // done flags
@@ -81,7 +84,8 @@ const (
 // COLMETADATA flags
 // https://msdn.microsoft.com/en-us/library/dd357363.aspx
 const (
-	colFlagNullable = 1
+	colFlagNullable  = 1
+	colFlagEncrypted = 0x0800
 	// TODO implement more flags
 )
 
@@ -143,9 +147,8 @@ func processEnvChg(ctx context.Context, sess *tdsSession) {
 				badStreamPanic(err)
 			}
 		case envTypLanguage:
-			// currently ignored
 			// new value
-			if _, err = readBVarChar(r); err != nil {
+			if sess.language, err = readBVarChar(r); err != nil {
 				badStreamPanic(err)
 			}
 			// old value
@@ -197,7 +200,6 @@ func processEnvChg(ctx context.Context, sess *tdsSession) {
 				badStreamPanic(err)
 			}
 		case envSqlCollation:
-			// currently ignored
 			var collationSize uint8
 			err = binary.Read(r, binary.LittleEndian, &collationSize)
 			if err != nil {
@@ -222,6 +224,7 @@ func processEnvChg(ctx context.Context, sess *tdsSession) {
 			if err != nil {
 				badStreamPanic(err)
 			}
+			sess.collation = cp.Collation{LcidAndFlags: info, SortId: sortID}
 
 			// old value, should be 0
 			if _, err = readBVarChar(r); err != nil {
@@ -232,7 +235,7 @@ func processEnvChg(ctx context.Context, sess *tdsSession) {
 			if len(tranid) != 8 {
 				badStreamPanicf("invalid size of transaction identifier: %d", len(tranid))
 			}
-			sess.tranid = binary.LittleEndian.Uint64(tranid)
+			sess.setTranID(binary.LittleEndian.Uint64(tranid))
 			if err != nil {
 				badStreamPanic(err)
 			}
@@ -259,27 +262,38 @@ func processEnvChg(ctx context.Context, sess *tdsSession) {
 					sess.logger.Log(ctx, msdsn.LogTransaction, fmt.Sprintf("ROLLBACK TRANSACTION %x", sess.tranid))
 				}
 			}
-			sess.tranid = 0
+			sess.setTranID(0)
 		case envEnlistDTC:
-			// currently ignored
-			// new value, should be 0
-			if _, err = readBVarChar(r); err != nil {
+			// the session was enlisted in a distributed transaction,
+			// new value is the transaction descriptor
+			tranid, err := readBVarByte(r)
+			if err != nil {
 				badStreamPanic(err)
 			}
-			// old value
-			if _, err = readBVarChar(r); err != nil {
+			if len(tranid) == 8 {
+				sess.setTranID(binary.LittleEndian.Uint64(tranid))
+			}
+			// old value, should be 0
+			if _, err = readBVarByte(r); err != nil {
 				badStreamPanic(err)
 			}
+			if sess.logFlags&logTransaction != 0 {
+				sess.logger.Log(ctx, msdsn.LogTransaction, fmt.Sprintf("ENLIST DTC TRANSACTION %x", sess.tranid))
+			}
 		case envDefectTran:
-			// currently ignored
+			// the session left the distributed transaction
 			// new value
-			if _, err = readBVarChar(r); err != nil {
+			if _, err = readBVarByte(r); err != nil {
 				badStreamPanic(err)
 			}
 			// old value, should be 0
-			if _, err = readBVarChar(r); err != nil {
+			if _, err = readBVarByte(r); err != nil {
 				badStreamPanic(err)
 			}
+			if sess.logFlags&logTransaction != 0 {
+				sess.logger.Log(ctx, msdsn.LogTransaction, fmt.Sprintf("DEFECT TRANSACTION %x", sess.tranid))
+			}
+			sess.setTranID(0)
 		case envDatabaseMirrorPartner:
 			sess.partner, err = readBVarChar(r)
 			if err != nil {
@@ -290,38 +304,47 @@ func processEnvChg(ctx context.Context, sess *tdsSession) {
 				badStreamPanic(err)
 			}
 		case envPromoteTran:
-			// currently ignored
-			// old value, should be 0
-			if _, err = readBVarChar(r); err != nil {
+			// new value, the DTC token as L_VARBYTE
+			var size uint32
+			if err = binary.Read(r, binary.LittleEndian, &size); err != nil {
 				badStreamPanic(err)
 			}
-			// dtc token
-			// spec says it should be L_VARBYTE, so this code might be wrong
-			if _, err = readBVarChar(r); err != nil {
+			if int64(size) > r.N {
+				badStreamPanicf("invalid size of DTC token: %d", size)
+			}
+			sess.dtcToken = make([]byte, size)
+			if _, err = io.ReadFull(r, sess.dtcToken); err != nil {
+				badStreamPanic(err)
+			}
+			// old value, should be 0
+			if _, err = readBVarByte(r); err != nil {
 				badStreamPanic(err)
 			}
 		case envTranMgrAddr:
 			// currently ignored
-			// old value, should be 0
-			if _, err = readBVarChar(r); err != nil {
+			// new value, XACT_MANAGER_ADDRESS = B_VARBYTE
+			if _, err = readBVarByte(r); err != nil {
 				badStreamPanic(err)
 			}
-			// XACT_MANAGER_ADDRESS = B_VARBYTE
-			if _, err = readBVarChar(r); err != nil {
+			// old value, should be 0
+			if _, err = readBVarByte(r); err != nil {
 				badStreamPanic(err)
 			}
 		case envTranEnded:
 			// currently ignored
-			// old value, B_VARBYTE
-			if _, err = readBVarChar(r); err != nil {
+			// new value, should be 0
+			if _, err = readBVarByte(r); err != nil {
 				badStreamPanic(err)
 			}
-			// should be 0
-			if _, err = readBVarChar(r); err != nil {
+			// old value, B_VARBYTE
+			if _, err = readBVarByte(r); err != nil {
 				badStreamPanic(err)
 			}
 		case envResetConnAck:
-			// currently ignored
+			// the session was reset to its login state
+			if sess.recovery != nil {
+				sess.recovery.deltas = map[byte][]byte{}
+			}
 			// old value, should be 0
 			if _, err = readBVarChar(r); err != nil {
 				badStreamPanic(err)
@@ -526,6 +549,36 @@ func parseFeatureExtAck(r *tdsBuffer) map[byte]interface{} {
 		length := r.uint32()
 
 		switch feature {
+		case featExtSESSIONRECOVERY:
+			data := readTokenData(r, length)
+			length = 0
+			// malformed recovery data leaves session recovery off
+			if states, err := parseSessionStates(data); err == nil {
+				ack[feature] = states
+			}
+
+		case featExtCOLUMNENCRYPTION:
+			if length > 0 {
+				ack[feature] = r.byte()
+				length--
+			}
+
+		case featExtUTF8SUPPORT:
+			if length > 0 {
+				ack[feature] = r.byte()&0x01 != 0
+				length--
+			}
+
+		case featExtDATACLASSIFICATION:
+			// version and whether classification is enabled
+			if length >= 2 {
+				version := r.byte()
+				if r.byte() != 0 && version <= dataClassificationVersion {
+					ack[feature] = version
+				}
+				length -= 2
+			}
+
 		case featExtFEDAUTH:
 			// In theory we need to know the federated authentication library to
 			// know how to parse, but the alternatives provide compatible structures.
@@ -554,12 +607,16 @@ func parseFeatureExtAck(r *tdsBuffer) map[byte]interface{} {
 }
 
 // http://msdn.microsoft.com/en-us/library/dd357363.aspx
-func parseColMetadata72(r *tdsBuffer) (columns []columnStruct) {
+func parseColMetadata72(r *tdsBuffer, s *tdsSession) (columns []columnStruct) {
 	count := r.uint16()
 	if count == 0xffff {
 		// no metadata is sent
 		return nil
 	}
+	var cekTable []cekEntry
+	if s.alwaysEncrypted {
+		cekTable = parseCekTable(r)
+	}
 	columns = make([]columnStruct, count)
 	for i := range columns {
 		column := &columns[i]
@@ -568,15 +625,29 @@ func parseColMetadata72(r *tdsBuffer) (columns []columnStruct) {
 
 		// parsing TYPE_INFO structure
 		column.ti = readTypeInfo(r)
+		if s.alwaysEncrypted && column.Flags&colFlagEncrypted != 0 {
+			// the column is reported with the type of its plain values
+			column.cryptoMeta = parseCryptoMetadata(r, cekTable, column.ti)
+			column.ti = column.cryptoMeta.baseTi
+		}
 		column.ColName = r.BVarChar()
 	}
 	return columns
 }
 
+// wireTypeInfo returns the type the column values are sent with.
+func (c *columnStruct) wireTypeInfo() *typeInfo {
+	if c.cryptoMeta != nil {
+		return &c.cryptoMeta.cipherTi
+	}
+	return &c.ti
+}
+
 // http://msdn.microsoft.com/en-us/library/dd357254.aspx
 func parseRow(r *tdsBuffer, columns []columnStruct, row []interface{}) {
-	for i, column := range columns {
-		row[i] = column.ti.Reader(&column.ti, r)
+	for i := range columns {
+		ti := columns[i].wireTypeInfo()
+		row[i] = ti.Reader(ti, r)
 	}
 }
 
@@ -585,12 +656,13 @@ func parseNbcRow(r *tdsBuffer, columns []columnStruct, row []interface{}) {
 	bitlen := (len(columns) + 7) / 8
 	pres := make([]byte, bitlen)
 	r.ReadFull(pres)
-	for i, col := range columns {
+	for i := range columns {
 		if pres[i/8]&(1<<(uint(i)%8)) != 0 {
 			row[i] = nil
 			continue
 		}
-		row[i] = col.ti.Reader(&col.ti, r)
+		ti := columns[i].wireTypeInfo()
+		row[i] = ti.Reader(ti, r)
 	}
 }
 
@@ -623,7 +695,7 @@ func parseInfo(r *tdsBuffer) (res Error) {
 }
 
 // https://msdn.microsoft.com/en-us/library/dd303881.aspx
-func parseReturnValue(r *tdsBuffer) (nv namedValue) {
+func parseReturnValue(r *tdsBuffer, s *tdsSession) (nv namedValue, cm *cryptoMetadata) {
 	/*
 		ParamOrdinal
 		ParamName
@@ -638,8 +710,15 @@ func parseReturnValue(r *tdsBuffer) (nv namedValue) {
 	nv.Name = r.BVarChar()
 	r.byte()
 	r.uint32() // UserType (uint16 prior to 7.2)
-	r.uint16()
+	flags := r.uint16()
 	ti := readTypeInfo(r)
+	if s.alwaysEncrypted && flags&colFlagEncrypted != 0 {
+		cm = parseCryptoMetadata(r, nil, ti)
+	}
+	if ti.TypeId == typeVariant {
+		// the base type is kept for Variant destinations
+		ti.Reader = readTypedVariant
+	}
 	nv.Value = ti.Reader(&ti, r)
 	return
 }
@@ -690,6 +769,8 @@ func processSingleResponse(ctx context.Context, sess *tdsSession, ch chan tokenS
 		case tokenFeatureExtAck:
 			featureExtAck := parseFeatureExtAck(sess.buf)
 			ch <- featureExtAck
+		case tokenSessionState:
+			sess.applySessionState(parseSessionState(sess.buf))
 		case tokenOrder:
 			order := parseOrder(sess.buf)
 			ch <- order
@@ -745,7 +826,15 @@ func processSingleResponse(ctx context.Context, sess *tdsSession, ch chan tokenS
 				return
 			}
 		case tokenColMetadata:
-			columns = parseColMetadata72(sess.buf)
+			columns = parseColMetadata72(sess.buf, sess)
+			readDataClassification(sess, columns)
+			if outs.returnVariants {
+				for i := range columns {
+					if columns[i].ti.TypeId == typeVariant {
+						columns[i].ti.Reader = readTypedVariant
+					}
+				}
+			}
 			ch <- columns
 
 			if outs.msgq != nil {
@@ -758,10 +847,32 @@ func processSingleResponse(ctx context.Context, sess *tdsSession, ch chan tokenS
 
 		case tokenRow:
 			row := make([]interface{}, len(columns))
+			if outs.rawRows {
+				parseRawRow(sess.buf, columns, row, false)
+				ch <- row
+				continue
+			}
+			if streamedColumn(columns, outs.streamPLP) {
+				stream := parseRowStream(sess.buf, columns, row)
+				ch <- row
+				waitStream(stream)
+				continue
+			}
 			parseRow(sess.buf, columns, row)
 			ch <- row
 		case tokenNbcRow:
 			row := make([]interface{}, len(columns))
+			if outs.rawRows {
+				parseRawRow(sess.buf, columns, row, true)
+				ch <- row
+				continue
+			}
+			if streamedColumn(columns, outs.streamPLP) {
+				stream := parseNbcRowStream(sess.buf, columns, row)
+				ch <- row
+				waitStream(stream)
+				continue
+			}
 			parseNbcRow(sess.buf, columns, row)
 			ch <- row
 		case tokenEnvChange:
@@ -790,17 +901,39 @@ func processSingleResponse(ctx context.Context, sess *tdsSession, ch chan tokenS
 				_ = sqlexp.ReturnMessageEnqueue(ctx, outs.msgq, sqlexp.MsgNotice{Message: info.Message})
 			}
 		case tokenReturnValue:
-			nv := parseReturnValue(sess.buf)
+			nv, cm := parseReturnValue(sess.buf, sess)
 			if len(nv.Name) > 0 {
 				name := nv.Name[1:] // Remove the leading "@".
 				if ov, has := outs.params[name]; has {
+					if cm != nil && nv.Value != nil {
+						nv.Value, err = decryptReturnValue(cm, outs.paramEncryption[nv.Name], nv.Value)
+						if err != nil {
+							ch <- err
+							continue
+						}
+					}
+					if v, ok := nv.Value.(Variant); ok {
+						if _, typed := ov.(*Variant); !typed {
+							nv.Value = v.Value
+						}
+					}
 					err = scanIntoOut(name, nv.Value, ov)
 					if err != nil {
 						fmt.Println("scan error", err)
 						ch <- err
 					}
 				}
+			} else if len(outs.returnValues) > 0 {
+				// unnamed output parameters are returned in order
+				err = convertAssign(outs.returnValues[0], nv.Value)
+				outs.returnValues = outs.returnValues[1:]
+				if err != nil {
+					ch <- err
+				}
 			}
+		case tokenDataClassification:
+			// classifications are read right after COLMETADATA
+			parseDataClassification(sess.buf, sess.dataClassificationVersion)
 		default:
 			badStreamPanic(fmt.Errorf("unknown token type returned: %v", token))
 		}
@@ -870,6 +1003,13 @@ func (t *tokenProcessor) iterateResponse() error {
 }
 
 func (t tokenProcessor) nextToken() (tokenStruct, error) {
+	t.sess.releaseStream()
+	tok, err := t.readToken()
+	t.sess.stream = rowStream(tok)
+	return tok, err
+}
+
+func (t tokenProcessor) readToken() (tokenStruct, error) {
 	// we do this separate non-blocking check on token channel to
 	// prioritize it over cancellation channel
 	select {
@@ -943,6 +1083,10 @@ func readCancelConfirmation(tokChan chan tokenStruct) bool {
 		switch tok := tok.(type) {
 		default:
 		// just skip token
+		case []interface{}:
+			if stream := rowStream(tok); stream != nil {
+				stream.release()
+			}
 		case doneStruct:
 			if tok.Status&doneAttn != 0 {
 				// got cancellation confirmation, exit
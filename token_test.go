@@ -40,3 +40,16 @@ func TestParseFeatureExtAck(t *testing.T) {
 		parseFeatureExtAck(r)
 	}
 }
+
+func TestParseFeatureExtAckUTF8Support(t *testing.T) {
+	b := []byte{featExtUTF8SUPPORT, 1, 0, 0, 0, 1, featExtTERMINATOR}
+	r := &tdsBuffer{
+		packetSize: len(b),
+		rbuf:       b,
+		rsize:      len(b),
+	}
+	ack := parseFeatureExtAck(r)
+	if supported, ok := ack[featExtUTF8SUPPORT].(bool); !ok || !supported {
+		t.Errorf("UTF-8 support ack not parsed: %v", ack)
+	}
+}
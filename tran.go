@@ -72,7 +72,7 @@ func sendCommitXact(buf *tdsBuffer, headers []headerStruct, name string, flags u
 		if err != nil {
 			return err
 		}
-		err = writeBVarChar(buf, name)
+		err = writeBVarChar(buf, newname)
 		if err != nil {
 			return err
 		}
@@ -101,10 +101,56 @@ func sendRollbackXact(buf *tdsBuffer, headers []headerStruct, name string, flags
 		if err != nil {
 			return err
 		}
-		err = writeBVarChar(buf, name)
+		err = writeBVarChar(buf, newname)
 		if err != nil {
 			return err
 		}
 	}
 	return buf.FinishPacket()
 }
+
+func sendSaveXact(buf *tdsBuffer, headers []headerStruct, name string, resetSession bool) error {
+	buf.BeginPacket(packTransMgrReq, resetSession)
+	writeAllHeaders(buf, headers)
+	var rqtype uint16 = tmSaveXact
+	err := binary.Write(buf, binary.LittleEndian, &rqtype)
+	if err != nil {
+		return err
+	}
+	err = writeBVarChar(buf, name)
+	if err != nil {
+		return err
+	}
+	return buf.FinishPacket()
+}
+
+func sendPropagateXact(buf *tdsBuffer, headers []headerStruct, cookie []byte, resetSession bool) error {
+	buf.BeginPacket(packTransMgrReq, resetSession)
+	writeAllHeaders(buf, headers)
+	var rqtype uint16 = tmPropagateXact
+	err := binary.Write(buf, binary.LittleEndian, &rqtype)
+	if err != nil {
+		return err
+	}
+	// US_VARBYTE, an empty cookie defects the session from the transaction
+	err = binary.Write(buf, binary.LittleEndian, uint16(len(cookie)))
+	if err != nil {
+		return err
+	}
+	_, err = buf.Write(cookie)
+	if err != nil {
+		return err
+	}
+	return buf.FinishPacket()
+}
+
+func sendPromoteXact(buf *tdsBuffer, headers []headerStruct, resetSession bool) error {
+	buf.BeginPacket(packTransMgrReq, resetSession)
+	writeAllHeaders(buf, headers)
+	var rqtype uint16 = tmPromoteXact
+	err := binary.Write(buf, binary.LittleEndian, &rqtype)
+	if err != nil {
+		return err
+	}
+	return buf.FinishPacket()
+}
@@ -4,13 +4,17 @@ package mssql
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"reflect"
 	"strings"
 	"time"
+
+	"github.com/denisenkom/go-mssqldb/internal/cp"
 )
 
 const (
@@ -27,14 +31,58 @@ var (
 	ErrorSkip             = errors.New("all fields mustn't skip")
 	ErrorObjectName       = errors.New("wrong tvp name")
 	ErrorWrongTyping      = errors.New("the number of elements in columnStr and tvpFieldIndexes do not align")
+	ErrorTVPColumns       = errors.New("TVP rows that are not structs need Columns")
 )
 
 //TVP is driver type, which allows supporting Table Valued Parameters (TVP) in SQL Server
 type TVP struct {
 	//TypeName mustn't be default value
 	TypeName string
-	//Value must be the slice, mustn't be nil
+	//Value must be a non-nil slice of structs, or rows of the columns
+	//defined by Columns: a [][]interface{}, a []map[string]interface{}, a
+	//RowSource or a *sql.Rows. The rows of a RowSource or *sql.Rows are
+	//encoded while the request is sent, a row that fails to convert then
+	//fails the request and the connection. Slices and maps are converted
+	//before the request is sent.
 	Value interface{}
+	//Columns define the columns of rows that are not structs in the order
+	//of the table type. For slices of structs they may set the SQLType of
+	//the fields that are not skipped, in their order. LookupTVPColumns
+	//returns the columns of a table type.
+	//
+	//The SQL type of a struct field can also be set with the type option
+	//of its tvp tag, e.g. `tvp:"Amount,type=decimal(18,4)"`.
+	Columns []TVPColumn
+}
+
+// TVPColumn defines a column of TVP rows that are not structs, or the SQL
+// type of a struct field.
+type TVPColumn struct {
+	//Name is the key of the column values in map rows.
+	Name string
+	//Type is a value of the Go type of the column, e.g. int64(0), "",
+	//time.Time{}, []byte{} or VarChar(""), like the struct field of the
+	//column.
+	Type interface{}
+	//SQLType is the declaration of the column in the table type, e.g.
+	//"decimal(18, 4)", "varchar(50)" or "datetime2(3)". The values are
+	//then converted to it like bulk copy values and Type is not needed.
+	SQLType string
+	//Collation is the collation of a char column, e.g.
+	//"Latin1_General_CI_AS", it overrides the collation option of the tvp
+	//tag of a struct field, e.g. `tvp:"Code,type=varchar(10),collation=Latin1_General_CI_AS"`.
+	//String values of the column are converted to the code page of the
+	//collation. The collation is looked up on the server when the TVP is
+	//first sent on a connection, collations of code pages that cannot be
+	//sent fail the query. Char columns without a collation get their values
+	//as UTF-8 when the server supports it.
+	//
+	//LookupTVPColumns sets the collations that can be sent.
+	Collation string
+
+	// collation is Collation as sent to the server, it is looked up by
+	// LookupTVPColumns and zero when not known
+	collation cp.Collation
 }
 
 func (tvp TVP) check() error {
@@ -48,6 +96,15 @@ func (tvp TVP) check() error {
 		return ErrorObjectName
 	}
 	valueOf := reflect.ValueOf(tvp.Value)
+	if tvp.rows() != nil {
+		if valueOf.Kind() == reflect.Slice && valueOf.IsNil() {
+			return ErrorTypeSliceIsEmpty
+		}
+		if len(tvp.Columns) == 0 {
+			return ErrorTVPColumns
+		}
+		return nil
+	}
 	if valueOf.Kind() != reflect.Slice {
 		return ErrorTypeSlice
 	}
@@ -66,30 +123,17 @@ func (tvp TVP) encode(schema, name string, columnStr []columnStruct, tvpFieldInd
 	}
 	preparedBuffer := make([]byte, 0, 20+(10*len(columnStr)))
 	buf := bytes.NewBuffer(preparedBuffer)
-	err := writeBVarChar(buf, "")
+	err := writeTVPMetadata(buf, schema, name, columnStr)
 	if err != nil {
 		return nil, err
 	}
 
-	writeBVarChar(buf, schema)
-	writeBVarChar(buf, name)
-	binary.Write(buf, binary.LittleEndian, uint16(len(columnStr)))
-
-	for i, column := range columnStr {
-		binary.Write(buf, binary.LittleEndian, uint32(column.UserType))
-		binary.Write(buf, binary.LittleEndian, uint16(column.Flags))
-		writeTypeInfo(buf, &columnStr[i].ti)
-		writeBVarChar(buf, "")
-	}
-	// The returned error is always nil
-	buf.WriteByte(_TVP_END_TOKEN)
-
-	conn := new(Conn)
-	conn.sess = new(tdsSession)
-	conn.sess.loginAck = loginAckStruct{TDSVersion: verTDS73}
-	stmt := &Stmt{
-		c: conn,
+	stmt := tvpStmt()
+	decls, err := tvp.fieldDecls(reflect.TypeOf(tvp.Value).Elem(), tvpFieldIndexes)
+	if err != nil {
+		return nil, err
 	}
+	bulk := &Bulk{cn: stmt.c}
 
 	val := reflect.ValueOf(tvp.Value)
 	for i := 0; i < val.Len(); i++ {
@@ -98,6 +142,12 @@ func (tvp TVP) encode(schema, name string, columnStr []columnStruct, tvpFieldInd
 		for columnStrIdx, fieldIdx := range tvpFieldIndexes {
 			field := refStr.Field(fieldIdx)
 			tvpVal := field.Interface()
+			if decls[columnStrIdx] != "" {
+				if err = writeTypedTVPValue(buf, bulk, columnStr[columnStrIdx], tvpVal); err != nil {
+					return nil, fmt.Errorf("failed to make tvp parameter row %d col %d: %s", i, columnStrIdx, err)
+				}
+				continue
+			}
 			if tvp.verifyStandardTypeOnNull(buf, tvpVal) {
 				continue
 			}
@@ -127,6 +177,13 @@ func (tvp TVP) encode(schema, name string, columnStr []columnStruct, tvpFieldInd
 			if err != nil {
 				return nil, fmt.Errorf("failed to make tvp parameter row col: %s", err)
 			}
+			if param.reader != nil {
+				// the TVP is sent as a whole, the stream is copied into it
+				if err = writePLPStream(buf, param.reader, defaultPacketSize); err != nil {
+					return nil, fmt.Errorf("failed to read tvp parameter row col: %s", err)
+				}
+				continue
+			}
 			columnStr[columnStrIdx].ti.Writer(buf, param.ti, param.buffer)
 		}
 	}
@@ -155,6 +212,11 @@ func (tvp TVP) columnTypes() ([]columnStruct, []int, error) {
 			continue
 		}
 		tvpFieldIndexes = append(tvpFieldIndexes, i)
+		if _, decl := parseTVPTag(tvpTagValue); decl != "" {
+			// the type of the column is declared
+			defaultValues = append(defaultValues, nil)
+			continue
+		}
 		if field.Type.Kind() == reflect.Ptr {
 			v := reflect.New(field.Type.Elem())
 			defaultValues = append(defaultValues, v.Interface())
@@ -167,22 +229,119 @@ func (tvp TVP) columnTypes() ([]columnStruct, []int, error) {
 		return nil, nil, ErrorSkip
 	}
 
-	conn := new(Conn)
-	conn.sess = new(tdsSession)
-	conn.sess.loginAck = loginAckStruct{TDSVersion: verTDS73}
-	stmt := &Stmt{
-		c: conn,
+	columnConfiguration, err := tvpColumnTypes(defaultValues)
+	if err != nil {
+		return nil, nil, err
+	}
+	decls, err := tvp.fieldDecls(tvpRow, tvpFieldIndexes)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, decl := range decls {
+		if decl == "" {
+			continue
+		}
+		if columnConfiguration[i].ti, err = parseTypeDecl(decl); err != nil {
+			return nil, nil, err
+		}
+	}
+	return columnConfiguration, tvpFieldIndexes, nil
+}
+
+// fieldDecls returns the declared SQL types of the struct fields at
+// tvpFieldIndexes, "" for the fields typed by their Go type.
+func (tvp TVP) fieldDecls(tvpRow reflect.Type, tvpFieldIndexes []int) ([]string, error) {
+	if len(tvp.Columns) > 0 && len(tvp.Columns) != len(tvpFieldIndexes) {
+		return nil, fmt.Errorf("mssql: TVP has %d Columns for %d struct fields", len(tvp.Columns), len(tvpFieldIndexes))
+	}
+	decls := make([]string, len(tvpFieldIndexes))
+	for i, fieldIdx := range tvpFieldIndexes {
+		_, decls[i] = parseTVPTag(tvpRow.Field(fieldIdx).Tag.Get(tvpTag))
+		if len(tvp.Columns) > 0 && tvp.Columns[i].SQLType != "" {
+			decls[i] = tvp.Columns[i].SQLType
+		}
 	}
+	return decls, nil
+}
+
+// parseTVPTag returns the name and the type option of a tvp tag, e.g.
+// "Amount,type=decimal(18,4)".
+func parseTVPTag(tag string) (name, decl string) {
+	parts := splitTVPTag(tag)
+	return parts[0], tvpTagOption(parts, "type")
+}
 
-	columnConfiguration := make([]columnStruct, 0, columnCount)
+// tvpTagOption returns the value of an option of the parts of a tvp tag,
+// e.g. of "collation=Latin1_General_CI_AS".
+func tvpTagOption(parts []string, key string) (value string) {
+	for _, opt := range parts[1:] {
+		if strings.HasPrefix(opt, key+"=") {
+			value = strings.TrimSpace(opt[len(key)+1:])
+		}
+	}
+	return value
+}
+
+// splitTVPTag splits a tvp tag at the commas outside of parentheses.
+func splitTVPTag(tag string) []string {
+	depth, start := 0, 0
+	var parts []string
+	for i, r := range tag {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, tag[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, tag[start:])
+}
+
+// definedColumnTypes returns the types of the columns of rows described
+// by Columns.
+func (tvp TVP) definedColumnTypes() ([]columnStruct, error) {
+	defaultValues := make([]interface{}, len(tvp.Columns))
+	for i, col := range tvp.Columns {
+		if col.SQLType != "" {
+			continue
+		}
+		if col.Type == nil {
+			return nil, fmt.Errorf("mssql: TVP column %d (%s) has no Type", i, col.Name)
+		}
+		defaultValues[i] = tvp.createZeroType(col.Type)
+	}
+	columnStr, err := tvpColumnTypes(defaultValues)
+	if err != nil {
+		return nil, err
+	}
+	for i, col := range tvp.Columns {
+		if col.SQLType == "" {
+			continue
+		}
+		if columnStr[i].ti, err = parseTypeDecl(col.SQLType); err != nil {
+			return nil, err
+		}
+	}
+	return columnStr, nil
+}
+
+// tvpColumnTypes returns the column types of the Go values of the columns.
+func tvpColumnTypes(defaultValues []interface{}) ([]columnStruct, error) {
+	stmt := tvpStmt()
+	columnConfiguration := make([]columnStruct, 0, len(defaultValues))
 	for index, val := range defaultValues {
 		cval, err := convertInputParameter(val)
 		if err != nil {
-			return nil, nil, fmt.Errorf("failed to convert tvp parameter row %d col %d: %s", index, val, err)
+			return nil, fmt.Errorf("failed to convert tvp parameter row %d col %d: %s", index, val, err)
 		}
 		param, err := stmt.makeParam(cval)
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 		column := columnStruct{
 			ti: param.ti,
@@ -193,8 +352,407 @@ func (tvp TVP) columnTypes() ([]columnStruct, []int, error) {
 		}
 		columnConfiguration = append(columnConfiguration, column)
 	}
+	return columnConfiguration, nil
+}
 
-	return columnConfiguration, tvpFieldIndexes, nil
+// tvpStmt returns a statement to make the parameters of TVP values.
+func tvpStmt() *Stmt {
+	conn := new(Conn)
+	conn.sess = new(tdsSession)
+	conn.sess.loginAck = loginAckStruct{TDSVersion: verTDS73}
+	return &Stmt{
+		c: conn,
+	}
+}
+
+// writeTVPMetadata writes the type name and the columns of a TVP.
+func writeTVPMetadata(w io.Writer, schema, name string, columnStr []columnStruct) error {
+	if err := writeBVarChar(w, ""); err != nil {
+		return err
+	}
+	writeBVarChar(w, schema)
+	writeBVarChar(w, name)
+	binary.Write(w, binary.LittleEndian, uint16(len(columnStr)))
+
+	for i, column := range columnStr {
+		binary.Write(w, binary.LittleEndian, uint32(column.UserType))
+		binary.Write(w, binary.LittleEndian, uint16(column.Flags))
+		writeTypeInfo(w, &columnStr[i].ti)
+		writeBVarChar(w, "")
+	}
+	_, err := w.Write([]byte{_TVP_END_TOKEN})
+	return err
+}
+
+// rows returns the rows of values described by Columns, nil for slices of
+// structs.
+func (tvp TVP) rows() RowSource {
+	switch v := tvp.Value.(type) {
+	case RowSource:
+		return v
+	case *sql.Rows:
+		return SQLRowSource(v)
+	case [][]interface{}:
+		return &tvpSliceRows{rows: v}
+	case []map[string]interface{}:
+		return &tvpMapRows{rows: v, columns: tvp.Columns}
+	}
+	return nil
+}
+
+// inMemory reports whether the rows are a slice or a map, they are
+// encoded before the request is sent.
+func (tvp TVP) inMemory() bool {
+	switch tvp.Value.(type) {
+	case [][]interface{}, []map[string]interface{}:
+		return true
+	}
+	return false
+}
+
+// encodeRows writes the TVP with the rows read from rows.
+func (tvp TVP) encodeRows(w io.Writer, schema, name string, columnStr []columnStruct, rows RowSource) error {
+	if err := writeTVPMetadata(w, schema, name, columnStr); err != nil {
+		return err
+	}
+	stmt := tvpStmt()
+	bulk := &Bulk{cn: stmt.c}
+	row := []byte{_TVP_ROW_TOKEN}
+	for n := 1; rows.Next(); n++ {
+		values, err := rows.Values()
+		if err != nil {
+			return err
+		}
+		if len(values) != len(columnStr) {
+			return fmt.Errorf("mssql: TVP row %d has %d values, the type has %d columns", n, len(values), len(columnStr))
+		}
+		if _, err = w.Write(row); err != nil {
+			return err
+		}
+		for i, val := range values {
+			if tvp.Columns[i].SQLType != "" {
+				err = writeTypedTVPValue(w, bulk, columnStr[i], val)
+			} else {
+				err = writeTVPValue(w, stmt, columnStr[i].ti, val)
+			}
+			if err != nil {
+				return fmt.Errorf("mssql: TVP row %d column %d: %v", n, i, err)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte{_TVP_END_TOKEN})
+	return err
+}
+
+// writeTVPValue writes a value of a column of type ti.
+func writeTVPValue(w io.Writer, stmt *Stmt, ti typeInfo, val interface{}) error {
+	cval, err := convertInputParameter(val)
+	if err != nil {
+		return err
+	}
+	if cval == nil {
+		return ti.Writer(w, ti, nil)
+	}
+	param, err := stmt.makeParam(cval)
+	if err != nil {
+		return err
+	}
+	if param.ti.TypeId != ti.TypeId {
+		return fmt.Errorf("value of type %T does not match the column type %s", val, makeDecl(ti))
+	}
+	if param.reader != nil {
+		return writePLPStream(w, param.reader, defaultPacketSize)
+	}
+	return ti.Writer(w, param.ti, param.buffer)
+}
+
+// writeTypedTVPValue writes a value of a column with a declared SQL type,
+// the value is converted like a bulk copy value. Strings of char columns
+// with a looked up collation are converted to its code page.
+func writeTypedTVPValue(w io.Writer, b *Bulk, col columnStruct, val interface{}) error {
+	param, err := b.makeParam(val, col)
+	if err != nil {
+		return err
+	}
+	if param.reader != nil {
+		return writePLPStream(w, param.reader, defaultPacketSize)
+	}
+	switch col.ti.TypeId {
+	case typeBigChar, typeBigVarChar:
+		if _, raw := val.([]byte); !raw && param.buffer != nil && col.ti.Collation != (cp.Collation{}) {
+			param.buffer = cp.UTF8ToCharset(col.ti.Collation, string(param.buffer))
+			param.ti.Size = len(param.buffer)
+		}
+	}
+	return col.ti.Writer(w, param.ti, param.buffer)
+}
+
+// LookupTVPColumns returns the columns of the table type typeName with
+// their SQL types, for TVP.Columns. q is a *sql.DB, *sql.Conn or *sql.Tx.
+func LookupTVPColumns(ctx context.Context, q interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}, typeName string) ([]TVPColumn, error) {
+	rows, err := q.QueryContext(ctx, `select c.name, type_name(c.system_type_id), c.max_length, c.precision, c.scale,
+	isnull(c.collation_name, ''),
+	isnull(cast(collationproperty(c.collation_name, 'LCID') as int), 0),
+	isnull(cast(collationproperty(c.collation_name, 'ComparisonStyle') as int), 0),
+	isnull(cast(collationproperty(c.collation_name, 'Version') as int), 0),
+	isnull(cast(collationproperty(c.collation_name, 'CodePage') as int), 0)
+from sys.table_types tt join sys.columns c on c.object_id = tt.type_table_object_id
+where tt.user_type_id = type_id(@p1)
+order by c.column_id`, typeName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []TVPColumn
+	for rows.Next() {
+		var (
+			name, typ, collation           string
+			length                         int
+			precision, scale               int
+			lcid, style, version, codePage int
+		)
+		err = rows.Scan(&name, &typ, &length, &precision, &scale, &collation, &lcid, &style, &version, &codePage)
+		if err != nil {
+			return nil, err
+		}
+		col := TVPColumn{Name: name, SQLType: columnDecl(typ, length, precision, scale)}
+		if col.collation = makeCollation(collation, lcid, style, version, codePage); col.collation != (cp.Collation{}) {
+			col.Collation = collation
+		}
+		columns = append(columns, col)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("mssql: table type %s not found", typeName)
+	}
+	return columns, nil
+}
+
+// collationNames returns the collation names of the columns of the TVP,
+// "" for columns without one. The Collation of Columns overrides the
+// collation option of the tvp tag of a struct field.
+func (tvp TVP) collationNames() []string {
+	if tvp.rows() != nil {
+		names := make([]string, len(tvp.Columns))
+		for i, col := range tvp.Columns {
+			names[i] = col.Collation
+		}
+		return names
+	}
+	tvpRow := reflect.TypeOf(tvp.Value).Elem()
+	var names []string
+	for i := 0; i < tvpRow.NumField(); i++ {
+		field := tvpRow.Field(i)
+		tvpTagValue, isTvpTag := field.Tag.Lookup(tvpTag)
+		jsonTagValue, isJsonTag := field.Tag.Lookup(jsonTag)
+		if IsSkipField(tvpTagValue, isTvpTag, jsonTagValue, isJsonTag) {
+			continue
+		}
+		name := tvpTagOption(splitTVPTag(tvpTagValue), "collation")
+		if n := len(names); n < len(tvp.Columns) && tvp.Columns[n].Collation != "" {
+			name = tvp.Columns[n].Collation
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// collation returns the collation called name of column i, the one looked
+// up with the column or the one resolved by resolveTVPCollations. It
+// returns the zero collation when it is not known.
+func (c *Conn) collation(name string, columns []TVPColumn, i int) cp.Collation {
+	if i < len(columns) && columns[i].Collation == name && columns[i].collation != (cp.Collation{}) {
+		return columns[i].collation
+	}
+	return c.collations[name]
+}
+
+// resolveTVPCollations looks up the collations named in TVP arguments that
+// the connection doesn't know yet, they are kept for the connection.
+func (s *Stmt) resolveTVPCollations(ctx context.Context, sess *tdsSession, args []namedValue) error {
+	var missing []string
+	for _, arg := range args {
+		tvp, ok := arg.Value.(TVP)
+		if !ok || tvp.check() != nil {
+			// makeParam reports the error
+			continue
+		}
+		for i, name := range tvp.collationNames() {
+			if name == "" || containsString(missing, name) {
+				continue
+			}
+			if _, known := s.c.collations[name]; known || s.c.collation(name, tvp.Columns, i) != (cp.Collation{}) {
+				continue
+			}
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	selects := make([]string, len(missing))
+	for i, name := range missing {
+		lit := "N'" + strings.Replace(name, "'", "''", -1) + "'"
+		selects[i] = fmt.Sprintf("select %s, isnull(cast(collationproperty(%s, 'LCID') as int), 0), "+
+			"isnull(cast(collationproperty(%s, 'ComparisonStyle') as int), 0), "+
+			"isnull(cast(collationproperty(%s, 'Version') as int), 0), "+
+			"isnull(cast(collationproperty(%s, 'CodePage') as int), 0)", lit, lit, lit, lit, lit)
+	}
+	headers := []headerStruct{
+		{hdrtype: dataStmHdrTransDescr,
+			data: transDescrHdr{s.c.sess.tranid, 1}.pack()},
+	}
+	reset := s.c.resetSession
+	s.c.resetSession = false
+	if err := sendSqlBatch72(sess.buf, strings.Join(selects, " union all "), headers, reset); err != nil {
+		s.c.connectionGood = false
+		return fmt.Errorf("failed to send SQL Batch: %v", err)
+	}
+	if s.c.collations == nil {
+		s.c.collations = map[string]cp.Collation{}
+	}
+	reader := startReading(sess, ctx, outputs{})
+	var firstError error
+	for {
+		tok, err := reader.nextToken()
+		if err != nil {
+			return s.c.checkBadConn(ctx, err, false)
+		}
+		if tok == nil {
+			break
+		}
+		switch token := tok.(type) {
+		case []interface{}:
+			name, _ := token[0].(string)
+			var props [4]int
+			for i := range props {
+				n, _ := token[i+1].(int64)
+				props[i] = int(n)
+			}
+			s.c.collations[name] = makeCollation(name, props[0], props[1], props[2], props[3])
+		case doneStruct:
+			if token.isError() && firstError == nil {
+				firstError = token.getError()
+			}
+		}
+	}
+	return firstError
+}
+
+// makeCollation returns the collation called name from its properties
+// returned by collationproperty. It returns the zero collation when the
+// collation has another code page than its LCID, like SQL collations of
+// other code pages, which are known by their sort id only.
+func makeCollation(name string, lcid, style, version, codePage int) cp.Collation {
+	if name == "" {
+		return cp.Collation{}
+	}
+	// flags of the TDS collation
+	var flags uint32
+	if style&1 != 0 {
+		flags |= 0x01 // ignore case
+	}
+	if style&2 != 0 {
+		flags |= 0x02 // ignore accent
+	}
+	if style&131072 != 0 {
+		flags |= 0x04 // ignore width
+	}
+	if style&65536 != 0 {
+		flags |= 0x08 // ignore kana type
+	}
+	for _, part := range strings.Split(strings.ToUpper(name), "_") {
+		switch part {
+		case "BIN":
+			flags |= 0x10
+		case "BIN2":
+			flags |= 0x20
+		case "UTF8":
+			flags |= 0x40
+		}
+	}
+	col := cp.Collation{LcidAndFlags: uint32(lcid)&0xfffff | flags<<20 | uint32(version)<<28}
+	if col.CodePage() != codePage {
+		return cp.Collation{}
+	}
+	return col
+}
+
+// columnDecl returns the declaration of a column described by sys.columns.
+func columnDecl(typ string, length, precision, scale int) string {
+	size := func(n int) string {
+		if length == -1 {
+			return typ + "(max)"
+		}
+		return fmt.Sprintf("%s(%d)", typ, n)
+	}
+	switch typ {
+	case "char", "varchar", "binary", "varbinary":
+		return size(length)
+	case "nchar", "nvarchar":
+		return size(length / 2)
+	case "decimal", "numeric":
+		return fmt.Sprintf("%s(%d, %d)", typ, precision, scale)
+	case "time", "datetime2", "datetimeoffset":
+		return fmt.Sprintf("%s(%d)", typ, scale)
+	}
+	return typ
+}
+
+type tvpSliceRows struct {
+	rows [][]interface{}
+	i    int
+}
+
+func (r *tvpSliceRows) Next() bool {
+	if r.i >= len(r.rows) {
+		return false
+	}
+	r.i++
+	return true
+}
+
+func (r *tvpSliceRows) Values() ([]interface{}, error) {
+	return r.rows[r.i-1], nil
+}
+
+func (r *tvpSliceRows) Err() error {
+	return nil
+}
+
+type tvpMapRows struct {
+	rows    []map[string]interface{}
+	columns []TVPColumn
+	values  []interface{}
+	i       int
+}
+
+func (r *tvpMapRows) Next() bool {
+	if r.i >= len(r.rows) {
+		return false
+	}
+	r.i++
+	return true
+}
+
+// Values returns the values of the columns, nil for missing keys.
+func (r *tvpMapRows) Values() ([]interface{}, error) {
+	r.values = r.values[:0]
+	for _, col := range r.columns {
+		r.values = append(r.values, r.rows[r.i-1][col.Name])
+	}
+	return r.values, nil
+}
+
+func (r *tvpMapRows) Err() error {
+	return nil
 }
 
 func IsSkipField(tvpTagValue string, isTvpValue bool, jsonTagValue string, isJsonTagValue bool) bool {
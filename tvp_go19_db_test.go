@@ -1348,3 +1348,131 @@ func TestTVPUnsigned(t *testing.T) {
 		t.Errorf("third result set had wrong value expected: %s actual: %s", "test", result3)
 	}
 }
+
+func TestTVPRows(t *testing.T) {
+	checkConnStr(t)
+	tl := testLogger{t: t}
+	defer tl.StopLogging()
+	SetLogger(&tl)
+
+	db, err := sql.Open("sqlserver", makeConnStr(t).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Exec("if type_id('dbo.tvpRowsType') is not null drop type dbo.tvpRowsType")
+	if _, err = db.Exec("create type dbo.tvpRowsType as table (id bigint, name nvarchar(100))"); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("drop type dbo.tvpRowsType")
+
+	keys, err := db.Query("select n, cast(n as nvarchar(100)) from (values (1), (2), (3)) t(n)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keys.Close()
+
+	columns := []TVPColumn{{Name: "id", Type: int64(0)}, {Name: "name", Type: ""}}
+	for _, value := range []interface{}{
+		[][]interface{}{{1, "1"}, {2, "2"}, {3, nil}},
+		[]map[string]interface{}{{"id": 1, "name": "1"}, {"id": 2, "name": "2"}, {"id": 3}},
+		keys,
+	} {
+		tvp := TVP{TypeName: "dbo.tvpRowsType", Value: value, Columns: columns}
+		var sum, names int64
+		err = db.QueryRow("select sum(id), count(name) from @rows", sql.Named("rows", tvp)).Scan(&sum, &names)
+		if err != nil {
+			t.Fatalf("%T: %v", value, err)
+		}
+		if sum != 6 || names < 2 {
+			t.Errorf("%T: unexpected sum %d and %d names", value, sum, names)
+		}
+	}
+}
+
+func TestTVPColumnTypes(t *testing.T) {
+	checkConnStr(t)
+	tl := testLogger{t: t}
+	defer tl.StopLogging()
+	SetLogger(&tl)
+
+	db, err := sql.Open("sqlserver", makeConnStr(t).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Exec("if type_id('dbo.tvpTypedType') is not null drop type dbo.tvpTypedType")
+	if _, err = db.Exec("create type dbo.tvpTypedType as table (amount decimal(18, 4), code varchar(10) collate Latin1_General_CI_AS, day date, note nvarchar(max))"); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("drop type dbo.tvpTypedType")
+
+	ctx := context.Background()
+	columns, err := LookupTVPColumns(ctx, db, "dbo.tvpTypedType")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TVPColumn{
+		{Name: "amount", SQLType: "decimal(18, 4)"},
+		{Name: "code", SQLType: "varchar(10)", Collation: "Latin1_General_CI_AS"},
+		{Name: "day", SQLType: "date"},
+		{Name: "note", SQLType: "nvarchar(max)"},
+	}
+	got := make([]TVPColumn, len(columns))
+	for i, col := range columns {
+		got[i] = TVPColumn{Name: col.Name, SQLType: col.SQLType}
+		if col.SQLType == "varchar(10)" {
+			got[i].Collation = col.Collation
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LookupTVPColumns = %+v, want %+v", columns, want)
+	}
+	if columns[1].collation.CodePage() != 1252 {
+		t.Errorf("expected the cp1252 collation of the code column, got %+v", columns[1].collation)
+	}
+	if _, err = LookupTVPColumns(ctx, db, "dbo.tvpMissingType"); err == nil {
+		t.Error("expected an error for a missing type")
+	}
+
+	type row struct {
+		Amount float64   `tvp:"amount,type=decimal(18,4)"`
+		Code   string    `tvp:"code,type=varchar(10)"`
+		Day    time.Time `tvp:"day,type=date"`
+		Note   string    `tvp:"note,type=nvarchar(max)"`
+	}
+	day := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	for _, value := range []interface{}{
+		[]row{{1.2345, "ab", day, "x"}, {2, "cd", day, ""}},
+		[][]interface{}{{"1.2345", "ab", day, "x"}, {2, "cd", day, nil}},
+	} {
+		tvp := TVP{TypeName: "dbo.tvpTypedType", Value: value}
+		if _, ok := value.([][]interface{}); ok {
+			tvp.Columns = columns
+		}
+		var (
+			sum  string
+			code string
+		)
+		err = db.QueryRow("select cast(sum(amount) as varchar(40)), min(code) from @rows where day = '2020-05-01'",
+			sql.Named("rows", tvp)).Scan(&sum, &code)
+		if err != nil {
+			t.Fatalf("%T: %v", value, err)
+		}
+		if sum != "3.2345" || code != "ab" {
+			t.Errorf("%T: got sum %s and code %s", value, sum, code)
+		}
+	}
+
+	// values of char columns are converted to the code page of the column
+	var code string
+	tvp := TVP{TypeName: "dbo.tvpTypedType", Value: [][]interface{}{{1, "é€", day, nil}}, Columns: columns}
+	if err = db.QueryRow("select code from @rows", sql.Named("rows", tvp)).Scan(&code); err != nil {
+		t.Fatal(err)
+	}
+	if code != "é€" {
+		t.Errorf("expected code é€, got %q", code)
+	}
+}
@@ -3,9 +3,16 @@
 package mssql
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/denisenkom/go-mssqldb/internal/cp"
 )
 
 type TestFields struct {
@@ -577,3 +584,391 @@ func TestTVP_encode(t *testing.T) {
 		})
 	}
 }
+
+func TestTVP_encodeStream(t *testing.T) {
+	type streamRow struct {
+		ID   int64
+		Data VarBinaryStream
+	}
+	type bytesRow struct {
+		ID   int64
+		Data []byte
+	}
+	encode := func(tvp TVP) []byte {
+		columnStr, tvpFieldIndexes, err := tvp.columnTypes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := tvp.encode("dbo", "tt", columnStr, tvpFieldIndexes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	got := encode(TVP{TypeName: "tt", Value: []streamRow{
+		{1, VarBinaryStream{R: strings.NewReader("abc")}},
+		{2, VarBinaryStream{}},
+	}})
+	want := encode(TVP{TypeName: "tt", Value: []bytesRow{
+		{1, []byte("abc")},
+		{2, nil},
+	}})
+	if !bytes.Equal(got, want) {
+		t.Errorf("TVP.encode() = % x, want % x", got, want)
+	}
+}
+
+func TestConvertReaderParameter(t *testing.T) {
+	r := strings.NewReader("abc")
+	v, err := convertInputParameter(VarBinaryStream{R: r})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := v.(VarBinaryStream); !ok || s.R != r {
+		t.Errorf("VarBinaryStream converted to %#v", v)
+	}
+	// a plain reader is streamed as varbinary(max)
+	if v, err = convertInputParameter(r); err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := v.(VarBinaryStream); !ok || s.R != r {
+		t.Errorf("io.Reader converted to %#v", v)
+	}
+}
+
+func TestTVP_encodeRows(t *testing.T) {
+	type structRow struct {
+		ID   int64
+		Name *string
+	}
+	name := "a"
+	tvp := TVP{TypeName: "tt", Value: []structRow{{1, &name}, {2, nil}}}
+	columnStr, tvpFieldIndexes, err := tvp.columnTypes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := tvp.encode("dbo", "tt", columnStr, tvpFieldIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	columns := []TVPColumn{{Name: "id", Type: int64(0)}, {Name: "name", Type: ""}}
+	for _, value := range []interface{}{
+		[][]interface{}{{1, "a"}, {int64(2), nil}},
+		[]map[string]interface{}{{"id": 1, "name": "a"}, {"id": 2}},
+		&tvpSliceRows{rows: [][]interface{}{{1, sql.NullString{String: "a", Valid: true}}, {2, sql.NullString{}}}},
+	} {
+		tvp := TVP{TypeName: "tt", Value: value, Columns: columns}
+		if err := tvp.check(); err != nil {
+			t.Fatal(err)
+		}
+		columnStr, err := tvp.definedColumnTypes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got bytes.Buffer
+		if err = tvp.encodeRows(&got, "dbo", "tt", columnStr, tvp.rows()); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Errorf("encodeRows(%T) = % x, want % x", value, got.Bytes(), want)
+		}
+	}
+}
+
+func TestTVP_encodeRowsErrors(t *testing.T) {
+	columns := []TVPColumn{{Name: "id", Type: int64(0)}}
+	if err := (TVP{TypeName: "tt", Value: [][]interface{}{{1}}}).check(); err != ErrorTVPColumns {
+		t.Errorf("expected ErrorTVPColumns without columns, got %v", err)
+	}
+	var nilRows [][]interface{}
+	if err := (TVP{TypeName: "tt", Value: nilRows, Columns: columns}).check(); err != ErrorTypeSliceIsEmpty {
+		t.Errorf("expected ErrorTypeSliceIsEmpty for nil rows, got %v", err)
+	}
+	if _, err := (TVP{TypeName: "tt", Value: [][]interface{}{}, Columns: []TVPColumn{{Name: "id"}}}).definedColumnTypes(); err == nil {
+		t.Error("expected an error for a column without a type")
+	}
+	for _, rows := range [][][]interface{}{
+		{{"x"}},
+		{{1, 2}},
+	} {
+		tvp := TVP{TypeName: "tt", Value: rows, Columns: columns}
+		columnStr, err := tvp.definedColumnTypes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = tvp.encodeRows(new(bytes.Buffer), "", "tt", columnStr, tvp.rows()); err == nil {
+			t.Errorf("expected an error for rows %v", rows)
+		}
+	}
+}
+
+func TestTVP_makeParamRows(t *testing.T) {
+	s := &Stmt{c: &Conn{sess: &tdsSession{}}}
+	columns := []TVPColumn{{Name: "id", Type: int64(0)}}
+	columnStr, _ := TVP{Columns: columns}.definedColumnTypes()
+	var want bytes.Buffer
+	TVP{Columns: columns}.encodeRows(&want, "dbo", "tt", columnStr, &tvpSliceRows{rows: [][]interface{}{{1}}})
+
+	// slices and maps are encoded before the request is sent
+	for _, value := range []interface{}{
+		[][]interface{}{{1}},
+		[]map[string]interface{}{{"id": 1}},
+	} {
+		p, err := s.makeParam(TVP{TypeName: "dbo.tt", Value: value, Columns: columns})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.encoder != nil || !bytes.Equal(p.buffer, want.Bytes()) {
+			t.Errorf("makeParam(%T) buffer = % x, want % x", value, p.buffer, want.Bytes())
+		}
+	}
+	for _, value := range []interface{}{
+		[][]interface{}{{1}, {"x"}},
+		[]map[string]interface{}{{"id": 1}, {"id": "x"}},
+	} {
+		if _, err := s.makeParam(TVP{TypeName: "dbo.tt", Value: value, Columns: columns}); err == nil {
+			t.Errorf("makeParam(%T) did not fail for a value of the wrong type", value)
+		}
+	}
+
+	// a RowSource is encoded while the request is sent
+	p, err := s.makeParam(TVP{TypeName: "dbo.tt", Value: &tvpSliceRows{rows: [][]interface{}{{1}}}, Columns: columns})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.encoder == nil || p.buffer != nil {
+		t.Fatal("expected the rows to be encoded while the request is sent")
+	}
+	var got bytes.Buffer
+	if err = p.encoder(&got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Errorf("encoder wrote % x, want % x", got.Bytes(), want.Bytes())
+	}
+}
+
+func TestTVPRowsSendError(t *testing.T) {
+	transport := &testRPCTransport{}
+	c := &Conn{
+		connector:      &Connector{},
+		sess:           &tdsSession{buf: newTdsBuffer(defaultPacketSize, transport)},
+		connectionGood: true,
+	}
+	s := &Stmt{c: c, query: "select count(*) from @p1"}
+	tvp := TVP{
+		TypeName: "dbo.tt",
+		Value:    &tvpSliceRows{rows: [][]interface{}{{1}, {"x"}}},
+		Columns:  []TVPColumn{{Name: "id", Type: int64(0)}},
+	}
+	_, err := s.exec(context.Background(), []namedValue{{Name: "p1", Ordinal: 1, Value: tvp}})
+	if err == nil {
+		t.Fatal("expected the error of the second row")
+	}
+	if _, retryable := err.(RetryableError); retryable || err == driver.ErrBadConn {
+		t.Errorf("a partly sent TVP must not be retried, got %#v", err)
+	}
+	if c.connectionGood {
+		t.Error("the connection must be marked bad")
+	}
+}
+
+func TestMakeCollation(t *testing.T) {
+	const ignoreCaseKanaWidth = 1 + 65536 + 131072
+	tests := []struct {
+		name                           string
+		lcid, style, version, codePage int
+		want                           cp.Collation
+	}{
+		{"Latin1_General_100_CI_AS_SC_UTF8", 1033, ignoreCaseKanaWidth, 2, 65001, utf8Collation},
+		{"SQL_Latin1_General_CP1_CI_AS", 1033, ignoreCaseKanaWidth, 0, 1252, cp.Collation{LcidAndFlags: 0x00d00409}},
+		{"Japanese_BIN2", 1041, 0, 0, 932, cp.Collation{LcidAndFlags: 0x02000411}},
+		// the sort id of the SQL collation would be needed for its code page
+		{"SQL_Latin1_General_CP1250_CI_AS", 1033, ignoreCaseKanaWidth, 0, 1250, cp.Collation{}},
+		{"", 0, 0, 0, 0, cp.Collation{}},
+	}
+	for _, test := range tests {
+		if got := makeCollation(test.name, test.lcid, test.style, test.version, test.codePage); got != test.want {
+			t.Errorf("makeCollation(%s) = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestTVPCollation(t *testing.T) {
+	s := &Stmt{c: &Conn{sess: &tdsSession{utf8: true}}}
+	latin1 := cp.Collation{LcidAndFlags: 0x00d00409}
+	columns := []TVPColumn{
+		{Name: "a", SQLType: "varchar(10)", Collation: "Latin1_General_CI_AS", collation: latin1},
+		{Name: "b", SQLType: "varchar(10)"},
+	}
+	p, err := s.makeParam(TVP{TypeName: "dbo.tt", Value: [][]interface{}{{"é", "é"}}, Columns: columns})
+	if err != nil {
+		t.Fatal(err)
+	}
+	columnStr, _ := TVP{Columns: columns}.definedColumnTypes()
+	columnStr[0].ti.Collation = latin1
+	columnStr[1].ti.Collation = utf8Collation
+	var want bytes.Buffer
+	writeTVPMetadata(&want, "dbo", "tt", columnStr)
+	want.WriteByte(_TVP_ROW_TOKEN)
+	// the first column is converted to cp1252, the second is sent as UTF-8
+	want.Write([]byte{1, 0, 0xe9, 2, 0, 0xc3, 0xa9})
+	want.WriteByte(_TVP_END_TOKEN)
+	if !bytes.Equal(p.buffer, want.Bytes()) {
+		t.Errorf("makeParam buffer = % x, want % x", p.buffer, want.Bytes())
+	}
+}
+
+func TestTVPCollationByName(t *testing.T) {
+	type codeRow struct {
+		Code  string `tvp:"Code,type=varchar(10),collation=Latin1_General_CI_AS"`
+		Other string `tvp:"Other,type=varchar(10),collation=Unknown_CI_AS"`
+	}
+	// the fake server answers the collation lookup of Latin1_General_CI_AS
+	transport := &testRPCTransport{}
+	var resp testRPCResponse
+	resp.b = append(resp.b, byte(tokenColMetadata))
+	resp.u16(5)
+	resp.u32(0)
+	resp.u16(colFlagNullable)
+	resp.b = append(resp.b, typeNVarChar, 0, 1, 0, 0, 0, 0, 0)
+	resp.b = appendBVarChar(resp.b, "")
+	for _, name := range []string{"lcid", "style", "version", "codepage"} {
+		resp.u32(0)
+		resp.u16(colFlagNullable)
+		resp.b = append(resp.b, typeIntN, 4)
+		resp.b = appendBVarChar(resp.b, name)
+	}
+	resp.b = append(resp.b, byte(tokenRow))
+	name := str2ucs2("Latin1_General_CI_AS")
+	resp.u16(uint16(len(name)))
+	resp.b = append(resp.b, name...)
+	for _, v := range []uint32{1033, 1 + 65536 + 131072, 0, 1252} {
+		resp.b = append(resp.b, 4)
+		resp.u32(v)
+	}
+	resp.done(&transport.responses)
+	c := &Conn{
+		connector:      &Connector{},
+		sess:           &tdsSession{buf: newTdsBuffer(defaultPacketSize, transport), utf8: true},
+		connectionGood: true,
+	}
+	s := &Stmt{c: c}
+
+	// Columns override the tag of the second field
+	tvp := TVP{
+		TypeName: "dbo.tt",
+		Value:    []codeRow{{"é", "é"}},
+		Columns:  []TVPColumn{{}, {Collation: "Latin1_General_CI_AS"}},
+	}
+	if err := s.resolveTVPCollations(context.Background(), c.sess, []namedValue{{Ordinal: 1, Value: tvp}}); err != nil {
+		t.Fatal(err)
+	}
+	latin1 := cp.Collation{LcidAndFlags: 0x00d00409}
+	if got := c.collations["Latin1_General_CI_AS"]; got != latin1 {
+		t.Fatalf("resolved collation = %+v, want %+v", got, latin1)
+	}
+	p, err := s.makeParam(tvp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// both columns are converted to cp1252
+	if !bytes.HasSuffix(p.buffer, []byte{_TVP_ROW_TOKEN, 1, 0, 0xe9, 1, 0, 0xe9, _TVP_END_TOKEN}) {
+		t.Errorf("makeParam buffer = % x, want the values in cp1252", p.buffer)
+	}
+
+	// names that weren't resolved fail the query
+	tvp.Columns = nil
+	if _, err := s.makeParam(tvp); err == nil || !strings.Contains(err.Error(), "Unknown_CI_AS") {
+		t.Errorf("makeParam with an unknown collation returned %v", err)
+	}
+}
+
+func TestParseTVPTag(t *testing.T) {
+	tests := []struct {
+		tag, name, decl string
+	}{
+		{"", "", ""},
+		{"Amount", "Amount", ""},
+		{"Amount,type=decimal(18,4)", "Amount", "decimal(18,4)"},
+		{",type=varchar(10)", "", "varchar(10)"},
+		{"-", "-", ""},
+		{"Code,collation=Latin1_General_CI_AS,type=varchar(10)", "Code", "varchar(10)"},
+	}
+	for _, tt := range tests {
+		name, decl := parseTVPTag(tt.tag)
+		if name != tt.name || decl != tt.decl {
+			t.Errorf("parseTVPTag(%q) = %q, %q, want %q, %q", tt.tag, name, decl, tt.name, tt.decl)
+		}
+	}
+	if got := tvpTagOption(splitTVPTag("Code,type=varchar(10),collation=Latin1_General_CI_AS"), "collation"); got != "Latin1_General_CI_AS" {
+		t.Errorf("collation option = %q", got)
+	}
+}
+
+func TestTVP_encodeTyped(t *testing.T) {
+	type structRow struct {
+		Amount float64   `tvp:"Amount,type=decimal(18,4)"`
+		Code   string    `tvp:",type=varchar(10)"`
+		Day    time.Time `tvp:"Day,type=date"`
+	}
+	day := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	tvp := TVP{TypeName: "tt", Value: []structRow{{1.5, "ab", day}}}
+	columnStr, tvpFieldIndexes, err := tvp.columnTypes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range []uint8{typeDecimalN, typeBigVarChar, typeDateN} {
+		if columnStr[i].ti.TypeId != id {
+			t.Errorf("column %d has type %#x, want %#x", i, columnStr[i].ti.TypeId, id)
+		}
+	}
+	want, err := tvp.encode("dbo", "tt", columnStr, tvpFieldIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same types declared by Columns
+	columns := []TVPColumn{{Name: "Amount", SQLType: "decimal(18,4)"}, {Name: "Code", SQLType: "varchar(10)"}, {Name: "Day", SQLType: "date"}}
+	rows := TVP{TypeName: "tt", Value: [][]interface{}{{"1.5", []byte("ab"), day}}, Columns: columns}
+	if err = rows.check(); err != nil {
+		t.Fatal(err)
+	}
+	columnStr, err = rows.definedColumnTypes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	if err = rows.encodeRows(&got, "dbo", "tt", columnStr, rows.rows()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("encodeRows = % x, want % x", got.Bytes(), want)
+	}
+
+	// Columns override the types of struct fields
+	type untagged struct {
+		Amount float64
+		Code   string
+		Day    time.Time
+	}
+	override := TVP{TypeName: "tt", Value: []untagged{{1.5, "ab", day}}, Columns: columns}
+	columnStr, tvpFieldIndexes, err = override.columnTypes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	overridden, err := override.encode("dbo", "tt", columnStr, tvpFieldIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(overridden, want) {
+		t.Errorf("encode with Columns = % x, want % x", overridden, want)
+	}
+	if _, _, err = (TVP{TypeName: "tt", Value: []untagged{}, Columns: columns[:1]}).columnTypes(); err == nil {
+		t.Error("expected an error for Columns that do not match the fields")
+	}
+	if _, err = (TVP{TypeName: "tt", Value: [][]interface{}{{"x"}}, Columns: []TVPColumn{{SQLType: "decimal(x)"}}}).definedColumnTypes(); err == nil {
+		t.Error("expected an error for an invalid SQLType")
+	}
+}
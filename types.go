@@ -3,11 +3,14 @@ package mssql
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"reflect"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/denisenkom/go-mssqldb/internal/cp"
@@ -214,7 +217,10 @@ func writeVarLen(w io.Writer, ti *typeInfo) (err error) {
 		typeNVarChar, typeNChar, typeXml, typeUdt:
 
 		// short len types
-		if ti.Size > 8000 || ti.Size == 0 {
+		if ti.TypeId == typeXml {
+			// xml has no maximum length
+			ti.Writer = writePLPType
+		} else if ti.Size > 8000 || ti.Size == 0 {
 			if err = binary.Write(w, binary.LittleEndian, uint16(0xffff)); err != nil {
 				return
 			}
@@ -234,13 +240,30 @@ func writeVarLen(w io.Writer, ti *typeInfo) (err error) {
 			if err = binary.Write(w, binary.LittleEndian, ti.XmlInfo.SchemaPresent); err != nil {
 				return
 			}
+			if ti.XmlInfo.SchemaPresent != 0 {
+				if err = writeBVarChar(w, ti.XmlInfo.DBName); err != nil {
+					return
+				}
+				if err = writeBVarChar(w, ti.XmlInfo.OwningSchema); err != nil {
+					return
+				}
+				if err = writeUsVarChar(w, ti.XmlInfo.XmlSchemaCollection); err != nil {
+					return
+				}
+			}
 		}
 	case typeText, typeImage, typeNText, typeVariant:
 		// LONGLEN_TYPE
 		if err = binary.Write(w, binary.LittleEndian, uint32(ti.Size)); err != nil {
 			return
 		}
-		if err = writeCollation(w, ti.Collation); err != nil {
+		switch ti.TypeId {
+		case typeText, typeNText:
+			if err = writeCollation(w, ti.Collation); err != nil {
+				return
+			}
+		case typeVariant:
+			ti.Writer = writeVariantType
 			return
 		}
 		ti.Writer = writeLongLenType
@@ -517,6 +540,10 @@ func readLongLenType(ti *typeInfo, r *tdsBuffer) interface{} {
 	panic("shoulnd't get here")
 }
 func writeLongLenType(w io.Writer, ti typeInfo, buf []byte) (err error) {
+	if buf == nil {
+		// a NULL value has no textptr
+		return binary.Write(w, binary.LittleEndian, byte(0))
+	}
 	//textptr
 	err = binary.Write(w, binary.LittleEndian, byte(0x10))
 	if err != nil {
@@ -558,92 +585,161 @@ func writeCollation(w io.Writer, col cp.Collation) (err error) {
 	return
 }
 
+// writes variant value, buf is the encoded value, see encodeVariant
+func writeVariantType(w io.Writer, ti typeInfo, buf []byte) (err error) {
+	if err = binary.Write(w, binary.LittleEndian, uint32(len(buf))); err != nil {
+		return
+	}
+	_, err = w.Write(buf)
+	return
+}
+
+// encodeVariant encodes a value as the base type, the properties and the
+// data of a variant value. Strings use the collation col.
+func encodeVariant(val interface{}, col cp.Collation) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	switch val := val.(type) {
+	case int64:
+		buf.Write([]byte{typeInt8, 0})
+		binary.Write(buf, binary.LittleEndian, val)
+	case float64:
+		buf.Write([]byte{typeFlt8, 0})
+		binary.Write(buf, binary.LittleEndian, math.Float64bits(val))
+	case bool:
+		buf.Write([]byte{typeBit, 0, 0})
+		if val {
+			buf.Bytes()[2] = 1
+		}
+	case string:
+		data := str2ucs2(val)
+		if len(data) > 8000 {
+			return nil, errors.New("mssql: string is too long for a sql_variant")
+		}
+		buf.Write([]byte{typeNVarChar, 7})
+		writeCollation(buf, col)
+		binary.Write(buf, binary.LittleEndian, uint16(len(data)))
+		buf.Write(data)
+	case []byte:
+		if len(val) > 8000 {
+			return nil, errors.New("mssql: binary value is too long for a sql_variant")
+		}
+		buf.Write([]byte{typeBigVarBin, 2})
+		binary.Write(buf, binary.LittleEndian, uint16(len(val)))
+		buf.Write(val)
+	case time.Time:
+		buf.Write([]byte{typeDateTimeOffsetN, 1, 7})
+		buf.Write(encodeDateTimeOffset(val, 7))
+	case Variant:
+		return val.encode(col)
+	default:
+		return nil, fmt.Errorf("mssql: invalid type for sql_variant: %T", val)
+	}
+	return buf.Bytes(), nil
+}
+
 // reads variant value
 // http://msdn.microsoft.com/en-us/library/dd303302.aspx
 func readVariantType(ti *typeInfo, r *tdsBuffer) interface{} {
+	val, _ := readVariant(r)
+	return val
+}
+
+// readTypedVariant reads a variant value as a Variant holding its base
+// type, nil for NULL.
+func readTypedVariant(ti *typeInfo, r *tdsBuffer) interface{} {
+	val, base := readVariant(r)
+	if val == nil {
+		return nil
+	}
+	return Variant{Value: val, BaseType: variantDecl(base)}
+}
+
+// readVariant reads a variant value and returns it with its base type.
+func readVariant(r *tdsBuffer) (interface{}, typeInfo) {
 	size := r.int32()
 	if size == 0 {
-		return nil
+		return nil, typeInfo{}
 	}
 	vartype := r.byte()
 	propbytes := int32(r.byte())
+	base := typeInfo{TypeId: vartype}
 	switch vartype {
 	case typeGuid:
 		buf := make([]byte, size-2-propbytes)
 		r.ReadFull(buf)
-		return buf
+		return buf, base
 	case typeBit:
-		return r.byte() != 0
+		return r.byte() != 0, base
 	case typeInt1:
-		return int64(r.byte())
+		return int64(r.byte()), base
 	case typeInt2:
-		return int64(int16(r.uint16()))
+		return int64(int16(r.uint16())), base
 	case typeInt4:
-		return int64(r.int32())
+		return int64(r.int32()), base
 	case typeInt8:
-		return int64(r.uint64())
+		return int64(r.uint64()), base
 	case typeDateTime:
 		buf := make([]byte, size-2-propbytes)
 		r.ReadFull(buf)
-		return decodeDateTime(buf)
+		return decodeDateTime(buf), base
 	case typeDateTim4:
 		buf := make([]byte, size-2-propbytes)
 		r.ReadFull(buf)
-		return decodeDateTim4(buf)
+		return decodeDateTim4(buf), base
 	case typeFlt4:
-		return float64(math.Float32frombits(r.uint32()))
+		return float64(math.Float32frombits(r.uint32())), base
 	case typeFlt8:
-		return math.Float64frombits(r.uint64())
+		return math.Float64frombits(r.uint64()), base
 	case typeMoney4:
 		buf := make([]byte, size-2-propbytes)
 		r.ReadFull(buf)
-		return decodeMoney4(buf)
+		return decodeMoney4(buf), base
 	case typeMoney:
 		buf := make([]byte, size-2-propbytes)
 		r.ReadFull(buf)
-		return decodeMoney(buf)
+		return decodeMoney(buf), base
 	case typeDateN:
 		buf := make([]byte, size-2-propbytes)
 		r.ReadFull(buf)
-		return decodeDate(buf)
+		return decodeDate(buf), base
 	case typeTimeN:
-		scale := r.byte()
+		base.Scale = r.byte()
 		buf := make([]byte, size-2-propbytes)
 		r.ReadFull(buf)
-		return decodeTime(scale, buf)
+		return decodeTime(base.Scale, buf), base
 	case typeDateTime2N:
-		scale := r.byte()
+		base.Scale = r.byte()
 		buf := make([]byte, size-2-propbytes)
 		r.ReadFull(buf)
-		return decodeDateTime2(scale, buf)
+		return decodeDateTime2(base.Scale, buf), base
 	case typeDateTimeOffsetN:
-		scale := r.byte()
+		base.Scale = r.byte()
 		buf := make([]byte, size-2-propbytes)
 		r.ReadFull(buf)
-		return decodeDateTimeOffset(scale, buf)
+		return decodeDateTimeOffset(base.Scale, buf), base
 	case typeBigVarBin, typeBigBinary:
-		r.uint16() // max length, ignoring
+		base.Size = int(r.uint16()) // max length
 		buf := make([]byte, size-2-propbytes)
 		r.ReadFull(buf)
-		return buf
+		return buf, base
 	case typeDecimalN, typeNumericN:
-		prec := r.byte()
-		scale := r.byte()
+		base.Prec = r.byte()
+		base.Scale = r.byte()
 		buf := make([]byte, size-2-propbytes)
 		r.ReadFull(buf)
-		return decodeDecimal(prec, scale, buf)
+		return decodeDecimal(base.Prec, base.Scale, buf), base
 	case typeBigVarChar, typeBigChar:
-		col := readCollation(r)
-		r.uint16() // max length, ignoring
+		base.Collation = readCollation(r)
+		base.Size = int(r.uint16()) // max length
 		buf := make([]byte, size-2-propbytes)
 		r.ReadFull(buf)
-		return decodeChar(col, buf)
+		return decodeChar(base.Collation, buf), base
 	case typeNVarChar, typeNChar:
-		_ = readCollation(r)
-		r.uint16() // max length, ignoring
+		base.Collation = readCollation(r)
+		base.Size = int(r.uint16()) // max length
 		buf := make([]byte, size-2-propbytes)
 		r.ReadFull(buf)
-		return decodeNChar(buf)
+		return decodeNChar(buf), base
 	default:
 		badStreamPanicf("Invalid variant typeid")
 	}
@@ -901,11 +997,9 @@ func calcTimeSize(scale int) int {
 func encodeTimeInt(seconds, ns, scale int, buf []byte) {
 	ns_total := int64(seconds)*1000*1000*1000 + int64(ns)
 	t := ns_total / int64(math.Pow10(int(scale)*-1)*1e9)
-	buf[0] = byte(t)
-	buf[1] = byte(t >> 8)
-	buf[2] = byte(t >> 16)
-	buf[3] = byte(t >> 24)
-	buf[4] = byte(t >> 32)
+	for i := 0; i < calcTimeSize(scale); i++ {
+		buf[i] = byte(t >> (8 * uint(i)))
+	}
 }
 
 func decodeTime(scale uint8, buf []byte) time.Time {
@@ -1230,6 +1324,8 @@ func makeDecl(ti typeInfo) string {
 		return ti.UdtInfo.TypeName
 	case typeGuid:
 		return "uniqueidentifier"
+	case typeVariant:
+		return "sql_variant"
 	case typeTvp:
 		if ti.UdtInfo.SchemaName != "" {
 			return fmt.Sprintf("%s.%s READONLY", ti.UdtInfo.SchemaName, ti.UdtInfo.TypeName)
@@ -1240,6 +1336,128 @@ func makeDecl(ti typeInfo) string {
 	}
 }
 
+// typeDecl matches a type declaration: the name and up to two
+// arguments.
+var typeDecl = regexp.MustCompile(`^([a-z0-9_]+)\s*(?:\(\s*(max|\d+)\s*(?:,\s*(\d+)\s*)?\))?$`)
+
+// parseTypeDecl returns the type declared with decl, e.g. "decimal(18, 4)",
+// the reverse of makeDecl.
+func parseTypeDecl(decl string) (ti typeInfo, err error) {
+	m := typeDecl.FindStringSubmatch(strings.ToLower(strings.TrimSpace(decl)))
+	if m == nil {
+		return ti, fmt.Errorf("mssql: invalid type %q", decl)
+	}
+	name := m[1]
+	hasArg := m[2] != ""
+	isMax := m[2] == "max"
+	arg := 0
+	if hasArg && !isMax {
+		arg, _ = strconv.Atoi(m[2])
+	}
+	scale := 0
+	if m[3] != "" {
+		scale, _ = strconv.Atoi(m[3])
+	}
+	// length is the size of char and binary types, 1 by default
+	length := func(unit int) int {
+		switch {
+		case isMax:
+			return 0
+		case hasArg:
+			return arg * unit
+		}
+		return unit
+	}
+	// fractional second digits, 7 by default
+	fsp := uint8(7)
+	if hasArg && !isMax {
+		fsp = uint8(arg)
+	}
+	switch name {
+	case "bit":
+		ti = typeInfo{TypeId: typeBitN, Size: 1}
+	case "tinyint":
+		ti = typeInfo{TypeId: typeIntN, Size: 1}
+	case "smallint":
+		ti = typeInfo{TypeId: typeIntN, Size: 2}
+	case "int":
+		ti = typeInfo{TypeId: typeIntN, Size: 4}
+	case "bigint":
+		ti = typeInfo{TypeId: typeIntN, Size: 8}
+	case "real":
+		ti = typeInfo{TypeId: typeFltN, Size: 4}
+	case "float":
+		ti = typeInfo{TypeId: typeFltN, Size: 8}
+		if hasArg && arg <= 24 {
+			ti.Size = 4
+		}
+	case "decimal", "numeric":
+		prec := 18
+		if hasArg && !isMax {
+			prec = arg
+		}
+		if prec < 1 || prec > 38 || scale > prec {
+			return ti, fmt.Errorf("mssql: invalid precision or scale in type %q", decl)
+		}
+		ti = typeInfo{TypeId: typeDecimalN, Prec: uint8(prec), Scale: uint8(scale)}
+		if name == "numeric" {
+			ti.TypeId = typeNumericN
+		}
+		switch {
+		case prec <= 9:
+			ti.Size = 5
+		case prec <= 19:
+			ti.Size = 9
+		case prec <= 28:
+			ti.Size = 13
+		default:
+			ti.Size = 17
+		}
+	case "smallmoney":
+		ti = typeInfo{TypeId: typeMoneyN, Size: 4}
+	case "money":
+		ti = typeInfo{TypeId: typeMoneyN, Size: 8}
+	case "date":
+		ti = typeInfo{TypeId: typeDateN, Size: 3}
+	case "time":
+		ti = typeInfo{TypeId: typeTimeN, Scale: fsp, Size: 5}
+	case "smalldatetime":
+		ti = typeInfo{TypeId: typeDateTimeN, Size: 4}
+	case "datetime":
+		ti = typeInfo{TypeId: typeDateTimeN, Size: 8}
+	case "datetime2":
+		ti = typeInfo{TypeId: typeDateTime2N, Scale: fsp, Size: 8}
+	case "datetimeoffset":
+		ti = typeInfo{TypeId: typeDateTimeOffsetN, Scale: fsp, Size: 10}
+	case "char":
+		ti = typeInfo{TypeId: typeBigChar, Size: length(1)}
+	case "varchar":
+		ti = typeInfo{TypeId: typeBigVarChar, Size: length(1)}
+	case "nchar":
+		ti = typeInfo{TypeId: typeNChar, Size: length(2)}
+	case "nvarchar":
+		ti = typeInfo{TypeId: typeNVarChar, Size: length(2)}
+	case "binary":
+		ti = typeInfo{TypeId: typeBigBinary, Size: length(1)}
+	case "varbinary":
+		ti = typeInfo{TypeId: typeBigVarBin, Size: length(1)}
+	case "uniqueidentifier":
+		ti = typeInfo{TypeId: typeGuid, Size: 16}
+	case "xml":
+		ti = typeInfo{TypeId: typeXml}
+	case "sql_variant":
+		ti = typeInfo{TypeId: typeVariant, Size: variantMaxSize}
+	default:
+		return ti, fmt.Errorf("mssql: unsupported type %q", decl)
+	}
+	switch {
+	case ti.Size > 8000 && ti.TypeId != typeVariant,
+		isMax && ti.TypeId != typeBigVarChar && ti.TypeId != typeNVarChar && ti.TypeId != typeBigVarBin:
+		return ti, fmt.Errorf("mssql: invalid length in type %q", decl)
+	}
+	return ti, nil
+}
+
 // makes go/sql type name as described below
 // RowsColumnTypeDatabaseTypeName may be implemented by Rows. It should return the
 // database system type name without the length. Type names should be uppercase.
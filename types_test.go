@@ -1,9 +1,12 @@
 package mssql
 
 import (
+	"bytes"
 	"reflect"
 	"testing"
 	"time"
+
+	"github.com/denisenkom/go-mssqldb/internal/cp"
 )
 
 func TestMakeGoLangScanType(t *testing.T) {
@@ -151,3 +154,103 @@ func handlePanic(t *testing.T) {
 		t.Errorf("recovered panic")
 	}
 }
+
+func TestVarCharParamCollation(t *testing.T) {
+	sess := &tdsSession{}
+	s := &Stmt{c: &Conn{sess: sess}}
+	for _, v := range []interface{}{VarChar("ü"), VarCharMax("ü")} {
+		p, err := s.makeParam(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.ti.Collation != (cp.Collation{}) {
+			t.Errorf("%T sent with collation %+v to a server without UTF-8 support", v, p.ti.Collation)
+		}
+	}
+	sess.utf8 = true
+	for _, v := range []interface{}{VarChar("ü"), VarCharMax("ü")} {
+		p, err := s.makeParam(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !p.ti.Collation.IsUTF8() {
+			t.Errorf("%T must be sent with a UTF-8 collation, got %+v", v, p.ti.Collation)
+		}
+		if got := decodeChar(p.ti.Collation, p.buffer); got != "ü" {
+			t.Errorf("unexpected value %q", got)
+		}
+	}
+}
+
+func TestWriteTypeInfoLongTypes(t *testing.T) {
+	tests := []struct {
+		ti       typeInfo
+		expected []byte
+	}{
+		// xml has no maximum length
+		{typeInfo{TypeId: typeXml}, []byte{typeXml, 0}},
+		// only text and ntext have a collation
+		{typeInfo{TypeId: typeImage, Size: 0x7fffffff}, []byte{typeImage, 0xff, 0xff, 0xff, 0x7f}},
+		{typeInfo{TypeId: typeVariant, Size: 8016}, []byte{typeVariant, 0x50, 0x1f, 0, 0}},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		ti := test.ti
+		if err := writeTypeInfo(&buf, &ti); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), test.expected) {
+			t.Errorf("type %#x written as % x, expected % x", test.ti.TypeId, buf.Bytes(), test.expected)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := writeLongLenType(&buf, typeInfo{TypeId: typeText}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), []byte{0}) {
+		t.Errorf("NULL text written as % x", buf.Bytes())
+	}
+}
+
+func TestParseTypeDecl(t *testing.T) {
+	tests := []struct {
+		decl string
+		want typeInfo
+	}{
+		{"int", typeInfo{TypeId: typeIntN, Size: 4}},
+		{"BIGINT", typeInfo{TypeId: typeIntN, Size: 8}},
+		{"float(24)", typeInfo{TypeId: typeFltN, Size: 4}},
+		{"decimal", typeInfo{TypeId: typeDecimalN, Size: 9, Prec: 18}},
+		{"decimal(18, 4)", typeInfo{TypeId: typeDecimalN, Size: 9, Prec: 18, Scale: 4}},
+		{"numeric(38,10)", typeInfo{TypeId: typeNumericN, Size: 17, Prec: 38, Scale: 10}},
+		{"money", typeInfo{TypeId: typeMoneyN, Size: 8}},
+		{"date", typeInfo{TypeId: typeDateN, Size: 3}},
+		{"datetime2", typeInfo{TypeId: typeDateTime2N, Size: 8, Scale: 7}},
+		{"datetime2(3)", typeInfo{TypeId: typeDateTime2N, Size: 8, Scale: 3}},
+		{"datetimeoffset(0)", typeInfo{TypeId: typeDateTimeOffsetN, Size: 10}},
+		{"varchar(50)", typeInfo{TypeId: typeBigVarChar, Size: 50}},
+		{"varchar(max)", typeInfo{TypeId: typeBigVarChar}},
+		{"char", typeInfo{TypeId: typeBigChar, Size: 1}},
+		{"nvarchar(10)", typeInfo{TypeId: typeNVarChar, Size: 20}},
+		{"varbinary ( max )", typeInfo{TypeId: typeBigVarBin}},
+		{"uniqueidentifier", typeInfo{TypeId: typeGuid, Size: 16}},
+		{"xml", typeInfo{TypeId: typeXml}},
+		{"sql_variant", typeInfo{TypeId: typeVariant, Size: variantMaxSize}},
+	}
+	for _, tt := range tests {
+		got, err := parseTypeDecl(tt.decl)
+		if err != nil {
+			t.Errorf("parseTypeDecl(%q) failed: %v", tt.decl, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseTypeDecl(%q) = %+v, want %+v", tt.decl, got, tt.want)
+		}
+	}
+	for _, decl := range []string{"", "geography", "decimal(39)", "decimal(5, 6)", "varchar(8001)", "int(", "decimal(max)"} {
+		if _, err := parseTypeDecl(decl); err == nil {
+			t.Errorf("parseTypeDecl(%q) should fail", decl)
+		}
+	}
+}
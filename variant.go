@@ -0,0 +1,172 @@
+package mssql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/denisenkom/go-mssqldb/internal/cp"
+)
+
+// variantMaxSize is the maximum length of sql_variant values.
+const variantMaxSize = 8016
+
+// Variant is a sql_variant value with the SQL type it has on the server,
+// its base type. It can be passed as a parameter, in TVP rows and to bulk
+// copy, and scanned from sql_variant columns and output parameters.
+type Variant struct {
+	// Value is the value, nil for NULL. It is converted to BaseType like
+	// bulk copy values.
+	Value interface{}
+	// BaseType is the declaration of the base type of Value, e.g. "int",
+	// "decimal(18, 4)", "varchar(50)" or "datetime2(3)". Values without a
+	// BaseType are sent as bigint, float, bit, nvarchar, varbinary or
+	// datetimeoffset by their Go type.
+	BaseType string
+}
+
+// Scan implements sql.Scanner. The BaseType is set for values returned
+// with ReturnVariants and for output parameters, it is empty otherwise.
+func (v *Variant) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case Variant:
+		*v = src
+	case *Variant:
+		*v = *src
+	default:
+		*v = Variant{Value: src}
+	}
+	return nil
+}
+
+// ReturnVariants, passed as a query argument, makes Rows return the values
+// of sql_variant columns as Variant holding their base type, e.g.
+//
+//	rows, err := db.QueryContext(ctx, "select name, value from settings", mssql.ReturnVariants{})
+//	...
+//	var name string
+//	var value mssql.Variant
+//	err = rows.Scan(&name, &value)
+//
+// A NULL value is returned as nil.
+type ReturnVariants struct{}
+
+// encode encodes the value as its base type, the properties and the data
+// of a variant value, see encodeVariant. Char values use the collation col
+// and are sent as they are.
+func (v Variant) encode(col cp.Collation) ([]byte, error) {
+	if v.Value == nil {
+		return nil, nil
+	}
+	if v.BaseType == "" {
+		val, err := bulkValue(v.Value)
+		if err != nil || val == nil {
+			return nil, err
+		}
+		return encodeVariant(val, col)
+	}
+	ti, err := parseTypeDecl(v.BaseType)
+	if err != nil {
+		return nil, err
+	}
+	ti.Collation = col
+	props, ok := variantProps(&ti)
+	if !ok {
+		return nil, fmt.Errorf("mssql: %s cannot be the base type of a sql_variant", v.BaseType)
+	}
+	p, err := (&Bulk{}).makeParam(v.Value, columnStruct{ColName: "sql_variant", ti: ti})
+	if err != nil {
+		return nil, err
+	}
+	if p.buffer == nil {
+		return nil, nil
+	}
+	switch ti.TypeId {
+	case typeBigVarChar, typeBigChar, typeNVarChar, typeNChar, typeBigVarBin, typeBigBinary:
+		if len(p.buffer) > ti.Size {
+			return nil, fmt.Errorf("mssql: value is too long for sql_variant of type %s", v.BaseType)
+		}
+	}
+	buf := make([]byte, 0, 2+len(props)+ti.Size+len(p.buffer))
+	buf = append(buf, ti.TypeId, byte(len(props)))
+	buf = append(buf, props...)
+	buf = append(buf, p.buffer...)
+	// fixed length values are padded like on the server
+	switch pad := ti.Size - len(p.buffer); ti.TypeId {
+	case typeBigChar:
+		buf = append(buf, strings.Repeat(" ", pad)...)
+	case typeNChar:
+		buf = append(buf, str2ucs2(strings.Repeat(" ", pad/2))...)
+	case typeBigBinary:
+		buf = append(buf, make([]byte, pad)...)
+	}
+	return buf, nil
+}
+
+// variantProps sets the type id of a variant value of type ti and returns
+// its properties. It reports false for types that variants cannot hold.
+func variantProps(ti *typeInfo) ([]byte, bool) {
+	switch ti.TypeId {
+	case typeIntN:
+		switch ti.Size {
+		case 1:
+			ti.TypeId = typeInt1
+		case 2:
+			ti.TypeId = typeInt2
+		case 4:
+			ti.TypeId = typeInt4
+		default:
+			ti.TypeId = typeInt8
+		}
+	case typeBitN:
+		ti.TypeId = typeBit
+	case typeFltN:
+		ti.TypeId = typeFlt8
+		if ti.Size == 4 {
+			ti.TypeId = typeFlt4
+		}
+	case typeMoneyN:
+		ti.TypeId = typeMoney
+		if ti.Size == 4 {
+			ti.TypeId = typeMoney4
+		}
+	case typeDateTimeN:
+		ti.TypeId = typeDateTime
+		if ti.Size == 4 {
+			ti.TypeId = typeDateTim4
+		}
+	case typeDateN, typeGuid:
+	case typeTimeN, typeDateTime2N, typeDateTimeOffsetN:
+		return []byte{ti.Scale}, true
+	case typeDecimalN, typeNumericN:
+		return []byte{ti.Prec, ti.Scale}, true
+	case typeBigVarChar, typeBigChar, typeNVarChar, typeNChar:
+		if ti.Size == 0 {
+			// max types
+			return nil, false
+		}
+		props := new(bytes.Buffer)
+		writeCollation(props, ti.Collation)
+		binary.Write(props, binary.LittleEndian, uint16(ti.Size))
+		return props.Bytes(), true
+	case typeBigVarBin, typeBigBinary:
+		if ti.Size == 0 {
+			return nil, false
+		}
+		props := make([]byte, 2)
+		binary.LittleEndian.PutUint16(props, uint16(ti.Size))
+		return props, true
+	default:
+		return nil, false
+	}
+	return nil, true
+}
+
+// variantDecl returns the declaration of the base type of a variant value.
+func variantDecl(base typeInfo) string {
+	if base.TypeId == typeTimeN {
+		return fmt.Sprintf("time(%d)", base.Scale)
+	}
+	return makeDecl(base)
+}
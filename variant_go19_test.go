@@ -0,0 +1,98 @@
+// +build go1.9
+
+package mssql
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+
+	"github.com/denisenkom/go-mssqldb/internal/cp"
+)
+
+func TestVariantParam(t *testing.T) {
+	c := &Conn{sess: &tdsSession{}}
+	nv := driver.NamedValue{Value: Variant{Value: "12.5", BaseType: "decimal(10, 2)"}}
+	if err := c.CheckNamedValue(&nv); err != nil {
+		t.Fatal(err)
+	}
+	s := &Stmt{c: c}
+	p, err := s.makeParam(nv.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ti.TypeId != typeVariant || p.ti.Size != variantMaxSize {
+		t.Errorf("unexpected type %#x size %d", p.ti.TypeId, p.ti.Size)
+	}
+	if decl := makeDecl(p.ti); decl != "sql_variant" {
+		t.Errorf("makeDecl = %s, want sql_variant", decl)
+	}
+	want, _ := Variant{Value: "12.5", BaseType: "decimal(10, 2)"}.encode(cp.Collation{})
+	if !bytes.Equal(p.buffer, want) {
+		t.Errorf("buffer = % x, want % x", p.buffer, want)
+	}
+
+	out := driver.NamedValue{Name: "v", Value: sql.Out{Dest: &Variant{BaseType: "int"}}}
+	if err = c.CheckNamedValue(&out); err != nil {
+		t.Fatal(err)
+	}
+	if p, err = s.makeParam(out.Value); err != nil {
+		t.Fatal(err)
+	}
+	if p.ti.TypeId != typeVariant || p.Flags != fByRevValue || p.buffer != nil {
+		t.Errorf("unexpected output parameter %+v", p)
+	}
+
+	ret := driver.NamedValue{Value: ReturnVariants{}}
+	if err = c.CheckNamedValue(&ret); err != driver.ErrRemoveArgument || !c.outs.returnVariants {
+		t.Errorf("ReturnVariants must set returnVariants, got %v", err)
+	}
+}
+
+func TestVariantTVP(t *testing.T) {
+	type setting struct {
+		Name  string
+		Value Variant
+	}
+	tvp := TVP{TypeName: "tt", Value: []setting{
+		{"a", Variant{Value: 1, BaseType: "int"}},
+		{"b", Variant{}},
+	}}
+	columnStr, tvpFieldIndexes, err := tvp.columnTypes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if columnStr[1].ti.TypeId != typeVariant {
+		t.Fatalf("Variant column has type %#x", columnStr[1].ti.TypeId)
+	}
+	structRows, err := tvp.encode("dbo", "tt", columnStr, tvpFieldIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := TVP{
+		TypeName: "tt",
+		Value:    [][]interface{}{{"a", 1}, {"b", nil}},
+		Columns:  []TVPColumn{{Name: "Name", Type: ""}, {Name: "Value", SQLType: "sql_variant"}},
+	}
+	if columnStr, err = rows.definedColumnTypes(); err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	if err = rows.encodeRows(&got, "dbo", "tt", columnStr, rows.rows()); err != nil {
+		t.Fatal(err)
+	}
+	rows.Value = [][]interface{}{{"a", Variant{Value: 1, BaseType: "int"}}, {"b", nil}}
+	var typed bytes.Buffer
+	if err = rows.encodeRows(&typed, "dbo", "tt", columnStr, rows.rows()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(typed.Bytes(), structRows) {
+		t.Errorf("encodeRows = % x, want % x", typed.Bytes(), structRows)
+	}
+	// a value without BaseType is sent as bigint
+	if bytes.Equal(got.Bytes(), structRows) {
+		t.Error("expected the untyped value to be sent as bigint")
+	}
+}
@@ -0,0 +1,131 @@
+package mssql
+
+import (
+	"bytes"
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/denisenkom/go-mssqldb/internal/cp"
+)
+
+// readVariantBytes reads an encoded variant value as a column value.
+func readVariantBytes(t *testing.T, buf []byte) interface{} {
+	var w bytes.Buffer
+	if err := writeVariantType(&w, typeInfo{}, buf); err != nil {
+		t.Fatal(err)
+	}
+	b := w.Bytes()
+	r := &tdsBuffer{
+		packetSize: len(b),
+		rbuf:       b,
+		rsize:      len(b),
+	}
+	val := readTypedVariant(&typeInfo{TypeId: typeVariant}, r)
+	if r.rpos != r.rsize {
+		t.Errorf("%d bytes not read", r.rsize-r.rpos)
+	}
+	return val
+}
+
+func TestVariantEncode(t *testing.T) {
+	col := cp.Collation{LcidAndFlags: 0x00d00409, SortId: 52}
+	tm := time.Date(2020, 5, 1, 12, 30, 15, 125000000, time.UTC)
+	tests := []struct {
+		in   Variant
+		want Variant
+	}{
+		{Variant{int64(-20), "int"}, Variant{int64(-20), "int"}},
+		{Variant{10, "tinyint"}, Variant{int64(10), "tinyint"}},
+		{Variant{"42", "BIGINT"}, Variant{int64(42), "bigint"}},
+		{Variant{true, "bit"}, Variant{true, "bit"}},
+		{Variant{0.5, "real"}, Variant{0.5, "real"}},
+		{Variant{1.25, "float"}, Variant{1.25, "float"}},
+		{Variant{"12.5", "decimal(10,2)"}, Variant{[]byte("12.50"), "decimal(10, 2)"}},
+		{Variant{"-3", "numeric(5, 0)"}, Variant{[]byte("-3"), "numeric(5, 0)"}},
+		{Variant{"1.5", "money"}, Variant{[]byte("1.5000"), "money"}},
+		{Variant{"1.5", "smallmoney"}, Variant{[]byte("1.5000"), "smallmoney"}},
+		{Variant{tm, "date"}, Variant{time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC), "date"}},
+		{Variant{tm, "datetime2(3)"}, Variant{tm, "datetime2(3)"}},
+		{Variant{tm.Truncate(time.Second), "datetime"}, Variant{tm.Truncate(time.Second), "datetime"}},
+		{Variant{tm, "time"}, Variant{time.Date(1, 1, 1, 12, 30, 15, 125000000, time.UTC), "time(7)"}},
+		{Variant{tm, "datetimeoffset(0)"}, Variant{tm.Truncate(time.Second), "datetimeoffset(0)"}},
+		{Variant{"abc", "varchar(10)"}, Variant{"abc", "varchar(10)"}},
+		{Variant{"ab", "char(4)"}, Variant{"ab  ", "char(4)"}},
+		{Variant{"héllo", "nvarchar(10)"}, Variant{"héllo", "nvarchar(10)"}},
+		{Variant{"a", "nchar(3)"}, Variant{"a  ", "nchar(3)"}},
+		{Variant{[]byte{1, 2}, "varbinary(4)"}, Variant{[]byte{1, 2}, "varbinary(4)"}},
+		{Variant{[]byte{1}, "binary(3)"}, Variant{[]byte{1, 0, 0}, "binary(3)"}},
+		{Variant{make([]byte, 16), "uniqueidentifier"}, Variant{make([]byte, 16), "uniqueidentifier"}},
+		// the base type of the Go type
+		{Variant{7, ""}, Variant{int64(7), "bigint"}},
+		{Variant{"x", ""}, Variant{"x", "nvarchar(1)"}},
+	}
+	for _, tt := range tests {
+		buf, err := tt.in.encode(col)
+		if err != nil {
+			t.Errorf("encode(%v) failed: %v", tt.in, err)
+			continue
+		}
+		got := readVariantBytes(t, buf)
+		v, ok := got.(Variant)
+		if !ok {
+			t.Errorf("encode(%v) read as %T", tt.in, got)
+			continue
+		}
+		if tm, ok := v.Value.(time.Time); ok {
+			v.Value = tm.UTC()
+		}
+		if !reflect.DeepEqual(v, tt.want) {
+			t.Errorf("encode(%v) read as %#v, want %#v", tt.in, v, tt.want)
+		}
+	}
+}
+
+func TestVariantEncodeNull(t *testing.T) {
+	for _, v := range []Variant{{}, {Value: sql.NullString{}, BaseType: "varchar(5)"}} {
+		buf, err := v.encode(cp.Collation{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf != nil {
+			t.Errorf("encode(%v) = % x, want NULL", v, buf)
+		}
+		if got := readVariantBytes(t, buf); got != nil {
+			t.Errorf("NULL read as %v", got)
+		}
+	}
+}
+
+func TestVariantEncodeErrors(t *testing.T) {
+	for _, v := range []Variant{
+		{"x", "varchar(max)"},
+		{"x", "xml"},
+		{"x", "sql_variant"},
+		{"abc", "varchar(2)"},
+		{"x", "int"},
+		{1, "geography"},
+		{struct{}{}, ""},
+	} {
+		if _, err := v.encode(cp.Collation{}); err == nil {
+			t.Errorf("encode(%v) should fail", v)
+		}
+	}
+}
+
+func TestVariantScan(t *testing.T) {
+	var v Variant
+	if err := v.Scan(Variant{int64(1), "int"}); err != nil {
+		t.Fatal(err)
+	}
+	if v != (Variant{int64(1), "int"}) {
+		t.Errorf("Scan(Variant) = %v", v)
+	}
+	if err := v.Scan("a"); err != nil {
+		t.Fatal(err)
+	}
+	if v != (Variant{Value: "a"}) {
+		t.Errorf("Scan(string) = %v", v)
+	}
+}